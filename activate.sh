@@ -174,7 +174,7 @@ start() {
 
 stop() {
 	stopwatchdog
-	curl -s http://${HOST}:${PORT}/extAdminShutdown/
+	curl -s -H "X-Admin-Token: $(cat admintoken 2>/dev/null)" http://${HOST}:${PORT}/extAdminShutdown/
 	if [ ${IAM} == "root" ]; then
 		sleep 6
 		rm -f /var/run/phonebook/phonebook.pid /var/lock/phonebook
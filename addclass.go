@@ -14,7 +14,9 @@ func adminAddClassHandler(w http.ResponseWriter, r *http.Request) {
 	var ui uiSupport
 	ssn = nil
 
-	loadCompanies()
+	if err := loadCompanies(); err != nil {
+		ulog("adminAddClassHandler: could not reload companies: %s\n", err.Error())
+	}
 	if 0 < initHandlerSession(ssn, &ui, w, r) {
 		return
 	}
@@ -34,7 +36,9 @@ func adminAddClassHandler(w http.ResponseWriter, r *http.Request) {
 	c.Description = ""
 
 	ui.A = &c
+	uiListsLock.RLock()
 	ui.CompanyList = PhonebookUI.CompanyList
+	uiListsLock.RUnlock()
 
 	err := renderTemplate(w, ui, "adminEditClass.html")
 
@@ -1,15 +1,24 @@
 package main
 
 import (
+	"crypto/subtle"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"phonebook/authz"
+	"phonebook/db"
 	"phonebook/sess"
 	"time"
 )
 
+// adminTokenFile holds the token that lets scripts on this machine, such
+// as activate.sh, stop the server. It is rewritten at every start and only
+// the user phonebook runs as can read it.
+const adminTokenFile = "admintoken"
+
 func adminHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/html")
 	var ssn *sess.Session
@@ -55,6 +64,7 @@ func restartHandler(w http.ResponseWriter, r *http.Request) {
 	if ok {
 		if perm&authz.PERMEXEC != 0 {
 			ulog("restart invoked by UID %d, %s\n", ssn.UID, ssn.Username)
+			sess.LogSecEvent(r, sess.SessionEvent(ssn, db.SECRESTART, 0, "", ""))
 			cmd := "restart"
 			out, err := exec.Command("./activate.sh", cmd).Output()
 			if err != nil {
@@ -80,20 +90,47 @@ func shutdownHandler(w http.ResponseWriter, r *http.Request) {
 	perm, ok := ssn.PMap.Ppr["Shutdown"]
 	if ok {
 		if perm&authz.PERMEXEC != 0 {
-			ulog("shutdownHandler successfully invoked\n")
-			extAdminShutdown(w, r)
+			ulog("shutdown invoked by UID %d, %s\n", ssn.UID, ssn.Username)
+			sess.LogSecEvent(r, sess.SessionEvent(ssn, db.SECSHUTDOWN, 0, "", ""))
+			shutdownServer(w)
 			return
 		}
 	}
 	http.Redirect(w, r, "/search/", http.StatusFound)
 }
 
+// writeAdminToken makes a new admin token and writes it to adminTokenFile
+//-----------------------------------------------------------------------------
+func writeAdminToken() error {
+	Phonebook.AdminToken = sess.NewSessionToken()
+	os.Remove(adminTokenFile) // so the new file gets our permissions
+	return ioutil.WriteFile(adminTokenFile, []byte(Phonebook.AdminToken+"\n"), 0600)
+}
+
+// extAdminShutdown lets activate.sh stop the server. The request must come
+// from this machine and send the token in adminTokenFile in its
+// X-Admin-Token header.
+//-----------------------------------------------------------------------------
 func extAdminShutdown(w http.ResponseWriter, r *http.Request) {
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	ip := net.ParseIP(host)
+	tok := r.Header.Get("X-Admin-Token")
+	if ip == nil || !ip.IsLoopback() || len(Phonebook.AdminToken) == 0 ||
+		subtle.ConstantTimeCompare([]byte(tok), []byte(Phonebook.AdminToken)) != 1 {
+		ulog("extAdminShutdown: refused request from %s\n", r.RemoteAddr)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	sess.LogSecEvent(r, db.SecEvent{Type: db.SECSHUTDOWN, ActorName: "activate.sh"})
+	shutdownServer(w)
+}
+
+// shutdownServer stops the server after giving it time to answer
+func shutdownServer(w http.ResponseWriter) {
 	fmt.Fprintf(w, "<html><body><h1>shutting down in 5 seconds!</h1></body></html>")
 	ulog("Shutdown initiated\n")
 	go func() {
 		time.Sleep(time.Duration(5 * time.Second))
 		os.Exit(0)
 	}()
-	return
 }
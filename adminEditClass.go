@@ -47,9 +47,11 @@ func adminEditClassHandler(w http.ResponseWriter, r *http.Request) {
 	initUIData(&ui)
 
 	// this interface needs the complete list of companies
+	uiListsLock.RLock()
 	for i := 0; i < len(PhonebookUI.CompanyList); i++ {
 		ui.CompanyList = append(ui.CompanyList, PhonebookUI.CompanyList[i])
 	}
+	uiListsLock.RUnlock()
 
 	err = renderTemplate(w, ui, "adminEditClass.html")
 
@@ -178,6 +178,24 @@ func adminViewHandler(w http.ResponseWriter, r *http.Request) {
 	PDetFilterSecurityRead(&d, ssn, authz.PERMVIEW|authz.PERMMOD)
 	ui.D = &d
 
+	//------------------------------------------------------------
+	// Account security admins see failed sign ins and can unlock,
+	// and can reset two-step sign in
+	//------------------------------------------------------------
+	if len(d.UserName) > 0 && hasAllCoAccess(ssn, authz.ELEMPERSON, "Role", authz.PERMMOD) {
+		lk, err := db.GetLoginLock(d.UserName)
+		if err != nil {
+			ulog("adminViewHandler: db.GetLoginLock: %s\n", err.Error())
+		}
+		ui.Y = &lk
+
+		tf, err := db.GetTwoFactor(int64(d.UID))
+		if err != nil {
+			ulog("adminViewHandler: db.GetTwoFactor: %s\n", err.Error())
+		}
+		ui.F = &twoFactor{Enabled: tf.Enabled}
+	}
+
 	err := renderTemplate(w, ui, "adminView.html")
 	if nil != err {
 		errmsg := fmt.Sprintf("adminViewHandler: err = %v\n", err)
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"fmt"
 	"net/http"
+	"phonebook/authz"
+	"phonebook/db"
 	"phonebook/sess"
 	"strconv"
 	"strings"
@@ -24,20 +27,124 @@ func adminViewBtnHandler(w http.ResponseWriter, r *http.Request) {
 		// fmt.Printf("breadcrumbBack redirects to: %s\n", s)
 		http.Redirect(w, r, s, http.StatusFound)
 	} else if action == "adminedit" || action == "adminview" || action == "add person" ||
-		action == "add business unit" || action == "add company" || action == "stats" || action == "setup" {
+		action == "add business unit" || action == "add company" || action == "stats" || action == "setup" ||
+		action == "api keys" || action == "roles" || action == "explain" || action == "security events" {
 		url := r.FormValue("url")
 		// fmt.Printf("action = %s,  url = %s\n", action, url)
 		http.Redirect(w, r, url, http.StatusFound)
+	} else if action == "unlock" {
+		adminUnlock(w, r, ssn)
+	} else if action == "reset2fa" {
+		adminResetTwoFactor(w, r, ssn)
+	} else if action == "become" {
+		uid, _ := strconv.Atoi(r.URL.Path[len("/adminViewBtn/"):])
+		http.Redirect(w, r, fmt.Sprintf("/become/%d", uid), http.StatusTemporaryRedirect) // keeps the POST and its csrf field
+	} else if action == "reload" {
+		adminReload(w, r, ssn)
 	} else if action == "shutdown" {
-		http.Redirect(w, r, r.FormValue("url"), http.StatusFound)
+		http.Redirect(w, r, "/shutdown/", http.StatusTemporaryRedirect) // keeps the POST and its csrf field
 	} else if action == "restart" {
-		http.Redirect(w, r, r.FormValue("url"), http.StatusFound)
+		http.Redirect(w, r, "/restart/", http.StatusTemporaryRedirect)
 	} else {
 		ulog("adminViewBtnHandler: unrecognized action: %s\n", action)
 		http.Redirect(w, r, "/search/", http.StatusFound)
 	}
 }
 
+// adminUnlock clears the failed sign ins of the person whose uid is in the
+// path, so they can sign in again right away.
+func adminUnlock(w http.ResponseWriter, r *http.Request, ssn *sess.Session) {
+	path := "/adminViewBtn/"
+	uid, _ := strconv.Atoi(r.URL.Path[len(path):])
+
+	//============================================================
+	// SECURITY
+	//============================================================
+	if !hasAllCoAccess(ssn, authz.ELEMPERSON, "Role", authz.PERMMOD) {
+		ulog("Permissions refuse unlock on userid=%d (%s), role=%s\n", ssn.UID, ssn.Firstname, ssn.PMap.Urole.Name)
+		http.Redirect(w, r, "/search/", http.StatusFound)
+		return
+	}
+
+	var d db.PersonDetail
+	d.UID = uid
+	if err := db.GetPersonDetail(&d); err != nil || len(d.UserName) == 0 {
+		ulog("adminUnlock: could not read person %d: %v\n", uid, err)
+		http.Redirect(w, r, "/search/", http.StatusFound)
+		return
+	}
+	if err := db.UnlockLogin(d.UserName); err != nil {
+		errmsg := fmt.Sprintf("adminUnlock: db.UnlockLogin: err = %v\n", err)
+		ulog(errmsg)
+		fmt.Println(errmsg)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ulog("user %s (%d) unlocked sign in for %s\n", ssn.Username, ssn.UID, d.UserName)
+	sess.LogSecEvent(r, sess.SessionEvent(ssn, db.SECUNLOCK, int64(uid), d.UserName, ""))
+	http.Redirect(w, r, fmt.Sprintf("/adminView/%d", uid), http.StatusFound)
+}
+
+// adminResetTwoFactor removes the two-step sign in of the person whose uid
+// is in the path, for someone who lost their phone and recovery codes. If
+// their role requires two-step sign in they enroll again at the next sign in.
+func adminResetTwoFactor(w http.ResponseWriter, r *http.Request, ssn *sess.Session) {
+	path := "/adminViewBtn/"
+	uid, _ := strconv.Atoi(r.URL.Path[len(path):])
+
+	//============================================================
+	// SECURITY
+	//============================================================
+	if !hasAllCoAccess(ssn, authz.ELEMPERSON, "Role", authz.PERMMOD) {
+		ulog("Permissions refuse reset2fa on userid=%d (%s), role=%s\n", ssn.UID, ssn.Firstname, ssn.PMap.Urole.Name)
+		http.Redirect(w, r, "/search/", http.StatusFound)
+		return
+	}
+
+	if err := db.DeleteTwoFactor(int64(uid)); err != nil {
+		errmsg := fmt.Sprintf("adminResetTwoFactor: db.DeleteTwoFactor: err = %v\n", err)
+		ulog(errmsg)
+		fmt.Println(errmsg)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ulog("user %s (%d) reset two-step sign in for uid %d\n", ssn.Username, ssn.UID, uid)
+	sess.LogSecEvent(r, sess.SessionEvent(ssn, db.SECRESET2FA, int64(uid), "", ""))
+	http.Redirect(w, r, fmt.Sprintf("/adminView/%d", uid), http.StatusFound)
+}
+
+// adminReload reloads the roles and lookup lists on this instance and tells
+// the other instances to do the same. It is for changes made directly in
+// the database, such as a new department or job title.
+func adminReload(w http.ResponseWriter, r *http.Request, ssn *sess.Session) {
+	//============================================================
+	// SECURITY
+	//============================================================
+	if ssn.PMap.Ppr["Restart"]&authz.PERMEXEC == 0 {
+		ulog("Permissions refuse reload on userid=%d (%s), role=%s\n", ssn.UID, ssn.Firstname, ssn.PMap.Urole.Name)
+		http.Redirect(w, r, "/search/", http.StatusFound)
+		return
+	}
+
+	ulog("user %s (%d) reloaded roles and lookup lists\n", ssn.Username, ssn.UID)
+	publishReload(db.RELOADMAPS)
+	if err := reloadMaps(); err != nil {
+		errmsg := fmt.Sprintf("adminReload: err = %v\n", err)
+		ulog(errmsg)
+		fmt.Println(errmsg)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := rolesChanged(); err != nil {
+		errmsg := fmt.Sprintf("adminReload: err = %v\n", err)
+		ulog(errmsg)
+		fmt.Println(errmsg)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/admin/", http.StatusFound)
+}
+
 func popHandler(w http.ResponseWriter, r *http.Request) {
 	var ssn *sess.Session
 	var ui uiSupport
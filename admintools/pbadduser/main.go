@@ -4,13 +4,13 @@
 package main
 
 import (
-	"crypto/sha512"
 	"database/sql"
 	"extres"
 	"flag"
 	"fmt"
 	"os"
 	"phonebook/lib"
+	"phonebook/pwhash"
 	"strings"
 
 	_ "github.com/go-sql-driver/mysql"
@@ -143,8 +143,11 @@ func main() {
 	}
 
 	getUsername()
-	sha := sha512.Sum512([]byte(App.passwd))
-	passhash := fmt.Sprintf("%x", sha)
+	passhash, err := pwhash.Hash(App.passwd)
+	if nil != err {
+		fmt.Printf("error = %v\n", err)
+		os.Exit(1)
+	}
 
 	stmt, err := App.db.Prepare("INSERT INTO people (UserName,passhash,FirstName,LastName,RID) VALUES(?,?,?,?,?)")
 	if nil != err {
@@ -0,0 +1,133 @@
+// pbexplain  a program to show which fields of a person, company or class
+//            a user can read, and what granted or denied each of them
+package main
+
+import (
+	"database/sql"
+	"extres"
+	"flag"
+	"fmt"
+	"os"
+	"phonebook/authz"
+	"phonebook/db"
+	"phonebook/lib"
+	"phonebook/sess"
+
+	_ "github.com/go-sql-driver/mysql"
+)
+
+// App is the global data structure for this app
+var App struct {
+	db     *sql.DB
+	DBName string
+	DBUser string
+	uid    int    // viewer
+	rname  string // role to give the viewer instead of their own
+	check  string // name of the sess.ExplainCheck
+	id     int    // uid, cocode or classcode of the data
+	all    bool   // list the fields the role has no permission for too
+}
+
+func readCommandLineArgs() {
+	dbuPtr := flag.String("B", "ec2-user", "database user name")
+	dbnmPtr := flag.String("N", "accord", "database name (accordtest, accord)")
+	uPtr := flag.Int("u", 0, "uid of the viewer")
+	rPtr := flag.String("r", "", "explain as if the viewer had this role")
+	cPtr := flag.String("c", "detail", "what reads the data, use -c list to see the choices")
+	iPtr := flag.Int("i", 0, "uid, company code or business unit code of the data")
+	aPtr := flag.Bool("a", false, "also list the fields that are never filtered")
+	flag.Parse()
+	App.DBName = *dbnmPtr
+	App.DBUser = *dbuPtr
+	App.uid = *uPtr
+	App.rname = *rPtr
+	App.check = *cPtr
+	App.id = *iPtr
+	App.all = *aPtr
+}
+
+func yesno(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+func main() {
+	readCommandLineArgs()
+
+	if App.check == "list" {
+		for i := 0; i < len(sess.ExplainChecks); i++ {
+			fmt.Printf("%-10s %s\n", sess.ExplainChecks[i].Name, sess.ExplainChecks[i].Descr)
+		}
+		os.Exit(0)
+	}
+	c := sess.FindExplainCheck(App.check)
+	if c == nil {
+		fmt.Printf("Unknown check: %s. Use -c list to see the choices.\n", App.check)
+		os.Exit(1)
+	}
+	if App.uid == 0 || App.id == 0 {
+		fmt.Printf("Please supply the viewer with -u and the data with -i\n")
+		os.Exit(1)
+	}
+
+	var err error
+	lib.ReadConfig()
+	s := extres.GetSQLOpenString(App.DBName, &lib.AppConfig)
+	App.db, err = sql.Open("mysql", s)
+	if nil != err {
+		fmt.Printf("sql.Open for database=%s, dbuser=%s: Error = %v\n", App.DBName, App.DBUser, err)
+	}
+	defer App.db.Close()
+	err = App.db.Ping()
+	if nil != err {
+		fmt.Printf("App.db.Ping for database=%s, dbuser=%s: Error = %v\n", App.DBName, App.DBUser, err)
+		os.Exit(1)
+	}
+	db.DB.DirDB = App.db
+	lib.Errcheck(db.Init())
+	authz.Init(false)
+	roles, err := db.GetRoles()
+	if err != nil {
+		fmt.Printf("Could not read the roles: %v\n", err)
+		os.Exit(1)
+	}
+	authz.SetRoles(roles)
+
+	rid := 0
+	if len(App.rname) > 0 {
+		for i := 0; i < len(roles); i++ {
+			if roles[i].Name == App.rname {
+				rid = roles[i].RID
+			}
+		}
+		if rid == 0 {
+			fmt.Printf("Could not find role named: %s\n", App.rname)
+			os.Exit(1)
+		}
+	}
+
+	viewer, err := sess.ExplainViewer(App.uid, rid)
+	if err != nil {
+		fmt.Printf("Could not read the viewer, uid %d: %v\n", App.uid, err)
+		os.Exit(1)
+	}
+	d, dataUID, err := sess.ExplainData(c, App.id)
+	if err != nil {
+		fmt.Printf("Could not read %d for %s: %v\n", App.id, c.Descr, err)
+		os.Exit(1)
+	}
+	x := sess.Explain(d, c.Elem, viewer, c.Perm, dataUID)
+
+	fmt.Printf("%s, viewer uid %d, role %s\n", c.Descr, App.uid, x.Role)
+	fmt.Printf("%s\n\n", x.Scope)
+	fmt.Printf("%-25s %-5s %-6s %-8s %s\n", "FIELD", "READ", "SHOWN", "EDITABLE", "WHY")
+	for i := 0; i < len(x.Fields); i++ {
+		f := x.Fields[i]
+		if !f.Found && !App.all {
+			continue
+		}
+		fmt.Printf("%-25s %-5s %-6s %-8s %s\n", f.Field, yesno(f.Read), yesno(f.View), yesno(f.Mod), f.Why)
+	}
+}
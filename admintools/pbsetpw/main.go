@@ -11,6 +11,7 @@ import (
 	"math/rand"
 	"os"
 	"phonebook/lib"
+	"phonebook/qb"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
@@ -40,9 +41,9 @@ func init() {
 
 func getUserName() {
 	n := 0
-	s := fmt.Sprintf("select username from people where FirstName=\"%s\" AND LastName=\"%s\"", App.fname, App.lname)
+	s, args := (&qb.Select{Cols: "username", From: "people", Where: qb.And(qb.Eq("FirstName", App.fname), qb.Eq("LastName", App.lname))}).SQL()
 	fmt.Println(s)
-	rows, err := App.db.Query(s)
+	rows, err := App.db.Query(s, args...)
 	errcheck(err)
 	defer rows.Close()
 	fmt.Printf("usernames for %s %s:\n", App.fname, App.lname)
@@ -65,8 +66,8 @@ func getUserName() {
 
 func getRealName() string {
 	var f, l, p string
-	s := fmt.Sprintf("select FirstName,LastName,PreferredName from people where username=\"%s\"", App.user)
-	errcheck(App.db.QueryRow(s).Scan(&f, &l, &p))
+	s, args := (&qb.Select{Cols: "FirstName,LastName,PreferredName", From: "people", Where: qb.Eq("username", App.user)}).SQL()
+	errcheck(App.db.QueryRow(s, args...).Scan(&f, &l, &p))
 	if len(p) > 0 {
 		f = p
 	}
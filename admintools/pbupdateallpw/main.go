@@ -3,13 +3,13 @@
 package main
 
 import (
-	"crypto/sha512"
 	"database/sql"
 	"extres"
 	"flag"
 	"fmt"
 	"os"
 	"phonebook/lib"
+	"phonebook/pwhash"
 
 	_ "github.com/go-sql-driver/mysql"
 )
@@ -49,18 +49,40 @@ func main() {
 		fmt.Printf("App.db.Ping: Error = %v\n", err)
 	}
 
-	sha := sha512.Sum512([]byte(App.password))
-	passhash := fmt.Sprintf("%x", sha)
-	update, err := App.db.Prepare("update people set passhash=?")
+	//------------------------------------------------------------------
+	// Each hash has its own salt, so hash the password for each person
+	//------------------------------------------------------------------
+	rows, err := App.db.Query("select UID from people")
 	if nil != err {
 		fmt.Printf("error = %v\n", err)
 		os.Exit(1)
 	}
-	_, err = update.Exec(passhash)
+	var uids []int
+	for rows.Next() {
+		var uid int
+		if err = rows.Scan(&uid); nil != err {
+			fmt.Printf("error = %v\n", err)
+			os.Exit(1)
+		}
+		uids = append(uids, uid)
+	}
+	rows.Close()
+
+	update, err := App.db.Prepare("update people set passhash=? where UID=?")
 	if nil != err {
 		fmt.Printf("error = %v\n", err)
-	} else {
-		fmt.Printf("password for all users has been set to \"%s\"\n", App.password)
+		os.Exit(1)
 	}
-
+	defer update.Close()
+	for i := 0; i < len(uids); i++ {
+		passhash, err := pwhash.Hash(App.password)
+		if nil == err {
+			_, err = update.Exec(passhash, uids[i])
+		}
+		if nil != err {
+			fmt.Printf("UID %d: error = %v\n", uids[i], err)
+			os.Exit(1)
+		}
+	}
+	fmt.Printf("password for all users has been set to \"%s\"\n", App.password)
 }
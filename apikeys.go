@@ -0,0 +1,132 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"net/http"
+	"phonebook/authz"
+	"phonebook/db"
+	"phonebook/sess"
+	"strconv"
+	"strings"
+)
+
+// apiKeys is the data for the API keys admin page
+type apiKeys struct {
+	Keys   []db.APIKey // all keys, revoked ones last
+	NewKey string      // key just created, it is only ever shown this once
+}
+
+// apikeysHandler lists the API keys and lets an account security admin
+// create and revoke them. A key is created either for a person, whose
+// username is given as the owner, or as a service account when no owner
+// is given.
+//-----------------------------------------------------------------------------
+func apikeysHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html")
+	var ssn *sess.Session
+	var ui uiSupport
+	ssn = nil
+	if 0 < initHandlerSession(ssn, &ui, w, r) {
+		return
+	}
+	ssn = ui.X
+	breadcrumbAdd(ssn, "API Keys", "/apikeys/")
+
+	//============================================================
+	// SECURITY
+	//============================================================
+	if !hasAllCoAccess(ssn, authz.ELEMPERSON, "Role", authz.PERMMOD) {
+		ulog("Permissions refuse apikeys page on userid=%d (%s), role=%s\n", ssn.UID, ssn.Firstname, ssn.PMap.Urole.Name)
+		http.Redirect(w, r, "/search/", http.StatusFound)
+		return
+	}
+
+	var q apiKeys
+	var errmsg string
+	var err error
+	action := strings.ToLower(r.FormValue("action"))
+	if r.Method != "POST" {
+		action = ""
+	}
+	switch action {
+	case "create":
+		q.NewKey, errmsg, err = createAPIKey(r, ssn)
+		ui.ErrMsg = template.HTML(template.HTMLEscapeString(errmsg))
+	case "revoke":
+		keyid, _ := strconv.ParseInt(r.FormValue("keyid"), 10, 64)
+		if err = db.RevokeAPIKey(keyid); err == nil {
+			ulog("user %s (%d) revoked API key %d\n", ssn.Username, ssn.UID, keyid)
+			sess.LogSecEvent(r, sess.SessionEvent(ssn, db.SECAPIKEYREVOKE, 0, "", fmt.Sprintf("key %d", keyid)))
+		}
+	}
+	if err == nil {
+		q.Keys, err = db.GetAPIKeys()
+	}
+	if err != nil {
+		errmsg := fmt.Sprintf("apikeysHandler: err = %v\n", err)
+		ulog(errmsg)
+		fmt.Println(errmsg)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ui.Q = &q
+
+	err = renderTemplate(w, ui, "apikeys.html")
+	if nil != err {
+		errmsg := fmt.Sprintf("apikeysHandler: err = %v\n", err)
+		ulog(errmsg)
+		fmt.Println(errmsg)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// createAPIKey creates the API key described by the form in r
+//
+// RETURNS
+//  key    - the new key, "" if none was created
+//  errmsg - message for the admin if the form is not valid
+//  err    - any other error encountered
+//-----------------------------------------------------------------------------
+func createAPIKey(r *http.Request, ssn *sess.Session) (string, string, error) {
+	name := strings.TrimSpace(r.FormValue("name"))
+	owner := strings.ToLower(strings.TrimSpace(r.FormValue("owner")))
+	rid, _ := strconv.Atoi(r.FormValue("rid"))
+	if len(name) == 0 || len(name) > 64 {
+		return "", "Please enter a name of at most 64 characters.", nil
+	}
+	if len(authz.RoleName(rid)) == 0 {
+		return "", "Please choose a role.", nil
+	}
+	if !sess.CanGrantRole(ssn, rid) {
+		return "", fmt.Sprintf("You cannot create a key with role %s, it can do more, or in more companies, than your own role.", authz.RoleName(rid)), nil
+	}
+	var uid int64
+	if len(owner) > 0 {
+		var firstname, preferredname, email, passhash string
+		var RID int
+		err := db.PrepStmts.LoginInfo.QueryRow(owner).Scan(&uid, &firstname, &preferredname, &email, &passhash, &RID)
+		if err == sql.ErrNoRows {
+			return "", fmt.Sprintf("There is no one with username %s.", owner), nil
+		}
+		if err != nil {
+			return "", "", err
+		}
+	}
+	key, err := db.NewAPIKey(uid, name, rid, ssn.UID)
+	if err != nil {
+		return "", "", err
+	}
+	if uid > 0 {
+		ulog("user %s (%d) created API key %q for %s with role %s\n", ssn.Username, ssn.UID, name, owner, authz.RoleName(rid))
+	} else {
+		ulog("user %s (%d) created service account %q with role %s\n", ssn.Username, ssn.UID, name, authz.RoleName(rid))
+	}
+	detail := fmt.Sprintf("role %s", authz.RoleName(rid))
+	if uid > 0 {
+		detail = fmt.Sprintf("for %s, role %s", owner, authz.RoleName(rid))
+	}
+	sess.LogSecEvent(r, sess.SessionEvent(ssn, db.SECAPIKEYCREATE, uid, name, detail))
+	return key, "", nil
+}
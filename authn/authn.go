@@ -0,0 +1,117 @@
+// Package authn checks the passwords users sign in with. Each way of
+// checking a password is a Provider. The local provider checks the hash in
+// people.passhash, other providers such as ldap ask another system. The
+// provider is chosen with AuthProvider in config.json. Usernames listed in
+// AuthLocalUsers, typically service accounts that have no account in the
+// other system, always use the local provider.
+//
+// Whatever the provider, a user must exist in the people table to sign in.
+// The provider only decides whether the password is right.
+package authn
+
+import (
+	"fmt"
+	"phonebook/lib"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Provider is implemented by each way of checking passwords
+type Provider interface {
+	// Authenticate returns true if password is correct for username.
+	// passhash is the user's hash from the people table, which only the
+	// local provider uses. An error means the password could not be
+	// checked, for example because a server is down.
+	Authenticate(username, password, passhash string) (bool, error)
+}
+
+var providers = map[string]Provider{"local": Local{}}
+var dflt Provider = Local{}
+var dfltName = "local"
+
+// Register adds a provider under the supplied name, replacing any provider
+// already registered with that name.
+//-----------------------------------------------------------------------------
+func Register(name string, p Provider) {
+	providers[name] = p
+}
+
+// Names returns the names of the registered providers
+//-----------------------------------------------------------------------------
+func Names() []string {
+	var m []string
+	for k := range providers {
+		m = append(m, k)
+	}
+	sort.Strings(m)
+	return m
+}
+
+// SetDefault selects the provider used for users not in AuthLocalUsers. An
+// empty name keeps the current default.
+//-----------------------------------------------------------------------------
+func SetDefault(name string) error {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if len(name) == 0 {
+		return nil
+	}
+	p, ok := providers[name]
+	if !ok {
+		return fmt.Errorf("unknown authentication provider: %s (use one of %s)", name, strings.Join(Names(), ", "))
+	}
+	dflt = p
+	dfltName = name
+	return nil
+}
+
+// Init registers the providers configured in config.json and selects the
+// one named by AuthProvider. Call it after lib.ReadConfig.
+//-----------------------------------------------------------------------------
+func Init() error {
+	c := lib.PBConfig.LDAP
+	if len(c.URL) > 0 {
+		Register("ldap", &LDAP{
+			URL:        c.URL,
+			StartTLS:   c.StartTLS,
+			BindDN:     c.BindDN,
+			BaseDN:     c.BaseDN,
+			UserFilter: c.UserFilter,
+			SearchDN:   c.SearchDN,
+			SearchPass: c.SearchPass,
+			Timeout:    time.Duration(c.Timeout) * time.Second,
+		})
+	}
+	if err := SetDefault(lib.PBConfig.AuthProvider); err != nil {
+		return err
+	}
+	lib.Ulog("authentication provider: %s\n", dfltName)
+	return nil
+}
+
+// LocalPassword returns true if username signs in with the password stored
+// in the people table, so it can be reset and changed here.
+//-----------------------------------------------------------------------------
+func LocalPassword(username string) bool {
+	_, ok := provider(username).(Local)
+	return ok
+}
+
+// provider returns the provider that checks username's password
+func provider(username string) Provider {
+	username = strings.ToLower(username)
+	for i := 0; i < len(lib.PBConfig.AuthLocalUsers); i++ {
+		if strings.ToLower(lib.PBConfig.AuthLocalUsers[i]) == username {
+			return Local{}
+		}
+	}
+	return dflt
+}
+
+// Authenticate returns true if password is correct for username, using the
+// provider for that username. passhash is the user's hash from the people
+// table.
+//-----------------------------------------------------------------------------
+func Authenticate(username, password, passhash string) (bool, error) {
+	return provider(username).Authenticate(username, password, passhash)
+}
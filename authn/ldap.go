@@ -0,0 +1,98 @@
+package authn
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"phonebook/lib"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// LDAP checks passwords with a simple bind to a directory server. The
+// user's DN is either BindDN with the username in place of %s, or, if
+// UserFilter is set, the DN of the single entry under BaseDN that matches
+// UserFilter with the username in place of %s. The username is escaped
+// before it is put in the DN or the filter.
+type LDAP struct {
+	URL        string        // ldap://host:389 or ldaps://host:636
+	StartTLS   bool          // upgrade an ldap:// connection with StartTLS
+	BindDN     string        // user DN with %s for the username
+	BaseDN     string        // where to search for users
+	UserFilter string        // search filter with %s for the username
+	SearchDN   string        // DN to bind as for the search, anonymous if empty
+	SearchPass string        // password for SearchDN
+	Timeout    time.Duration // how long to wait for the server
+}
+
+// dial connects to the server, using TLS if configured
+func (l *LDAP) dial() (*ldap.Conn, error) {
+	u, err := url.Parse(l.URL)
+	if err != nil {
+		return nil, err
+	}
+	tc := &tls.Config{ServerName: u.Hostname()}
+	conn, err := ldap.DialURL(l.URL, ldap.DialWithDialer(&net.Dialer{Timeout: l.Timeout}), ldap.DialWithTLSConfig(tc))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(l.Timeout)
+	if l.StartTLS {
+		if err = conn.StartTLS(tc); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// userDN returns the DN of username, or "" if there is no such user
+func (l *LDAP) userDN(conn *ldap.Conn, username string) (string, error) {
+	if len(l.UserFilter) == 0 {
+		return fmt.Sprintf(l.BindDN, ldap.EscapeDN(username)), nil
+	}
+	if len(l.SearchDN) > 0 {
+		if err := conn.Bind(l.SearchDN, l.SearchPass); err != nil {
+			return "", fmt.Errorf("bind as %s for user search: %s", l.SearchDN, err.Error())
+		}
+	}
+	req := ldap.NewSearchRequest(l.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(l.Timeout/time.Second), false,
+		fmt.Sprintf(l.UserFilter, ldap.EscapeFilter(username)), []string{"dn"}, nil)
+	res, err := conn.Search(req)
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return "", err
+	}
+	if res == nil || len(res.Entries) != 1 {
+		return "", nil // not found, or ambiguous
+	}
+	return res.Entries[0].DN, nil
+}
+
+// Authenticate returns true if the directory server accepts a bind as
+// username with password. passhash is not used.
+func (l *LDAP) Authenticate(username, password, passhash string) (bool, error) {
+	if len(password) == 0 {
+		return false, nil // an empty password is an unauthenticated bind, which always succeeds
+	}
+	conn, err := l.dial()
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	dn, err := l.userDN(conn, username)
+	if err != nil || len(dn) == 0 {
+		return false, err
+	}
+	err = conn.Bind(dn, password)
+	switch {
+	case err == nil:
+		return true, nil
+	case ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials):
+		return false, nil
+	}
+	lib.Ulog("authn: ldap bind as %s: %s\n", dn, err.Error())
+	return false, err
+}
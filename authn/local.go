@@ -0,0 +1,23 @@
+package authn
+
+import (
+	"phonebook/db"
+	"phonebook/lib"
+	"phonebook/pwhash"
+)
+
+// Local checks passwords against the hashes in people.passhash. A hash
+// stored with an older scheme is replaced with one made by the current
+// scheme once the password is known to be right.
+type Local struct{}
+
+// Authenticate returns true if password matches passhash
+func (Local) Authenticate(username, password, passhash string) (bool, error) {
+	ok, rehash := pwhash.Verify(password, passhash)
+	if ok && rehash {
+		if err := lib.UpdateUserPassword(username, password, db.DB.DirDB); err != nil {
+			lib.Ulog("authn: could not rehash password for %s: %s\n", username, err.Error())
+		}
+	}
+	return ok, nil
+}
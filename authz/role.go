@@ -1,6 +1,9 @@
 package authz
 
-import "phonebook/lib"
+import (
+	"phonebook/lib"
+	"sync"
+)
 
 //--------------------------------------------------------------------
 //  ROLE SECURITY
@@ -16,6 +19,7 @@ const (
 	PERMOWNERMOD   = 1 << 6 // OK for the owner to modify this field
 	PERMOWNERPRINT = 1 << 7 // OK for the owner to modify this field
 	PERMEXEC       = 1 << 8 // OK to execute
+	PERMMGRVIEW    = 1 << 9 // OK for the person's managers of record to view this field (applies to Person elements)
 
 	ELEMPERSON  = 1 // people
 	ELEMCOMPANY = 2 // companies
@@ -23,6 +27,45 @@ const (
 	ELEMPBSVC   = 4 // the executable service
 )
 
+// PermBit names one of the permission bits
+type PermBit struct {
+	Bit  int    // the PERM value
+	Name string // what admins see
+}
+
+// PermBits are the permission bits, in the order the admin pages show them
+var PermBits = []PermBit{
+	{PERMVIEW, "View"},
+	{PERMCREATE, "Create"},
+	{PERMMOD, "Modify"},
+	{PERMDEL, "Delete"},
+	{PERMPRINT, "Print"},
+	{PERMOWNERVIEW, "Owner View"},
+	{PERMOWNERMOD, "Owner Modify"},
+	{PERMOWNERPRINT, "Owner Print"},
+	{PERMEXEC, "Execute"},
+	{PERMMGRVIEW, "Manager View"},
+}
+
+// PermString returns the names of the bits set in perm, or "none"
+//-----------------------------------------------------------------------------
+func PermString(perm int) string {
+	s := ""
+	for i := 0; i < len(PermBits); i++ {
+		if perm&PermBits[i].Bit == 0 {
+			continue
+		}
+		if len(s) > 0 {
+			s += ", "
+		}
+		s += PermBits[i].Name
+	}
+	if len(s) == 0 {
+		return "none"
+	}
+	return s
+}
+
 // FieldPerm defines how a specific element field can be accessed
 type FieldPerm struct {
 	Elem  int    // Element: Person, Company, or Class
@@ -33,21 +76,27 @@ type FieldPerm struct {
 
 // Role defines a collection of FieldPerms that can be assigned to a person
 type Role struct {
-	RID   int         // assigned by DB
-	Name  string      // role name
-	Descr string      // role description
-	Perms []FieldPerm // permissions for all fields, all entities
+	RID     int         // assigned by DB
+	Name    string      // role name
+	Descr   string      // role description
+	Perms   []FieldPerm // permissions for all fields, all entities
+	Scope   int         // companies the permissions apply to: SCOPEALL, SCOPEOWN or SCOPELIST
+	CoCodes []int       // the companies for SCOPELIST
+	OutRID  int         // role whose permissions, limited to these, apply outside the scope
 }
 
 // PermMaps provides maps for quick access to a field.
 // This is a handy structure for a session.
 //-----------------------------------------------------------------------------
 type PermMaps struct {
-	Urole Role           // user's role
-	Pp    map[string]int // quick way to reference person permissions based on field name
-	Pco   map[string]int // quick way to reference company permissions based on field name
-	Pcl   map[string]int // quick way to reference db.Class permissions based on field name
-	Ppr   map[string]int
+	Urole   Role           // user's role
+	Pp      map[string]int // quick way to reference person permissions based on field name
+	Pco     map[string]int // quick way to reference company permissions based on field name
+	Pcl     map[string]int // quick way to reference db.Class permissions based on field name
+	Ppr     map[string]int
+	Scope   int       // SCOPEALL, SCOPEOWN or SCOPELIST
+	CoCodes []int     // companies in scope, see SetOwnCompany for SCOPEOWN
+	Out     *PermMaps // permissions outside the scope, nil for SCOPEALL
 }
 
 // Authz is the context structure for the authorization framework
@@ -57,6 +106,10 @@ var Authz struct {
 	SecurityDebug bool // push security debug messages to the logfile
 }
 
+// rolesMu guards Authz.Roles, which the role editor replaces while the
+// server is running
+var rolesMu sync.RWMutex
+
 // Init initializes the authorization framework
 //-----------------------------------------------------------------------------
 func Init(debug bool) {
@@ -64,21 +117,41 @@ func Init(debug bool) {
 	Authz.SecurityDebug = debug
 }
 
+// GetRoles returns the current roles. The slice is replaced, never changed,
+// when the roles are updated, so callers can use it freely but must not
+// modify it.
+//-----------------------------------------------------------------------------
+func GetRoles() []Role {
+	rolesMu.RLock()
+	defer rolesMu.RUnlock()
+	return Authz.Roles
+}
+
+// SetRoles replaces the roles with the supplied ones. Sessions keep the
+// permissions they were given until their PermMaps are rebuilt.
+//-----------------------------------------------------------------------------
+func SetRoles(roles []Role) {
+	rolesMu.Lock()
+	Authz.Roles = roles
+	rolesMu.Unlock()
+}
+
 // GetRoleInfo populates the PermMaps
 //-----------------------------------------------------------------------------
 func GetRoleInfo(rid int, s *PermMaps) {
 	found := -1
 	idx := -1
+	roles := GetRoles()
 
 	// try to find the requested index
-	// lib.Ulog("len(Authz.Roles)=%d\n", len(Authz.Roles))
+	// lib.Ulog("len(roles)=%d\n", len(roles))
 	// lib.Ulog("GetRoleInfo - looking for rid=%d\n", rid)
-	for i := 0; i < len(Authz.Roles); i++ {
-		// lib.Ulog("Authz.Roles[%d] = %+v\n", i, Authz.Roles[i])
-		if rid == Authz.Roles[i].RID {
+	for i := 0; i < len(roles); i++ {
+		// lib.Ulog("roles[%d] = %+v\n", i, roles[i])
+		if rid == roles[i].RID {
 			found = i
 			idx = i
-			s.Urole.Name = Authz.Roles[i].Name
+			s.Urole.Name = roles[i].Name
 			s.Urole.RID = rid
 			break
 		}
@@ -89,17 +162,35 @@ func GetRoleInfo(rid int, s *PermMaps) {
 		lib.Ulog("Did not find rid == %d, all permissions set to read-only\n", rid)
 	}
 
-	r := Authz.Roles[idx]
+	r := roles[idx]
+	fillPermMaps(s, &r, found < 0)
+	s.Scope = SCOPEALL
+	s.CoCodes = nil
+	s.Out = nil
+	if found >= 0 && r.Scope != SCOPEALL {
+		s.Urole.Scope = r.Scope
+		s.Urole.CoCodes = r.CoCodes
+		s.Urole.OutRID = r.OutRID
+		s.Scope = r.Scope
+		s.CoCodes = append([]int{}, r.CoCodes...)
+		s.Out = outPermMaps(roles, r.OutRID, s)
+	}
+}
+
+// fillPermMaps sets the fast access maps and Urole.Perms of s from the
+// permissions of r. If readOnly is true every field only gets PERMVIEW.
+func fillPermMaps(s *PermMaps, r *Role, readOnly bool) {
 	s.Pp = make(map[string]int)
 	s.Pco = make(map[string]int)
 	s.Pcl = make(map[string]int)
 	s.Ppr = make(map[string]int)
+	s.Urole.Perms = nil
 
 	for i := 0; i < len(r.Perms); i++ {
 		var f FieldPerm
 		f.Elem = r.Perms[i].Elem
 		f.Field = r.Perms[i].Field
-		if found < 0 {
+		if readOnly {
 			f.Perm = PERMVIEW
 		} else {
 			f.Perm = r.Perms[i].Perm
@@ -119,3 +210,103 @@ func GetRoleInfo(rid int, s *PermMaps) {
 		}
 	}
 }
+
+// TwoFactorRequired returns true if users with the role in s must sign in
+// with a second factor. Roles named in TwoFactorRoles in config.json always
+// require it. Unless TwoFactorPrivileged is turned off, so does any role
+// that can run the service's privileged functions or change compensation
+// or deductions.
+//-----------------------------------------------------------------------------
+func TwoFactorRequired(s *PermMaps) bool {
+	for i := 0; i < len(lib.PBConfig.TwoFactorRoles); i++ {
+		if lib.PBConfig.TwoFactorRoles[i] == s.Urole.Name {
+			return true
+		}
+	}
+	if !lib.PBConfig.TwoFactorPrivileged {
+		return false
+	}
+	for _, p := range s.Ppr {
+		if p&PERMEXEC != 0 {
+			return true
+		}
+	}
+	return s.Pp["Comps"]&PERMMOD != 0 || s.Pp["Deductions"]&PERMMOD != 0
+}
+
+// RoleName returns the name of the role with the supplied rid, or "" if
+// there is no such role.
+//-----------------------------------------------------------------------------
+func RoleName(rid int) string {
+	roles := GetRoles()
+	for i := 0; i < len(roles); i++ {
+		if rid == roles[i].RID {
+			return roles[i].Name
+		}
+	}
+	return ""
+}
+
+// LimitPerms removes from s every permission that o does not also have, so
+// that s can do no more than either role allows. If either is limited to
+// some companies, s ends up limited to the companies both cover, and
+// outside them to what both allow outside their scopes.
+//-----------------------------------------------------------------------------
+func LimitPerms(s, o *PermMaps) {
+	sOut, oOut := s.Out, o.Out
+	if sOut == nil && oOut != nil {
+		sOut = s.clone()
+	}
+	if oOut == nil {
+		oOut = o
+	}
+	limitMaps(s, o)
+	if sOut == nil {
+		return
+	}
+	limitMaps(sOut, oOut)
+	s.Out = sOut
+	switch {
+	case s.Scope == SCOPEALL:
+		s.Scope = o.Scope
+		s.CoCodes = append([]int{}, o.CoCodes...)
+	case o.Scope != SCOPEALL:
+		var c []int
+		for i := 0; i < len(s.CoCodes); i++ {
+			if o.InScope(s.CoCodes[i]) {
+				c = append(c, s.CoCodes[i])
+			}
+		}
+		s.Scope = SCOPELIST
+		s.CoCodes = c
+	}
+}
+
+// limitMaps removes from the maps of s every permission o does not have
+func limitMaps(s, o *PermMaps) {
+	for k, v := range s.Pp {
+		s.Pp[k] = v & o.Pp[k]
+	}
+	for k, v := range s.Pco {
+		s.Pco[k] = v & o.Pco[k]
+	}
+	for k, v := range s.Pcl {
+		s.Pcl[k] = v & o.Pcl[k]
+	}
+	for k, v := range s.Ppr {
+		s.Ppr[k] = v & o.Ppr[k]
+	}
+	for i := 0; i < len(s.Urole.Perms); i++ {
+		f := &s.Urole.Perms[i]
+		switch f.Elem {
+		case ELEMPERSON:
+			f.Perm = s.Pp[f.Field]
+		case ELEMCOMPANY:
+			f.Perm = s.Pco[f.Field]
+		case ELEMCLASS:
+			f.Perm = s.Pcl[f.Field]
+		case ELEMPBSVC:
+			f.Perm = s.Ppr[f.Field]
+		}
+	}
+}
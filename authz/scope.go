@@ -0,0 +1,170 @@
+package authz
+
+// A role's permissions can be limited to some of the companies. For people,
+// companies and classes of any other company the role has the permissions
+// of its OutRID role instead, but never more than its own. With no OutRID
+// it has no permissions at all outside its scope.
+const (
+	SCOPEALL  = 0 // the role's permissions apply to every company
+	SCOPEOWN  = 1 // only to the company of the person who holds the role
+	SCOPELIST = 2 // only to the companies in Role.CoCodes
+)
+
+// ScopeNames are the names of the scopes, for the role editor and logs
+var ScopeNames = map[int]string{
+	SCOPEALL:  "all companies",
+	SCOPEOWN:  "own company",
+	SCOPELIST: "listed companies",
+}
+
+// outPermMaps returns the permissions a role with the permissions in s has
+// outside its scope: those of the role with the supplied rid, limited to s.
+func outPermMaps(roles []Role, rid int, s *PermMaps) *PermMaps {
+	o := new(PermMaps)
+	var r Role
+	for i := 0; i < len(roles); i++ {
+		if roles[i].RID == rid {
+			r = roles[i]
+			break
+		}
+	}
+	fillPermMaps(o, &r, false)
+	o.Urole.RID = r.RID
+	o.Urole.Name = r.Name
+	// A field s has a permission for but the out role does not mention is
+	// denied outside the scope. Leaving it out of the maps would tell
+	// FilterSecurityRead that the field is not filtered at all.
+	for i := 0; i < len(s.Urole.Perms); i++ {
+		f := s.Urole.Perms[i]
+		m := o.elemMap(f.Elem)
+		if _, ok := m[f.Field]; m == nil || ok {
+			continue
+		}
+		m[f.Field] = PERMNONE
+		o.Urole.Perms = append(o.Urole.Perms, FieldPerm{Elem: f.Elem, Field: f.Field, Perm: PERMNONE, Descr: f.Descr})
+	}
+	limitMaps(o, s)
+	return o
+}
+
+// clone returns a copy of p that shares nothing with it
+func (p *PermMaps) clone() *PermMaps {
+	c := *p
+	c.Pp = copyPerms(p.Pp)
+	c.Pco = copyPerms(p.Pco)
+	c.Pcl = copyPerms(p.Pcl)
+	c.Ppr = copyPerms(p.Ppr)
+	c.Urole.Perms = append([]FieldPerm{}, p.Urole.Perms...)
+	c.CoCodes = append([]int{}, p.CoCodes...)
+	c.Out = nil
+	return &c
+}
+
+func copyPerms(m map[string]int) map[string]int {
+	c := make(map[string]int, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+// SetOwnCompany tells p which company its holder works for. A role scoped
+// to its holder's own company covers no company until this is called.
+//-----------------------------------------------------------------------------
+func (p *PermMaps) SetOwnCompany(coCode int) {
+	if p.Scope == SCOPEOWN {
+		p.CoCodes = []int{coCode}
+	}
+}
+
+// InScope returns true if p's own permissions apply to the supplied company
+//-----------------------------------------------------------------------------
+func (p *PermMaps) InScope(coCode int) bool {
+	if p.Scope == SCOPEALL {
+		return true
+	}
+	for i := 0; i < len(p.CoCodes); i++ {
+		if p.CoCodes[i] == coCode {
+			return true
+		}
+	}
+	return false
+}
+
+// For returns the permissions p has on data belonging to the supplied
+// company.
+//-----------------------------------------------------------------------------
+func (p *PermMaps) For(coCode int) *PermMaps {
+	if p.InScope(coCode) || p.Out == nil {
+		return p
+	}
+	return p.Out
+}
+
+// Everywhere returns the permissions p has in every company. For a role
+// limited to some companies they are the ones it has outside its scope,
+// which are never more than its own.
+//-----------------------------------------------------------------------------
+func (p *PermMaps) Everywhere() *PermMaps {
+	if p.Scope == SCOPEALL {
+		return p
+	}
+	if p.Out == nil {
+		return new(PermMaps)
+	}
+	return p.Out
+}
+
+// elemMap returns the map of p that holds the permissions for element el
+func (p *PermMaps) elemMap(el int) map[string]int {
+	switch el {
+	case ELEMPERSON:
+		return p.Pp
+	case ELEMCOMPANY:
+		return p.Pco
+	case ELEMCLASS:
+		return p.Pcl
+	case ELEMPBSVC:
+		return p.Ppr
+	}
+	return nil
+}
+
+// perm returns the permission p has on field n of element el
+func (p *PermMaps) perm(el int, n string) int {
+	return p.elemMap(el)[n]
+}
+
+// allows returns true if p has every permission in perms
+func (p *PermMaps) allows(perms []FieldPerm) bool {
+	for i := 0; i < len(perms); i++ {
+		if perms[i].Perm&^p.perm(perms[i].Elem, perms[i].Field) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Covers returns true if p allows everything role r allows, in every
+// company r allows it in. It keeps an admin from creating a role, or
+// handing out one, that can do more than they can. A role limited to its
+// holder's own company may be held by someone in any company, so p must
+// allow its permissions everywhere, as for a role that is not limited.
+//-----------------------------------------------------------------------------
+func (p *PermMaps) Covers(r *Role) bool {
+	if r.Scope == SCOPELIST {
+		for i := 0; i < len(r.CoCodes); i++ {
+			if !p.For(r.CoCodes[i]).allows(r.Perms) {
+				return false
+			}
+		}
+	} else if !p.Everywhere().allows(r.Perms) {
+		return false
+	}
+	if r.Scope == SCOPEALL || r.OutRID == 0 {
+		return true
+	}
+	var rp PermMaps
+	fillPermMaps(&rp, r, false)
+	return p.Everywhere().allows(outPermMaps(GetRoles(), r.OutRID, &rp).Urole.Perms)
+}
@@ -0,0 +1,143 @@
+package authz
+
+import "testing"
+
+const (
+	testAdmin   = 1 // every permission everywhere
+	testViewer  = 2 // only LastName, view
+	testHR      = 3 // company 5 only, nothing outside it
+	testHROut   = 4 // company 5 only, testViewer outside it
+	testCompany = 5 // the company testHR and testHROut are limited to
+	testOther   = 7 // some other company
+)
+
+func testRoles() []Role {
+	return []Role{
+		{RID: testAdmin, Name: "Administrator", Perms: []FieldPerm{
+			{Elem: ELEMPERSON, Field: "LastName", Perm: PERMVIEW | PERMMOD},
+			{Elem: ELEMPERSON, Field: "Comps", Perm: PERMVIEW | PERMMOD},
+			{Elem: ELEMCOMPANY, Field: "LegalName", Perm: PERMVIEW | PERMMOD},
+		}},
+		{RID: testViewer, Name: "Viewer", Perms: []FieldPerm{
+			{Elem: ELEMPERSON, Field: "LastName", Perm: PERMVIEW},
+		}},
+		{RID: testHR, Name: "HR", Scope: SCOPELIST, CoCodes: []int{testCompany}, Perms: []FieldPerm{
+			{Elem: ELEMPERSON, Field: "LastName", Perm: PERMVIEW | PERMMOD},
+			{Elem: ELEMPERSON, Field: "Comps", Perm: PERMVIEW},
+		}},
+		{RID: testHROut, Name: "HR Out", Scope: SCOPELIST, CoCodes: []int{testCompany}, OutRID: testViewer, Perms: []FieldPerm{
+			{Elem: ELEMPERSON, Field: "LastName", Perm: PERMVIEW | PERMMOD},
+			{Elem: ELEMPERSON, Field: "Comps", Perm: PERMVIEW},
+		}},
+	}
+}
+
+func testPermMaps(t *testing.T, rid int) *PermMaps {
+	SetRoles(testRoles())
+	var p PermMaps
+	GetRoleInfo(rid, &p)
+	if p.Urole.RID != rid {
+		t.Fatalf("GetRoleInfo(%d) did not find the role", rid)
+	}
+	return &p
+}
+
+func TestFor(t *testing.T) {
+	tests := []struct {
+		name   string
+		rid    int
+		coCode int
+		field  string
+		want   int
+	}{
+		{"unscoped", testAdmin, testOther, "Comps", PERMVIEW | PERMMOD},
+		{"in scope", testHR, testCompany, "Comps", PERMVIEW},
+		{"out of scope, no out role", testHR, testOther, "Comps", PERMNONE},
+		{"out of scope, no out role, other field", testHR, testOther, "LastName", PERMNONE},
+		{"out role, field it grants", testHROut, testOther, "LastName", PERMVIEW},
+		{"out role narrower than the role", testHROut, testOther, "Comps", PERMNONE},
+	}
+	for _, tt := range tests {
+		p := testPermMaps(t, tt.rid).For(tt.coCode)
+		got, found := p.Pp[tt.field]
+		if !found {
+			t.Errorf("%s: %s is missing from the person permissions, so it would not be filtered", tt.name, tt.field)
+		}
+		if got != tt.want {
+			t.Errorf("%s: For(%d).Pp[%q] = %s, want %s", tt.name, tt.coCode, tt.field, PermString(got), PermString(tt.want))
+		}
+	}
+}
+
+func TestEverywhere(t *testing.T) {
+	tests := []struct {
+		rid   int
+		field string
+		want  int
+	}{
+		{testAdmin, "Comps", PERMVIEW | PERMMOD},
+		{testHR, "LastName", PERMNONE},
+		{testHR, "Comps", PERMNONE},
+		{testHROut, "LastName", PERMVIEW},
+		{testHROut, "Comps", PERMNONE},
+	}
+	for _, tt := range tests {
+		if got := testPermMaps(t, tt.rid).Everywhere().perm(ELEMPERSON, tt.field); got != tt.want {
+			t.Errorf("role %d: Everywhere() %s = %s, want %s", tt.rid, tt.field, PermString(got), PermString(tt.want))
+		}
+	}
+}
+
+func TestCovers(t *testing.T) {
+	lastNameView := []FieldPerm{{Elem: ELEMPERSON, Field: "LastName", Perm: PERMVIEW}}
+	compsView := []FieldPerm{{Elem: ELEMPERSON, Field: "Comps", Perm: PERMVIEW}}
+	roles := testRoles()
+	tests := []struct {
+		name string
+		rid  int
+		r    Role
+		want bool
+	}{
+		{"admin covers a scoped role", testAdmin, roles[testHR-1], true},
+		{"scoped role does not cover admin", testHR, roles[testAdmin-1], false},
+		{"same company", testHR, Role{Scope: SCOPELIST, CoCodes: []int{testCompany}, Perms: lastNameView}, true},
+		{"other company", testHR, Role{Scope: SCOPELIST, CoCodes: []int{testOther}, Perms: lastNameView}, false},
+		{"own company may be anywhere", testHR, Role{Scope: SCOPEOWN, Perms: lastNameView}, false},
+		{"out role covers everywhere", testHROut, Role{Perms: lastNameView}, true},
+		{"out role narrower", testHROut, Role{Perms: compsView}, false},
+		{"wider out role", testHR, Role{Scope: SCOPELIST, CoCodes: []int{testCompany}, OutRID: testViewer, Perms: lastNameView}, false},
+		{"same out role", testHROut, Role{Scope: SCOPELIST, CoCodes: []int{testCompany}, OutRID: testViewer, Perms: lastNameView}, true},
+	}
+	for _, tt := range tests {
+		if got := testPermMaps(t, tt.rid).Covers(&tt.r); got != tt.want {
+			t.Errorf("%s: Covers = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLimitPerms(t *testing.T) {
+	tests := []struct {
+		name   string
+		s, o   int
+		coCode int
+		field  string
+		want   int
+	}{
+		{"admin limited to HR, in scope", testAdmin, testHR, testCompany, "Comps", PERMVIEW},
+		{"admin limited to HR, out of scope", testAdmin, testHR, testOther, "Comps", PERMNONE},
+		{"HR limited to admin, in scope", testHR, testAdmin, testCompany, "LastName", PERMVIEW | PERMMOD},
+		{"HR limited to admin, out of scope", testHR, testAdmin, testOther, "LastName", PERMNONE},
+		{"HR out limited to viewer, in scope", testHROut, testViewer, testCompany, "Comps", PERMNONE},
+		{"HR out limited to viewer, out of scope", testHROut, testViewer, testOther, "LastName", PERMVIEW},
+	}
+	for _, tt := range tests {
+		s, o := testPermMaps(t, tt.s), testPermMaps(t, tt.o)
+		LimitPerms(s, o)
+		if s.InScope(testOther) {
+			t.Errorf("%s: the limited permissions are in scope for company %d", tt.name, testOther)
+		}
+		if got := s.For(tt.coCode).perm(ELEMPERSON, tt.field); got != tt.want {
+			t.Errorf("%s: For(%d) %s = %s, want %s", tt.name, tt.coCode, tt.field, PermString(got), PermString(tt.want))
+		}
+	}
+}
@@ -41,10 +41,19 @@ func adminBecomeHandler(w http.ResponseWriter, r *http.Request) {
 	// SECURITY
 	//============================================================
 	if tmp.PMap.Urole.Name != "Administrator" {
+		ulog("Permissions refuse become on userid=%d (%s), role=%s\n", ssn.UIDorig, ssn.Firstname, tmp.PMap.Urole.Name)
+		sess.LogSecEvent(r, sess.SessionEvent(ssn, db.SECBECOMEREFUSED, int64(uid), "", ""))
 		http.Redirect(w, r, "/search/", http.StatusFound)
 		return
 	}
 
-	sessionBecome(ssn, uid)
-	searchHandler(w, r)
+	e := sess.SessionEvent(ssn, db.SECBECOME, int64(uid), "", "")
+	if err := sessionBecome(w, r, ssn, uid); err != nil {
+		ulog("adminBecomeHandler: could not rotate session token: %s\n", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	e.TargetName = ssn.Username
+	sess.LogSecEvent(r, e)
+	http.Redirect(w, r, "/search/", http.StatusFound)
 }
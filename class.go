@@ -1,6 +1,7 @@
 package main
 
 import (
+	"database/sql"
 	"fmt"
 	"net/http"
 	"phonebook/authz"
@@ -18,17 +19,9 @@ func getClassInfo(classcode int, c *db.Class) {
 	<-Phonebook.ReqCountersMemAck    // make sure we got it
 	Counters.ViewClass++             // initialize our data
 	Phonebook.ReqCountersMemAck <- 1 // tell Dispatcher we're done with the data
-	// s := fmt.Sprintf("select classcode,Name,Designation,Description from classes where classcode=%d", classcode)
-	rows, err := Phonebook.prepstmt.classInfo.Query(classcode)
-	errcheck(err)
-	defer rows.Close()
-	for rows.Next() {
-		errcheck(rows.Scan(&c.ClassCode, &c.CoCode, &c.Name, &c.Designation, &c.Description))
-	}
-	errcheck(rows.Err())
-
-	if c.CoCode > 0 {
-		errcheck(Phonebook.prepstmt.companyInfo.QueryRow(c.CoCode).Scan(&c.C.CoCode, &c.C.LegalName, &c.C.CommonName, &c.C.Address, &c.C.Address2, &c.C.City, &c.C.State, &c.C.PostalCode, &c.C.Country, &c.C.Phone, &c.C.Fax, &c.C.Email, &c.C.Designation, &c.C.Active, &c.C.EmploysPersonnel))
+	err := db.GetClassInfo(classcode, c)
+	if err != sql.ErrNoRows {
+		errcheck(err)
 	}
 }
 
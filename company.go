@@ -1,6 +1,7 @@
 package main
 
 import (
+	"database/sql"
 	"fmt"
 	"net/http"
 	"phonebook/authz"
@@ -48,23 +49,10 @@ func getCompanyInfo(cocode int, c *db.Company) {
 	<-Phonebook.ReqCountersMemAck    // make sure we got it
 	Counters.ViewCompany++           // initialize our data
 	Phonebook.ReqCountersMemAck <- 1 // tell Dispatcher we're done with the data
-	rows, err := Phonebook.prepstmt.companyInfo.Query(cocode)
-	errcheck(err)
-	defer rows.Close()
-	for rows.Next() {
-		errcheck(rows.Scan(&c.CoCode, &c.LegalName, &c.CommonName, &c.Address, &c.Address2, &c.City, &c.State, &c.PostalCode, &c.Country, &c.Phone, &c.Fax, &c.Email, &c.Designation, &c.Active, &c.EmploysPersonnel))
+	err := db.GetCompanyInfo(cocode, c)
+	if err != sql.ErrNoRows {
+		errcheck(err)
 	}
-	errcheck(rows.Err())
-
-	rows, err = Phonebook.prepstmt.CompanyClasses.Query(cocode)
-	errcheck(err)
-	defer rows.Close()
-	for rows.Next() {
-		var cl db.Class
-		errcheck(rows.Scan(&cl.ClassCode, &cl.CoCode, &cl.Name, &cl.Designation, &cl.Description, &cl.LastModTime, &cl.LastModBy))
-		c.C = append(c.C, cl)
-	}
-	errcheck(rows.Err())
 }
 
 func companyHandler(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/subtle"
+	"html/template"
+	"net/http"
+	"phonebook/sess"
+	"regexp"
+)
+
+// csrfFieldName is the form field that carries the CSRF token
+const csrfFieldName = "csrf"
+
+// csrfFormTag matches the start tag of a form that is posted
+var csrfFormTag = regexp.MustCompile(`(?i)<form\b[^>]*\bmethod\s*=\s*"?post"?[^>]*>`)
+
+// csrfInject adds a hidden field with the CSRF token of the supplied
+// session token to every posted form in page.
+//-----------------------------------------------------------------------------
+func csrfInject(page []byte, token string) []byte {
+	field := []byte(`<input type="hidden" name="` + csrfFieldName + `" value="` +
+		template.HTMLEscapeString(sess.CSRFToken(token)) + `">`)
+	return csrfFormTag.ReplaceAllFunc(page, func(tag []byte) []byte {
+		return append(append([]byte{}, tag...), field...)
+	})
+}
+
+// csrfOK returns true if the request carries the CSRF token of the session
+// cookie it was sent with.
+//-----------------------------------------------------------------------------
+func csrfOK(r *http.Request) bool {
+	cookie, err := r.Cookie(sess.SessionCookieName)
+	if err != nil || len(cookie.Value) == 0 {
+		return false
+	}
+	want := sess.CSRFToken(cookie.Value)
+	return 1 == subtle.ConstantTimeCompare([]byte(r.PostFormValue(csrfFieldName)), []byte(want))
+}
+
+// csrfRefuse logs and refuses a request that failed the CSRF check
+func csrfRefuse(w http.ResponseWriter, r *http.Request) {
+	ulog("CSRF check failed: %s %s from %s\n", r.Method, r.URL.Path, sess.ClientIP(r))
+	http.Error(w, "Forbidden: the form has expired, please go back, reload the page and try again", http.StatusForbidden)
+}
+
+// csrfPOST wraps a handler that changes something. The request must be a
+// POST carrying the CSRF token of its session, otherwise it is refused
+// before the handler runs.
+//-----------------------------------------------------------------------------
+func csrfPOST(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !csrfOK(r) {
+			csrfRefuse(w, r)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// csrfForm wraps a handler that shows a page on GET and changes something
+// on POST. A POST must carry the CSRF token of its session.
+//-----------------------------------------------------------------------------
+func csrfForm(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" && !csrfOK(r) {
+			csrfRefuse(w, r)
+			return
+		}
+		h(w, r)
+	}
+}
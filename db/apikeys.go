@@ -0,0 +1,144 @@
+package db
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"phonebook/lib"
+	"time"
+)
+
+// API keys let scripts and other services call the web services without a
+// user's password. A key either belongs to a person, in which case it can
+// never do more than the person's own role allows, or it is a service
+// account with no person behind it. Either way it acts with the role it was
+// created with. Only a hash of the key is kept in the apikeys table, the
+// key itself is shown once when it is created.
+const (
+	APIKEYLEN    = 32     // random bytes in an API key
+	APIKEYPREFIX = "pbk_" // start of every API key, so they are easy to spot
+	APIKEYSHOWN  = 12     // characters of a key kept in the clear to tell keys apart
+)
+
+// ErrAPIKeyInvalid is returned when an API key does not exist, has been
+// revoked, or belongs to a person who has been deleted.
+var ErrAPIKeyInvalid = fmt.Errorf("invalid API key")
+
+// APIKey describes an API key
+type APIKey struct {
+	KeyID    int64     // assigned by DB
+	UID      int64     // person the key belongs to, 0 for a service account
+	UserName string    // username of the person, "" for a service account
+	Name     string    // service account name, or what a personal key is for
+	RID      int       // role the key acts with
+	Prefix   string    // first characters of the key
+	CreateBy int64     // uid of the admin who created the key
+	Created  time.Time // when the key was created
+	LastUsed time.Time // when the key was last used
+	LastIP   string    // address the key was last used from
+	Revoked  bool      // true once the key has been revoked
+}
+
+// createAPIKeyPreparedStmts creates the prepared sql statements used to
+// manage the apikeys table.
+//-----------------------------------------------------------------------------
+func createAPIKeyPreparedStmts() {
+	var err error
+	flds := "k.KeyID,k.UID,COALESCE(p.UserName,''),k.Name,k.RID,k.Prefix,k.CreateBy,k.DtCreate,k.DtLastUsed,k.LastIP,k.Revoked"
+	from := " FROM apikeys k LEFT JOIN people p ON p.UID=k.UID"
+	PrepStmts.GetAPIKey, err = DB.DirDB.Prepare("SELECT " + flds + from + " WHERE k.KeyHash=? AND k.Revoked=0")
+	lib.Errcheck(err)
+	PrepStmts.GetAPIKeys, err = DB.DirDB.Prepare("SELECT " + flds + from + " ORDER BY k.Revoked,k.Name,k.KeyID")
+	lib.Errcheck(err)
+	PrepStmts.InsertAPIKey, err = DB.DirDB.Prepare("INSERT INTO apikeys (KeyHash,Prefix,UID,Name,RID,CreateBy,DtCreate) VALUES(?,?,?,?,?,?,?)")
+	lib.Errcheck(err)
+	PrepStmts.UseAPIKey, err = DB.DirDB.Prepare("UPDATE apikeys SET DtLastUsed=?,LastIP=? WHERE KeyID=? AND (DtLastUsed<? OR LastIP<>?)")
+	lib.Errcheck(err)
+	PrepStmts.RevokeAPIKey, err = DB.DirDB.Prepare("UPDATE apikeys SET Revoked=1,DtRevoked=? WHERE KeyID=? AND Revoked=0")
+	lib.Errcheck(err)
+}
+
+// scanAPIKey reads k from a row selected by GetAPIKey or GetAPIKeys
+func scanAPIKey(s interface {
+	Scan(...interface{}) error
+}, k *APIKey) error {
+	var revoked int
+	err := s.Scan(&k.KeyID, &k.UID, &k.UserName, &k.Name, &k.RID, &k.Prefix, &k.CreateBy, &k.Created, &k.LastUsed, &k.LastIP, &revoked)
+	k.Revoked = revoked != 0
+	return err
+}
+
+// NewAPIKey creates an API key
+//
+// INPUTS
+//  uid      - person the key belongs to, 0 for a service account
+//  name     - service account name, or what a personal key is for
+//  rid      - role the key acts with
+//  createBy - uid of the admin creating the key
+//
+// RETURNS
+//  key      - the key, to be shown to the admin once
+//  err      - any error encountered
+//-----------------------------------------------------------------------------
+func NewAPIKey(uid int64, name string, rid int, createBy int64) (string, error) {
+	b := make([]byte, APIKEYLEN)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	key := APIKEYPREFIX + base64.RawURLEncoding.EncodeToString(b)
+	_, err := PrepStmts.InsertAPIKey.Exec(HashToken(key), key[:APIKEYSHOWN], uid, name, rid, createBy, time.Now())
+	if err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// GetAPIKey returns the unrevoked API key matching the supplied key. It
+// returns ErrAPIKeyInvalid if there is none, or if the key belongs to a
+// person who no longer exists.
+//-----------------------------------------------------------------------------
+func GetAPIKey(key string) (APIKey, error) {
+	var k APIKey
+	err := scanAPIKey(PrepStmts.GetAPIKey.QueryRow(HashToken(key)), &k)
+	if err == sql.ErrNoRows || (err == nil && k.UID > 0 && len(k.UserName) == 0) {
+		return k, ErrAPIKeyInvalid
+	}
+	return k, err
+}
+
+// GetAPIKeys returns all API keys, revoked ones last
+//-----------------------------------------------------------------------------
+func GetAPIKeys() ([]APIKey, error) {
+	var keys []APIKey
+	rows, err := PrepStmts.GetAPIKeys.Query()
+	if err != nil {
+		return keys, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var k APIKey
+		if err = scanAPIKey(rows, &k); err != nil {
+			return keys, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// UseAPIKey records that an API key was used from the supplied address. To
+// save a write on every request the time is only updated once a minute
+// unless the address changes.
+//-----------------------------------------------------------------------------
+func UseAPIKey(k *APIKey, ip string) error {
+	now := time.Now()
+	_, err := PrepStmts.UseAPIKey.Exec(now, ip, k.KeyID, now.Add(-time.Minute), ip)
+	return err
+}
+
+// RevokeAPIKey revokes the API key with the supplied id
+//-----------------------------------------------------------------------------
+func RevokeAPIKey(keyid int64) error {
+	_, err := PrepStmts.RevokeAPIKey.Exec(time.Now(), keyid)
+	return err
+}
@@ -0,0 +1,177 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"phonebook/lib"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Every write to a person, company or class adds a row to the changelog
+// table for each field it changes, in the same transaction as the write.
+// Creating a record logs each field it was given with an empty old value,
+// deleting one logs each field it had with an empty new value. Rows are
+// only ever added to the changelog table, never updated or removed.
+
+// Change is one changed field
+type Change struct {
+	CLID      int64     // assigned by DB
+	Elem      int       // authz.ELEMPERSON, ELEMCOMPANY or ELEMCLASS
+	ID        int       // uid, cocode or classcode of what changed
+	Field     string    // name of the field, as in the fieldperms table
+	Old       string    // value before the change, "" if it was created
+	New       string    // value after the change, "" if it was deleted
+	Actor     int64     // uid of the person who made the change
+	Dt        time.Time // when the change was made
+	ActorName string    // first and last name of the actor, from GetChanges
+}
+
+// personChangeFlds are the PersonDetail fields that InsertPerson and
+// UpdatePerson write: the personWriteFlds, except LastModBy, and the lists.
+var personChangeFlds = append(append([]string{}, personWriteFlds[:len(personWriteFlds)-1]...), "Comps", "Deductions")
+
+// myDetailsFlds are the PersonDetail fields that UpdateMyDetails writes
+var myDetailsFlds = []string{"PreferredName", "PrimaryEmail", "OfficePhone", "CellPhone",
+	"EmergencyContactName", "EmergencyContactPhone",
+	"HomeStreetAddress", "HomeStreetAddress2", "HomeCity", "HomeState", "HomePostalCode", "HomeCountry",
+	"ProfileImagePath"}
+
+// companyChangeFlds are the Company fields that InsertCompany and
+// UpdateCompany write
+var companyChangeFlds = []string{"LegalName", "CommonName", "Designation", "Email", "Phone", "Fax",
+	"Active", "EmploysPersonnel", "Address", "Address2", "City", "State", "PostalCode", "Country"}
+
+// classChangeFlds are the Class fields that InsertClass and UpdateClass write
+var classChangeFlds = []string{"CoCode", "Name", "Designation", "Description"}
+
+// createChangeLogPreparedStmts creates the prepared sql statements used to
+// add to and read the changelog table.
+//-----------------------------------------------------------------------------
+func createChangeLogPreparedStmts() {
+	var err error
+	PrepStmts.InsertChange, err = DB.DirDB.Prepare("INSERT INTO changelog (Elem,ID,Field,OldValue,NewValue,Actor,DtChange) VALUES(?,?,?,?,?,?,?)")
+	lib.Errcheck(err)
+	PrepStmts.GetChanges, err = DB.DirDB.Prepare("SELECT c.CLID,c.Elem,c.ID,c.Field,c.OldValue,c.NewValue,c.Actor,c.DtChange," +
+		"COALESCE(p.FirstName,''),COALESCE(p.LastName,'') FROM changelog c LEFT JOIN people p ON p.UID=c.Actor " +
+		"WHERE c.Elem=? AND c.ID=? ORDER BY c.CLID DESC")
+	lib.Errcheck(err)
+}
+
+// changeValue returns v the way it is kept in the changelog table. Dates
+// prior to 1970 are unset, the same as in dateToDBStr, and lists are sorted
+// so that only a change in their contents is a change.
+func changeValue(v reflect.Value) string {
+	switch x := v.Interface().(type) {
+	case time.Time:
+		if x.Year() < 1970 {
+			return ""
+		}
+		return x.Format("2006-01-02")
+	case []int:
+		m := append([]int{}, x...)
+		sort.Ints(m)
+		s := make([]string, len(m))
+		for i := 0; i < len(m); i++ {
+			s[i] = strconv.Itoa(m[i])
+		}
+		return strings.Join(s, ",")
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// diffChanges compares the fields flds of before and after, which must be
+// pointers to the same type of struct, and returns a Change for each field
+// that differs. before is nil when the record is created and after is nil
+// when it is deleted.
+//
+// INPUTS
+//  elem   - authz.ELEMPERSON, ELEMCOMPANY or ELEMCLASS
+//  id     - uid, cocode or classcode of the record
+//  before - the record before the change, or nil
+//  after  - the record after the change, or nil
+//  flds   - names of the fields to compare
+//  actor  - uid of the person making the change
+//
+// RETURNS
+//  the changes, in the order of flds
+//-----------------------------------------------------------------------------
+func diffChanges(elem, id int, before, after interface{}, flds []string, actor int64) []Change {
+	var m []Change
+	now := time.Now()
+	for i := 0; i < len(flds); i++ {
+		c := Change{Elem: elem, ID: id, Field: flds[i], Actor: actor, Dt: now}
+		if before != nil {
+			c.Old = changeValue(reflect.ValueOf(before).Elem().FieldByName(flds[i]))
+		}
+		if after != nil {
+			c.New = changeValue(reflect.ValueOf(after).Elem().FieldByName(flds[i]))
+		}
+		if c.Old != c.New {
+			m = append(m, c)
+		}
+	}
+	return m
+}
+
+// writeChanges adds m to the changelog table within tx
+//-----------------------------------------------------------------------------
+func writeChanges(tx *sql.Tx, m []Change) error {
+	stmt := tx.Stmt(PrepStmts.InsertChange)
+	for i := 0; i < len(m); i++ {
+		if _, err := stmt.Exec(m[i].Elem, m[i].ID, m[i].Field, m[i].Old, m[i].New, m[i].Actor, m[i].Dt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inTx runs f in a transaction, which is committed if f succeeds and rolled
+// back if it fails. who names the caller in the log.
+//-----------------------------------------------------------------------------
+func inTx(who string, f func(tx *sql.Tx) error) error {
+	tx, err := DB.DirDB.Begin()
+	if err != nil {
+		return err
+	}
+	if err = f(tx); err != nil {
+		if e := tx.Rollback(); e != nil {
+			lib.Ulog("%s: rollback failed: %s\n", who, e.Error())
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetChanges returns the changes made to a person, company or class, the
+// most recent first.
+//
+// INPUTS
+//  elem - authz.ELEMPERSON, ELEMCOMPANY or ELEMCLASS
+//  id   - uid, cocode or classcode
+//
+// RETURNS
+//  the changes
+//  any error encountered
+//-----------------------------------------------------------------------------
+func GetChanges(elem, id int) ([]Change, error) {
+	var m []Change
+	rows, err := PrepStmts.GetChanges.Query(elem, id)
+	if err != nil {
+		return m, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c Change
+		var first, last string
+		if err = rows.Scan(&c.CLID, &c.Elem, &c.ID, &c.Field, &c.Old, &c.New, &c.Actor, &c.Dt, &first, &last); err != nil {
+			return m, err
+		}
+		c.ActorName = strings.TrimSpace(first + " " + last)
+		m = append(m, c)
+	}
+	return m, rows.Err()
+}
@@ -0,0 +1,373 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"phonebook/authz"
+	"phonebook/lib"
+	"phonebook/qb"
+	"strings"
+)
+
+var companyFlds = "CoCode,LegalName,CommonName,Address,Address2,City,State,PostalCode,Country,Phone,Fax,Email,Designation,Active,EmploysPersonnel"
+var classFlds = "ClassCode,CoCode,Name,Designation,Description,LastModTime,LastModBy"
+
+// CompanyListFields maps the names of the company fields that a list may be
+// searched or sorted on to their column names.
+var CompanyListFields = map[string]string{
+	"CoCode":           "CoCode",
+	"LegalName":        "LegalName",
+	"CommonName":       "CommonName",
+	"Address":          "Address",
+	"City":             "City",
+	"State":            "State",
+	"PostalCode":       "PostalCode",
+	"Country":          "Country",
+	"Phone":            "Phone",
+	"Fax":              "Fax",
+	"Email":            "Email",
+	"Designation":      "Designation",
+	"Active":           "Active",
+	"EmploysPersonnel": "EmploysPersonnel",
+}
+
+// ClassListFields maps the names of the class fields that a list may be
+// searched or sorted on to their column names.
+var ClassListFields = map[string]string{
+	"ClassCode":   "ClassCode",
+	"CoCode":      "CoCode",
+	"Name":        "Name",
+	"Designation": "Designation",
+	"Description": "Description",
+}
+
+// MAXLIST is the most records a list request returns
+const MAXLIST = 1000
+
+// SearchTerm is a single search condition for a list request
+type SearchTerm struct {
+	Field    string // name of the field to compare
+	Operator string // is, begins, contains, ends
+	Value    string // value to compare against
+}
+
+// ListParams describes the page, sort order, and search conditions for
+// a list request.
+type ListParams struct {
+	Search      []SearchTerm // search conditions
+	SearchLogic string       // AND or OR, how the search conditions are combined
+	SortField   string       // name of the field to sort on
+	SortDesc    bool         // true to sort in descending order
+	Offset      int          // number of records to skip
+	Limit       int          // maximum number of records to return
+}
+
+// createCompanyPreparedStmts creates the prepared sql statements used to
+// read and write the companies and classes tables.
+//-----------------------------------------------------------------------------
+func createCompanyPreparedStmts() {
+	var err error
+	PrepStmts.GetCompany, err = DB.DirDB.Prepare("SELECT " + companyFlds + " FROM companies WHERE CoCode=?")
+	lib.Errcheck(err)
+	PrepStmts.GetCompanyClasses, err = DB.DirDB.Prepare("SELECT " + classFlds + " FROM classes WHERE CoCode=?")
+	lib.Errcheck(err)
+	PrepStmts.InsertCompany, err = DB.DirDB.Prepare("INSERT INTO companies (LegalName,CommonName,Designation," +
+		"Email,Phone,Fax,Active,EmploysPersonnel,Address,Address2,City,State,PostalCode,Country,lastmodby) " +
+		"VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)")
+	lib.Errcheck(err)
+	PrepStmts.UpdateCompany, err = DB.DirDB.Prepare("UPDATE companies SET LegalName=?,CommonName=?,Designation=?,Email=?,Phone=?,Fax=?,EmploysPersonnel=?,Active=?,Address=?,Address2=?,City=?,State=?,PostalCode=?,Country=?,lastmodby=? WHERE CoCode=?")
+	lib.Errcheck(err)
+	PrepStmts.DeleteCompany, err = DB.DirDB.Prepare("DELETE FROM companies WHERE CoCode=?")
+	lib.Errcheck(err)
+	PrepStmts.CompanyRefCount, err = DB.DirDB.Prepare("SELECT COUNT(*) FROM people WHERE CoCode=?")
+	lib.Errcheck(err)
+
+	PrepStmts.GetClass, err = DB.DirDB.Prepare("SELECT " + classFlds + " FROM classes WHERE ClassCode=?")
+	lib.Errcheck(err)
+	PrepStmts.InsertClass, err = DB.DirDB.Prepare("INSERT INTO classes (CoCode,Name,Designation,Description,lastmodby) VALUES(?,?,?,?,?)")
+	lib.Errcheck(err)
+	PrepStmts.UpdateClass, err = DB.DirDB.Prepare("UPDATE classes SET CoCode=?,Name=?,Designation=?,Description=?,lastmodby=? WHERE ClassCode=?")
+	lib.Errcheck(err)
+	PrepStmts.DeleteClass, err = DB.DirDB.Prepare("DELETE FROM classes WHERE ClassCode=?")
+	lib.Errcheck(err)
+	PrepStmts.ClassRefCount, err = DB.DirDB.Prepare("SELECT COUNT(*) FROM people WHERE ClassCode=?")
+	lib.Errcheck(err)
+}
+
+func scanCompany(r rowScanner, c *Company) error {
+	return r.Scan(&c.CoCode, &c.LegalName, &c.CommonName, &c.Address, &c.Address2, &c.City, &c.State, &c.PostalCode, &c.Country, &c.Phone, &c.Fax, &c.Email, &c.Designation, &c.Active, &c.EmploysPersonnel)
+}
+
+func scanClass(r rowScanner, c *Class) error {
+	return r.Scan(&c.ClassCode, &c.CoCode, &c.Name, &c.Designation, &c.Description, &c.LastModTime, &c.LastModBy)
+}
+
+// GetCompanyInfo reads the company with the supplied cocode along with the
+// list of classes that belong to it.
+//
+// INPUTS
+//  cocode - the company to read
+//  c      - where to put the data
+//
+// RETURNS
+//  error - any error encountered. sql.ErrNoRows if there is no such company
+//-----------------------------------------------------------------------------
+func GetCompanyInfo(cocode int, c *Company) error {
+	if err := scanCompany(PrepStmts.GetCompany.QueryRow(cocode), c); err != nil {
+		return err
+	}
+	rows, err := PrepStmts.GetCompanyClasses.Query(cocode)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cl Class
+		if err = scanClass(rows, &cl); err != nil {
+			return err
+		}
+		c.C = append(c.C, cl)
+	}
+	return rows.Err()
+}
+
+// GetClassInfo reads the class with the supplied classcode along with the
+// company it belongs to.
+//
+// INPUTS
+//  classcode - the class to read
+//  c         - where to put the data
+//
+// RETURNS
+//  error - any error encountered. sql.ErrNoRows if there is no such class
+//-----------------------------------------------------------------------------
+func GetClassInfo(classcode int, c *Class) error {
+	if err := scanClass(PrepStmts.GetClass.QueryRow(classcode), c); err != nil {
+		return err
+	}
+	if c.CoCode > 0 {
+		return scanCompany(PrepStmts.GetCompany.QueryRow(c.CoCode), &c.C)
+	}
+	return nil
+}
+
+// InsertCompany adds c to the companies table and sets c.CoCode to the
+// code of the new record.
+//-----------------------------------------------------------------------------
+func InsertCompany(c *Company, modby int64) error {
+	return inTx("InsertCompany", func(tx *sql.Tx) error {
+		res, err := tx.Stmt(PrepStmts.InsertCompany).Exec(c.LegalName, c.CommonName, c.Designation,
+			c.Email, c.Phone, c.Fax, c.Active, c.EmploysPersonnel,
+			c.Address, c.Address2, c.City, c.State, c.PostalCode, c.Country, modby)
+		if err != nil {
+			return err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		c.CoCode = int(id)
+		return writeChanges(tx, diffChanges(authz.ELEMCOMPANY, c.CoCode, nil, c, companyChangeFlds, modby))
+	})
+}
+
+// UpdateCompany writes c to the companies table
+//-----------------------------------------------------------------------------
+func UpdateCompany(c *Company, modby int64) error {
+	return inTx("UpdateCompany", func(tx *sql.Tx) error {
+		var old Company
+		if err := scanCompany(tx.Stmt(PrepStmts.GetCompany).QueryRow(c.CoCode), &old); err != nil {
+			return err
+		}
+		_, err := tx.Stmt(PrepStmts.UpdateCompany).Exec(c.LegalName, c.CommonName, c.Designation, c.Email, c.Phone,
+			c.Fax, c.EmploysPersonnel, c.Active, c.Address, c.Address2, c.City, c.State,
+			c.PostalCode, c.Country, modby, c.CoCode)
+		if err != nil {
+			return err
+		}
+		return writeChanges(tx, diffChanges(authz.ELEMCOMPANY, c.CoCode, &old, c, companyChangeFlds, modby))
+	})
+}
+
+// DeleteCompany removes the company with the supplied cocode. It fails if
+// there are people who work for the company. The fields the company had are
+// logged as changed by actor.
+//-----------------------------------------------------------------------------
+func DeleteCompany(cocode int, actor int64) error {
+	var n int
+	if err := PrepStmts.CompanyRefCount.QueryRow(cocode).Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return fmt.Errorf("company %d is referenced by %d people", cocode, n)
+	}
+	return inTx("DeleteCompany", func(tx *sql.Tx) error {
+		var old Company
+		if err := scanCompany(tx.Stmt(PrepStmts.GetCompany).QueryRow(cocode), &old); err != nil {
+			return err
+		}
+		if _, err := tx.Stmt(PrepStmts.DeleteCompany).Exec(cocode); err != nil {
+			return err
+		}
+		return writeChanges(tx, diffChanges(authz.ELEMCOMPANY, cocode, &old, nil, companyChangeFlds, actor))
+	})
+}
+
+// InsertClass adds c to the classes table and sets c.ClassCode to the
+// code of the new record.
+//-----------------------------------------------------------------------------
+func InsertClass(c *Class, modby int64) error {
+	return inTx("InsertClass", func(tx *sql.Tx) error {
+		res, err := tx.Stmt(PrepStmts.InsertClass).Exec(c.CoCode, c.Name, c.Designation, c.Description, modby)
+		if err != nil {
+			return err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		c.ClassCode = int(id)
+		return writeChanges(tx, diffChanges(authz.ELEMCLASS, c.ClassCode, nil, c, classChangeFlds, modby))
+	})
+}
+
+// UpdateClass writes c to the classes table
+//-----------------------------------------------------------------------------
+func UpdateClass(c *Class, modby int64) error {
+	return inTx("UpdateClass", func(tx *sql.Tx) error {
+		var old Class
+		if err := scanClass(tx.Stmt(PrepStmts.GetClass).QueryRow(c.ClassCode), &old); err != nil {
+			return err
+		}
+		if _, err := tx.Stmt(PrepStmts.UpdateClass).Exec(c.CoCode, c.Name, c.Designation, c.Description, modby, c.ClassCode); err != nil {
+			return err
+		}
+		return writeChanges(tx, diffChanges(authz.ELEMCLASS, c.ClassCode, &old, c, classChangeFlds, modby))
+	})
+}
+
+// DeleteClass removes the class with the supplied classcode. It fails if
+// there are people who belong to the class. The fields the class had are
+// logged as changed by actor.
+//-----------------------------------------------------------------------------
+func DeleteClass(classcode int, actor int64) error {
+	var n int
+	if err := PrepStmts.ClassRefCount.QueryRow(classcode).Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return fmt.Errorf("class %d is referenced by %d people", classcode, n)
+	}
+	return inTx("DeleteClass", func(tx *sql.Tx) error {
+		var old Class
+		if err := scanClass(tx.Stmt(PrepStmts.GetClass).QueryRow(classcode), &old); err != nil {
+			return err
+		}
+		if _, err := tx.Stmt(PrepStmts.DeleteClass).Exec(classcode); err != nil {
+			return err
+		}
+		return writeChanges(tx, diffChanges(authz.ELEMCLASS, classcode, &old, nil, classChangeFlds, actor))
+	})
+}
+
+// listSelect builds the select statement for a list request. Only the
+// fields in flds may be searched or sorted on, and at most MAXLIST records
+// are returned.
+//-----------------------------------------------------------------------------
+func listSelect(p *ListParams, cols, table string, flds map[string]string, dflt string) *qb.Select {
+	var conds []*qb.Cond
+	for i := 0; i < len(p.Search); i++ {
+		if col, ok := flds[p.Search[i].Field]; ok {
+			conds = append(conds, qb.Match(col, p.Search[i].Operator, p.Search[i].Value))
+		}
+	}
+	q := qb.Select{Cols: cols, From: table, Limit: p.Limit, Offset: p.Offset}
+	if strings.ToUpper(p.SearchLogic) == "OR" {
+		q.Where = qb.Or(conds...)
+	} else {
+		q.Where = qb.And(conds...)
+	}
+	order, ok := flds[p.SortField]
+	if !ok {
+		order = dflt
+	}
+	if p.SortDesc {
+		order += " DESC"
+	}
+	q.OrderBy = order
+	if q.Limit <= 0 {
+		q.Limit = 100
+	}
+	if q.Limit > MAXLIST {
+		q.Limit = MAXLIST
+	}
+	return &q
+}
+
+// GetCompanies returns a page of companies
+//
+// INPUTS
+//  p - page, sort order, and search conditions
+//
+// RETURNS
+//  []Company - the companies in the requested page
+//  int64     - number of companies that match the search conditions
+//  error     - any error encountered
+//-----------------------------------------------------------------------------
+func GetCompanies(p *ListParams) ([]Company, int64, error) {
+	var total int64
+	m := []Company{}
+	q := listSelect(p, companyFlds, "companies", CompanyListFields, "LegalName")
+	cq, args := q.CountSQL()
+	if err := DB.DirDB.QueryRow(cq, args...).Scan(&total); err != nil {
+		return m, total, err
+	}
+	sq, args := q.SQL()
+	rows, err := DB.DirDB.Query(sq, args...)
+	if err != nil {
+		return m, total, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c Company
+		if err = scanCompany(rows, &c); err != nil {
+			return m, total, err
+		}
+		m = append(m, c)
+	}
+	return m, total, rows.Err()
+}
+
+// GetClasses returns a page of classes
+//
+// INPUTS
+//  p - page, sort order, and search conditions
+//
+// RETURNS
+//  []Class - the classes in the requested page
+//  int64   - number of classes that match the search conditions
+//  error   - any error encountered
+//-----------------------------------------------------------------------------
+func GetClasses(p *ListParams) ([]Class, int64, error) {
+	var total int64
+	m := []Class{}
+	q := listSelect(p, classFlds, "classes", ClassListFields, "Designation")
+	cq, args := q.CountSQL()
+	if err := DB.DirDB.QueryRow(cq, args...).Scan(&total); err != nil {
+		return m, total, err
+	}
+	sq, args := q.SQL()
+	rows, err := DB.DirDB.Query(sq, args...)
+	if err != nil {
+		return m, total, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c Class
+		if err = scanClass(rows, &c); err != nil {
+			return m, total, err
+		}
+		m = append(m, c)
+	}
+	return m, total, rows.Err()
+}
@@ -0,0 +1,196 @@
+package db
+
+import (
+	"phonebook/lib"
+	"time"
+)
+
+// Failed sign in attempts are counted in the loginfailures table, once per
+// username and once per client IP address, so that every instance of the
+// server sees the same counts. After a few failures each further attempt
+// has to wait twice as long as the one before. Enough failures lock the
+// username or IP address out until LoginLockoutMinutes have passed since the
+// last failure. A successful sign in clears the username's count, but not
+// the IP address's. Password reset requests are counted in the same table,
+// under their own kinds, and are refused without any backoff once the limit
+// is reached.
+const (
+	LOGINKINDUSER      = 0           // loginfailures row counts failures for a username
+	LOGINKINDIP        = 1           // loginfailures row counts failures from an IP address
+	LOGINKINDRESETUSER = 2           // loginfailures row counts password reset requests for a username
+	LOGINKINDRESETIP   = 3           // loginfailures row counts password reset requests from an IP address
+	LOGINBACKOFFBASE   = time.Second // wait after the first failure past the free ones
+)
+
+// LoginLock describes the failed sign in attempts for a username or IP
+type LoginLock struct {
+	Failures int           // failed attempts within the lockout window
+	Last     time.Time     // time of the most recent failure
+	Wait     time.Duration // how long until the next attempt is allowed, 0 if allowed now
+	Locked   bool          // true if Failures reached the lockout limit
+}
+
+// createLoginThrottlePreparedStmts creates the prepared sql statements used
+// to manage the loginfailures table.
+//-----------------------------------------------------------------------------
+func createLoginThrottlePreparedStmts() {
+	var err error
+	PrepStmts.GetLoginFailures, err = DB.DirDB.Prepare("SELECT Failures,DtLast FROM loginfailures WHERE Kind=? AND Name=?")
+	lib.Errcheck(err)
+	PrepStmts.AddLoginFailure, err = DB.DirDB.Prepare("INSERT INTO loginfailures (Kind,Name,Failures,DtLast) VALUES(?,?,1,?) " +
+		"ON DUPLICATE KEY UPDATE Failures=IF(DtLast<?,1,Failures+1),DtLast=VALUES(DtLast)")
+	lib.Errcheck(err)
+	PrepStmts.DeleteLoginFailures, err = DB.DirDB.Prepare("DELETE FROM loginfailures WHERE Kind=? AND Name=?")
+	lib.Errcheck(err)
+	PrepStmts.StaleLoginFailures, err = DB.DirDB.Prepare("DELETE FROM loginfailures WHERE DtLast<?")
+	lib.Errcheck(err)
+}
+
+// loginWindow is how long failures are remembered
+func loginWindow() time.Duration {
+	return time.Duration(lib.PBConfig.LoginLockoutMinutes) * time.Minute
+}
+
+// loginLimits returns the number of failures allowed before backoff starts
+// and the number that locks out, for the supplied kind of row.
+func loginLimits(kind int) (free, max int) {
+	switch kind {
+	case LOGINKINDIP:
+		return lib.PBConfig.LoginMaxFailures, lib.PBConfig.LoginMaxIPFailures
+	case LOGINKINDRESETUSER:
+		return lib.PBConfig.PWResetMaxRequests, lib.PBConfig.PWResetMaxRequests
+	case LOGINKINDRESETIP:
+		return lib.PBConfig.PWResetMaxIPRequests, lib.PBConfig.PWResetMaxIPRequests
+	}
+	return lib.PBConfig.LoginFreeFailures, lib.PBConfig.LoginMaxFailures
+}
+
+// loginDelay returns how long after the last failure the next attempt is
+// allowed, and whether the row is locked out.
+func loginDelay(kind, failures int) (time.Duration, bool) {
+	free, max := loginLimits(kind)
+	window := loginWindow()
+	switch {
+	case failures >= max:
+		return window, true
+	case failures < free:
+		return 0, false
+	}
+	d := LOGINBACKOFFBASE
+	for i := free; i < failures && d < window; i++ {
+		d *= 2
+	}
+	if d > window {
+		d = window
+	}
+	return d, false
+}
+
+// loginName truncates name to the size of the loginfailures Name column
+func loginName(name string) string {
+	if len(name) > 64 {
+		return name[:64]
+	}
+	return name
+}
+
+// getLoginLock reads the failure count for the supplied row
+func getLoginLock(kind int, name string) (LoginLock, error) {
+	var l LoginLock
+	name = loginName(name)
+	err := PrepStmts.GetLoginFailures.QueryRow(kind, name).Scan(&l.Failures, &l.Last)
+	if err != nil {
+		if lib.IsSQLNoResultsError(err) {
+			return l, nil
+		}
+		return l, err
+	}
+	now := time.Now()
+	if l.Last.Add(loginWindow()).Before(now) {
+		return LoginLock{}, nil // forgotten
+	}
+	var d time.Duration
+	d, l.Locked = loginDelay(kind, l.Failures)
+	if until := l.Last.Add(d); until.After(now) {
+		l.Wait = until.Sub(now)
+	}
+	return l, nil
+}
+
+// GetLoginLock returns the failed sign in attempts for the supplied username
+//-----------------------------------------------------------------------------
+func GetLoginLock(username string) (LoginLock, error) {
+	return getLoginLock(LOGINKINDUSER, username)
+}
+
+// loginWait returns the longer of the waits for the username and ip rows
+func loginWait(ukind, ikind int, username, ip string) (time.Duration, error) {
+	u, err := getLoginLock(ukind, username)
+	if err != nil {
+		return 0, err
+	}
+	a, err := getLoginLock(ikind, ip)
+	if err != nil {
+		return 0, err
+	}
+	if a.Wait > u.Wait {
+		return a.Wait, nil
+	}
+	return u.Wait, nil
+}
+
+// addLoginFailure counts one more attempt in the username and ip rows
+func addLoginFailure(ukind, ikind int, username, ip string) error {
+	now := time.Now()
+	stale := now.Add(-loginWindow())
+	if _, err := PrepStmts.StaleLoginFailures.Exec(stale); err != nil {
+		return err
+	}
+	if _, err := PrepStmts.AddLoginFailure.Exec(ukind, loginName(username), now, stale); err != nil {
+		return err
+	}
+	_, err := PrepStmts.AddLoginFailure.Exec(ikind, loginName(ip), now, stale)
+	return err
+}
+
+// LoginWait returns how long a client at ip must wait before it may try to
+// sign in as username. Zero means it may try now.
+//-----------------------------------------------------------------------------
+func LoginWait(username, ip string) (time.Duration, error) {
+	return loginWait(LOGINKINDUSER, LOGINKINDIP, username, ip)
+}
+
+// LoginFailed records a failed attempt to sign in as username from ip. The
+// username is counted whether or not it exists.
+//-----------------------------------------------------------------------------
+func LoginFailed(username, ip string) error {
+	return addLoginFailure(LOGINKINDUSER, LOGINKINDIP, username, ip)
+}
+
+// PWResetWait returns how long a client at ip must wait before it may ask
+// for another password reset for username. Zero means it may ask now.
+//-----------------------------------------------------------------------------
+func PWResetWait(username, ip string) (time.Duration, error) {
+	return loginWait(LOGINKINDRESETUSER, LOGINKINDRESETIP, username, ip)
+}
+
+// PWResetRequested records a request from ip for a password reset for
+// username. The username is counted whether or not it exists.
+//-----------------------------------------------------------------------------
+func PWResetRequested(username, ip string) error {
+	return addLoginFailure(LOGINKINDRESETUSER, LOGINKINDRESETIP, username, ip)
+}
+
+// LoginSucceeded clears the failed attempts for username
+//-----------------------------------------------------------------------------
+func LoginSucceeded(username string) error {
+	_, err := PrepStmts.DeleteLoginFailures.Exec(LOGINKINDUSER, loginName(username))
+	return err
+}
+
+// UnlockLogin clears the failed attempts for username so that it can sign
+// in again right away. It is used by administrators.
+//-----------------------------------------------------------------------------
+func UnlockLogin(username string) error {
+	return LoginSucceeded(username)
+}
@@ -0,0 +1,474 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"phonebook/authz"
+	"phonebook/lib"
+	"strings"
+	"time"
+)
+
+// personFlds is the list of people table columns read into a PersonDetail
+// by scanPersonDetail.  The order must match the Scan in scanPersonDetail.
+var personFlds = "UID,UserName,LastName,FirstName,MiddleName,Salutation," + // 6
+	"ClassCode,Status,PositionControlNumber," + // 9
+	"OfficePhone,OfficeFax,CellPhone,PrimaryEmail," + // 13
+	"SecondaryEmail,EligibleForRehire,LastReview,NextReview," + // 17
+	"BirthMonth,BirthDOM,HomeStreetAddress,HomeStreetAddress2,HomeCity," + // 22
+	"HomeState,HomePostalCode,HomeCountry," + // 25
+	"AcceptedHealthInsurance,AcceptedDentalInsurance,Accepted401K," + // 28
+	"JobCode,Hire,Termination," + // 31
+	"MgrUID,DeptCode,CoCode,StateOfEmployment," + // 35
+	"CountryOfEmployment,PreferredName," + // 37
+	"EmergencyContactName,EmergencyContactPhone,RID" // 40
+
+// personWriteFlds is the list of people table columns written by InsertPerson
+// and UpdatePerson.  The order must match personWriteVals.
+var personWriteFlds = []string{
+	"Salutation", "FirstName", "MiddleName", "LastName", "PreferredName", // 5
+	"EmergencyContactName", "EmergencyContactPhone", // 7
+	"PrimaryEmail", "SecondaryEmail", "OfficePhone", "OfficeFax", "CellPhone", "CoCode", "JobCode", // 14
+	"PositionControlNumber", "DeptCode", // 16
+	"HomeStreetAddress", "HomeStreetAddress2", "HomeCity", "HomeState", "HomePostalCode", "HomeCountry", // 22
+	"Status", "EligibleForRehire", "Accepted401K", "AcceptedDentalInsurance", "AcceptedHealthInsurance", // 27
+	"Hire", "Termination", "ClassCode", // 30
+	"BirthMonth", "BirthDOM", "MgrUID", "StateOfEmployment", "CountryOfEmployment", // 35
+	"LastReview", "NextReview", "RID", "LastModBy", // 39
+}
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// createPeoplePreparedStmts creates the prepared sql statements used to
+// read and write the people table and the tables that reference it.
+//-----------------------------------------------------------------------------
+func createPeoplePreparedStmts() {
+	var err error
+	PrepStmts.GetPersonDetail, err = DB.DirDB.Prepare("SELECT " + personFlds + " FROM people WHERE UID=?")
+	lib.Errcheck(err)
+	PrepStmts.GetPeople, err = DB.DirDB.Prepare("SELECT " + personFlds + " FROM people ORDER BY LastName,FirstName LIMIT ? OFFSET ?")
+	lib.Errcheck(err)
+	PrepStmts.CountPeople, err = DB.DirDB.Prepare("SELECT COUNT(*) FROM people")
+	lib.Errcheck(err)
+
+	ins := strings.Join(personWriteFlds, ",") + ",UserName"
+	vals := strings.Repeat("?,", len(personWriteFlds)) + "?"
+	PrepStmts.InsertPerson, err = DB.DirDB.Prepare("INSERT INTO people (" + ins + ") VALUES(" + vals + ")")
+	lib.Errcheck(err)
+	PrepStmts.UpdatePerson, err = DB.DirDB.Prepare("UPDATE people SET " + strings.Join(personWriteFlds, "=?,") + "=? WHERE UID=?")
+	lib.Errcheck(err)
+	PrepStmts.DeletePerson, err = DB.DirDB.Prepare("DELETE FROM people WHERE UID=?")
+	lib.Errcheck(err)
+	PrepStmts.UpdateMyDetails, err = DB.DirDB.Prepare("UPDATE people SET PreferredName=?,PrimaryEmail=?,OfficePhone=?,CellPhone=?," +
+		"EmergencyContactName=?,EmergencyContactPhone=?," +
+		"HomeStreetAddress=?,HomeStreetAddress2=?,HomeCity=?,HomeState=?,HomePostalCode=?,HomeCountry=?,LastModBy=?,ImagePath=? " +
+		"WHERE UID=?")
+	lib.Errcheck(err)
+
+	PrepStmts.GetComps, err = DB.DirDB.Prepare("SELECT Type FROM compensation WHERE UID=?")
+	lib.Errcheck(err)
+	PrepStmts.InsertComp, err = DB.DirDB.Prepare("INSERT INTO compensation (UID,Type) VALUES(?,?)")
+	lib.Errcheck(err)
+	PrepStmts.DeleteComps, err = DB.DirDB.Prepare("DELETE FROM compensation WHERE UID=?")
+	lib.Errcheck(err)
+	PrepStmts.GetDeductions, err = DB.DirDB.Prepare("SELECT Deduction FROM deductions WHERE UID=?")
+	lib.Errcheck(err)
+	PrepStmts.InsertDeduction, err = DB.DirDB.Prepare("INSERT INTO deductions (UID,Deduction) VALUES(?,?)")
+	lib.Errcheck(err)
+	PrepStmts.DeleteDeductions, err = DB.DirDB.Prepare("DELETE FROM deductions WHERE UID=?")
+	lib.Errcheck(err)
+
+	PrepStmts.DirectReportsCount, err = DB.DirDB.Prepare("SELECT COUNT(*) FROM people WHERE Status=1 AND MgrUID=?")
+	lib.Errcheck(err)
+	PrepStmts.GetMgrUID, err = DB.DirDB.Prepare("SELECT MgrUID FROM people WHERE UID=?")
+	lib.Errcheck(err)
+	PrepStmts.UserNameCount, err = DB.DirDB.Prepare("SELECT COUNT(*) FROM people WHERE UserName=?")
+	lib.Errcheck(err)
+	PrepStmts.NameFromUID, err = DB.DirDB.Prepare("SELECT FirstName,LastName FROM people WHERE UID=?")
+	lib.Errcheck(err)
+	PrepStmts.DeptName, err = DB.DirDB.Prepare("SELECT Name FROM departments WHERE DeptCode=?")
+	lib.Errcheck(err)
+	PrepStmts.JobTitle, err = DB.DirDB.Prepare("SELECT Title FROM jobtitles WHERE JobCode=?")
+	lib.Errcheck(err)
+}
+
+// scanPersonDetail reads the columns listed in personFlds into d
+//-----------------------------------------------------------------------------
+func scanPersonDetail(r rowScanner, d *PersonDetail) error {
+	return r.Scan(&d.UID, &d.UserName, &d.LastName, &d.FirstName, &d.MiddleName, &d.Salutation,
+		&d.ClassCode, &d.Status, &d.PositionControlNumber,
+		&d.OfficePhone, &d.OfficeFax, &d.CellPhone, &d.PrimaryEmail,
+		&d.SecondaryEmail, &d.EligibleForRehire, &d.LastReview, &d.NextReview,
+		&d.BirthMonth, &d.BirthDOM, &d.HomeStreetAddress, &d.HomeStreetAddress2, &d.HomeCity,
+		&d.HomeState, &d.HomePostalCode, &d.HomeCountry,
+		&d.AcceptedHealthInsurance, &d.AcceptedDentalInsurance, &d.Accepted401K,
+		&d.JobCode, &d.Hire, &d.Termination,
+		&d.MgrUID, &d.DeptCode, &d.CoCode, &d.StateOfEmployment,
+		&d.CountryOfEmployment, &d.PreferredName,
+		&d.EmergencyContactName, &d.EmergencyContactPhone, &d.RID)
+}
+
+// personWriteVals returns the values for the columns in personWriteFlds
+//-----------------------------------------------------------------------------
+func personWriteVals(d *PersonDetail, modby int64) []interface{} {
+	return []interface{}{
+		d.Salutation, d.FirstName, d.MiddleName, d.LastName, d.PreferredName,
+		d.EmergencyContactName, d.EmergencyContactPhone,
+		d.PrimaryEmail, d.SecondaryEmail, d.OfficePhone, d.OfficeFax, d.CellPhone, d.CoCode, d.JobCode,
+		d.PositionControlNumber, d.DeptCode,
+		d.HomeStreetAddress, d.HomeStreetAddress2, d.HomeCity, d.HomeState, d.HomePostalCode, d.HomeCountry,
+		d.Status, d.EligibleForRehire, d.Accepted401K, d.AcceptedDentalInsurance, d.AcceptedHealthInsurance,
+		dateToDBStr(d.Hire), dateToDBStr(d.Termination), d.ClassCode,
+		d.BirthMonth, d.BirthDOM, d.MgrUID, d.StateOfEmployment, d.CountryOfEmployment,
+		dateToDBStr(d.LastReview), dateToDBStr(d.NextReview), d.RID, modby,
+	}
+}
+
+// dateToDBStr formats a date for a database write. Dates prior to 1970
+// are treated as unset.
+func dateToDBStr(d time.Time) string {
+	if d.Year() < 1970 {
+		return "0000-00-00"
+	}
+	return d.Format("2006-01-02")
+}
+
+// GetPersonDetail reads the person with uid d.UID from the people table along
+// with the person's compensation types and deductions. It also fills in the
+// manager name, department name and job title.
+//
+// INPUTS
+//  d     - d.UID identifies the person to read
+//
+// RETURNS
+//  error - any error encountered. sql.ErrNoRows if there is no such person
+//-----------------------------------------------------------------------------
+func GetPersonDetail(d *PersonDetail) error {
+	if err := scanPersonDetail(PrepStmts.GetPersonDetail.QueryRow(d.UID), d); err != nil {
+		return err
+	}
+	if err := getPersonLists(d); err != nil {
+		return err
+	}
+	getPersonNames(d)
+	return nil
+}
+
+// GetPeople returns a page of people from the people table sorted by
+// last name then first name. Compensation types and deductions are not
+// loaded for the people in the list.
+//
+// INPUTS
+//  offset - number of people to skip
+//  limit  - maximum number of people to return
+//
+// RETURNS
+//  []PersonDetail - the people in the requested page
+//  int64          - total number of people in the table
+//  error          - any error encountered
+//-----------------------------------------------------------------------------
+func GetPeople(offset, limit int) ([]PersonDetail, int64, error) {
+	var total int64
+	m := []PersonDetail{}
+	if err := PrepStmts.CountPeople.QueryRow().Scan(&total); err != nil {
+		return m, total, err
+	}
+	rows, err := PrepStmts.GetPeople.Query(limit, offset)
+	if err != nil {
+		return m, total, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var d PersonDetail
+		if err = scanPersonDetail(rows, &d); err != nil {
+			return m, total, err
+		}
+		getPersonNames(&d)
+		m = append(m, d)
+	}
+	return m, total, rows.Err()
+}
+
+// getPersonLists reads the compensation types and deductions for d.UID
+func getPersonLists(d *PersonDetail) error {
+	var err error
+	if d.Comps, err = intList(PrepStmts.GetComps, d.UID); err != nil {
+		return err
+	}
+	d.Deductions, err = intList(PrepStmts.GetDeductions, d.UID)
+	return err
+}
+
+// intList returns the single int column read by stmt for uid
+func intList(stmt *sql.Stmt, uid int) ([]int, error) {
+	m := []int{}
+	rows, err := stmt.Query(uid)
+	if err != nil {
+		return m, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var n int
+		if err = rows.Scan(&n); err != nil {
+			return m, err
+		}
+		m = append(m, n)
+	}
+	return m, rows.Err()
+}
+
+// getPersonTx reads the person with the supplied uid within tx, along with
+// the person's image path, compensation types and deductions. It is the
+// record the changelog compares a write against.
+//-----------------------------------------------------------------------------
+func getPersonTx(tx *sql.Tx, uid int) (PersonDetail, error) {
+	var d PersonDetail
+	var err error
+	if err = scanPersonDetail(tx.Stmt(PrepStmts.GetPersonDetail).QueryRow(uid), &d); err != nil {
+		return d, err
+	}
+	if err = tx.Stmt(PrepStmts.GetImagePath).QueryRow(uid).Scan(&d.ProfileImagePath); err != nil {
+		return d, err
+	}
+	if d.Comps, err = intList(tx.Stmt(PrepStmts.GetComps), uid); err != nil {
+		return d, err
+	}
+	d.Deductions, err = intList(tx.Stmt(PrepStmts.GetDeductions), uid)
+	return d, err
+}
+
+// getPersonNames fills in the names associated with the codes in d. Lookup
+// failures simply leave the name empty.
+func getPersonNames(d *PersonDetail) {
+	var first, last string
+	if d.MgrUID > 0 && nil == PrepStmts.NameFromUID.QueryRow(d.MgrUID).Scan(&first, &last) {
+		d.MgrName = fmt.Sprintf("%s %s", first, last)
+	}
+	if d.DeptCode > 0 {
+		PrepStmts.DeptName.QueryRow(d.DeptCode).Scan(&d.DeptName)
+	}
+	if d.JobCode > 0 {
+		PrepStmts.JobTitle.QueryRow(d.JobCode).Scan(&d.JobTitle)
+	}
+}
+
+// GenerateUserName builds a username that is not already in use from the
+// supplied first and last names.
+//-----------------------------------------------------------------------------
+func GenerateUserName(first, last string) (string, error) {
+	base := strings.ToLower(first + last)
+	if len(first) > 0 {
+		base = strings.ToLower(first[0:1] + last)
+	}
+	base = strings.Map(func(r rune) rune {
+		if strings.ContainsRune("., -&`~!@#$%^*()_+={}'[]\";:<>/?\\", r) {
+			return -1
+		}
+		return r
+	}, base)
+	if len(base) > 17 {
+		base = base[0:17]
+	}
+	UserName := base
+	for i := 1; ; i++ {
+		var n int
+		if err := PrepStmts.UserNameCount.QueryRow(UserName).Scan(&n); err != nil {
+			return "", err
+		}
+		if n == 0 {
+			return UserName, nil
+		}
+		UserName = fmt.Sprintf("%s%d", base, i)
+	}
+}
+
+// InsertPerson adds a new person to the people table along with the
+// person's compensation types and deductions.
+//
+// INPUTS
+//  d     - the person to add. d.UserName must be set. On success d.UID
+//          is set to the UID of the new record.
+//  modby - UID of the user making the change
+//
+// RETURNS
+//  error - any error encountered
+//-----------------------------------------------------------------------------
+func InsertPerson(d *PersonDetail, modby int64) error {
+	return inTx("InsertPerson", func(tx *sql.Tx) error {
+		res, err := tx.Stmt(PrepStmts.InsertPerson).Exec(append(personWriteVals(d, modby), d.UserName)...)
+		if err != nil {
+			return err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		d.UID = int(id)
+		if err = savePersonLists(tx, d); err != nil {
+			return err
+		}
+		return writeChanges(tx, diffChanges(authz.ELEMPERSON, d.UID, nil, d, append([]string{"UserName"}, personChangeFlds...), modby))
+	})
+}
+
+// UpdatePerson writes d to the people table and replaces the person's
+// compensation types and deductions.
+//
+// INPUTS
+//  d     - the person to update, identified by d.UID
+//  modby - UID of the user making the change
+//
+// RETURNS
+//  error - any error encountered
+//-----------------------------------------------------------------------------
+func UpdatePerson(d *PersonDetail, modby int64) error {
+	return inTx("UpdatePerson", func(tx *sql.Tx) error {
+		old, err := getPersonTx(tx, d.UID)
+		if err != nil {
+			return err
+		}
+		if _, err = tx.Stmt(PrepStmts.UpdatePerson).Exec(append(personWriteVals(d, modby), d.UID)...); err != nil {
+			return err
+		}
+		if err = savePersonLists(tx, d); err != nil {
+			return err
+		}
+		return writeChanges(tx, diffChanges(authz.ELEMPERSON, d.UID, &old, d, personChangeFlds, modby))
+	})
+}
+
+// UpdateMyDetails writes the fields people may change about themselves,
+// listed in myDetailsFlds, to the people table.
+//
+// INPUTS
+//  d     - the person to update, identified by d.UID
+//  modby - UID of the user making the change
+//
+// RETURNS
+//  error - any error encountered
+//-----------------------------------------------------------------------------
+func UpdateMyDetails(d *PersonDetail, modby int64) error {
+	return inTx("UpdateMyDetails", func(tx *sql.Tx) error {
+		old, err := getPersonTx(tx, d.UID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Stmt(PrepStmts.UpdateMyDetails).Exec(d.PreferredName, d.PrimaryEmail, d.OfficePhone, d.CellPhone,
+			d.EmergencyContactName, d.EmergencyContactPhone,
+			d.HomeStreetAddress, d.HomeStreetAddress2, d.HomeCity, d.HomeState, d.HomePostalCode, d.HomeCountry,
+			modby, d.ProfileImagePath, d.UID)
+		if err != nil {
+			return err
+		}
+		return writeChanges(tx, diffChanges(authz.ELEMPERSON, d.UID, &old, d, myDetailsFlds, modby))
+	})
+}
+
+// savePersonLists replaces the compensation and deductions rows for d.UID
+// within tx
+func savePersonLists(tx *sql.Tx, d *PersonDetail) error {
+	if _, err := tx.Stmt(PrepStmts.DeleteComps).Exec(d.UID); err != nil {
+		return err
+	}
+	for i := 0; i < len(d.Comps); i++ {
+		if _, err := tx.Stmt(PrepStmts.InsertComp).Exec(d.UID, d.Comps[i]); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Stmt(PrepStmts.DeleteDeductions).Exec(d.UID); err != nil {
+		return err
+	}
+	for i := 0; i < len(d.Deductions); i++ {
+		if _, err := tx.Stmt(PrepStmts.InsertDeduction).Exec(d.UID, d.Deductions[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetDirectReportsCount returns the number of active people who report
+// to the person with the supplied uid.
+//-----------------------------------------------------------------------------
+func GetDirectReportsCount(uid int) (int, error) {
+	var n int
+	err := PrepStmts.DirectReportsCount.QueryRow(uid).Scan(&n)
+	return n, err
+}
+
+// IsManagerOf returns true if mgr is one of the first depth people in the
+// MgrUID chain above the person with the supplied uid: their manager, their
+// manager's manager, and so on.
+//-----------------------------------------------------------------------------
+func IsManagerOf(mgr int64, uid int, depth int) (bool, error) {
+	seen := map[int]bool{uid: true}
+	for i := 0; i < depth; i++ {
+		var m int
+		err := PrepStmts.GetMgrUID.QueryRow(uid).Scan(&m)
+		if lib.IsSQLNoResultsError(err) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if m == 0 || seen[m] { // top of the chain, or a loop
+			return false, nil
+		}
+		if int64(m) == mgr {
+			return true, nil
+		}
+		seen[m] = true
+		uid = m
+	}
+	return false, nil
+}
+
+// DeletePerson removes the person with the supplied uid from the people
+// table along with all references to the person in the deductions and
+// compensation tables. The fields the person had are logged as changed by
+// actor.
+//-----------------------------------------------------------------------------
+func DeletePerson(uid int, actor int64) error {
+	return inTx("DeletePerson", func(tx *sql.Tx) error {
+		old, err := getPersonTx(tx, uid)
+		if err != nil {
+			return err
+		}
+		if _, err = tx.Stmt(PrepStmts.DeletePerson).Exec(uid); err != nil {
+			return err
+		}
+		if _, err = tx.Stmt(PrepStmts.DeleteDeductions).Exec(uid); err != nil {
+			return err
+		}
+		if _, err = tx.Stmt(PrepStmts.DeleteComps).Exec(uid); err != nil {
+			return err
+		}
+		return writeChanges(tx, diffChanges(authz.ELEMPERSON, uid, &old, nil, append([]string{"UserName"}, personChangeFlds...), actor))
+	})
+}
+
+// GetUserNameByEmail returns the username of the person whose primary
+// email address is email. It returns "" if no one, or more than one
+// person, has that address.
+//-----------------------------------------------------------------------------
+func GetUserNameByEmail(email string) (string, error) {
+	rows, err := PrepStmts.UserNameByEmail.Query(email)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	var m []string
+	for rows.Next() {
+		var s string
+		if err = rows.Scan(&s); err != nil {
+			return "", err
+		}
+		m = append(m, s)
+	}
+	if err = rows.Err(); err != nil || len(m) != 1 {
+		return "", err
+	}
+	return m[0], nil
+}
@@ -0,0 +1,139 @@
+package db
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"phonebook/lib"
+	"time"
+)
+
+// PWRESETTOKENLEN is the number of random bytes in a password reset token
+const PWRESETTOKENLEN = 32
+
+// ErrPWResetInvalid is returned when a password reset token does not exist,
+// has already been used, or has expired.
+var ErrPWResetInvalid = fmt.Errorf("this password reset link is invalid or has expired")
+
+// PWReset describes a pending password reset. Only a hash of the token is
+// kept in the pwresets table, the token itself is only in the email sent
+// to the user.
+type PWReset struct {
+	UID      int64     // uid of the user resetting the password
+	UserName string    // username of the user resetting the password
+	Expire   time.Time // when the token expires
+}
+
+// createPWResetPreparedStmts creates the prepared sql statements used to
+// manage the pwresets table.
+//-----------------------------------------------------------------------------
+func createPWResetPreparedStmts() {
+	var err error
+	PrepStmts.InsertPWReset, err = DB.DirDB.Prepare("INSERT INTO pwresets (TokenHash,UID,UserName,DtExpire,IP) VALUES(?,?,?,?,?)")
+	lib.Errcheck(err)
+	PrepStmts.GetPWReset, err = DB.DirDB.Prepare("SELECT UID,UserName,DtExpire FROM pwresets WHERE TokenHash=? AND Used=0 AND DtExpire>?")
+	lib.Errcheck(err)
+	PrepStmts.UsePWReset, err = DB.DirDB.Prepare("UPDATE pwresets SET Used=1 WHERE TokenHash=? AND Used=0 AND DtExpire>?")
+	lib.Errcheck(err)
+	PrepStmts.DeletePWResets, err = DB.DirDB.Prepare("DELETE FROM pwresets WHERE DtExpire<=?")
+	lib.Errcheck(err)
+}
+
+// NewPWReset creates a single use password reset token for the supplied
+// user. Reset tokens previously issued to the user keep working until they
+// expire or one of them is used. Expired tokens are discarded. The user's
+// password is not changed.
+//
+// INPUTS
+//  uid      - the user's uid
+//  username - the user's username
+//  ip       - address of the client that asked for the reset
+//  ttl      - how long the token is valid
+//
+// RETURNS
+//  token    - the token to send to the user
+//  err      - any error encountered
+//-----------------------------------------------------------------------------
+func NewPWReset(uid int64, username, ip string, ttl time.Duration) (string, error) {
+	b := make([]byte, PWRESETTOKENLEN)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	now := time.Now()
+	if _, err := PrepStmts.DeletePWResets.Exec(now); err != nil {
+		return "", err
+	}
+	if _, err := PrepStmts.InsertPWReset.Exec(HashToken(token), uid, username, now.Add(ttl), ip); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// GetPWReset returns the pending password reset for token. It returns
+// ErrPWResetInvalid if the token is unknown, used, or expired.
+//-----------------------------------------------------------------------------
+func GetPWReset(token string) (PWReset, error) {
+	var p PWReset
+	err := PrepStmts.GetPWReset.QueryRow(HashToken(token), time.Now()).Scan(&p.UID, &p.UserName, &p.Expire)
+	if err == sql.ErrNoRows {
+		return p, ErrPWResetInvalid
+	}
+	return p, err
+}
+
+// CompletePWReset uses token to set a new password. The token is marked as
+// used and the password hash is updated in a single transaction, so a token
+// can only change the password once. The user's other reset tokens are
+// discarded and the user's sessions are removed from the sessions table.
+//
+// INPUTS
+//  token    - the token from the reset link
+//  passhash - the hash of the new password
+//
+// RETURNS
+//  PWReset  - the user whose password was changed
+//  err      - ErrPWResetInvalid if the token cannot be used, or any other
+//             error encountered
+//-----------------------------------------------------------------------------
+func CompletePWReset(token, passhash string) (PWReset, error) {
+	p, err := GetPWReset(token)
+	if err != nil {
+		return p, err
+	}
+	tx, err := DB.DirDB.Begin()
+	if err != nil {
+		return p, err
+	}
+	if err = completePWReset(tx, token, passhash, p.UID); err != nil {
+		if e := tx.Rollback(); e != nil {
+			lib.Ulog("CompletePWReset: rollback failed: %s\n", e.Error())
+		}
+		return p, err
+	}
+	return p, tx.Commit()
+}
+
+// completePWReset does the CompletePWReset updates within tx
+func completePWReset(tx *sql.Tx, token, passhash string, uid int64) error {
+	res, err := tx.Stmt(PrepStmts.UsePWReset).Exec(HashToken(token), time.Now())
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n != 1 {
+		return ErrPWResetInvalid // it was used or expired since GetPWReset
+	}
+	if _, err = tx.Exec("UPDATE people SET passhash=? WHERE UID=?", passhash, uid); err != nil {
+		return err
+	}
+	if _, err = tx.Exec("DELETE FROM pwresets WHERE UID=? AND Used=0", uid); err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM sessions WHERE UID=?", uid)
+	return err
+}
@@ -0,0 +1,69 @@
+package db
+
+import (
+	"phonebook/lib"
+	"time"
+)
+
+// Every instance of the server caches the roles and the lookup lists
+// (companies, classes, departments and job titles). Whoever changes them
+// bumps their version in the reloadversions table, and each instance
+// reloads what it has cached when it sees a version it has not loaded.
+const (
+	RELOADMAPS  = "maps"  // companies, classes, departments and job titles
+	RELOADROLES = "roles" // roles and their field permissions
+)
+
+// createReloadPreparedStmts creates the prepared sql statements used to read
+// and bump the reload versions.
+//-----------------------------------------------------------------------------
+func createReloadPreparedStmts() {
+	var err error
+	PrepStmts.GetReloadVersions, err = DB.DirDB.Prepare("SELECT Name,Version FROM reloadversions")
+	lib.Errcheck(err)
+	PrepStmts.BumpReloadVersion, err = DB.DirDB.Prepare("INSERT INTO reloadversions (Name,Version,DtChange) VALUES(?,1,?) " +
+		"ON DUPLICATE KEY UPDATE Version=LAST_INSERT_ID(Version+1),DtChange=VALUES(DtChange)")
+	lib.Errcheck(err)
+}
+
+// GetReloadVersions returns the current version of everything in the
+// reloadversions table, indexed by name. Names with no row are version 0.
+//-----------------------------------------------------------------------------
+func GetReloadVersions() (map[string]int64, error) {
+	m := map[string]int64{}
+	rows, err := PrepStmts.GetReloadVersions.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		var v int64
+		if err = rows.Scan(&name, &v); err != nil {
+			return nil, err
+		}
+		m[name] = v
+	}
+	return m, rows.Err()
+}
+
+// BumpReloadVersion records a change to name
+//
+// RETURNS
+//  the new version
+//  any error encountered
+//-----------------------------------------------------------------------------
+func BumpReloadVersion(name string) (int64, error) {
+	res, err := PrepStmts.BumpReloadVersion.Exec(name, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if n == 1 { // the row was inserted
+		return 1, nil
+	}
+	return res.LastInsertId()
+}
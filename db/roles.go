@@ -0,0 +1,253 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"phonebook/authz"
+	"phonebook/lib"
+)
+
+// ErrRoleInUse is returned when deleting a role that people or API keys
+// still hold, or that another role uses outside its scope.
+var ErrRoleInUse = fmt.Errorf("role is in use")
+
+// RoleMember is a person who holds a role
+type RoleMember struct {
+	UID       int64  // person's uid
+	UserName  string // username
+	FirstName string // first name
+	LastName  string // last name
+	RID       int    // role the person holds
+}
+
+// createRolePreparedStmts creates the prepared sql statements used to read
+// and edit the roles and fieldperms tables.
+//-----------------------------------------------------------------------------
+func createRolePreparedStmts() {
+	var err error
+	PrepStmts.GetRoles, err = DB.DirDB.Prepare("SELECT RID,Name,COALESCE(Descr,''),Scope,OutRID FROM roles ORDER BY RID")
+	lib.Errcheck(err)
+	PrepStmts.GetFieldPerms, err = DB.DirDB.Prepare("SELECT RID,Elem,Field,Perm,COALESCE(Descr,'') FROM fieldperms ORDER BY RID,Elem,Field")
+	lib.Errcheck(err)
+	PrepStmts.InsertRole, err = DB.DirDB.Prepare("INSERT INTO roles (Name,Descr,Scope,OutRID) VALUES(?,?,?,?)")
+	lib.Errcheck(err)
+	PrepStmts.UpdateRole, err = DB.DirDB.Prepare("UPDATE roles SET Name=?,Descr=?,Scope=?,OutRID=? WHERE RID=?")
+	lib.Errcheck(err)
+	PrepStmts.DeleteRole, err = DB.DirDB.Prepare("DELETE FROM roles WHERE RID=?")
+	lib.Errcheck(err)
+	PrepStmts.InsertFieldPerm, err = DB.DirDB.Prepare("INSERT INTO fieldperms (RID,Elem,Field,Perm,Descr) VALUES(?,?,?,?,?)")
+	lib.Errcheck(err)
+	PrepStmts.DeleteFieldPerms, err = DB.DirDB.Prepare("DELETE FROM fieldperms WHERE RID=?")
+	lib.Errcheck(err)
+	PrepStmts.RoleRefCount, err = DB.DirDB.Prepare("SELECT (SELECT COUNT(*) FROM people WHERE RID=?)+(SELECT COUNT(*) FROM apikeys WHERE RID=? AND Revoked=0)+(SELECT COUNT(*) FROM roles WHERE OutRID=?)")
+	lib.Errcheck(err)
+	PrepStmts.GetRoleMembers, err = DB.DirDB.Prepare("SELECT UID,UserName,FirstName,LastName,RID FROM people ORDER BY LastName,FirstName")
+	lib.Errcheck(err)
+	PrepStmts.GetRoleCompanies, err = DB.DirDB.Prepare("SELECT RID,CoCode FROM rolecompanies ORDER BY RID,CoCode")
+	lib.Errcheck(err)
+	PrepStmts.InsertRoleCompany, err = DB.DirDB.Prepare("INSERT INTO rolecompanies (RID,CoCode) VALUES(?,?)")
+	lib.Errcheck(err)
+	PrepStmts.DeleteRoleCompanies, err = DB.DirDB.Prepare("DELETE FROM rolecompanies WHERE RID=?")
+	lib.Errcheck(err)
+}
+
+// GetRoles reads all the roles, their field permissions and the companies
+// they are limited to
+//-----------------------------------------------------------------------------
+func GetRoles() ([]authz.Role, error) {
+	var roles []authz.Role
+	rows, err := PrepStmts.GetRoles.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var r authz.Role
+		r.Perms = make([]authz.FieldPerm, 0)
+		if err = rows.Scan(&r.RID, &r.Name, &r.Descr, &r.Scope, &r.OutRID); err != nil {
+			return nil, err
+		}
+		roles = append(roles, r)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	prows, err := PrepStmts.GetFieldPerms.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer prows.Close()
+	for prows.Next() {
+		var rid int
+		var f authz.FieldPerm
+		if err = prows.Scan(&rid, &f.Elem, &f.Field, &f.Perm, &f.Descr); err != nil {
+			return nil, err
+		}
+		for i := 0; i < len(roles); i++ {
+			if roles[i].RID == rid {
+				roles[i].Perms = append(roles[i].Perms, f)
+				break
+			}
+		}
+	}
+	if err = prows.Err(); err != nil {
+		return nil, err
+	}
+
+	crows, err := PrepStmts.GetRoleCompanies.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer crows.Close()
+	for crows.Next() {
+		var rid, cocode int
+		if err = crows.Scan(&rid, &cocode); err != nil {
+			return nil, err
+		}
+		for i := 0; i < len(roles); i++ {
+			if roles[i].RID == rid {
+				roles[i].CoCodes = append(roles[i].CoCodes, cocode)
+				break
+			}
+		}
+	}
+	return roles, crows.Err()
+}
+
+// InsertRole adds the role r and its field permissions, and sets r.RID
+//-----------------------------------------------------------------------------
+func InsertRole(r *authz.Role) error {
+	tx, err := DB.DirDB.Begin()
+	if err != nil {
+		return err
+	}
+	if err = insertRole(tx, r); err != nil {
+		if e := tx.Rollback(); e != nil {
+			lib.Ulog("InsertRole: rollback failed: %s\n", e.Error())
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
+// insertRole does the InsertRole inserts within tx
+func insertRole(tx *sql.Tx, r *authz.Role) error {
+	res, err := tx.Stmt(PrepStmts.InsertRole).Exec(r.Name, r.Descr, r.Scope, r.OutRID)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	r.RID = int(id)
+	if err = insertFieldPerms(tx, r); err != nil {
+		return err
+	}
+	return insertRoleCompanies(tx, r)
+}
+
+// insertFieldPerms writes the field permissions of r within tx
+func insertFieldPerms(tx *sql.Tx, r *authz.Role) error {
+	for i := 0; i < len(r.Perms); i++ {
+		f := &r.Perms[i]
+		if _, err := tx.Stmt(PrepStmts.InsertFieldPerm).Exec(r.RID, f.Elem, f.Field, f.Perm, f.Descr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insertRoleCompanies writes the companies r is limited to within tx
+func insertRoleCompanies(tx *sql.Tx, r *authz.Role) error {
+	for i := 0; i < len(r.CoCodes); i++ {
+		if _, err := tx.Stmt(PrepStmts.InsertRoleCompany).Exec(r.RID, r.CoCodes[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UpdateRole saves the name, description, scope and every field permission
+// of r
+//-----------------------------------------------------------------------------
+func UpdateRole(r *authz.Role) error {
+	tx, err := DB.DirDB.Begin()
+	if err != nil {
+		return err
+	}
+	if err = updateRole(tx, r); err != nil {
+		if e := tx.Rollback(); e != nil {
+			lib.Ulog("UpdateRole: rollback failed: %s\n", e.Error())
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
+// updateRole does the UpdateRole updates within tx
+func updateRole(tx *sql.Tx, r *authz.Role) error {
+	if _, err := tx.Stmt(PrepStmts.UpdateRole).Exec(r.Name, r.Descr, r.Scope, r.OutRID, r.RID); err != nil {
+		return err
+	}
+	if _, err := tx.Stmt(PrepStmts.DeleteFieldPerms).Exec(r.RID); err != nil {
+		return err
+	}
+	if err := insertFieldPerms(tx, r); err != nil {
+		return err
+	}
+	if _, err := tx.Stmt(PrepStmts.DeleteRoleCompanies).Exec(r.RID); err != nil {
+		return err
+	}
+	return insertRoleCompanies(tx, r)
+}
+
+// DeleteRole deletes the role with the supplied rid, its field permissions
+// and its companies. It returns ErrRoleInUse if any person or unrevoked API
+// key holds the role, or if another role uses it outside its scope.
+//-----------------------------------------------------------------------------
+func DeleteRole(rid int) error {
+	var n int
+	if err := PrepStmts.RoleRefCount.QueryRow(rid, rid, rid).Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return ErrRoleInUse
+	}
+	tx, err := DB.DirDB.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Stmt(PrepStmts.DeleteFieldPerms).Exec(rid); err == nil {
+		if _, err = tx.Stmt(PrepStmts.DeleteRoleCompanies).Exec(rid); err == nil {
+			_, err = tx.Stmt(PrepStmts.DeleteRole).Exec(rid)
+		}
+	}
+	if err != nil {
+		if e := tx.Rollback(); e != nil {
+			lib.Ulog("DeleteRole: rollback failed: %s\n", e.Error())
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetRoleMembers returns everyone who holds a role, by last name
+//-----------------------------------------------------------------------------
+func GetRoleMembers() ([]RoleMember, error) {
+	var m []RoleMember
+	rows, err := PrepStmts.GetRoleMembers.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p RoleMember
+		if err = rows.Scan(&p.UID, &p.UserName, &p.FirstName, &p.LastName, &p.RID); err != nil {
+			return nil, err
+		}
+		m = append(m, p)
+	}
+	return m, rows.Err()
+}
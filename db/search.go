@@ -0,0 +1,297 @@
+package db
+
+import (
+	"net/url"
+	"phonebook/authz"
+	"phonebook/idx"
+	"phonebook/qb"
+	"strconv"
+	"strings"
+)
+
+// STATUSANY is the PeopleSearch.Status value that matches both active and
+// inactive people.
+const STATUSANY = -1
+
+// SORTRELEVANCE is the PeopleSearch.SortField value that orders the
+// results by how well the names match the query. With no query it is the
+// same as sorting by last name.
+const SORTRELEVANCE = "Relevance"
+
+// MAXRANKED is the maximum number of name index hits used in a search
+const MAXRANKED = 1000
+
+// PeopleSearchSortFields maps the names of the columns a people search
+// may be sorted on to their sql expressions.
+var PeopleSearchSortFields = map[string]string{
+	"FirstName":     "people.FirstName",
+	"LastName":      "people.LastName",
+	"PreferredName": "people.PreferredName",
+	"PrimaryEmail":  "people.PrimaryEmail",
+	"OfficePhone":   "people.OfficePhone",
+	"CellPhone":     "people.CellPhone",
+	"DeptName":      "DeptName",
+	"Employer":      "Employer",
+}
+
+// PeopleSearch describes the filters, sort order and page for a search of
+// the people table. Zero values mean "no filter" except for Status, where
+// STATUSANY must be used to include both active and inactive people.
+type PeopleSearch struct {
+	Query               string `json:"query"`               // free text matched against names, email, phones and department names
+	CoCode              int    `json:"CoCode"`              // company
+	ClassCode           int    `json:"ClassCode"`           // class (business unit)
+	DeptCode            int    `json:"DeptCode"`            // department
+	JobCode             int    `json:"JobCode"`             // job title
+	MgrUID              int    `json:"MgrUID"`              // manager's UID
+	MgrName             string `json:"MgrName"`             // text matched against the manager's name
+	StateOfEmployment   string `json:"StateOfEmployment"`   // exact match
+	CountryOfEmployment string `json:"CountryOfEmployment"` // exact match
+	Status              int    `json:"Status"`              // 1 = active, 0 = inactive, STATUSANY = both
+	SortField           string `json:"sort"`                // SORTRELEVANCE or one of the keys of PeopleSearchSortFields
+	SortDesc            bool   `json:"desc"`                // sort in descending order
+	Offset              int    `json:"offset"`              // number of matches to skip
+	Limit               int    `json:"limit"`               // page size
+	CoCodes             []int  `json:"-"`                   // if not nil, only people in these companies match
+	ranked              []int  // UIDs of the name index hits for Query, best first
+}
+
+// NewPeopleSearch returns a PeopleSearch with the default values: active
+// people only, sorted by relevance, 75 per page.
+//-----------------------------------------------------------------------------
+func NewPeopleSearch() PeopleSearch {
+	return PeopleSearch{Status: 1, SortField: SORTRELEVANCE, Limit: 75}
+}
+
+// PeopleSearchFromValues fills in a PeopleSearch from url values, such as
+// those in an http request's Form or query string. Values that are missing
+// or cannot be parsed keep their defaults.
+//-----------------------------------------------------------------------------
+func PeopleSearchFromValues(v url.Values) PeopleSearch {
+	f := NewPeopleSearch()
+	atoi := func(name string, dflt int) int {
+		if n, err := strconv.Atoi(strings.TrimSpace(v.Get(name))); err == nil {
+			return n
+		}
+		return dflt
+	}
+	f.Query = strings.TrimSpace(v.Get("searchstring"))
+	f.CoCode = atoi("CoCode", 0)
+	f.ClassCode = atoi("ClassCode", 0)
+	f.DeptCode = atoi("DeptCode", 0)
+	f.JobCode = atoi("JobCode", 0)
+	f.MgrUID = atoi("MgrUID", 0)
+	f.MgrName = strings.TrimSpace(v.Get("MgrName"))
+	f.StateOfEmployment = strings.TrimSpace(v.Get("StateOfEmployment"))
+	f.CountryOfEmployment = strings.TrimSpace(v.Get("CountryOfEmployment"))
+	f.Status = atoi("Status", f.Status)
+	if "" != v.Get("inclterms") { // the original search form's checkbox
+		f.Status = STATUSANY
+	}
+	if s := v.Get("sort"); len(s) > 0 {
+		f.SortField = s
+	}
+	f.SortDesc = v.Get("desc") == "1" || v.Get("desc") == "true"
+	f.Offset = atoi("offset", 0)
+	f.Limit = atoi("limit", f.Limit)
+	return f
+}
+
+// Values returns the url values that PeopleSearchFromValues would parse to
+// produce f. It is used to build the links for paging and sorting.
+//-----------------------------------------------------------------------------
+func (f *PeopleSearch) Values() url.Values {
+	v := url.Values{}
+	setInt := func(name string, n int) {
+		if n != 0 {
+			v.Set(name, strconv.Itoa(n))
+		}
+	}
+	setStr := func(name, s string) {
+		if len(s) > 0 {
+			v.Set(name, s)
+		}
+	}
+	setStr("searchstring", f.Query)
+	setInt("CoCode", f.CoCode)
+	setInt("ClassCode", f.ClassCode)
+	setInt("DeptCode", f.DeptCode)
+	setInt("JobCode", f.JobCode)
+	setInt("MgrUID", f.MgrUID)
+	setStr("MgrName", f.MgrName)
+	setStr("StateOfEmployment", f.StateOfEmployment)
+	setStr("CountryOfEmployment", f.CountryOfEmployment)
+	v.Set("Status", strconv.Itoa(f.Status))
+	setStr("sort", f.SortField)
+	if f.SortDesc {
+		v.Set("desc", "1")
+	}
+	setInt("offset", f.Offset)
+	setInt("limit", f.Limit)
+	return v
+}
+
+// textCond returns the free text condition for a people search. It
+// matches names, email, phones and department names.
+//-----------------------------------------------------------------------------
+func textCond(query string) *qb.Cond {
+	if len(query) == 0 {
+		return nil
+	}
+	var names *qb.Cond
+	t := strings.Fields(query)
+	switch len(t) {
+	case 2:
+		names = qb.Or(
+			qb.And(qb.Contains("people.FirstName", t[0]), qb.Contains("people.LastName", t[1])),
+			qb.And(qb.Contains("people.PreferredName", t[0]), qb.Contains("people.LastName", t[1])))
+	case 3:
+		names = qb.Or(
+			qb.And(qb.Contains("people.FirstName", t[0]), qb.Contains("people.MiddleName", t[1]), qb.Contains("people.LastName", t[2])),
+			qb.And(qb.Contains("people.PreferredName", t[0]), qb.Contains("people.MiddleName", t[1]), qb.Contains("people.LastName", t[2])))
+	default:
+		names = qb.Or(qb.Contains("people.LastName", query), qb.Contains("people.FirstName", query), qb.Contains("people.PreferredName", query))
+	}
+	return qb.Or(names,
+		qb.Contains("people.PrimaryEmail", query),
+		qb.Contains("people.CellPhone", query),
+		qb.Contains("people.OfficePhone", query),
+		qb.Contains("people.OfficeFax", query),
+		qb.Contains("departments.Name", query))
+}
+
+// Where returns the condition that selects the people matching f. People
+// found by the name index match in addition to those found by textCond.
+//-----------------------------------------------------------------------------
+func (f *PeopleSearch) Where() *qb.Cond {
+	text := textCond(f.Query)
+	if len(f.ranked) > 0 {
+		text = qb.Or(text, qb.InInts("people.UID", f.ranked))
+	}
+	var conds = []*qb.Cond{text}
+	if f.Status != STATUSANY {
+		conds = append(conds, qb.Eq("people.Status", f.Status))
+	}
+	if f.CoCode > 0 {
+		conds = append(conds, qb.Eq("people.CoCode", f.CoCode))
+	}
+	if f.CoCodes != nil {
+		conds = append(conds, qb.InInts("people.CoCode", f.CoCodes))
+	}
+	if f.ClassCode > 0 {
+		conds = append(conds, qb.Eq("people.ClassCode", f.ClassCode))
+	}
+	if f.DeptCode > 0 {
+		conds = append(conds, qb.Eq("people.DeptCode", f.DeptCode))
+	}
+	if f.JobCode > 0 {
+		conds = append(conds, qb.Eq("people.JobCode", f.JobCode))
+	}
+	if f.MgrUID > 0 {
+		conds = append(conds, qb.Eq("people.MgrUID", f.MgrUID))
+	}
+	if len(f.MgrName) > 0 {
+		pat := "%" + qb.EscapeLike(f.MgrName) + "%"
+		conds = append(conds, qb.Raw("people.MgrUID IN (SELECT m.UID FROM people m WHERE "+
+			"m.FirstName LIKE ? OR m.LastName LIKE ? OR m.PreferredName LIKE ? OR CONCAT(m.FirstName,' ',m.LastName) LIKE ?)",
+			pat, pat, pat, pat))
+	}
+	if len(f.StateOfEmployment) > 0 {
+		conds = append(conds, qb.Eq("people.StateOfEmployment", f.StateOfEmployment))
+	}
+	if len(f.CountryOfEmployment) > 0 {
+		conds = append(conds, qb.Eq("people.CountryOfEmployment", f.CountryOfEmployment))
+	}
+	return qb.And(conds...)
+}
+
+// relevanceOrder returns the ORDER BY expression that puts the people in
+// ranked first, in the order given. The UIDs come from the index, not from
+// the user, so they are formatted directly into the expression.
+//-----------------------------------------------------------------------------
+func relevanceOrder(ranked []int) string {
+	if len(ranked) == 0 {
+		return ""
+	}
+	ids := make([]string, len(ranked))
+	for i := 0; i < len(ranked); i++ {
+		ids[i] = strconv.Itoa(ranked[i])
+	}
+	field := "FIELD(people.UID," + strings.Join(ids, ",") + ")"
+	return field + "=0," + field
+}
+
+// SearchPeople returns the page of people matching f along with the total
+// number of matches. If f.Query is set, the names found by the name index
+// (including misspellings) match along with the people found by the text
+// search, and SORTRELEVANCE orders them by their index score.
+//
+// INPUTS
+//  f - filters, sort order and page
+//
+// RETURNS
+//  []Person - the people in the requested page. DeptName and Employer are set.
+//  int64    - total number of people matching the filters
+//  error    - any error encountered
+//-----------------------------------------------------------------------------
+func SearchPeople(f *PeopleSearch) ([]Person, int64, error) {
+	var total int64
+	m := []Person{}
+	if f.Limit <= 0 {
+		f.Limit = 75
+	}
+	if f.Limit > 1000 {
+		f.Limit = 1000
+	}
+	if f.Offset < 0 {
+		f.Offset = 0
+	}
+	f.ranked = nil
+	if len(f.Query) > 0 {
+		f.ranked = idx.IDs(idx.Search(f.Query, authz.ELEMPERSON, MAXRANKED))
+	}
+	var order string
+	if f.SortField == SORTRELEVANCE {
+		f.SortDesc = false
+		order = relevanceOrder(f.ranked)
+	} else {
+		var ok bool
+		if order, ok = PeopleSearchSortFields[f.SortField]; !ok {
+			f.SortField = "LastName"
+			order = PeopleSearchSortFields[f.SortField]
+		}
+		if f.SortDesc {
+			order += " DESC"
+		}
+	}
+	q := qb.Select{
+		Cols: "people.UID,people.LastName,people.FirstName,people.PreferredName,people.JobCode,people.PrimaryEmail," +
+			"people.OfficePhone,people.OfficeFax,people.CellPhone,people.DeptCode,people.CoCode," +
+			"IFNULL(departments.Name,'') AS DeptName,IFNULL(companies.LegalName,'') AS Employer",
+		From: "people LEFT JOIN departments ON people.DeptCode=departments.DeptCode " +
+			"LEFT JOIN companies ON people.CoCode=companies.CoCode",
+		Where:   f.Where(),
+		OrderBy: strings.TrimPrefix(order+",people.LastName,people.FirstName,people.UID", ","),
+		Limit:   f.Limit,
+		Offset:  f.Offset,
+	}
+	s, args := q.CountSQL()
+	if err := DB.DirDB.QueryRow(s, args...).Scan(&total); err != nil {
+		return m, total, err
+	}
+	s, args = q.SQL()
+	rows, err := DB.DirDB.Query(s, args...)
+	if err != nil {
+		return m, total, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p Person
+		if err = rows.Scan(&p.UID, &p.LastName, &p.FirstName, &p.PreferredName, &p.JobCode, &p.PrimaryEmail,
+			&p.OfficePhone, &p.OfficeFax, &p.CellPhone, &p.DeptCode, &p.CoCode, &p.DeptName, &p.Employer); err != nil {
+			return m, total, err
+		}
+		m = append(m, p)
+	}
+	return m, total, rows.Err()
+}
@@ -0,0 +1,212 @@
+package db
+
+import (
+	"net/url"
+	"phonebook/lib"
+	"phonebook/qb"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Security events record sign ins, impersonation and admin actions in the
+// secevents table, where they can be searched and exported. Phonebook.log
+// still gets its free-form line for each of them.
+const (
+	SECSIGNIN        = "signin"          // a person signed in
+	SECSIGNINFAILED  = "signin-failed"   // wrong user name, password or second step code
+	SECSIGNINREFUSED = "signin-refused"  // too many failed sign ins, the attempt was not checked
+	SECSIGNOUT       = "signout"         // a person signed out
+	SECPWRESETREQ    = "pwreset-request" // a password reset link was sent
+	SECPWRESET       = "pwreset"         // a password was changed with a reset link
+	SECPWCHANGE      = "pwchange"        // a person changed their own password
+	SECBECOME        = "become"          // an administrator started acting as another person
+	SECBECOMEREFUSED = "become-refused"  // someone who is not an administrator tried to
+	SECROLEASSIGN    = "role-assign"     // a person was given a different role
+	SECROLEEDIT      = "role-edit"       // a role was created, changed or deleted
+	SECUNLOCK        = "unlock"          // failed sign ins were cleared for a person
+	SECRESET2FA      = "reset-2fa"       // two-step sign in was removed for a person
+	SECAPIKEYCREATE  = "apikey-create"   // an API key or service account was created
+	SECAPIKEYREVOKE  = "apikey-revoke"   // an API key was revoked
+	SECSHUTDOWN      = "shutdown"        // the server was told to stop
+	SECRESTART       = "restart"         // the server was told to restart
+)
+
+// SecEventTypes lists the event types, for the admin screen
+var SecEventTypes = []string{SECSIGNIN, SECSIGNINFAILED, SECSIGNINREFUSED, SECSIGNOUT,
+	SECPWRESETREQ, SECPWRESET, SECPWCHANGE, SECBECOME, SECBECOMEREFUSED,
+	SECROLEASSIGN, SECROLEEDIT, SECUNLOCK, SECRESET2FA, SECAPIKEYCREATE, SECAPIKEYREVOKE,
+	SECSHUTDOWN, SECRESTART}
+
+// MAXSECEVENTS is the most security events GetSecEvents returns at once
+const MAXSECEVENTS = 1000
+
+// SecEvent is one security event
+type SecEvent struct {
+	EventID    int64     `json:"id"`         // assigned by DB
+	Type       string    `json:"type"`       // one of the SEC... types
+	Actor      int64     `json:"actor"`      // uid of who did it, 0 if unknown
+	ActorName  string    `json:"actorName"`  // username of the actor, or the user name tried
+	Target     int64     `json:"target"`     // uid of the person it was done to, 0 if none
+	TargetName string    `json:"targetName"` // username, role or key it was done to
+	IP         string    `json:"ip"`         // address of the actor
+	UserAgent  string    `json:"userAgent"`  // client of the actor
+	Detail     string    `json:"detail"`     // anything else worth knowing
+	Dt         time.Time `json:"time"`       // when it happened
+}
+
+// SecEventFilter selects security events. Zero values select everything.
+type SecEventFilter struct {
+	UID   int64     // events where this uid is the actor or the target
+	Name  string    // events where this username is the actor or the target
+	Type  string    // events of this type
+	Start time.Time // events at or after this time
+	Stop  time.Time // events before this time
+	After int64     // events with a greater EventID, for collecting only the new ones
+	Limit int       // at most this many, the most recent
+}
+
+// SecEventFilterFromValues fills in a SecEventFilter from url values, such
+// as those in an http request's Form or query string:
+//
+//  user  - username or uid of the actor or target
+//  type  - event type
+//  from  - first day, yyyy-mm-dd
+//  to    - last day, yyyy-mm-dd, events on this day are included
+//  after - only events with a greater id
+//  limit - at most this many events
+//
+// Values that are missing or cannot be parsed select everything.
+//-----------------------------------------------------------------------------
+func SecEventFilterFromValues(v url.Values) SecEventFilter {
+	var f SecEventFilter
+	user := strings.TrimSpace(v.Get("user"))
+	if n, err := strconv.ParseInt(user, 10, 64); err == nil {
+		f.UID = n
+	} else {
+		f.Name = strings.ToLower(user)
+	}
+	f.Type = strings.TrimSpace(v.Get("type"))
+	if t, err := time.ParseInLocation("2006-01-02", strings.TrimSpace(v.Get("from")), time.Local); err == nil {
+		f.Start = t
+	}
+	if t, err := time.ParseInLocation("2006-01-02", strings.TrimSpace(v.Get("to")), time.Local); err == nil {
+		f.Stop = t.AddDate(0, 0, 1)
+	}
+	f.After, _ = strconv.ParseInt(strings.TrimSpace(v.Get("after")), 10, 64)
+	f.Limit, _ = strconv.Atoi(strings.TrimSpace(v.Get("limit")))
+	return f
+}
+
+// Values returns the url values that SecEventFilterFromValues would parse
+// to produce f. It is used to build the export link.
+//-----------------------------------------------------------------------------
+func (f *SecEventFilter) Values() url.Values {
+	v := url.Values{}
+	if f.UID > 0 {
+		v.Set("user", strconv.FormatInt(f.UID, 10))
+	} else if len(f.Name) > 0 {
+		v.Set("user", f.Name)
+	}
+	if len(f.Type) > 0 {
+		v.Set("type", f.Type)
+	}
+	if !f.Start.IsZero() {
+		v.Set("from", f.Start.Format("2006-01-02"))
+	}
+	if !f.Stop.IsZero() {
+		v.Set("to", f.Stop.AddDate(0, 0, -1).Format("2006-01-02"))
+	}
+	if f.After > 0 {
+		v.Set("after", strconv.FormatInt(f.After, 10))
+	}
+	if f.Limit > 0 {
+		v.Set("limit", strconv.Itoa(f.Limit))
+	}
+	return v
+}
+
+var secEventFlds = "EventID,EventType,Actor,ActorName,Target,TargetName,IP,UserAgent,Detail,DtEvent"
+
+// createSecEventPreparedStmts creates the prepared sql statements used to
+// add security events.
+//-----------------------------------------------------------------------------
+func createSecEventPreparedStmts() {
+	var err error
+	PrepStmts.InsertSecEvent, err = DB.DirDB.Prepare("INSERT INTO secevents (EventType,Actor,ActorName,Target,TargetName,IP,UserAgent,Detail,DtEvent) VALUES(?,?,?,?,?,?,?,?,?)")
+	lib.Errcheck(err)
+}
+
+// truncate returns s cut to at most n bytes, to fit its column
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+// InsertSecEvent adds e to the secevents table. If e.Dt is not set it is
+// set to now.
+//-----------------------------------------------------------------------------
+func InsertSecEvent(e *SecEvent) error {
+	if e.Dt.IsZero() {
+		e.Dt = time.Now()
+	}
+	res, err := PrepStmts.InsertSecEvent.Exec(e.Type, e.Actor, truncate(e.ActorName, 64), e.Target, truncate(e.TargetName, 128),
+		truncate(e.IP, 40), truncate(e.UserAgent, 256), truncate(e.Detail, 1024), e.Dt)
+	if err != nil {
+		return err
+	}
+	e.EventID, err = res.LastInsertId()
+	return err
+}
+
+// GetSecEvents returns the security events selected by f, the most recent
+// first. At most f.Limit are returned, or MAXSECEVENTS if f.Limit is not
+// set or is larger than that. When f.After is set the oldest are returned
+// first instead, so that a collector can ask again for those after the last
+// id it got without missing any.
+//-----------------------------------------------------------------------------
+func GetSecEvents(f *SecEventFilter) ([]SecEvent, error) {
+	m := []SecEvent{}
+	var conds []*qb.Cond
+	if f.UID > 0 {
+		conds = append(conds, qb.Or(qb.Eq("Actor", f.UID), qb.Eq("Target", f.UID)))
+	}
+	if len(f.Name) > 0 {
+		conds = append(conds, qb.Or(qb.Eq("ActorName", f.Name), qb.Eq("TargetName", f.Name)))
+	}
+	if len(f.Type) > 0 {
+		conds = append(conds, qb.Eq("EventType", f.Type))
+	}
+	if !f.Start.IsZero() {
+		conds = append(conds, qb.Ge("DtEvent", f.Start))
+	}
+	if !f.Stop.IsZero() {
+		conds = append(conds, qb.Lt("DtEvent", f.Stop))
+	}
+	if f.After > 0 {
+		conds = append(conds, qb.Gt("EventID", f.After))
+	}
+	q := qb.Select{Cols: secEventFlds, From: "secevents", Where: qb.And(conds...), OrderBy: "EventID DESC", Limit: f.Limit}
+	if f.After > 0 {
+		q.OrderBy = "EventID"
+	}
+	if q.Limit <= 0 || q.Limit > MAXSECEVENTS {
+		q.Limit = MAXSECEVENTS
+	}
+	sq, args := q.SQL()
+	rows, err := DB.DirDB.Query(sq, args...)
+	if err != nil {
+		return m, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e SecEvent
+		if err = rows.Scan(&e.EventID, &e.Type, &e.Actor, &e.ActorName, &e.Target, &e.TargetName, &e.IP, &e.UserAgent, &e.Detail, &e.Dt); err != nil {
+			return m, err
+		}
+		m = append(m, e)
+	}
+	return m, rows.Err()
+}
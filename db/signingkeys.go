@@ -0,0 +1,68 @@
+package db
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"phonebook/lib"
+	"time"
+)
+
+// SigningKey is an Ed25519 key used to sign the tokens issued to other
+// services. The keys are kept in the signingkeys table so that every
+// phonebook instance signs with the same key. The table holds private
+// keys, so it must be protected like the passhash column.
+type SigningKey struct {
+	KID     string    // key id, put in the header of the tokens it signs
+	Seed    []byte    // ed25519 private key seed
+	Created time.Time // when the key was made
+}
+
+// createSigningKeyPreparedStmts creates the prepared sql statements used to
+// manage the signingkeys table.
+//-----------------------------------------------------------------------------
+func createSigningKeyPreparedStmts() {
+	var err error
+	PrepStmts.GetSigningKeys, err = DB.DirDB.Prepare("SELECT KID,PrivateKey,DtCreate FROM signingkeys WHERE DtCreate>? ORDER BY DtCreate DESC")
+	lib.Errcheck(err)
+	PrepStmts.InsertSigningKey, err = DB.DirDB.Prepare("INSERT INTO signingkeys (KID,PrivateKey,DtCreate) VALUES(?,?,?)")
+	lib.Errcheck(err)
+}
+
+// GetSigningKeys returns the signing keys made after since, newest first
+//
+// INPUTS
+//  since - keys made at or before this time are not returned
+//
+// RETURNS
+//  keys  - the signing keys
+//  err   - any error encountered
+//-----------------------------------------------------------------------------
+func GetSigningKeys(since time.Time) ([]SigningKey, error) {
+	var keys []SigningKey
+	rows, err := PrepStmts.GetSigningKeys.Query(since)
+	if err != nil {
+		return keys, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var k SigningKey
+		var seed string
+		if err = rows.Scan(&k.KID, &seed, &k.Created); err != nil {
+			return keys, err
+		}
+		k.Seed, err = base64.StdEncoding.DecodeString(seed)
+		if err != nil || len(k.Seed) != ed25519.SeedSize {
+			lib.Ulog("GetSigningKeys: key %s is not a valid ed25519 seed, skipped\n", k.KID)
+			continue
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// InsertSigningKey saves a new signing key
+//-----------------------------------------------------------------------------
+func InsertSigningKey(k *SigningKey) error {
+	_, err := PrepStmts.InsertSigningKey.Exec(k.KID, base64.StdEncoding.EncodeToString(k.Seed), k.Created)
+	return err
+}
@@ -0,0 +1,348 @@
+package db
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"fmt"
+	"phonebook/authz"
+	"phonebook/lib"
+	"phonebook/totp"
+	"strings"
+	"time"
+)
+
+// Two-step sign in. A user who has enrolled has a TOTP secret in the
+// twofactor table and a set of single use recovery codes, stored hashed, in
+// the recoverycodes table. After a correct password the user gets a login
+// challenge, a short lived token stored hashed in the loginchallenges table,
+// and only gets a session once the challenge is answered with a code.
+const (
+	RECOVERYCODES        = 10 // number of recovery codes issued at a time
+	RECOVERYCODELEN      = 10 // characters in a recovery code, not counting the dash
+	LOGINCHALLENGELEN    = 32 // random bytes in a login challenge token
+	LOGINCHALLENGEMAXTRY = 5  // wrong codes allowed before a challenge is discarded
+)
+
+// ErrLoginChallengeInvalid is returned when a login challenge does not
+// exist or has expired.
+var ErrLoginChallengeInvalid = fmt.Errorf("the sign in has expired, please sign in again")
+
+// TwoFactor describes a user's TOTP enrollment
+type TwoFactor struct {
+	UID      int64  // uid of the user
+	Secret   string // base32 TOTP secret, empty if the user has not started enrolling
+	Enabled  bool   // true once the user has confirmed the secret with a code
+	LastStep int64  // step of the last code accepted, codes cannot be reused
+}
+
+// LoginChallenge is a sign in waiting for its second step
+type LoginChallenge struct {
+	UID       int64     // uid of the user signing in
+	UserName  string    // username of the user signing in
+	Expire    time.Time // when the challenge expires
+	IP        string    // client that supplied the password
+	UserAgent string    // user agent that supplied the password
+	Attempts  int       // wrong codes entered so far
+}
+
+// createTwoFactorPreparedStmts creates the prepared sql statements used to
+// manage the twofactor, recoverycodes and loginchallenges tables.
+//-----------------------------------------------------------------------------
+func createTwoFactorPreparedStmts() {
+	var err error
+	PrepStmts.GetTwoFactor, err = DB.DirDB.Prepare("SELECT Secret,Enabled,LastStep FROM twofactor WHERE UID=?")
+	lib.Errcheck(err)
+	PrepStmts.StartTwoFactor, err = DB.DirDB.Prepare("INSERT INTO twofactor (UID,Secret,Enabled,LastStep) VALUES(?,?,0,0) " +
+		"ON DUPLICATE KEY UPDATE Secret=IF(Enabled=0,VALUES(Secret),Secret)")
+	lib.Errcheck(err)
+	PrepStmts.UseTwoFactorStep, err = DB.DirDB.Prepare("UPDATE twofactor SET LastStep=? WHERE UID=? AND LastStep<?")
+	lib.Errcheck(err)
+	PrepStmts.DeleteTwoFactor, err = DB.DirDB.Prepare("DELETE FROM twofactor WHERE UID=?")
+	lib.Errcheck(err)
+	PrepStmts.UseRecoveryCode, err = DB.DirDB.Prepare("UPDATE recoverycodes SET Used=1 WHERE UID=? AND CodeHash=? AND Used=0")
+	lib.Errcheck(err)
+	PrepStmts.CountRecoveryCodes, err = DB.DirDB.Prepare("SELECT COUNT(*) FROM recoverycodes WHERE UID=? AND Used=0")
+	lib.Errcheck(err)
+	PrepStmts.DeleteRecoveryCodes, err = DB.DirDB.Prepare("DELETE FROM recoverycodes WHERE UID=?")
+	lib.Errcheck(err)
+	PrepStmts.InsertRecoveryCode, err = DB.DirDB.Prepare("INSERT INTO recoverycodes (UID,CodeHash) VALUES(?,?)")
+	lib.Errcheck(err)
+	PrepStmts.InsertLoginChallenge, err = DB.DirDB.Prepare("INSERT INTO loginchallenges (TokenHash,UID,UserName,DtExpire,IP,UserAgent) VALUES(?,?,?,?,?,?)")
+	lib.Errcheck(err)
+	PrepStmts.GetLoginChallenge, err = DB.DirDB.Prepare("SELECT UID,UserName,DtExpire,IP,UserAgent,Attempts FROM loginchallenges WHERE TokenHash=? AND DtExpire>?")
+	lib.Errcheck(err)
+	PrepStmts.FailLoginChallenge, err = DB.DirDB.Prepare("UPDATE loginchallenges SET Attempts=Attempts+1 WHERE TokenHash=?")
+	lib.Errcheck(err)
+	PrepStmts.DeleteLoginChallenge, err = DB.DirDB.Prepare("DELETE FROM loginchallenges WHERE TokenHash=? OR DtExpire<=?")
+	lib.Errcheck(err)
+}
+
+// GetTwoFactor returns the TOTP enrollment of the supplied user. If the
+// user has never enrolled, the returned Secret is empty.
+//-----------------------------------------------------------------------------
+func GetTwoFactor(uid int64) (TwoFactor, error) {
+	t := TwoFactor{UID: uid}
+	var enabled int
+	err := PrepStmts.GetTwoFactor.QueryRow(uid).Scan(&t.Secret, &enabled, &t.LastStep)
+	if err == sql.ErrNoRows {
+		return t, nil
+	}
+	t.Enabled = enabled != 0
+	return t, err
+}
+
+// TwoFactorNeeded returns true if the user must enter a code after their
+// password, either because they enrolled or because their role, rid,
+// requires it.
+//-----------------------------------------------------------------------------
+func TwoFactorNeeded(uid int64, rid int) (bool, error) {
+	tf, err := GetTwoFactor(uid)
+	if err != nil {
+		return false, err
+	}
+	if tf.Enabled {
+		return true, nil
+	}
+	var pm authz.PermMaps
+	authz.GetRoleInfo(rid, &pm)
+	return authz.TwoFactorRequired(&pm), nil
+}
+
+// CheckTwoFactorCode checks a code entered by the user. A 6 digit code is
+// checked against the TOTP secret. Once the user is enrolled a code cannot
+// be used twice. If recovery is true, anything else is tried as one of the
+// user's recovery codes.
+//
+// RETURNS
+//  step - the TOTP step matched, 0 if a recovery code was used
+//  ok   - true if the code is accepted
+//  err  - any database error
+//-----------------------------------------------------------------------------
+func CheckTwoFactorCode(tf *TwoFactor, code string, recovery bool) (int64, bool, error) {
+	code = strings.TrimSpace(code)
+	if len(code) == 0 {
+		return 0, false, nil
+	}
+	if len(strings.Replace(code, " ", "", -1)) == totp.DIGITS {
+		step, ok := totp.Verify(tf.Secret, code, time.Now(), tf.LastStep)
+		if !ok || !tf.Enabled {
+			return step, ok, nil
+		}
+		ok, err := UseTwoFactorStep(tf.UID, step)
+		return step, ok, err
+	}
+	if !recovery || !tf.Enabled {
+		return 0, false, nil
+	}
+	ok, err := UseRecoveryCode(tf.UID, code)
+	return 0, ok, err
+}
+
+// StartTwoFactor saves secret as the user's TOTP secret. The secret is not
+// used to sign in until EnableTwoFactor is called. If the user is already
+// enrolled the existing secret is kept.
+//-----------------------------------------------------------------------------
+func StartTwoFactor(uid int64, secret string) error {
+	_, err := PrepStmts.StartTwoFactor.Exec(uid, secret)
+	return err
+}
+
+// UseTwoFactorStep records step as the last TOTP step used by the user. It
+// returns false if a code for this step or a later one was already used,
+// possibly by another instance of the server.
+//-----------------------------------------------------------------------------
+func UseTwoFactorStep(uid, step int64) (bool, error) {
+	res, err := PrepStmts.UseTwoFactorStep.Exec(step, uid, step)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// EnableTwoFactor turns on two-step sign in for the user, whose code for
+// step has just been checked, and issues new recovery codes.
+//
+// RETURNS
+//  codes - the recovery codes, to be shown to the user once
+//  err   - any error encountered
+//-----------------------------------------------------------------------------
+func EnableTwoFactor(uid, step int64) ([]string, error) {
+	codes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	tx, err := DB.DirDB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	if err = enableTwoFactor(tx, uid, step, codes); err != nil {
+		if e := tx.Rollback(); e != nil {
+			lib.Ulog("EnableTwoFactor: rollback failed: %s\n", e.Error())
+		}
+		return nil, err
+	}
+	return codes, tx.Commit()
+}
+
+// enableTwoFactor does the EnableTwoFactor updates within tx. If step is 0
+// only the recovery codes are replaced.
+func enableTwoFactor(tx *sql.Tx, uid, step int64, codes []string) error {
+	if step > 0 {
+		if _, err := tx.Exec("UPDATE twofactor SET Enabled=1,LastStep=? WHERE UID=?", step, uid); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Stmt(PrepStmts.DeleteRecoveryCodes).Exec(uid); err != nil {
+		return err
+	}
+	for i := 0; i < len(codes); i++ {
+		if _, err := tx.Stmt(PrepStmts.InsertRecoveryCode).Exec(uid, HashToken(normalRecoveryCode(codes[i]))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewRecoveryCodes replaces the user's recovery codes with new ones
+//-----------------------------------------------------------------------------
+func NewRecoveryCodes(uid int64) ([]string, error) {
+	codes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	tx, err := DB.DirDB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	if err = enableTwoFactor(tx, uid, 0, codes); err != nil {
+		if e := tx.Rollback(); e != nil {
+			lib.Ulog("NewRecoveryCodes: rollback failed: %s\n", e.Error())
+		}
+		return nil, err
+	}
+	return codes, tx.Commit()
+}
+
+// newRecoveryCodes returns RECOVERYCODES random codes, formatted xxxxx-xxxxx
+func newRecoveryCodes() ([]string, error) {
+	enc := base32.StdEncoding.WithPadding(base32.NoPadding)
+	codes := make([]string, RECOVERYCODES)
+	b := make([]byte, RECOVERYCODELEN*5/8)
+	for i := 0; i < len(codes); i++ {
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		s := strings.ToLower(enc.EncodeToString(b))
+		codes[i] = s[:RECOVERYCODELEN/2] + "-" + s[RECOVERYCODELEN/2:]
+	}
+	return codes, nil
+}
+
+// normalRecoveryCode returns code as it is hashed, without the dash or
+// spaces and in lower case
+func normalRecoveryCode(code string) string {
+	code = strings.Replace(code, "-", "", -1)
+	code = strings.Replace(code, " ", "", -1)
+	return strings.ToLower(code)
+}
+
+// UseRecoveryCode marks code as used if it is one of the user's unused
+// recovery codes. It returns false if it is not.
+//-----------------------------------------------------------------------------
+func UseRecoveryCode(uid int64, code string) (bool, error) {
+	res, err := PrepStmts.UseRecoveryCode.Exec(uid, HashToken(normalRecoveryCode(code)))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// RecoveryCodesLeft returns the number of unused recovery codes the user has
+//-----------------------------------------------------------------------------
+func RecoveryCodesLeft(uid int64) (int, error) {
+	var n int
+	err := PrepStmts.CountRecoveryCodes.QueryRow(uid).Scan(&n)
+	return n, err
+}
+
+// DeleteTwoFactor removes the user's TOTP secret and recovery codes. The
+// user can sign in with only a password again, unless their role requires
+// two-step sign in, in which case they enroll again at their next sign in.
+//-----------------------------------------------------------------------------
+func DeleteTwoFactor(uid int64) error {
+	if _, err := PrepStmts.DeleteTwoFactor.Exec(uid); err != nil {
+		return err
+	}
+	_, err := PrepStmts.DeleteRecoveryCodes.Exec(uid)
+	return err
+}
+
+// NewLoginChallenge creates the token for the second step of a sign in by
+// the supplied user, whose password has been checked. Expired challenges
+// are removed.
+//
+// INPUTS
+//  uid      - the user's uid
+//  username - the user's username
+//  ip       - address of the client that supplied the password
+//  ua       - user agent of the client that supplied the password
+//  ttl      - how long the challenge is valid
+//
+// RETURNS
+//  token    - the token to send to the client
+//  err      - any error encountered
+//-----------------------------------------------------------------------------
+func NewLoginChallenge(uid int64, username, ip, ua string, ttl time.Duration) (string, error) {
+	b := make([]byte, LOGINCHALLENGELEN)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	now := time.Now()
+	if _, err := PrepStmts.DeleteLoginChallenge.Exec("", now); err != nil {
+		return "", err
+	}
+	if len(ua) > 256 {
+		ua = ua[:256]
+	}
+	if _, err := PrepStmts.InsertLoginChallenge.Exec(HashToken(token), uid, username, now.Add(ttl), ip, ua); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// GetLoginChallenge returns the sign in waiting for its second step. It
+// returns ErrLoginChallengeInvalid if the token is unknown or expired.
+//-----------------------------------------------------------------------------
+func GetLoginChallenge(token string) (LoginChallenge, error) {
+	var c LoginChallenge
+	err := PrepStmts.GetLoginChallenge.QueryRow(HashToken(token), time.Now()).Scan(&c.UID, &c.UserName, &c.Expire, &c.IP, &c.UserAgent, &c.Attempts)
+	if err == sql.ErrNoRows {
+		return c, ErrLoginChallengeInvalid
+	}
+	return c, err
+}
+
+// LoginChallengeFailed records a wrong code for the challenge. After
+// LOGINCHALLENGEMAXTRY wrong codes the challenge is removed and the user
+// has to start again with their password.
+//-----------------------------------------------------------------------------
+func LoginChallengeFailed(token string, c *LoginChallenge) error {
+	c.Attempts++
+	if c.Attempts >= LOGINCHALLENGEMAXTRY {
+		return DeleteLoginChallenge(token)
+	}
+	_, err := PrepStmts.FailLoginChallenge.Exec(HashToken(token))
+	return err
+}
+
+// DeleteLoginChallenge removes the challenge, along with any that expired
+//-----------------------------------------------------------------------------
+func DeleteLoginChallenge(token string) error {
+	_, err := PrepStmts.DeleteLoginChallenge.Exec(HashToken(token), time.Now())
+	return err
+}
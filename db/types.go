@@ -1,7 +1,9 @@
 package db
 
 import (
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"phonebook/lib"
 	"time"
 )
@@ -74,6 +76,7 @@ type Person struct {
 	DeptCode         int
 	DeptName         string
 	Employer         string
+	CoCode           int
 	ProfileImageURL  string
 	ProfileImagePath string
 }
@@ -144,7 +147,7 @@ type PersonDetail struct {
 }
 
 // SessionCookie defines the struct for the database table where session
-// cookies are managed.
+// cookies are managed. The sessions table only holds HashToken(Cookie).
 type SessionCookie struct {
 	UID       int64     // uid of the user
 	UserName  string    // username for the user
@@ -161,8 +164,84 @@ var PrepStmts struct {
 	GetSessionCookie     *sql.Stmt
 	InsertSessionCookie  *sql.Stmt
 	UpdateSessionCookie  *sql.Stmt
+	UpdateSessionToken   *sql.Stmt
+	InsertPWReset        *sql.Stmt
+	GetPWReset           *sql.Stmt
+	UsePWReset           *sql.Stmt
+	DeletePWResets       *sql.Stmt
+	GetLoginFailures     *sql.Stmt
+	AddLoginFailure      *sql.Stmt
+	DeleteLoginFailures  *sql.Stmt
+	StaleLoginFailures   *sql.Stmt
+	GetTwoFactor         *sql.Stmt
+	StartTwoFactor       *sql.Stmt
+	UseTwoFactorStep     *sql.Stmt
+	DeleteTwoFactor      *sql.Stmt
+	UseRecoveryCode      *sql.Stmt
+	CountRecoveryCodes   *sql.Stmt
+	DeleteRecoveryCodes  *sql.Stmt
+	InsertRecoveryCode   *sql.Stmt
+	InsertLoginChallenge *sql.Stmt
+	GetLoginChallenge    *sql.Stmt
+	FailLoginChallenge   *sql.Stmt
+	DeleteLoginChallenge *sql.Stmt
+	GetSigningKeys       *sql.Stmt
+	InsertSigningKey     *sql.Stmt
+	GetAPIKey            *sql.Stmt
+	GetAPIKeys           *sql.Stmt
+	InsertAPIKey         *sql.Stmt
+	UseAPIKey            *sql.Stmt
+	RevokeAPIKey         *sql.Stmt
+	GetRoles             *sql.Stmt
+	GetFieldPerms        *sql.Stmt
+	InsertRole           *sql.Stmt
+	UpdateRole           *sql.Stmt
+	DeleteRole           *sql.Stmt
+	InsertFieldPerm      *sql.Stmt
+	DeleteFieldPerms     *sql.Stmt
+	RoleRefCount         *sql.Stmt
+	GetRoleMembers       *sql.Stmt
+	GetRoleCompanies     *sql.Stmt
+	InsertRoleCompany    *sql.Stmt
+	DeleteRoleCompanies  *sql.Stmt
+	GetReloadVersions    *sql.Stmt
+	BumpReloadVersion    *sql.Stmt
 	LoginInfo            *sql.Stmt
+	UserNameByEmail      *sql.Stmt
 	GetImagePath         *sql.Stmt
+	GetPersonDetail      *sql.Stmt
+	GetPeople            *sql.Stmt
+	CountPeople          *sql.Stmt
+	InsertPerson         *sql.Stmt
+	UpdatePerson         *sql.Stmt
+	DeletePerson         *sql.Stmt
+	GetComps             *sql.Stmt
+	InsertComp           *sql.Stmt
+	DeleteComps          *sql.Stmt
+	GetDeductions        *sql.Stmt
+	InsertDeduction      *sql.Stmt
+	DeleteDeductions     *sql.Stmt
+	DirectReportsCount   *sql.Stmt
+	GetMgrUID            *sql.Stmt
+	UserNameCount        *sql.Stmt
+	NameFromUID          *sql.Stmt
+	DeptName             *sql.Stmt
+	JobTitle             *sql.Stmt
+	GetCompany           *sql.Stmt
+	GetCompanyClasses    *sql.Stmt
+	InsertCompany        *sql.Stmt
+	UpdateCompany        *sql.Stmt
+	DeleteCompany        *sql.Stmt
+	CompanyRefCount      *sql.Stmt
+	GetClass             *sql.Stmt
+	InsertClass          *sql.Stmt
+	UpdateClass          *sql.Stmt
+	DeleteClass          *sql.Stmt
+	ClassRefCount        *sql.Stmt
+	UpdateMyDetails      *sql.Stmt
+	InsertChange         *sql.Stmt
+	GetChanges           *sql.Stmt
+	InsertSecEvent       *sql.Stmt
 }
 
 // CreatePreparedStmts creates prepared sql statements
@@ -180,13 +259,29 @@ func CreatePreparedStmts() {
 	lib.Errcheck(err)
 	PrepStmts.DeleteExpiredCookies, err = DB.DirDB.Prepare("DELETE FROM sessions WHERE DtExpire <= ?")
 	lib.Errcheck(err)
+	PrepStmts.UpdateSessionToken, err = DB.DirDB.Prepare("UPDATE sessions SET Cookie=? WHERE Cookie=?")
+	lib.Errcheck(err)
 
 	PrepStmts.LoginInfo, err = DB.DirDB.Prepare("SELECT uid,firstname,preferredname,PrimaryEmail,passhash,rid FROM people WHERE UserName=?")
 	lib.Errcheck(err)
+	PrepStmts.UserNameByEmail, err = DB.DirDB.Prepare("SELECT UserName FROM people WHERE PrimaryEmail=? LIMIT 2")
+	lib.Errcheck(err)
 
 	// get image path from the people table
 	PrepStmts.GetImagePath, err = DB.DirDB.Prepare("SELECT ImagePath from people WHERE UID=?")
 	lib.Errcheck(err)
+
+	createPeoplePreparedStmts()
+	createCompanyPreparedStmts()
+	createPWResetPreparedStmts()
+	createLoginThrottlePreparedStmts()
+	createTwoFactorPreparedStmts()
+	createSigningKeyPreparedStmts()
+	createAPIKeyPreparedStmts()
+	createRolePreparedStmts()
+	createReloadPreparedStmts()
+	createChangeLogPreparedStmts()
+	createSecEventPreparedStmts()
 }
 
 // Init initializes the database infrastructure
@@ -218,24 +313,24 @@ func Init() error {
 //-----------------------------------------------------------------------------
 func GetSessionCookie(cookie string) (SessionCookie, error) {
 	var c SessionCookie
-	err := PrepStmts.GetSessionCookie.QueryRow(cookie).Scan(&c.UID, &c.UserName, &c.Cookie, &c.Expire, &c.UserAgent, &c.IP)
+	err := PrepStmts.GetSessionCookie.QueryRow(HashToken(cookie)).Scan(&c.UID, &c.UserName, &c.Cookie, &c.Expire, &c.UserAgent, &c.IP)
 	if nil != err {
 		if !lib.IsSQLNoResultsError(err) {
 			lib.Ulog("UpdateSessionCookie: error updating expire time:  %v\n", err)
-			lib.Ulog("cookie = %s\n", cookie)
 			return c, err
 		}
+		return c, nil
 	}
+	c.Cookie = cookie // the table only has the hash
 	return c, nil
 }
 
 // DeleteSessionCookie updates the specified cookie with the new expire time
 //-----------------------------------------------------------------------------
 func DeleteSessionCookie(cookie string) error {
-	_, err := PrepStmts.DeleteSessionCookie.Exec(cookie)
+	_, err := PrepStmts.DeleteSessionCookie.Exec(HashToken(cookie))
 	if nil != err {
 		lib.Ulog("UpdateSessionCookie: error updating expire time:  %v\n", err)
-		lib.Ulog("cookie = %s\n", cookie)
 	}
 	return err
 }
@@ -244,10 +339,10 @@ func DeleteSessionCookie(cookie string) error {
 //-----------------------------------------------------------------------------
 func InsertSessionCookie(UID int64, user string, cookie string, dt *time.Time, ua, ip string) error {
 	lib.Console("InsertSessionCookie: %d, %s, ua = %s, ip = %s\n", UID, user, ua, ip)
-	_, err := PrepStmts.InsertSessionCookie.Exec(UID, user, cookie, *dt, ua, ip)
+	_, err := PrepStmts.InsertSessionCookie.Exec(UID, user, HashToken(cookie), *dt, ua, ip)
 	if nil != err {
 		lib.Ulog("InsertSessionCookie: error inserting Cookie:  %v\n", err)
-		lib.Ulog("UID = %d, user = %s, ip = %s cookie = %s, ua = %s\n", UID, user, ip, cookie, ua)
+		lib.Ulog("UID = %d, user = %s, ip = %s, ua = %s\n", UID, user, ip, ua)
 	}
 	return err
 }
@@ -255,9 +350,29 @@ func InsertSessionCookie(UID int64, user string, cookie string, dt *time.Time, u
 // UpdateSessionCookie inserts a new session cookie into the sessions table
 //-----------------------------------------------------------------------------
 func UpdateSessionCookie(cookie string, dt *time.Time) error {
-	_, err := PrepStmts.UpdateSessionCookie.Exec(*dt, cookie)
+	_, err := PrepStmts.UpdateSessionCookie.Exec(*dt, HashToken(cookie))
 	if nil != err {
 		lib.Ulog("UpdateSessionCookie: error updating Cookie:  %v\n", err)
 	}
 	return err
 }
+
+// UpdateSessionToken replaces the cookie value of a session in the
+// sessions table. It is used when a session's token is rotated.
+//-----------------------------------------------------------------------------
+func UpdateSessionToken(oldcookie, newcookie string) error {
+	_, err := PrepStmts.UpdateSessionToken.Exec(HashToken(newcookie), HashToken(oldcookie))
+	if nil != err {
+		lib.Ulog("UpdateSessionToken: error updating Cookie:  %v\n", err)
+	}
+	return err
+}
+
+// HashToken returns the value stored in the database for a session or
+// password reset token. Tokens are random, so an unsalted sha256 is enough
+// to keep a copy of the table from being usable to sign in.
+//-----------------------------------------------------------------------------
+func HashToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
@@ -27,3 +27,146 @@ update people set ImagePath="281.jpg" WHERE UID=281;
 -- Add UserAgent, IP to sessions table
 ALTER TABLE sessions ADD COLUMN UserAgent VARCHAR(256) NOT NULL DEFAULT '';
 ALTER TABLE sessions ADD COLUMN IP VARCHAR(40) NOT NULL DEFAULT '';
+
+-- Oct 18, 2026
+-- Add pwresets table for password reset links
+CREATE TABLE pwresets (
+    TokenHash CHAR(64) NOT NULL,
+    UID BIGINT NOT NULL,
+    UserName VARCHAR(40) NOT NULL DEFAULT '',
+    DtCreate TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    DtExpire DATETIME NOT NULL DEFAULT '2000-01-01 00:00:00',
+    Used SMALLINT NOT NULL DEFAULT 0,
+    IP VARCHAR(40) NOT NULL DEFAULT '',
+    PRIMARY KEY (TokenHash)
+);
+
+-- Oct 18, 2026
+-- Session tokens are random and the sessions table stores their sha256.
+-- Existing sessions cannot be converted, users sign in again.
+DELETE FROM sessions;
+ALTER TABLE sessions MODIFY Cookie CHAR(64) NOT NULL DEFAULT '';
+
+-- Oct 18, 2026
+-- Add loginfailures table for sign in throttling and lockout
+CREATE TABLE loginfailures (
+    Kind SMALLINT NOT NULL DEFAULT 0,
+    Name VARCHAR(64) NOT NULL DEFAULT '',
+    Failures INT NOT NULL DEFAULT 0,
+    DtLast DATETIME NOT NULL DEFAULT '2000-01-01 00:00:00',
+    PRIMARY KEY (Kind, Name)
+);
+
+-- Oct 18, 2026
+-- Add twofactor, recoverycodes and loginchallenges tables for two-step sign in
+CREATE TABLE twofactor (
+    UID BIGINT NOT NULL,
+    Secret VARCHAR(64) NOT NULL DEFAULT '',
+    Enabled SMALLINT NOT NULL DEFAULT 0,
+    LastStep BIGINT NOT NULL DEFAULT 0,
+    DtCreate TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (UID)
+);
+
+CREATE TABLE recoverycodes (
+    UID BIGINT NOT NULL,
+    CodeHash CHAR(64) NOT NULL,
+    Used SMALLINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (UID, CodeHash)
+);
+
+CREATE TABLE loginchallenges (
+    TokenHash CHAR(64) NOT NULL,
+    UID BIGINT NOT NULL,
+    UserName VARCHAR(40) NOT NULL DEFAULT '',
+    DtExpire DATETIME NOT NULL DEFAULT '2000-01-01 00:00:00',
+    IP VARCHAR(40) NOT NULL DEFAULT '',
+    UserAgent VARCHAR(256) NOT NULL DEFAULT '',
+    Attempts INT NOT NULL DEFAULT 0,
+    PRIMARY KEY (TokenHash)
+);
+
+-- Oct 18, 2026
+-- Add signingkeys table for the tokens issued by authenticate
+CREATE TABLE signingkeys (
+    KID VARCHAR(32) NOT NULL,
+    PrivateKey VARCHAR(128) NOT NULL DEFAULT '',
+    DtCreate DATETIME NOT NULL DEFAULT '2000-01-01 00:00:00',
+    PRIMARY KEY (KID)
+);
+
+-- Oct 18, 2026
+-- Add apikeys table for personal API keys and service accounts
+CREATE TABLE apikeys (
+    KeyID BIGINT NOT NULL AUTO_INCREMENT,
+    KeyHash CHAR(64) NOT NULL,
+    Prefix VARCHAR(16) NOT NULL DEFAULT '',
+    UID BIGINT NOT NULL DEFAULT 0,
+    Name VARCHAR(64) NOT NULL DEFAULT '',
+    RID BIGINT NOT NULL DEFAULT 0,
+    CreateBy BIGINT NOT NULL DEFAULT 0,
+    DtCreate DATETIME NOT NULL DEFAULT '2000-01-01 00:00:00',
+    DtLastUsed DATETIME NOT NULL DEFAULT '2000-01-01 00:00:00',
+    LastIP VARCHAR(40) NOT NULL DEFAULT '',
+    Revoked SMALLINT NOT NULL DEFAULT 0,
+    DtRevoked DATETIME NOT NULL DEFAULT '2000-01-01 00:00:00',
+    PRIMARY KEY (KeyID),
+    UNIQUE KEY (KeyHash)
+);
+
+-- Oct 18, 2026
+-- Add reloadversions table so every instance reloads roles and lookup lists
+-- changed elsewhere. After editing departments or jobtitles by hand, run:
+--   UPDATE reloadversions SET Version=Version+1 WHERE Name='maps';
+CREATE TABLE reloadversions (
+    Name VARCHAR(25) NOT NULL,
+    Version BIGINT NOT NULL DEFAULT 0,
+    DtChange DATETIME NOT NULL DEFAULT '2000-01-01 00:00:00',
+    PRIMARY KEY (Name)
+);
+
+-- Oct 18, 2026
+-- Limit roles to all, their holder's own, or a list of companies
+ALTER TABLE roles ADD COLUMN Scope SMALLINT NOT NULL DEFAULT 0 AFTER Descr;
+ALTER TABLE roles ADD COLUMN OutRID MEDIUMINT NOT NULL DEFAULT 0 AFTER Scope;
+CREATE TABLE rolecompanies (
+    RID MEDIUMINT NOT NULL,
+    CoCode MEDIUMINT NOT NULL,
+    PRIMARY KEY (RID, CoCode)
+);
+
+-- Oct 18, 2026
+-- Add changelog table, one row for each field changed in a person, company
+-- or class. Rows are only ever added. To keep them that way, the account
+-- phonebook uses needs no more than INSERT and SELECT on it.
+CREATE TABLE changelog (
+    CLID BIGINT NOT NULL AUTO_INCREMENT,
+    Elem SMALLINT NOT NULL,
+    ID BIGINT NOT NULL,
+    Field VARCHAR(50) NOT NULL,
+    OldValue TEXT NOT NULL,
+    NewValue TEXT NOT NULL,
+    Actor BIGINT NOT NULL DEFAULT 0,
+    DtChange DATETIME NOT NULL DEFAULT '2000-01-01 00:00:00',
+    PRIMARY KEY (CLID),
+    KEY (Elem, ID)
+);
+
+-- Oct 18, 2026
+-- Add secevents table for sign ins, impersonation and admin actions
+CREATE TABLE secevents (
+    EventID BIGINT NOT NULL AUTO_INCREMENT,
+    EventType VARCHAR(25) NOT NULL,
+    Actor BIGINT NOT NULL DEFAULT 0,
+    ActorName VARCHAR(64) NOT NULL DEFAULT '',
+    Target BIGINT NOT NULL DEFAULT 0,
+    TargetName VARCHAR(128) NOT NULL DEFAULT '',
+    IP VARCHAR(40) NOT NULL DEFAULT '',
+    UserAgent VARCHAR(256) NOT NULL DEFAULT '',
+    Detail VARCHAR(1024) NOT NULL DEFAULT '',
+    DtEvent DATETIME NOT NULL DEFAULT '2000-01-01 00:00:00',
+    PRIMARY KEY (EventID),
+    KEY (DtEvent),
+    KEY (Actor),
+    KEY (Target)
+);
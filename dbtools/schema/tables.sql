@@ -139,17 +139,132 @@ CREATE TABLE roles (
     RID MEDIUMINT NOT NULL AUTO_INCREMENT,
     Name VARCHAR(25) NOT NULL,
     Descr VARCHAR(256),
+    Scope SMALLINT NOT NULL DEFAULT 0,                      -- companies the role applies to: 0 = all, 1 = own, 2 = listed in rolecompanies
+    OutRID MEDIUMINT NOT NULL DEFAULT 0,                    -- role whose permissions apply outside the scope, 0 = none
     PRIMARY KEY(RID)
 );
 
 CREATE TABLE sessions (
     UID BIGINT NOT NULL,
     UserName VARCHAR(40) NOT NULL DEFAULT '',
-    Cookie VARCHAR(40) NOT NULL DEFAULT '',
+    Cookie CHAR(64) NOT NULL DEFAULT '',                    -- sha256 of the session token
     DtExpire DATETIME NOT NULL DEFAULT '2000-01-01 00:00:00',
     UserAgent VARCHAR(256) NOT NULL DEFAULT '',
     IP VARCHAR(40) NOT NULL DEFAULT ''
 );
 
+CREATE TABLE pwresets (
+    TokenHash CHAR(64) NOT NULL,                            -- sha256 of the token emailed to the user
+    UID BIGINT NOT NULL,
+    UserName VARCHAR(40) NOT NULL DEFAULT '',
+    DtCreate TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    DtExpire DATETIME NOT NULL DEFAULT '2000-01-01 00:00:00',
+    Used SMALLINT NOT NULL DEFAULT 0,                       -- 1 once the token has been used
+    IP VARCHAR(40) NOT NULL DEFAULT '',                     -- client that asked for the reset
+    PRIMARY KEY (TokenHash)
+);
+
+CREATE TABLE loginfailures (
+    Kind SMALLINT NOT NULL DEFAULT 0,                       -- 0 = username, 1 = IP address, 2 = reset username, 3 = reset IP address
+    Name VARCHAR(64) NOT NULL DEFAULT '',                   -- the username or IP address
+    Failures INT NOT NULL DEFAULT 0,                        -- failed sign ins since the count was last cleared
+    DtLast DATETIME NOT NULL DEFAULT '2000-01-01 00:00:00', -- time of the most recent failure
+    PRIMARY KEY (Kind, Name)
+);
+
+CREATE TABLE twofactor (
+    UID BIGINT NOT NULL,
+    Secret VARCHAR(64) NOT NULL DEFAULT '',                 -- base32 TOTP secret
+    Enabled SMALLINT NOT NULL DEFAULT 0,                    -- 1 once the user confirmed the secret with a code
+    LastStep BIGINT NOT NULL DEFAULT 0,                     -- TOTP step of the last code accepted
+    DtCreate TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (UID)
+);
+
+CREATE TABLE recoverycodes (
+    UID BIGINT NOT NULL,
+    CodeHash CHAR(64) NOT NULL,                             -- sha256 of the recovery code
+    Used SMALLINT NOT NULL DEFAULT 0,                       -- 1 once the code has been used
+    PRIMARY KEY (UID, CodeHash)
+);
+
+CREATE TABLE loginchallenges (
+    TokenHash CHAR(64) NOT NULL,                            -- sha256 of the token sent with the second step form
+    UID BIGINT NOT NULL,
+    UserName VARCHAR(40) NOT NULL DEFAULT '',
+    DtExpire DATETIME NOT NULL DEFAULT '2000-01-01 00:00:00',
+    IP VARCHAR(40) NOT NULL DEFAULT '',                     -- client that supplied the password
+    UserAgent VARCHAR(256) NOT NULL DEFAULT '',
+    Attempts INT NOT NULL DEFAULT 0,                        -- wrong codes entered so far
+    PRIMARY KEY (TokenHash)
+);
+
+CREATE TABLE signingkeys (
+    KID VARCHAR(32) NOT NULL,                               -- key id, in the header of the tokens it signs
+    PrivateKey VARCHAR(128) NOT NULL DEFAULT '',            -- base64 ed25519 private key seed
+    DtCreate DATETIME NOT NULL DEFAULT '2000-01-01 00:00:00',
+    PRIMARY KEY (KID)
+);
+
+CREATE TABLE apikeys (
+    KeyID BIGINT NOT NULL AUTO_INCREMENT,
+    KeyHash CHAR(64) NOT NULL,                              -- sha256 of the key
+    Prefix VARCHAR(16) NOT NULL DEFAULT '',                 -- first characters of the key, to tell keys apart
+    UID BIGINT NOT NULL DEFAULT 0,                          -- person the key belongs to, 0 for a service account
+    Name VARCHAR(64) NOT NULL DEFAULT '',                   -- service account name, or what a personal key is for
+    RID BIGINT NOT NULL DEFAULT 0,                          -- role the key acts with
+    CreateBy BIGINT NOT NULL DEFAULT 0,                     -- uid of the admin who created the key
+    DtCreate DATETIME NOT NULL DEFAULT '2000-01-01 00:00:00',
+    DtLastUsed DATETIME NOT NULL DEFAULT '2000-01-01 00:00:00',
+    LastIP VARCHAR(40) NOT NULL DEFAULT '',                 -- address the key was last used from
+    Revoked SMALLINT NOT NULL DEFAULT 0,
+    DtRevoked DATETIME NOT NULL DEFAULT '2000-01-01 00:00:00',
+    PRIMARY KEY (KeyID),
+    UNIQUE KEY (KeyHash)
+);
+
+CREATE TABLE reloadversions (
+    Name VARCHAR(25) NOT NULL,                              -- what changed: maps or roles
+    Version BIGINT NOT NULL DEFAULT 0,                      -- bumped on every change, instances reload when it moves
+    DtChange DATETIME NOT NULL DEFAULT '2000-01-01 00:00:00',
+    PRIMARY KEY (Name)
+);
+
+CREATE TABLE rolecompanies (
+    RID MEDIUMINT NOT NULL,                                 -- role with Scope 2
+    CoCode MEDIUMINT NOT NULL,                              -- a company it applies to
+    PRIMARY KEY (RID, CoCode)
+);
+
+CREATE TABLE changelog (
+    CLID BIGINT NOT NULL AUTO_INCREMENT,
+    Elem SMALLINT NOT NULL,                                 -- 1 = person, 2 = company, 3 = class
+    ID BIGINT NOT NULL,                                     -- UID, CoCode or ClassCode
+    Field VARCHAR(50) NOT NULL,                             -- field name, as in fieldperms
+    OldValue TEXT NOT NULL,                                 -- empty when the record was created
+    NewValue TEXT NOT NULL,                                 -- empty when the record was deleted
+    Actor BIGINT NOT NULL DEFAULT 0,                        -- uid of the person who made the change
+    DtChange DATETIME NOT NULL DEFAULT '2000-01-01 00:00:00',
+    PRIMARY KEY (CLID),
+    KEY (Elem, ID)
+);
+
+CREATE TABLE secevents (
+    EventID BIGINT NOT NULL AUTO_INCREMENT,
+    EventType VARCHAR(25) NOT NULL,                         -- signin, signin-failed, become, ...
+    Actor BIGINT NOT NULL DEFAULT 0,                        -- uid of who did it, 0 if unknown
+    ActorName VARCHAR(64) NOT NULL DEFAULT '',              -- username of the actor, or the user name tried
+    Target BIGINT NOT NULL DEFAULT 0,                       -- uid of the person it was done to, 0 if none
+    TargetName VARCHAR(128) NOT NULL DEFAULT '',            -- username, role or key it was done to
+    IP VARCHAR(40) NOT NULL DEFAULT '',                     -- address of the actor
+    UserAgent VARCHAR(256) NOT NULL DEFAULT '',             -- client of the actor
+    Detail VARCHAR(1024) NOT NULL DEFAULT '',
+    DtEvent DATETIME NOT NULL DEFAULT '2000-01-01 00:00:00',
+    PRIMARY KEY (EventID),
+    KEY (DtEvent),
+    KEY (Actor),
+    KEY (Target)
+);
+
 -- Add the Administrator as the first and only user
 -- INSERT INTO people (UserName,FirstName,LastName) VALUES("administrator","Administrator","Administrator");
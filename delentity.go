@@ -5,6 +5,9 @@ import (
 	"net/http"
 	"phonebook/authz"
 	"phonebook/db"
+	"phonebook/idx"
+	"phonebook/lib"
+	"phonebook/qb"
 	"phonebook/sess"
 	"strconv"
 	"strings"
@@ -44,16 +47,20 @@ func intPersonRefErrHandler(w http.ResponseWriter, r *http.Request, path string)
 		PDetFilterSecurityRead(ui.D, ssn, authz.PERMVIEW)
 		breadcrumbAdd(ssn, "Inactivate Person", fmt.Sprintf("/inactivatePerson/%d", uid))
 
-		s := fmt.Sprintf("select uid,lastname,firstname,preferredname,jobcode,primaryemail,officephone,cellphone,deptcode from people where status=1 and mgruid=%d", uid)
+		s, args := (&qb.Select{
+			Cols:  "uid,lastname,firstname,preferredname,jobcode,primaryemail,officephone,cellphone,deptcode,cocode",
+			From:  "people",
+			Where: qb.And(qb.Eq("status", 1), qb.Eq("mgruid", uid)),
+		}).SQL()
 		// fmt.Printf("QUERY = %s\n", s)
-		rows, err := Phonebook.db.Query(s) // note: the single arg to Query causes the sql impl to NOT create a prepared statement
+		rows, err := Phonebook.db.Query(s, args...)
 		errcheck(err)
 		defer rows.Close()
 		var d searchResults
 
 		for rows.Next() {
 			var m db.Person
-			errcheck(rows.Scan(&m.UID, &m.LastName, &m.FirstName, &m.PreferredName, &m.JobCode, &m.PrimaryEmail, &m.OfficePhone, &m.CellPhone, &m.DeptCode))
+			errcheck(rows.Scan(&m.UID, &m.LastName, &m.FirstName, &m.PreferredName, &m.JobCode, &m.PrimaryEmail, &m.OfficePhone, &m.CellPhone, &m.DeptCode, &m.CoCode))
 			m.DeptName = getDepartmentFromDeptCode(m.DeptCode)
 			pm := &m
 			filterSecurityRead(pm, authz.ELEMPERSON, ssn, authz.PERMVIEW|authz.PERMMOD, m.UID)
@@ -86,8 +93,8 @@ func getDirectReportsCount(uid int) int {
 	//===============================================================
 	//  Check to see if this person manages anyone before deleting...
 	//===============================================================
-	s := fmt.Sprintf("select uid from people where status=1 and MgrUID=%d", uid)
-	rows, err := Phonebook.db.Query(s)
+	s, args := (&qb.Select{Cols: "uid", From: "people", Where: qb.And(qb.Eq("status", 1), qb.Eq("MgrUID", uid))}).SQL()
+	rows, err := Phonebook.db.Query(s, args...)
 	errcheck(err)
 	defer rows.Close()
 	var refuid int
@@ -134,41 +141,36 @@ func delPersonHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var coCode int
+	if err = Phonebook.prepstmt.getUserCoCode.QueryRow(uid).Scan(&coCode); err != nil && !lib.IsSQLNoResultsError(err) {
+		errcheck(err)
+	}
+	if !hasCoAccess(ssn, authz.ELEMPERSON, "ElemEntity", authz.PERMDEL, coCode) {
+		ulog("Permissions refuse delPersonHandler for uid %d of company %d on userid=%d (%s), role=%s\n", uid, coCode, ssn.UID, ssn.Firstname, ssn.PMap.Urole.Name)
+		http.Redirect(w, r, "/search/", http.StatusFound)
+		return
+	}
+
 	count := getDirectReportsCount(uid)
 	if count > 0 {
 		http.Redirect(w, r, fmt.Sprintf("/delPersonRefErr/%d", uid), http.StatusFound)
 		return
 	}
 
-	//===============================
-	//  ******  BEGIN TRANSACTION  ******
-	//===============================
 	//------------------------------------------------------------
 	// in order to delete a person, we must delete all references
 	// to the person in the following database tables:
 	//		deductions
 	//		compensation
+	// db.DeletePerson does it in one transaction along with the
+	// changelog rows for the fields the person had.
 	//------------------------------------------------------------
 	s := fmt.Sprintf("DELETE FROM people WHERE UID=%d", uid)
-	_, err = Phonebook.prepstmt.delPerson.Exec(uid)
-	if delCheckError(c, ssn, err, s, w, r) {
-		return
-	}
-
-	s = fmt.Sprintf("DELETE FROM deductions WHERE UID=%d", uid)
-	_, err = Phonebook.prepstmt.delPersonDeduct.Exec(uid)
-	if delCheckError(c, ssn, err, s, w, r) {
-		return
-	}
-
-	s = fmt.Sprintf("DELETE FROM compensation WHERE UID=%d", uid)
-	_, err = Phonebook.prepstmt.delPersonComp.Exec(uid)
+	err = db.DeletePerson(uid, ssn.UID)
 	if delCheckError(c, ssn, err, s, w, r) {
 		return
 	}
-	//===============================
-	//  ******  END TRANSACTION  ******
-	//===============================
+	idx.Remove(authz.ELEMPERSON, uid)
 
 	http.Redirect(w, r, "/search/", http.StatusFound)
 }
@@ -195,15 +197,19 @@ func delClassRefErr(w http.ResponseWriter, r *http.Request) {
 
 		breadcrumbAdd(ssn, "Delete Class", fmt.Sprintf("/delClassRefErr/%d", classcode))
 
-		s := fmt.Sprintf("select uid,lastname,firstname,preferredname,jobcode,primaryemail,officephone,cellphone,deptcode from people where classcode=%d", classcode)
-		rows, err := Phonebook.db.Query(s) // does NOT create a prepared statement
+		s, args := (&qb.Select{
+			Cols:  "uid,lastname,firstname,preferredname,jobcode,primaryemail,officephone,cellphone,deptcode,cocode",
+			From:  "people",
+			Where: qb.Eq("classcode", classcode),
+		}).SQL()
+		rows, err := Phonebook.db.Query(s, args...)
 		errcheck(err)
 		defer rows.Close()
 		var d searchResults
 
 		for rows.Next() {
 			var m db.Person
-			errcheck(rows.Scan(&m.UID, &m.LastName, &m.FirstName, &m.PreferredName, &m.JobCode, &m.PrimaryEmail, &m.OfficePhone, &m.CellPhone, &m.DeptCode))
+			errcheck(rows.Scan(&m.UID, &m.LastName, &m.FirstName, &m.PreferredName, &m.JobCode, &m.PrimaryEmail, &m.OfficePhone, &m.CellPhone, &m.DeptCode, &m.CoCode))
 			m.DeptName = getDepartmentFromDeptCode(m.DeptCode)
 			pm := &m
 			// pm.filterSecurityRead(ssn, authz.PERMVIEW|authz.PERMMOD)
@@ -258,11 +264,21 @@ func delClassHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var cl db.Class
+	if err = db.GetClassInfo(ClassCode, &cl); err != nil && !lib.IsSQLNoResultsError(err) {
+		errcheck(err)
+	}
+	if !hasCoAccess(ssn, authz.ELEMCLASS, "ElemEntity", authz.PERMDEL, cl.CoCode) {
+		ulog("Permissions refuse delClassHandler for class %d of company %d on userid=%d (%s), role=%s\n", ClassCode, cl.CoCode, ssn.UID, ssn.Firstname, ssn.PMap.Urole.Name)
+		http.Redirect(w, r, "/search/", http.StatusFound)
+		return
+	}
+
 	//===============================================================
 	//  Check for references to this db.Class before deleting
 	//===============================================================
-	s := fmt.Sprintf("select uid from people where classcode=%d", ClassCode)
-	rows, err := Phonebook.db.Query(s)
+	s, args := (&qb.Select{Cols: "uid", From: "people", Where: qb.Eq("classcode", ClassCode)}).SQL()
+	rows, err := Phonebook.db.Query(s, args...)
 	errcheck(err)
 	defer rows.Close()
 	count := 0
@@ -284,17 +300,16 @@ func delClassHandler(w http.ResponseWriter, r *http.Request) {
 	//		deductions
 	//		compensationc,
 	//===============================================================
-	// s = fmt.Sprintf("DELETE FROM classes WHERE ClassCode=%d", ClassCode)
-	// stmt, err := Phonebook.db.Prepare(s)
+	s = fmt.Sprintf("DELETE FROM classes WHERE ClassCode=%d", ClassCode)
 	if delCheckError(c, ssn, err, s, w, r) {
 		return
 	}
-	_, err = Phonebook.prepstmt.delClass.Exec(ClassCode)
+	err = db.DeleteClass(ClassCode, ssn.UID)
 	if delCheckError(c, ssn, err, s, w, r) {
 		return
 	}
 	// we've deleted it, now we need to reload our db.Class list...
-	loadClasses()
+	classesChanged()
 	http.Redirect(w, r, "/searchcl/", http.StatusFound)
 }
 
@@ -329,6 +344,7 @@ func delCoRefErr(w http.ResponseWriter, r *http.Request) {
 		for rows.Next() {
 			var m db.Person
 			errcheck(rows.Scan(&m.UID, &m.LastName, &m.FirstName, &m.PreferredName, &m.JobCode, &m.PrimaryEmail, &m.OfficePhone, &m.CellPhone, &m.DeptCode))
+			m.CoCode = cocode
 			m.DeptName = getDepartmentFromDeptCode(m.DeptCode)
 			pm := &m
 			// pm.filterSecurityRead(ssn, authz.PERMVIEW|authz.PERMMOD)
@@ -383,11 +399,17 @@ func delCoHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !hasCoAccess(ssn, authz.ELEMCOMPANY, "ElemEntity", authz.PERMDEL, CoCode) {
+		ulog("Permissions refuse delCoHandler for company %d on userid=%d (%s), role=%s\n", CoCode, ssn.UID, ssn.Firstname, ssn.PMap.Urole.Name)
+		http.Redirect(w, r, "/search/", http.StatusFound)
+		return
+	}
+
 	//===============================================================
 	//  Check for references to this db.Class before deleting
 	//===============================================================
-	s := fmt.Sprintf("select uid from people where CoCode=%d", CoCode)
-	rows, err := Phonebook.db.Query(s)
+	s, args := (&qb.Select{Cols: "uid", From: "people", Where: qb.Eq("CoCode", CoCode)}).SQL()
+	rows, err := Phonebook.db.Query(s, args...)
 	errcheck(err)
 	defer rows.Close()
 	count := 0
@@ -410,15 +432,11 @@ func delCoHandler(w http.ResponseWriter, r *http.Request) {
 	//		compensation
 	//===============================================================
 	s = fmt.Sprintf("DELETE FROM companies WHERE CoCode=%d", CoCode)
-	stmt, err := Phonebook.db.Prepare(s)
-	if delCheckError(c, ssn, err, s, w, r) {
-		return
-	}
-	_, err = stmt.Exec()
+	err = db.DeleteCompany(CoCode, ssn.UID)
 	if delCheckError(c, ssn, err, s, w, r) {
 		return
 	}
 	// we've deleted it, now we need to reload our company list...
-	loadCompanies()
+	companiesChanged()
 	http.Redirect(w, r, "/searchco/", http.StatusFound)
 }
@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"phonebook/authz"
 	"phonebook/db"
+	"phonebook/lib"
 	"phonebook/sess"
 	"phonebook/ui"
 	"strconv"
@@ -101,6 +102,34 @@ func getPersonDetail(d *db.PersonDetail, uid int) int {
 	return 0
 }
 
+// readDetail reads what the detail page shows about the person with the
+// supplied uid into d.
+func readDetail(uid int, d *db.PersonDetail, uis *uiSupport) {
+	d.Image = ui.GetImageLocation(uid)
+	rows, err := Phonebook.prepstmt.personDetail.Query(uid)
+	errcheck(err)
+	defer rows.Close()
+	for rows.Next() {
+		errcheck(rows.Scan(&d.LastName, &d.MiddleName, &d.FirstName, &d.PreferredName,
+			&d.JobCode, &d.PrimaryEmail,
+			&d.OfficePhone, &d.CellPhone, &d.DeptCode, &d.CoCode, &d.MgrUID,
+			&d.ClassCode, &d.EmergencyContactName, &d.EmergencyContactPhone,
+			&d.HomeStreetAddress, &d.HomeStreetAddress2, &d.HomeCity,
+			&d.HomeState, &d.HomePostalCode, &d.HomeCountry, &d.OfficeFax))
+	}
+	errcheck(rows.Err())
+	d.MgrName = getNameFromUID(d.MgrUID)
+	d.DeptName = getDepartmentFromDeptCode(d.DeptCode)
+	d.JobTitle = getJobTitle(d.JobCode)
+	getCompanyInfo(d.CoCode, &d.Company)
+	getReports(uid, d)
+	d.Class = uis.ClassCodeToName[d.ClassCode]
+	err = Phonebook.prepstmt.personReviews.QueryRow(uid).Scan(&d.LastReview, &d.NextReview)
+	if err != nil && !lib.IsSQLNoResultsError(err) {
+		errcheck(err)
+	}
+}
+
 func detailHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/html")
 	var sess *sess.Session
@@ -135,37 +164,21 @@ func detailHandler(w http.ResponseWriter, r *http.Request) {
 	//=================================================================
 	// SECURITY
 	//=================================================================
-	if !sess.ElemPermsAny(authz.ELEMPERSON, authz.PERMVIEW|authz.PERMOWNERVIEW) {
+	if !sess.ElemPermsAny(authz.ELEMPERSON, authz.PERMVIEW|authz.PERMOWNERVIEW|authz.PERMMGRVIEW) {
 		ulog("ViewPersonDetail: Permission refusal on userid=%d (%s), role=%s\n", sess.UID, sess.Firstname, sess.PMap.Urole.Name)
 		http.Redirect(w, r, "/search/", http.StatusFound)
 		return
 	}
 
 	if uid > 0 {
-		d.Image = ui.GetImageLocation(uid)
-		rows, err := Phonebook.prepstmt.personDetail.Query(uid)
-		errcheck(err)
-		defer rows.Close()
-		for rows.Next() {
-			errcheck(rows.Scan(&d.LastName, &d.MiddleName, &d.FirstName, &d.PreferredName,
-				&d.JobCode, &d.PrimaryEmail,
-				&d.OfficePhone, &d.CellPhone, &d.DeptCode, &d.CoCode, &d.MgrUID,
-				&d.ClassCode, &d.EmergencyContactName, &d.EmergencyContactPhone,
-				&d.HomeStreetAddress, &d.HomeStreetAddress2, &d.HomeCity,
-				&d.HomeState, &d.HomePostalCode, &d.HomeCountry, &d.OfficeFax))
-		}
-		errcheck(rows.Err())
-		d.MgrName = getNameFromUID(d.MgrUID)
-		d.DeptName = getDepartmentFromDeptCode(d.DeptCode)
-		d.JobTitle = getJobTitle(d.JobCode)
-		getCompanyInfo(d.CoCode, &d.Company)
-		getReports(uid, &d)
-		d.Class = uis.ClassCodeToName[d.ClassCode]
+		readDetail(uid, &d, &uis)
 	}
 
 	uis.D = &d
 
-	filterSecurityRead(uis.D, authz.ELEMPERSON, sess, authz.PERMVIEW, d.UID)
+	// managers of record may see fields such as the review dates of the
+	// people who report to them
+	filterSecurityRead(uis.D, authz.ELEMPERSON, sess, authz.PERMVIEW|authz.PERMMGRVIEW, d.UID)
 
 	err := renderTemplate(w, uis, "detail.html")
 	if nil != err {
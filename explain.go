@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"phonebook/authz"
+	"phonebook/db"
+	"phonebook/lib"
+	"phonebook/sess"
+	"strconv"
+)
+
+// permExplain is the data for the permission explain page
+type permExplain struct {
+	UID     int                 // viewer
+	RID     int                 // role the viewer is given, 0 for their own
+	Check   string              // name of the sess.ExplainCheck
+	ID      int                 // uid, cocode or classcode of the data
+	Checks  []sess.ExplainCheck // the reads that can be checked
+	Roles   []authz.Role        // the roles, Perms are not used
+	Viewer  string              // name of the viewer
+	Person  bool                // true if the data is a person, for the preview
+	Explain *sess.Explanation   // the result, nil until there is one
+}
+
+// permExplainHandler shows how the permissions of a viewer, or of anyone
+// holding a role, apply to each field of a person, company or class. The
+// fields go through the same tests as when the viewer reads them, and the
+// page shows what granted or denied each one. The preview action shows the
+// detail page as the viewer would see it.
+//-----------------------------------------------------------------------------
+func permExplainHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html")
+	var ssn *sess.Session
+	var ui uiSupport
+	ssn = nil
+	if 0 < initHandlerSession(ssn, &ui, w, r) {
+		return
+	}
+	ssn = ui.X
+	breadcrumbAdd(ssn, "Explain Permissions", "/explain/")
+
+	//============================================================
+	// SECURITY
+	//============================================================
+	if !rolesAccess(w, r, ssn) {
+		return
+	}
+
+	var x permExplain
+	var errmsg string
+	x.UID, _ = strconv.Atoi(r.FormValue("uid"))
+	x.RID, _ = strconv.Atoi(r.FormValue("rid"))
+	x.ID, _ = strconv.Atoi(r.FormValue("id"))
+	x.Check = r.FormValue("check")
+	x.Checks = sess.ExplainChecks
+	x.Roles = authz.GetRoles()
+	c := sess.FindExplainCheck(x.Check)
+	if c == nil {
+		c = &sess.ExplainChecks[0]
+		x.Check = c.Name
+	}
+	x.Person = c.Elem == authz.ELEMPERSON
+
+	if x.UID > 0 && x.ID > 0 {
+		errmsg = explainPerms(w, r, ssn, &ui, &x, c)
+		if len(errmsg) == 0 && x.Explain == nil {
+			return // the preview was rendered
+		}
+	}
+
+	ui.E = &x
+	ui.ErrMsg = template.HTML(template.HTMLEscapeString(errmsg))
+	err := renderTemplate(w, ui, "explain.html")
+	if nil != err {
+		errmsg := fmt.Sprintf("permExplainHandler: err = %v\n", err)
+		ulog(errmsg)
+		fmt.Println(errmsg)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// explainPerms fills in x.Explain, or for the preview action renders the
+// detail page as the viewer would see it. It returns a message for the
+// admin if the viewer or the data cannot be read.
+func explainPerms(w http.ResponseWriter, r *http.Request, ssn *sess.Session, ui *uiSupport, x *permExplain, c *sess.ExplainCheck) string {
+	if x.RID != 0 && len(authz.RoleName(x.RID)) == 0 {
+		x.RID = 0
+	}
+	viewer, err := sess.ExplainViewer(x.UID, x.RID)
+	if lib.IsSQLNoResultsError(err) {
+		return fmt.Sprintf("There is no person with uid %d.", x.UID)
+	}
+	if err != nil {
+		return err.Error()
+	}
+	x.Viewer = getNameFromUID(x.UID)
+
+	if r.FormValue("action") == "preview" && x.Person {
+		if !viewer.ElemPermsAny(authz.ELEMPERSON, authz.PERMVIEW|authz.PERMOWNERVIEW|authz.PERMMGRVIEW) {
+			return fmt.Sprintf("%s would be sent back to the search page, the role has no permission to view people.", x.Viewer)
+		}
+		var d db.PersonDetail
+		d.Reports = make([]db.Person, 0)
+		d.UID = x.ID
+		readDetail(x.ID, &d, ui)
+		filterSecurityRead(&d, authz.ELEMPERSON, viewer, authz.PERMVIEW|authz.PERMMGRVIEW, d.UID)
+		// The viewer may hold a role that can read more than the admin can,
+		// so the admin's own permissions are applied too.
+		filterSecurityRead(&d, authz.ELEMPERSON, ssn, authz.PERMVIEW|authz.PERMMGRVIEW, d.UID)
+		ui.D = &d
+		breadcrumbAdd(ssn, "Preview as "+x.Viewer, fmt.Sprintf("/explain/?action=preview&uid=%d&rid=%d&id=%d", x.UID, x.RID, x.ID))
+		if err = renderTemplate(w, *ui, "detail.html"); err != nil {
+			errmsg := fmt.Sprintf("explainPerms: err = %v\n", err)
+			ulog(errmsg)
+			fmt.Println(errmsg)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return ""
+	}
+
+	d, dataUID, err := sess.ExplainData(c, x.ID)
+	if lib.IsSQLNoResultsError(err) {
+		return fmt.Sprintf("There is nothing with id %d to check.", x.ID)
+	}
+	if err != nil {
+		return err.Error()
+	}
+	e := sess.Explain(d, c.Elem, viewer, c.Perm, dataUID)
+	x.Explain = &e
+	return ""
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"phonebook/authz"
+	"phonebook/db"
+	"phonebook/sess"
+	"strconv"
+	"strings"
+)
+
+// historyPage is the data for the change history page
+type historyPage struct {
+	Elem    string      // person, company or class
+	ID      int         // uid, cocode or classcode
+	Name    string      // what changed, "" if it has been deleted
+	Back    string      // the page the history is for
+	Changes []db.Change // the changes the viewer can read, the most recent first
+}
+
+// changesCoCode returns the company the data in the changes m, the most
+// recent first, last belonged to. It is for data that has been deleted.
+func changesCoCode(m []db.Change) int {
+	for i := 0; i < len(m); i++ {
+		if m[i].Field == "CoCode" {
+			s := m[i].New
+			if len(s) == 0 {
+				s = m[i].Old
+			}
+			n, _ := strconv.Atoi(s)
+			return n
+		}
+	}
+	return 0
+}
+
+// historyHandler shows who changed what in a person, company or class, and
+// when, from the changelog. The url is /history/<person|company|class>/<id>.
+// Only the changes to fields the viewer can read are shown.
+//-----------------------------------------------------------------------------
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html")
+	var ssn *sess.Session
+	var ui uiSupport
+	ssn = nil
+	if 0 < initHandlerSession(ssn, &ui, w, r) {
+		return
+	}
+	ssn = ui.X
+
+	var h historyPage
+	path := "/history/"
+	m := strings.Split(r.URL.Path[len(path):], "/")
+	if len(m) == 2 {
+		h.Elem = m[0]
+		h.ID, _ = strconv.Atoi(m[1])
+	}
+
+	var el, perm, dataUID int
+	coCode := -1
+	switch h.Elem {
+	case "person":
+		el, perm, dataUID = authz.ELEMPERSON, authz.PERMVIEW|authz.PERMMOD, h.ID
+		h.Back = fmt.Sprintf("/adminView/%d", h.ID)
+		var d db.PersonDetail
+		d.UID = h.ID
+		if db.GetPersonDetail(&d) == nil {
+			coCode = d.CoCode
+			h.Name = d.FirstName + " " + d.LastName
+		}
+	case "company":
+		el, perm, coCode = authz.ELEMCOMPANY, authz.PERMVIEW, h.ID
+		h.Back = fmt.Sprintf("/company/%d", h.ID)
+		var c db.Company
+		if db.GetCompanyInfo(h.ID, &c) == nil {
+			h.Name = c.LegalName
+		}
+	case "class":
+		el, perm = authz.ELEMCLASS, authz.PERMVIEW
+		h.Back = fmt.Sprintf("/class/%d", h.ID)
+		var c db.Class
+		if db.GetClassInfo(h.ID, &c) == nil {
+			coCode = c.CoCode
+			h.Name = c.Name
+		}
+	default:
+		fmt.Fprintf(w, "The RequestURI needs person, company or class and its id. They were not found on the URI:  %s\n", r.RequestURI)
+		return
+	}
+	breadcrumbAdd(ssn, "History", r.URL.Path)
+
+	//============================================================
+	// SECURITY
+	//============================================================
+	if !ssn.ElemPermsAll(el, perm) {
+		ulog("Permissions refuse history page on userid=%d (%s), role=%s\n", ssn.UID, ssn.Firstname, ssn.PMap.Urole.Name)
+		http.Redirect(w, r, "/search/", http.StatusFound)
+		return
+	}
+
+	changes, err := db.GetChanges(el, h.ID)
+	if err != nil {
+		errmsg := fmt.Sprintf("historyHandler: db.GetChanges: err = %v\n", err)
+		ulog(errmsg)
+		fmt.Println(errmsg)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if coCode < 0 {
+		coCode = changesCoCode(changes)
+	}
+	h.Changes = sess.FilterChanges(changes, el, ssn, perm, coCode, dataUID)
+
+	ui.H = &h
+	err = renderTemplate(w, ui, "history.html")
+	if nil != err {
+		errmsg := fmt.Sprintf("historyHandler: err = %v\n", err)
+		ulog(errmsg)
+		fmt.Println(errmsg)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,526 @@
+// Package idx is an in-memory name index over people, companies, and
+// classes. It finds names that match a query exactly, by prefix, by sound
+// (soundex), or within a small edit distance, so that misspelled names
+// such as "Jon" for "John" or "Mansur" for "Mansour" still produce hits.
+// Matches are ranked: an exact last name match first, then an exact
+// preferred name match, then other exact and prefix matches, then fuzzy
+// matches.
+//
+// The index is loaded from the database by Init. It is kept current by
+// calling UpdatePerson or Remove after a person is written, and
+// ReloadCompanies or ReloadClasses after the companies or classes change.
+package idx
+
+import (
+	"database/sql"
+	"phonebook/authz"
+	"phonebook/lib"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Scores for the different kinds of matches. A hit's score is the sum of
+// the best score for each word in the query.
+const (
+	SCORELASTNAME      = 100 // exact match on a person's last name
+	SCOREPREFERREDNAME = 90  // exact match on a person's preferred name
+	SCOREEXACT         = 80  // exact match on any other name
+	SCOREPREFIX        = 60  // the name begins with the query word
+	SCOREPHONETIC      = 40  // the name sounds like the query word
+	SCOREFUZZY         = 35  // the name is within a small edit distance, less 5 per edit
+)
+
+// roles of the words in an entry
+const (
+	roleOther = iota
+	roleLast
+	rolePreferred
+)
+
+// word is a single normalized word from a name along with its soundex code
+type word struct {
+	text string
+	code string
+	role int
+}
+
+// entry is the indexed form of a person, company, or class
+type entry struct {
+	name     string // display name
+	title    string // job title, company common name, or class designation
+	image    string // profile image path, people only
+	active   bool   // people and companies can be inactive
+	employer bool   // the company employs personnel
+	coCode   int    // company the person or class belongs to, or the company itself
+	words    []word
+}
+
+// Hit is a single search result
+type Hit struct {
+	Kind     int    // authz.ELEMPERSON, authz.ELEMCOMPANY, or authz.ELEMCLASS
+	ID       int    // UID, CoCode, or ClassCode
+	Name     string // display name
+	Title    string // job title, company common name, or class designation
+	Image    string // profile image path, people only
+	Active   bool   // false for inactive people and companies
+	Employer bool   // true for companies that employ personnel
+	CoCode   int    // company the person or class belongs to, or the company itself
+	Score    int    // relevance, higher is better
+}
+
+// Index is the shared index data. Access to the entries is serialized
+// through ReqMem and ReqMemAck in the same way as the other shared data in
+// phonebook.
+var Index struct {
+	db          *sql.DB
+	entries     map[int]map[int]*entry // kind -> id -> entry
+	initialized bool
+	ReqMem      chan int // request to access the index
+	ReqMemAck   chan int // acknowledge access granted / released
+}
+
+// dispatcher controls access to the index
+func dispatcher() {
+	for {
+		select {
+		case <-Index.ReqMem:
+			Index.ReqMemAck <- 1 // tell caller go ahead
+			<-Index.ReqMemAck    // block until caller is done with mem
+		}
+	}
+}
+
+// Init builds the index from the database and starts its dispatcher.
+//
+// INPUTS
+//  db - the phonebook database
+//
+// RETURNS
+//  any error encountered
+//-----------------------------------------------------------------------------
+func Init(db *sql.DB) error {
+	Index.db = db
+	Index.ReqMem = make(chan int)
+	Index.ReqMemAck = make(chan int)
+	Index.entries = map[int]map[int]*entry{
+		authz.ELEMPERSON:  {},
+		authz.ELEMCOMPANY: {},
+		authz.ELEMCLASS:   {},
+	}
+	go dispatcher()
+	Index.initialized = true
+	return Rebuild()
+}
+
+// Rebuild reloads the entire index from the database
+//-----------------------------------------------------------------------------
+func Rebuild() error {
+	if err := loadPeople(""); err != nil {
+		return err
+	}
+	if err := ReloadCompanies(); err != nil {
+		return err
+	}
+	return ReloadClasses()
+}
+
+// set replaces the entry for kind/id. A nil entry removes it.
+func set(kind, id int, e *entry) {
+	Index.ReqMem <- 1 // ask to access the shared mem, blocks until granted
+	<-Index.ReqMemAck // make sure we got it
+	if e == nil {
+		delete(Index.entries[kind], id)
+	} else {
+		Index.entries[kind][id] = e
+	}
+	Index.ReqMemAck <- 1 // tell dispatcher we're done with the data
+}
+
+// replaceKind replaces all the entries for kind
+func replaceKind(kind int, m map[int]*entry) {
+	Index.ReqMem <- 1 // ask to access the shared mem, blocks until granted
+	<-Index.ReqMemAck // make sure we got it
+	Index.entries[kind] = m
+	Index.ReqMemAck <- 1 // tell dispatcher we're done with the data
+}
+
+// loadPeople indexes the people selected by where. If where is empty all
+// people are reindexed.
+func loadPeople(where string, args ...interface{}) error {
+	s := "SELECT people.UID,people.FirstName,people.MiddleName,people.LastName,people.PreferredName," +
+		"IFNULL(jobtitles.Title,''),people.ImagePath,people.Status,people.CoCode " +
+		"FROM people LEFT JOIN jobtitles ON people.JobCode=jobtitles.JobCode"
+	if len(where) > 0 {
+		s += " WHERE " + where
+	}
+	rows, err := Index.db.Query(s, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	m := map[int]*entry{}
+	for rows.Next() {
+		var uid, status, coCode int
+		var first, middle, last, preferred, title, image string
+		if err = rows.Scan(&uid, &first, &middle, &last, &preferred, &title, &image, &status, &coCode); err != nil {
+			return err
+		}
+		e := personEntry(first, middle, last, preferred)
+		e.title = title
+		e.image = image
+		e.active = status == 1
+		e.coCode = coCode
+		m[uid] = e
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	if len(where) == 0 {
+		replaceKind(authz.ELEMPERSON, m)
+		return nil
+	}
+	for uid, e := range m {
+		set(authz.ELEMPERSON, uid, e)
+	}
+	return nil
+}
+
+// ReloadCompanies reindexes all companies. It does nothing until Init has
+// been called.
+//-----------------------------------------------------------------------------
+func ReloadCompanies() error {
+	if !Index.initialized {
+		return nil
+	}
+	return loadCompanies()
+}
+
+// ReloadClasses reindexes all classes. It does nothing until Init has been
+// called.
+//-----------------------------------------------------------------------------
+func ReloadClasses() error {
+	if !Index.initialized {
+		return nil
+	}
+	return loadClasses()
+}
+
+// loadCompanies reindexes all companies
+func loadCompanies() error {
+	rows, err := Index.db.Query("SELECT CoCode,LegalName,CommonName,Designation,Active,EmploysPersonnel FROM companies")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	m := map[int]*entry{}
+	for rows.Next() {
+		var code, active, employer int
+		var legal, common, designation string
+		if err = rows.Scan(&code, &legal, &common, &designation, &active, &employer); err != nil {
+			return err
+		}
+		e := newEntry(legal, []string{legal, common, designation}, roleOther)
+		e.title = common
+		e.active = active == 1
+		e.employer = employer != 0
+		e.coCode = code
+		m[code] = e
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	replaceKind(authz.ELEMCOMPANY, m)
+	return nil
+}
+
+// loadClasses reindexes all classes
+func loadClasses() error {
+	rows, err := Index.db.Query("SELECT ClassCode,Name,Designation,CoCode FROM classes")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	m := map[int]*entry{}
+	for rows.Next() {
+		var code, coCode int
+		var name, designation string
+		if err = rows.Scan(&code, &name, &designation, &coCode); err != nil {
+			return err
+		}
+		e := newEntry(name, []string{name, designation}, roleOther)
+		e.title = designation
+		e.active = true
+		e.coCode = coCode
+		m[code] = e
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	replaceKind(authz.ELEMCLASS, m)
+	return nil
+}
+
+// UpdatePerson reindexes the person with the supplied uid. Call it after
+// the person's record has been written. If the person no longer exists it
+// is removed from the index.
+//-----------------------------------------------------------------------------
+func UpdatePerson(uid int) error {
+	if !Index.initialized {
+		return nil
+	}
+	set(authz.ELEMPERSON, uid, nil)
+	return loadPeople("people.UID=?", uid)
+}
+
+// Remove removes an entry from the index
+//
+// INPUTS
+//  kind - authz.ELEMPERSON, authz.ELEMCOMPANY, or authz.ELEMCLASS
+//  id   - the UID, CoCode, or ClassCode
+//-----------------------------------------------------------------------------
+func Remove(kind, id int) {
+	if !Index.initialized {
+		return
+	}
+	set(kind, id, nil)
+}
+
+// Errlog logs an index maintenance error. The index is an optimization,
+// so errors updating it are logged rather than returned to the user.
+//-----------------------------------------------------------------------------
+func Errlog(funcname string, err error) {
+	if err != nil {
+		lib.Ulog("%s: error updating search index: %s\n", funcname, err.Error())
+	}
+}
+
+// personEntry returns the index entry for a person
+func personEntry(first, middle, last, preferred string) *entry {
+	name := first
+	if len(preferred) > 0 {
+		name = preferred
+	}
+	e := entry{name: strings.TrimSpace(name + " " + last)}
+	e.words = append(e.words, words(last, roleLast)...)
+	e.words = append(e.words, words(preferred, rolePreferred)...)
+	e.words = append(e.words, words(first, roleOther)...)
+	e.words = append(e.words, words(middle, roleOther)...)
+	return &e
+}
+
+// newEntry returns an index entry whose words come from names
+func newEntry(name string, names []string, role int) *entry {
+	e := entry{name: name}
+	for i := 0; i < len(names); i++ {
+		e.words = append(e.words, words(names[i], role)...)
+	}
+	return &e
+}
+
+// words splits s into normalized words
+func words(s string, role int) []word {
+	var m []word
+	for _, t := range tokenize(s) {
+		m = append(m, word{text: t, code: Soundex(t), role: role})
+	}
+	return m
+}
+
+// tokenize lowercases s and splits it on anything that is not a letter or
+// a digit.
+func tokenize(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsDigit(c)
+	})
+}
+
+// Search returns the entries that match query, best first.
+//
+// INPUTS
+//  query - the text to search for. Every word in the query must match
+//          some word of an entry.
+//  kind  - authz.ELEMPERSON, authz.ELEMCOMPANY, authz.ELEMCLASS, or 0 for all
+//  max   - maximum number of hits to return, 0 means no limit
+//
+// RETURNS
+//  the hits sorted by descending score, then name
+//-----------------------------------------------------------------------------
+func Search(query string, kind, max int) []Hit {
+	var m []Hit
+	q := tokenize(query)
+	if len(q) == 0 || !Index.initialized {
+		return m
+	}
+	codes := make([]string, len(q))
+	for i := 0; i < len(q); i++ {
+		codes[i] = Soundex(q[i])
+	}
+
+	Index.ReqMem <- 1 // ask to access the shared mem, blocks until granted
+	<-Index.ReqMemAck // make sure we got it
+	for k, entries := range Index.entries {
+		if kind != 0 && kind != k {
+			continue
+		}
+		for id, e := range entries {
+			if score := e.score(q, codes); score > 0 {
+				m = append(m, Hit{Kind: k, ID: id, Name: e.name, Title: e.title, Image: e.image,
+					Active: e.active, Employer: e.employer, CoCode: e.coCode, Score: score})
+			}
+		}
+	}
+	Index.ReqMemAck <- 1 // tell dispatcher we're done with the data
+
+	sort.Slice(m, func(i, j int) bool {
+		if m[i].Score != m[j].Score {
+			return m[i].Score > m[j].Score
+		}
+		if m[i].Name != m[j].Name {
+			return m[i].Name < m[j].Name
+		}
+		return m[i].ID < m[j].ID
+	})
+	if max > 0 && len(m) > max {
+		m = m[:max]
+	}
+	return m
+}
+
+// IDs returns the IDs of the supplied hits in order
+//-----------------------------------------------------------------------------
+func IDs(m []Hit) []int {
+	ids := make([]int, len(m))
+	for i := 0; i < len(m); i++ {
+		ids[i] = m[i].ID
+	}
+	return ids
+}
+
+// score returns the relevance of e for the query words q, whose soundex
+// codes are in codes. It returns 0 if any query word does not match.
+func (e *entry) score(q, codes []string) int {
+	total := 0
+	for i := 0; i < len(q); i++ {
+		best := 0
+		for j := 0; j < len(e.words); j++ {
+			if s := matchScore(q[i], codes[i], &e.words[j]); s > best {
+				best = s
+			}
+		}
+		if best == 0 {
+			return 0
+		}
+		total += best
+	}
+	return total
+}
+
+// matchScore returns the score for query word t, with soundex code, against w
+func matchScore(t, code string, w *word) int {
+	if t == w.text {
+		switch w.role {
+		case roleLast:
+			return SCORELASTNAME
+		case rolePreferred:
+			return SCOREPREFERREDNAME
+		}
+		return SCOREEXACT
+	}
+	if len(t) >= 2 && strings.HasPrefix(w.text, t) {
+		return SCOREPREFIX
+	}
+	if len(t) < 3 {
+		return 0
+	}
+	if code == w.code && len(code) > 0 {
+		return SCOREPHONETIC
+	}
+	maxd := 1
+	if len(t) > 5 {
+		maxd = 2
+	}
+	if d := Distance(t, w.text, maxd); d <= maxd {
+		return SCOREFUZZY - 5*d
+	}
+	return 0
+}
+
+// Soundex returns the American Soundex code for s, or "" if s has no
+// letters.
+//-----------------------------------------------------------------------------
+func Soundex(s string) string {
+	const codes = "01230120022455012623010202" // a..z
+	var b []byte
+	var last byte
+	for _, c := range strings.ToLower(s) {
+		if c < 'a' || c > 'z' {
+			continue
+		}
+		d := codes[c-'a']
+		if len(b) == 0 {
+			b = append(b, byte(unicode.ToUpper(c)))
+			last = d
+			continue
+		}
+		switch c {
+		case 'h', 'w': // do not separate letters with the same code
+			continue
+		}
+		if d != '0' && d != last {
+			b = append(b, d)
+		}
+		last = d
+		if len(b) == 4 {
+			break
+		}
+	}
+	if len(b) == 0 {
+		return ""
+	}
+	return (string(b) + "000")[:4]
+}
+
+// Distance returns the Levenshtein distance between a and b. Once the
+// distance is known to exceed max, max+1 is returned.
+//-----------------------------------------------------------------------------
+func Distance(a, b string, max int) int {
+	ra, rb := []rune(a), []rune(b)
+	if d := len(ra) - len(rb); d > max || -d > max {
+		return max + 1
+	}
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := 0; j <= len(rb); j++ {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		rowmin := cur[0]
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if cur[j] < rowmin {
+				rowmin = cur[j]
+			}
+		}
+		if rowmin > max {
+			return max + 1
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
@@ -0,0 +1,135 @@
+package idx
+
+import (
+	"phonebook/authz"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+var testInit sync.Once
+
+// useTestEntries replaces the index with the supplied people and companies
+// without reading the database
+func useTestEntries(people, companies map[int]*entry) {
+	testInit.Do(func() {
+		Index.ReqMem = make(chan int)
+		Index.ReqMemAck = make(chan int)
+		Index.entries = map[int]map[int]*entry{}
+		go dispatcher()
+		Index.initialized = true
+	})
+	replaceKind(authz.ELEMPERSON, people)
+	replaceKind(authz.ELEMCOMPANY, companies)
+	replaceKind(authz.ELEMCLASS, map[int]*entry{})
+}
+
+func TestRanking(t *testing.T) {
+	useTestEntries(map[int]*entry{
+		1: personEntry("Bob", "", "Mansour", ""),         // exact last name
+		2: personEntry("Robert", "", "Smith", "Mansour"), // exact preferred name
+		3: personEntry("Mansour", "", "Jones", ""),       // exact first name
+		4: personEntry("Ali", "", "Mansouri", ""),        // prefix
+		5: personEntry("Ali", "", "Mansur", ""),          // sounds the same
+		6: personEntry("Ali", "", "Nansour", ""),         // one edit
+		7: personEntry("Ali", "", "Miller", ""),          // no match
+	}, map[int]*entry{
+		1: newEntry("Mansour Holdings", []string{"Mansour Holdings", "MH"}, roleOther),
+	})
+
+	m := Search("mansour", authz.ELEMPERSON, 0)
+	if got, want := IDs(m), []int{1, 2, 3, 4, 5, 6}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("Search returned %v, want %v", got, want)
+	}
+	scores := []int{SCORELASTNAME, SCOREPREFERREDNAME, SCOREEXACT, SCOREPREFIX, SCOREPHONETIC, SCOREFUZZY - 5}
+	for i := range m {
+		if m[i].Score != scores[i] {
+			t.Errorf("%s: score %d, want %d", m[i].Name, m[i].Score, scores[i])
+		}
+	}
+	if m[1].Name != "Mansour Smith" {
+		t.Errorf("the display name is %q, want the preferred name", m[1].Name)
+	}
+
+	if m = Search("MANSOUR", 0, 0); len(m) != 7 || m[0].Kind != authz.ELEMPERSON || m[0].ID != 1 {
+		t.Errorf("searching everything returned %+v", m)
+	}
+	if m = Search("mansour", authz.ELEMCOMPANY, 0); len(m) != 1 || m[0].Kind != authz.ELEMCOMPANY {
+		t.Errorf("searching companies returned %+v", m)
+	}
+	if m = Search("mansour", authz.ELEMPERSON, 2); !reflect.DeepEqual(IDs(m), []int{1, 2}) {
+		t.Errorf("Search with max 2 returned %v", IDs(m))
+	}
+	if m = Search("mansour bob", authz.ELEMPERSON, 0); !reflect.DeepEqual(IDs(m), []int{1}) {
+		t.Errorf("every word must match, got %v", IDs(m))
+	}
+	if m = Search(" - ", 0, 0); len(m) != 0 {
+		t.Errorf("a query with no words returned %v", IDs(m))
+	}
+}
+
+func TestMatchScore(t *testing.T) {
+	tests := []struct {
+		q    string
+		w    string
+		want int
+	}{
+		{"jon", "john", SCOREPHONETIC},
+		{"jo", "john", SCOREPREFIX},
+		{"j", "john", 0},
+		{"jo", "jane", 0},
+		{"jhon", "john", SCOREPHONETIC},
+		{"mansor", "mansour", SCOREPHONETIC},
+		{"katherine", "kathryn", SCOREPHONETIC},
+		{"catherine", "katherine", SCOREFUZZY - 5},
+		{"smiht", "smith", SCOREPHONETIC},
+		{"xyz", "abc", 0},
+	}
+	for _, tt := range tests {
+		w := words(tt.w, roleOther)[0]
+		if got := matchScore(tt.q, Soundex(tt.q), &w); got != tt.want {
+			t.Errorf("matchScore(%q, %q) = %d, want %d", tt.q, tt.w, got, tt.want)
+		}
+	}
+}
+
+func TestSoundex(t *testing.T) {
+	tests := []struct {
+		s, want string
+	}{
+		{"Robert", "R163"},
+		{"Rupert", "R163"},
+		{"Rubin", "R150"},
+		{"Ashcraft", "A261"},
+		{"Tymczak", "T522"},
+		{"Pfister", "P236"},
+		{"Lee", "L000"},
+		{"O'Hara", "O600"},
+		{"123", ""},
+	}
+	for _, tt := range tests {
+		if got := Soundex(tt.s); got != tt.want {
+			t.Errorf("Soundex(%q) = %q, want %q", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		max  int
+		want int
+	}{
+		{"kitten", "sitting", 3, 3},
+		{"kitten", "sitting", 2, 3},
+		{"same", "same", 1, 0},
+		{"", "abc", 5, 3},
+		{"a", "abcd", 1, 2},
+		{"josé", "jose", 1, 1},
+	}
+	for _, tt := range tests {
+		if got := Distance(tt.a, tt.b, tt.max); got != tt.want {
+			t.Errorf("Distance(%q, %q, %d) = %d, want %d", tt.a, tt.b, tt.max, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,320 @@
+// Package jwt issues and checks the signed tokens that authenticate hands
+// to other services. They are JSON Web Tokens signed with Ed25519 (alg
+// EdDSA) carrying the user's uid, username, role name and expiry.
+//
+// The signing keys are kept in the signingkeys table so that every
+// phonebook instance signs with the same key. When the newest key is
+// TokenKeyDays old a new one is made. Keys stay valid, and are published
+// by Keys, for another TokenKeyDays so tokens signed just before a change
+// can still be checked. Services that share phonebook's database check
+// tokens with Verify. Others read the key set from /v1/keys and check
+// tokens with JWKS.Verify, or with any JOSE library.
+package jwt
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"phonebook/db"
+	"phonebook/lib"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ALG is the JWS algorithm of the tokens
+	ALG = "EdDSA"
+
+	keyRefresh = 10 * time.Minute // how often the keys are reread, to pick up ones made by other instances
+	keyRetry   = time.Minute      // least time between rereads caused by an unknown key id
+)
+
+// Claims are the contents of a token
+type Claims struct {
+	Issuer   string `json:"iss"`      // BaseURL of the phonebook that issued the token
+	Subject  string `json:"sub"`      // uid, as a string
+	UID      int64  `json:"uid"`      // uid of the user
+	UserName string `json:"username"` // username of the user
+	Role     string `json:"role"`     // name of the user's role
+	IssuedAt int64  `json:"iat"`      // unix time the token was issued
+	Expire   int64  `json:"exp"`      // unix time the token expires
+}
+
+// JWK is the public half of a signing key in JSON Web Key format
+type JWK struct {
+	Kty string `json:"kty"` // always OKP
+	Crv string `json:"crv"` // always Ed25519
+	X   string `json:"x"`   // base64url public key
+	Kid string `json:"kid"` // key id
+	Alg string `json:"alg"` // always EdDSA
+	Use string `json:"use"` // always sig
+}
+
+// JWKS is a JSON Web Key Set, the response of /v1/keys
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
+
+var keys struct {
+	sync.Mutex
+	list   []db.SigningKey // newest first
+	loaded time.Time       // when list was read
+}
+
+// Issuer returns the iss claim of the tokens this phonebook issues
+//-----------------------------------------------------------------------------
+func Issuer() string {
+	return strings.TrimRight(lib.PBConfig.BaseURL, "/")
+}
+
+// keyLife returns how long a key is used for signing
+func keyLife() time.Duration {
+	return time.Duration(lib.PBConfig.TokenKeyDays) * 24 * time.Hour
+}
+
+// load rereads the keys if they were read more than keyRefresh ago, or if
+// force is set. If there is no key, or the newest one is too old to sign
+// with, a new one is made. The caller must hold the keys lock.
+func load(force bool) error {
+	now := time.Now()
+	if !force && len(keys.list) > 0 && now.Sub(keys.loaded) < keyRefresh {
+		return nil
+	}
+	list, err := db.GetSigningKeys(now.Add(-2 * keyLife()))
+	if err != nil {
+		return err
+	}
+	if len(list) == 0 || now.Sub(list[0].Created) >= keyLife() {
+		k, err := newKey(now)
+		if err != nil {
+			return err
+		}
+		list = append([]db.SigningKey{k}, list...)
+		lib.Ulog("jwt: made new signing key %s\n", k.KID)
+	}
+	keys.list = list
+	keys.loaded = now
+	return nil
+}
+
+// newKey makes and saves a new signing key
+func newKey(now time.Time) (db.SigningKey, error) {
+	var k db.SigningKey
+	id := make([]byte, 12)
+	if _, err := rand.Read(id); err != nil {
+		return k, err
+	}
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return k, err
+	}
+	k.KID = base64.RawURLEncoding.EncodeToString(id)
+	k.Seed = priv.Seed()
+	k.Created = now
+	return k, db.InsertSigningKey(&k)
+}
+
+// find returns the key with the supplied id. If it is not known the keys
+// are reread, at most once every keyRetry, in case another instance made it.
+func find(kid string) (db.SigningKey, bool, error) {
+	keys.Lock()
+	defer keys.Unlock()
+	if err := load(false); err != nil {
+		return db.SigningKey{}, false, err
+	}
+	for pass := 0; pass < 2; pass++ {
+		for i := 0; i < len(keys.list); i++ {
+			if keys.list[i].KID == kid {
+				return keys.list[i], true, nil
+			}
+		}
+		if pass > 0 || time.Since(keys.loaded) < keyRetry {
+			break
+		}
+		if err := load(true); err != nil {
+			return db.SigningKey{}, false, err
+		}
+	}
+	return db.SigningKey{}, false, nil
+}
+
+// encode returns the base64url encoding of v as json
+func encode(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// New returns a signed token for the supplied user
+//
+// INPUTS
+//  uid      - uid of the user
+//  username - username of the user
+//  role     - name of the user's role
+//  expire   - when the token expires, normally when the user's session does
+//
+// RETURNS
+//  token    - the signed token
+//  err      - any error encountered
+//-----------------------------------------------------------------------------
+func New(uid int64, username, role string, expire time.Time) (string, error) {
+	c := Claims{
+		Issuer:   Issuer(),
+		Subject:  strconv.FormatInt(uid, 10),
+		UID:      uid,
+		UserName: username,
+		Role:     role,
+		IssuedAt: time.Now().Unix(),
+		Expire:   expire.Unix(),
+	}
+	return Sign(&c)
+}
+
+// Sign returns the token for the supplied claims, signed with the newest key
+//-----------------------------------------------------------------------------
+func Sign(c *Claims) (string, error) {
+	keys.Lock()
+	err := load(false)
+	var k db.SigningKey
+	if err == nil {
+		k = keys.list[0]
+	}
+	keys.Unlock()
+	if err != nil {
+		return "", fmt.Errorf("jwt: loading signing keys: %s", err.Error())
+	}
+	h, err := encode(header{Alg: ALG, Typ: "JWT", Kid: k.KID})
+	if err != nil {
+		return "", err
+	}
+	p, err := encode(c)
+	if err != nil {
+		return "", err
+	}
+	sig := ed25519.Sign(ed25519.NewKeyFromSeed(k.Seed), []byte(h+"."+p))
+	return h + "." + p + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// Verify checks the signature, issuer and expiry of the supplied token and
+// returns its claims. It is for services that share phonebook's database.
+//-----------------------------------------------------------------------------
+func Verify(token string) (Claims, error) {
+	return verify(token, Issuer(), func(kid string) (ed25519.PublicKey, error) {
+		k, ok, err := find(kid)
+		if err != nil {
+			return nil, fmt.Errorf("jwt: loading signing keys: %s", err.Error())
+		}
+		if !ok {
+			return nil, fmt.Errorf("jwt: unknown key %q", kid)
+		}
+		return ed25519.NewKeyFromSeed(k.Seed).Public().(ed25519.PublicKey), nil
+	})
+}
+
+// Verify checks the signature, issuer and expiry of the supplied token with
+// the keys in ks and returns its claims. It is for services that read the
+// key set from /v1/keys. issuer is the BaseURL of the phonebook that issued
+// the token, without a trailing slash.
+//-----------------------------------------------------------------------------
+func (ks *JWKS) Verify(token, issuer string) (Claims, error) {
+	return verify(token, issuer, ks.key)
+}
+
+// key returns the public key with the supplied id
+func (ks *JWKS) key(kid string) (ed25519.PublicKey, error) {
+	for i := 0; i < len(ks.Keys); i++ {
+		k := ks.Keys[i]
+		if k.Kid != kid {
+			continue
+		}
+		if k.Kty != "OKP" || k.Crv != "Ed25519" || (len(k.Alg) > 0 && k.Alg != ALG) {
+			return nil, fmt.Errorf("jwt: key %q is not an %s key", kid, ALG)
+		}
+		b, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(b) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("jwt: malformed key %q", kid)
+		}
+		return ed25519.PublicKey(b), nil
+	}
+	return nil, fmt.Errorf("jwt: unknown key %q", kid)
+}
+
+// verify checks token with the public key that key returns for its key id
+func verify(token, issuer string, key func(kid string) (ed25519.PublicKey, error)) (Claims, error) {
+	var c Claims
+	var h header
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return c, fmt.Errorf("jwt: malformed token")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return c, fmt.Errorf("jwt: malformed header")
+	}
+	if err = json.Unmarshal(b, &h); err != nil {
+		return c, fmt.Errorf("jwt: malformed header")
+	}
+	if h.Alg != ALG {
+		return c, fmt.Errorf("jwt: unsupported alg %q", h.Alg)
+	}
+	pub, err := key(h.Kid)
+	if err != nil {
+		return c, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return c, fmt.Errorf("jwt: malformed signature")
+	}
+	if !ed25519.Verify(pub, []byte(parts[0]+"."+parts[1]), sig) {
+		return c, fmt.Errorf("jwt: bad signature")
+	}
+	if b, err = base64.RawURLEncoding.DecodeString(parts[1]); err != nil {
+		return c, fmt.Errorf("jwt: malformed claims")
+	}
+	if err = json.Unmarshal(b, &c); err != nil {
+		return c, fmt.Errorf("jwt: malformed claims")
+	}
+	if c.Issuer != issuer {
+		return c, fmt.Errorf("jwt: token issued by %q", c.Issuer)
+	}
+	if time.Now().Unix() >= c.Expire {
+		return c, fmt.Errorf("jwt: token expired")
+	}
+	return c, nil
+}
+
+// Keys returns the public halves of the keys that tokens may be signed
+// with, newest first.
+//-----------------------------------------------------------------------------
+func Keys() (JWKS, error) {
+	ks := JWKS{Keys: []JWK{}}
+	keys.Lock()
+	defer keys.Unlock()
+	if err := load(false); err != nil {
+		return ks, err
+	}
+	for i := 0; i < len(keys.list); i++ {
+		pub := ed25519.NewKeyFromSeed(keys.list[i].Seed).Public().(ed25519.PublicKey)
+		ks.Keys = append(ks.Keys, JWK{
+			Kty: "OKP",
+			Crv: "Ed25519",
+			X:   base64.RawURLEncoding.EncodeToString(pub),
+			Kid: keys.list[i].KID,
+			Alg: ALG,
+			Use: "sig",
+		})
+	}
+	return ks, nil
+}
@@ -0,0 +1,173 @@
+package jwt
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"phonebook/db"
+	"phonebook/lib"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testIssuer = "https://phonebook.example.com"
+
+// testKey returns a signing key with a fixed seed made from b
+func testKey(kid string, b byte) db.SigningKey {
+	seed := make([]byte, ed25519.SeedSize)
+	for i := range seed {
+		seed[i] = b
+	}
+	return db.SigningKey{KID: kid, Seed: seed, Created: time.Now()}
+}
+
+// useTestKeys makes Sign and Verify use the supplied keys without reading
+// the signingkeys table
+func useTestKeys(list ...db.SigningKey) {
+	lib.PBConfig.BaseURL = testIssuer + "/"
+	keys.Lock()
+	keys.list = list
+	keys.loaded = time.Now()
+	keys.Unlock()
+}
+
+// signWith returns a token with the supplied header and claims signed by k
+func signWith(t *testing.T, k db.SigningKey, h header, c *Claims) string {
+	hs, err := encode(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps, err := encode(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := ed25519.Sign(ed25519.NewKeyFromSeed(k.Seed), []byte(hs+"."+ps))
+	return hs + "." + ps + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func testClaims(expire time.Time) *Claims {
+	return &Claims{Issuer: testIssuer, Subject: "42", UID: 42, UserName: "jdoe", Role: "Viewer",
+		IssuedAt: time.Now().Unix(), Expire: expire.Unix()}
+}
+
+func TestRoundTrip(t *testing.T) {
+	useTestKeys(testKey("new", 1), testKey("old", 2))
+	tok, err := New(42, "jdoe", "Viewer", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	c, err := Verify(tok)
+	if err != nil {
+		t.Fatalf("Verify: %s", err)
+	}
+	if c.UID != 42 || c.Subject != "42" || c.UserName != "jdoe" || c.Role != "Viewer" || c.Issuer != testIssuer {
+		t.Errorf("Verify returned %+v", c)
+	}
+
+	ks, err := Keys()
+	if err != nil {
+		t.Fatalf("Keys: %s", err)
+	}
+	if len(ks.Keys) != 2 || ks.Keys[0].Kid != "new" {
+		t.Fatalf("Keys returned %+v, want new then old", ks.Keys)
+	}
+	if c, err = ks.Verify(tok, testIssuer); err != nil || c.UID != 42 {
+		t.Errorf("JWKS.Verify = %+v, %v", c, err)
+	}
+
+	old := signWith(t, testKey("old", 2), header{Alg: ALG, Typ: "JWT", Kid: "old"}, testClaims(time.Now().Add(time.Hour)))
+	if _, err = Verify(old); err != nil {
+		t.Errorf("a token signed with the older key was refused: %s", err)
+	}
+}
+
+func TestVerifyRefuses(t *testing.T) {
+	k := testKey("new", 1)
+	useTestKeys(k)
+	hdr := header{Alg: ALG, Typ: "JWT", Kid: "new"}
+	good := testClaims(time.Now().Add(time.Hour))
+	valid := signWith(t, k, hdr, good)
+	parts := strings.Split(valid, ".")
+
+	// the HS256 confusion: an HMAC keyed with the public key
+	pub := ed25519.NewKeyFromSeed(k.Seed).Public().(ed25519.PublicKey)
+	hs, _ := encode(header{Alg: "HS256", Typ: "JWT", Kid: "new"})
+	m := hmac.New(sha256.New, pub)
+	m.Write([]byte(hs + "." + parts[1]))
+	hmacTok := hs + "." + parts[1] + "." + base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+
+	none, _ := encode(header{Alg: "none", Typ: "JWT"})
+	other := *good
+	other.UID = 1
+	otherClaims, _ := encode(&other)
+	wrongIssuer := *good
+	wrongIssuer.Issuer = "https://evil.example.com"
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"expired", signWith(t, k, hdr, testClaims(time.Now().Add(-time.Second)))},
+		{"wrong key", signWith(t, testKey("new", 3), hdr, good)},
+		{"unknown key id", signWith(t, testKey("gone", 4), header{Alg: ALG, Typ: "JWT", Kid: "gone"}, good)},
+		{"alg none", none + "." + parts[1] + "."},
+		{"alg HS256", hmacTok},
+		{"changed claims", parts[0] + "." + otherClaims + "." + parts[2]},
+		{"wrong issuer", signWith(t, k, hdr, &wrongIssuer)},
+		{"two parts", parts[0] + "." + parts[1]},
+		{"bad header", "!!." + parts[1] + "." + parts[2]},
+		{"bad signature encoding", parts[0] + "." + parts[1] + ".!!"},
+		{"empty", ""},
+	}
+	ks, err := Keys()
+	if err != nil {
+		t.Fatalf("Keys: %s", err)
+	}
+	for _, tt := range tests {
+		if c, err := Verify(tt.token); err == nil {
+			t.Errorf("%s: Verify accepted the token, claims %+v", tt.name, c)
+		}
+		if c, err := ks.Verify(tt.token, testIssuer); err == nil {
+			t.Errorf("%s: JWKS.Verify accepted the token, claims %+v", tt.name, c)
+		}
+	}
+	if _, err := Verify(valid); err != nil {
+		t.Errorf("the untouched token was refused: %s", err)
+	}
+}
+
+func TestKeySetRefuses(t *testing.T) {
+	k := testKey("new", 1)
+	useTestKeys(k)
+	tok := signWith(t, k, header{Alg: ALG, Typ: "JWT", Kid: "new"}, testClaims(time.Now().Add(time.Hour)))
+	ks, err := Keys()
+	if err != nil {
+		t.Fatalf("Keys: %s", err)
+	}
+	good := ks.Keys[0]
+	bad := func(f func(j *JWK)) JWKS {
+		j := good
+		f(&j)
+		return JWKS{Keys: []JWK{j}}
+	}
+	tests := []struct {
+		name string
+		ks   JWKS
+	}{
+		{"no keys", JWKS{}},
+		{"other curve", bad(func(j *JWK) { j.Crv = "X25519" })},
+		{"other key type", bad(func(j *JWK) { j.Kty = "EC" })},
+		{"other alg", bad(func(j *JWK) { j.Alg = "ES256" })},
+		{"short key", bad(func(j *JWK) { j.X = j.X[:10] })},
+	}
+	for _, tt := range tests {
+		if _, err := tt.ks.Verify(tok, testIssuer); err == nil {
+			t.Errorf("%s: the token was accepted", tt.name)
+		}
+	}
+	if _, err := ks.Verify(tok, testIssuer+"/"); err == nil {
+		t.Errorf("a token was accepted for another issuer")
+	}
+}
@@ -4,8 +4,12 @@ import (
 	"encoding/json"
 	"extres"
 	"fmt"
+	"html"
 	"io/ioutil"
+	"net/url"
 	"os"
+	"phonebook/pwhash"
+	"strings"
 
 	"gopkg.in/gomail.v2"
 )
@@ -33,6 +37,103 @@ import (
 //=======================================================================================
 var AppConfig extres.ExternalResources
 
+// PhonebookConfig holds the settings in config.json that are specific to
+// phonebook and are not part of extres.ExternalResources. Settings missing
+// from config.json keep their defaults.
+//=======================================================================================
+type PhonebookConfig struct {
+	PasswordHash   string `json:"PasswordHash"`   // scheme for new password hashes: bcrypt (default) or argon2id
+	BaseURL        string `json:"BaseURL"`        // URL users reach phonebook at, used for links in emails
+	PWResetMinutes int    `json:"PWResetMinutes"` // how long a password reset link stays valid
+	SessionBindIP  bool   `json:"SessionBindIP"`  // only accept a session cookie from the IP address that signed in
+	SessionBindUA  bool   `json:"SessionBindUA"`  // only accept a session cookie from the user agent that signed in
+
+	TrustedProxies []string `json:"TrustedProxies"` // addresses or CIDR ranges of reverse proxies whose X-Forwarded-For is believed
+
+	LoginFreeFailures   int `json:"LoginFreeFailures"`   // failed sign ins for a username before each attempt must wait
+	LoginMaxFailures    int `json:"LoginMaxFailures"`    // failed sign ins that lock a username out
+	LoginMaxIPFailures  int `json:"LoginMaxIPFailures"`  // failed sign ins that lock an IP address out
+	LoginLockoutMinutes int `json:"LoginLockoutMinutes"` // how long failures are remembered and lockouts last
+
+	PWResetMaxRequests   int `json:"PWResetMaxRequests"`   // password reset requests for a username per LoginLockoutMinutes
+	PWResetMaxIPRequests int `json:"PWResetMaxIPRequests"` // password reset requests from an IP address per LoginLockoutMinutes
+
+	TwoFactorIssuer     string   `json:"TwoFactorIssuer"`     // service name shown in authenticator apps
+	TwoFactorPrivileged bool     `json:"TwoFactorPrivileged"` // roles with privileged permissions must use two-step sign in
+	TwoFactorRoles      []string `json:"TwoFactorRoles"`      // names of other roles that must use two-step sign in
+	TwoFactorMinutes    int      `json:"TwoFactorMinutes"`    // how long after the password the second step must be completed
+
+	TokenKeyDays       int `json:"TokenKeyDays"`       // days a key signs the tokens from authenticate before a new key is made
+	ReloadCheckSeconds int `json:"ReloadCheckSeconds"` // how often to look for roles and lookup lists changed by other instances
+	ManagerDepth       int `json:"ManagerDepth"`       // levels of the MgrUID chain above a person who are its managers of record, 0 for none
+
+	AuthProvider   string     `json:"AuthProvider"`   // how passwords are checked: local (default) or ldap
+	AuthLocalUsers []string   `json:"AuthLocalUsers"` // usernames that always use local passwords, such as service accounts
+	LDAP           LDAPConfig `json:"LDAP"`           // directory server used when AuthProvider is ldap
+	OIDC           OIDCConfig `json:"OIDC"`           // OpenID Connect provider for single sign-on
+}
+
+// OIDCConfig describes the OpenID Connect provider users can sign in with
+// from the sign in page. Single sign-on is off unless Issuer is set. The
+// email address in the ID token is matched to people.PrimaryEmail. If
+// that finds no one and the address is in one of UserNameDomains, the part
+// before the @ is matched to people.UserName.
+//=======================================================================================
+type OIDCConfig struct {
+	Issuer          string   `json:"Issuer"`          // issuer URL, the provider's settings are discovered from it
+	ClientID        string   `json:"ClientID"`        // client id registered with the provider
+	ClientSecret    string   `json:"ClientSecret"`    // client secret, empty for a public client
+	RedirectURL     string   `json:"RedirectURL"`     // defaults to BaseURL/oidc/callback/
+	Scopes          []string `json:"Scopes"`          // scopes to request besides openid, default email
+	ButtonText      string   `json:"ButtonText"`      // text of the link on the sign in page
+	UserNameDomains []string `json:"UserNameDomains"` // email domains whose addresses may be matched by username
+	AllowUnverified bool     `json:"AllowUnverified"` // accept emails the provider says are not verified
+}
+
+// LDAPConfig describes the directory server that checks passwords when
+// AuthProvider is ldap. Users are found either by putting the username
+// into BindDN, or, if UserFilter is set, by searching under BaseDN,
+// optionally after binding as SearchDN. Either way the username is the
+// one in the people table.
+//=======================================================================================
+type LDAPConfig struct {
+	URL        string `json:"URL"`        // ldap://host:389 or ldaps://host:636
+	StartTLS   bool   `json:"StartTLS"`   // upgrade an ldap:// connection with StartTLS
+	BindDN     string `json:"BindDN"`     // DN of a user with %s for the username, e.g. uid=%s,ou=people,dc=example,dc=com
+	BaseDN     string `json:"BaseDN"`     // where to search for users when UserFilter is set
+	UserFilter string `json:"UserFilter"` // search filter with %s for the username, e.g. (&(objectClass=person)(uid=%s))
+	SearchDN   string `json:"SearchDN"`   // DN to bind as for the search, anonymous if empty
+	SearchPass string `json:"SearchPass"` // password for SearchDN
+	Timeout    int    `json:"Timeout"`    // seconds to wait for the server
+}
+
+// PBConfig is the shared struct of phonebook specific configuration values
+//=======================================================================================
+var PBConfig = PhonebookConfig{
+	BaseURL:        "https://directory.airoller.com",
+	PWResetMinutes: 60,
+
+	LoginFreeFailures:   3,
+	LoginMaxFailures:    10,
+	LoginMaxIPFailures:  50,
+	LoginLockoutMinutes: 15,
+
+	PWResetMaxRequests:   3,
+	PWResetMaxIPRequests: 10,
+
+	TwoFactorIssuer:     "Accord Directory",
+	TwoFactorPrivileged: true,
+	TwoFactorMinutes:    5,
+
+	TokenKeyDays:       30,
+	ReloadCheckSeconds: 30,
+	ManagerDepth:       1,
+
+	AuthProvider: "local",
+	LDAP:         LDAPConfig{Timeout: 10},
+	OIDC:         OIDCConfig{Scopes: []string{"email"}, ButtonText: "Sign in with your company account"},
+}
+
 // ReadConfig will read the configuration file "config.json" if
 // it exists in the current directory
 //=======================================================================================
@@ -42,7 +143,9 @@ func ReadConfig() {
 		content, err := ioutil.ReadFile(fname)
 		Errcheck(err)
 		Errcheck(json.Unmarshal(content, &AppConfig))
+		Errcheck(json.Unmarshal(content, &PBConfig))
 	}
+	Errcheck(pwhash.SetDefault(PBConfig.PasswordHash))
 }
 
 // GetSQLOpenString builds the string to use for opening an sql database.
@@ -71,3 +174,21 @@ func SMTPDialAndSend(m *gomail.Message) error {
 	d := gomail.NewDialer(AppConfig.SMTPHost, AppConfig.SMTPPort, AppConfig.SMTPLogin, AppConfig.SMTPPass)
 	return d.DialAndSend(m)
 }
+
+// SendPWResetEmail emails the link to the page where username can choose a
+// new password. token is the password reset token that goes in the link.
+//=======================================================================================
+func SendPWResetEmail(addr, username, token string) error {
+	link := fmt.Sprintf("%s/setpw/?token=%s", strings.TrimRight(PBConfig.BaseURL, "/"), url.QueryEscape(token))
+	m := gomail.NewMessage()
+	m.SetHeader("From", "sman@accordinterests.com")
+	m.SetHeader("To", addr)
+	msg := fmt.Sprintf("Hello %s,<br><br>We received a request to reset your Accord password. ", html.EscapeString(username))
+	msg += fmt.Sprintf(`To choose a new password, please go to <a href="%s">%s</a><br><br>`, link, link)
+	msg += fmt.Sprintf("This link can only be used once and it expires in %d minutes. ", PBConfig.PWResetMinutes)
+	msg += "Your current password keeps working until you choose a new one. "
+	msg += "If you did not ask to reset your password you can ignore this email."
+	m.SetHeader("Subject", "Reset your Accord password")
+	m.SetBody("text/html", msg)
+	return SMTPDialAndSend(m)
+}
@@ -1,12 +1,12 @@
 package lib
 
 import (
-	"crypto/sha512"
 	"database/sql"
 	"extres"
 	"fmt"
 	"log"
 	"math/rand"
+	"phonebook/pwhash"
 	"runtime/debug"
 	"strconv"
 	"strings"
@@ -61,9 +61,12 @@ func RandPasswordStringRunes(n int) string {
 }
 
 // UpdateUserPassword sets the supplied user's password to the supplied password.
+// The password is hashed with the default pwhash scheme.
 func UpdateUserPassword(user, password string, db *sql.DB) error {
-	sha := sha512.Sum512([]byte(password))
-	passhash := fmt.Sprintf("%x", sha)
+	passhash, err := pwhash.Hash(password)
+	if nil != err {
+		return err
+	}
 	update, err := db.Prepare("UPDATE people SET passhash=? WHERE UserName=?")
 	if nil != err {
 		return err
@@ -2,6 +2,7 @@ package main
 
 import (
 	"net/http"
+	"phonebook/db"
 	"phonebook/sess"
 	"time"
 )
@@ -26,7 +27,11 @@ func logoffHandler(w http.ResponseWriter, r *http.Request) {
 	if nil != cookie && err == nil {
 		ssn, ok = sess.SessionGet(cookie.Value)
 		if ok {
+			sess.LogSecEvent(r, sess.SessionEvent(ssn, db.SECSIGNOUT, 0, "", ""))
 			sess.SessionDelete(ssn)
+		} else if err = db.DeleteSessionCookie(cookie.Value); err != nil {
+			// signed in through another instance, only the table has it
+			ulog("logoffHandler: db.DeleteSessionCookie: %s\n", err.Error())
 		}
 		// force the cookie to expire
 		cookie.Expires = time.Date(1970, time.January, 1, 0, 0, 0, 0, time.UTC)
@@ -0,0 +1,172 @@
+// lookup.js - type-ahead support for phonebook input fields. It uses the
+// /v1/lookup service to show the best matching people, companies, or
+// classes as the user types.
+//
+// pbLookup(id, opts) attaches the type-ahead list to the input with the
+// supplied id. opts may contain:
+//     type     - "person", "company", or "class". All types if omitted.
+//     target   - id of an input that receives the id (UID, CoCode, or
+//                ClassCode) of the selected item
+//     go       - if true, selecting an item opens its page
+//     employer - if true, only companies that employ personnel are listed
+//     inactive - if true, inactive people and companies are listed
+//     max      - maximum number of items to list, default 10
+//-----------------------------------------------------------------------------
+function pbLookup(id, opts) {
+    "use strict";
+    var input = document.getElementById(id);
+    if (!input) {
+        return;
+    }
+    opts = opts || {};
+    var list = document.createElement("div");
+    var items = [];
+    var current = -1;
+    var timer = null;
+    var lastQuery = "";
+
+    list.className = "lookup";
+    list.style.display = "none";
+    input.setAttribute("autocomplete", "off");
+    input.parentNode.insertBefore(list, input.nextSibling);
+
+    function hide() {
+        list.style.display = "none";
+        current = -1;
+    }
+
+    function highlight(n) {
+        var rows = list.childNodes;
+        for (var i = 0; i < rows.length; i++) {
+            rows[i].className = (i === n) ? "lookupItem lookupCurrent" : "lookupItem";
+        }
+        current = n;
+    }
+
+    function pick(n) {
+        var item = items[n];
+        if (!item) {
+            return;
+        }
+        hide();
+        if (opts.go) {
+            window.location.href = item.url;
+            return;
+        }
+        input.value = item.name;
+        lastQuery = item.name;
+        if (opts.target) {
+            var t = document.getElementById(opts.target);
+            if (t) {
+                t.value = item.id;
+            }
+        }
+    }
+
+    function show(records) {
+        items = records || [];
+        while (list.firstChild) {
+            list.removeChild(list.firstChild);
+        }
+        if (items.length === 0) {
+            hide();
+            return;
+        }
+        items.forEach(function(item, i) {
+            var row = document.createElement("div");
+            row.className = "lookupItem";
+            if (item.imageURL) {
+                var img = document.createElement("img");
+                img.src = item.imageURL;
+                img.className = "profile-image lookupImage";
+                row.appendChild(img);
+            }
+            var name = document.createElement("span");
+            name.className = "lookupName";
+            name.textContent = item.name;
+            row.appendChild(name);
+            if (item.title) {
+                var title = document.createElement("span");
+                title.className = "lookupTitle";
+                title.textContent = item.title;
+                row.appendChild(title);
+            }
+            row.addEventListener("mousedown", function(e) {
+                e.preventDefault(); // keep the focus in the input
+                pick(i);
+            });
+            list.appendChild(row);
+        });
+        list.style.left = input.offsetLeft + "px";
+        list.style.top = (input.offsetTop + input.offsetHeight) + "px";
+        list.style.minWidth = input.offsetWidth + "px";
+        list.style.display = "block";
+        current = -1;
+    }
+
+    function fetch() {
+        var q = input.value.trim();
+        if (q === lastQuery) {
+            return;
+        }
+        lastQuery = q;
+        if (q.length === 0) {
+            show([]);
+            return;
+        }
+        var url = "/v1/lookup/?q=" + encodeURIComponent(q) + "&max=" + (opts.max || 10);
+        if (opts.type) {
+            url += "&type=" + encodeURIComponent(opts.type);
+        }
+        if (opts.employer) {
+            url += "&employer=1";
+        }
+        if (opts.inactive) {
+            url += "&inactive=1";
+        }
+        var req = new XMLHttpRequest();
+        req.open("GET", url);
+        req.onload = function() {
+            if (req.status !== 200 || q !== lastQuery) {
+                return; // a newer request is on its way
+            }
+            try {
+                var resp = JSON.parse(req.responseText);
+                show(resp.status === "success" ? resp.records : []);
+            } catch (e) {
+                show([]);
+            }
+        };
+        req.send();
+    }
+
+    input.addEventListener("input", function() {
+        clearTimeout(timer);
+        timer = setTimeout(fetch, 150);
+    });
+    input.addEventListener("keydown", function(e) {
+        if (list.style.display === "none") {
+            return;
+        }
+        switch (e.key) {
+            case "ArrowDown":
+                highlight(Math.min(current + 1, items.length - 1));
+                e.preventDefault();
+                break;
+            case "ArrowUp":
+                highlight(Math.max(current - 1, 0));
+                e.preventDefault();
+                break;
+            case "Enter":
+                if (current >= 0) {
+                    pick(current);
+                    e.preventDefault();
+                }
+                break;
+            case "Escape":
+                hide();
+                break;
+        }
+    });
+    input.addEventListener("blur", hide);
+}
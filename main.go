@@ -12,8 +12,10 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"phonebook/authn"
 	"phonebook/authz"
 	"phonebook/db"
+	"phonebook/idx"
 	"phonebook/lib"
 	"phonebook/sess"
 	"phonebook/ws"
@@ -110,6 +112,13 @@ var adminScreenFields = []dataFields{
 type searchResults struct {
 	Query   string
 	Matches []db.Person
+	Filter  db.PeopleSearch   // filters, sort order and page used to produce Matches
+	Total   int64             // total number of people matching Filter
+	First   int               // 1-based index of the first match on this page
+	Last    int               // 1-based index of the last match on this page
+	PrevURL string            // link to the previous page, empty if this is the first page
+	NextURL string            // link to the next page, empty if this is the last page
+	SortURL map[string]string // links to sort the results by each column
 }
 
 type searchCoResults struct {
@@ -122,9 +131,37 @@ type searchClassResults struct {
 	Matches []db.Class
 }
 
+type searchAllResults struct {
+	Query          string
+	People         []db.Person
+	PeopleTotal    int
+	Companies      []db.Company
+	CompaniesTotal int
+	Classes        []db.Class
+	ClassesTotal   int
+}
+
+type pwReset struct {
+	Token   string // reset token from the emailed link
+	Minutes int    // how long reset links stay valid
+	Done    bool   // true once the new password has been set
+}
+
+type twoFactor struct {
+	Token    string       // login challenge token, on the second step of sign in
+	Secret   string       // TOTP secret being enrolled
+	URI      template.URL // otpauth URI for Secret, for authenticator apps
+	Enabled  bool         // true if the user signs in with a second step
+	Required bool         // true if the user's role requires a second step
+	Codes    []string     // new recovery codes, shown only once
+	Left     int          // number of unused recovery codes
+}
+
 type signin struct {
-	ErrNo  int    // 0 = no error, otherwise signin error
-	ErrMsg string // err message string for user
+	ErrNo   int    // 0 = no error, otherwise signin error
+	ErrMsg  string // err message string for user
+	SSO     bool   // true if single sign-on is configured
+	SSOText string // text of the single sign-on link
 }
 
 //--------------------------------------------------------------------
@@ -150,6 +187,15 @@ type uiSupport struct {
 	S                *signin
 	T                *searchCoResults
 	L                *searchClassResults
+	G                *searchAllResults
+	P                *pwReset
+	Y                *db.LoginLock // failed sign ins of the person on the adminView page
+	F                *twoFactor
+	Q                *apiKeys     // the API keys admin page
+	Z                *roleAdmin   // the roles admin pages
+	E                *permExplain // the permission explain page
+	H                *historyPage // the change history page
+	V                *secEvents   // the security events admin page
 	X                *sess.Session
 	K                *UsageCounters
 	Ki               *UsageCounters
@@ -167,36 +213,16 @@ type PrepSQL struct {
 	getComps           *sql.Stmt // compensations associated with a user
 	myDeductions       *sql.Stmt // deductions for a specific user
 	adminPersonDetails *sql.Stmt // for AdminView and AdminEdit
-	classInfo          *sql.Stmt // get db.Class attributes
-	companyInfo        *sql.Stmt // company attributes
 	countersUpdate     *sql.Stmt // feature usage counters update
-	delClass           *sql.Stmt // deletes a db.Class
 	delCompany         *sql.Stmt // deletes a company
-	delPerson          *sql.Stmt // deletes a person
-	delPersonComp      *sql.Stmt // part of delperson
-	delPersonDeduct    *sql.Stmt // part of delperson
 	getJobTitle        *sql.Stmt // title associated with a job code
 	nameFromUID        *sql.Stmt // name lookup
 	deptName           *sql.Stmt // name from DeptCode
 	directReports      *sql.Stmt // folks who report to an individual
 	personDetail       *sql.Stmt // get a bunch of user attributes
-	adminInsertPerson  *sql.Stmt // insert a new person
-	adminReadBack      *sql.Stmt // read back newly inserted person
-	adminUpdatePerson  *sql.Stmt // admin update person
-	insertComp         *sql.Stmt // part of admin update person
-	insertDeduct       *sql.Stmt // part of admin update person
-	insertClass        *sql.Stmt // adding a new db.Class
-	classReadBack      *sql.Stmt // read back newly written db.Class
-	updateClass        *sql.Stmt // update a db.Class
-	insertCompany      *sql.Stmt // insert a new company
-	companyReadback    *sql.Stmt // read back newly written company
-	updateCompany      *sql.Stmt // update a company
-	updateMyDetails    *sql.Stmt // person updating their own details
+	personReviews      *sql.Stmt // last and next review dates, for managers of record
 	updatePasswd       *sql.Stmt // person updating their passwd
-	readFieldPerms     *sql.Stmt // read field permissions
-	accessRoles        *sql.Stmt // read access roles
 	getUserCoCode      *sql.Stmt // read the cocode for a person
-	CompanyClasses     *sql.Stmt // read a list of classes that belong to a company
 	GetAllCompanies    *sql.Stmt // query to select all companies
 }
 
@@ -219,6 +245,7 @@ var Phonebook struct {
 	SessionTimeout     time.Duration // timeout in minutes
 	SessionCleanupTime time.Duration // time in minutes
 	CountersUpdateTime int           // time in minutes
+	AdminToken         string        // token local scripts send to /extAdminShutdown/
 }
 
 // UsageCounters defines the type of stats phonebook stores
@@ -337,6 +364,8 @@ func initUI() {
 // }
 
 func initUIData(u *uiSupport) {
+	uiListsLock.RLock()
+	defer uiListsLock.RUnlock()
 	u.Images = make(map[string]string, len(PhonebookUI.Images))
 	for k, v := range PhonebookUI.Images {
 		u.Images[k] = v
@@ -369,11 +398,12 @@ func initUIData(u *uiSupport) {
 	for i := 0; i < len(PhonebookUI.Months); i++ {
 		u.Months[i] = PhonebookUI.Months[i]
 	}
-	u.Roles = make([]authz.Role, len(authz.Authz.Roles))
-	for i := 0; i < len(authz.Authz.Roles); i++ {
+	roles := authz.GetRoles()
+	u.Roles = make([]authz.Role, len(roles))
+	for i := 0; i < len(roles); i++ {
 		u.Roles[i] = authz.Role{}
-		u.Roles[i].Name = authz.Authz.Roles[i].Name
-		u.Roles[i].RID = authz.Authz.Roles[i].RID
+		u.Roles[i].Name = roles[i].Name
+		u.Roles[i].RID = roles[i].RID
 	}
 	u.ErrMsg = ""
 }
@@ -389,45 +419,120 @@ func Dispatcher() {
 	}
 }
 
-func loadCompanies() {
-	PhonebookUI.CoCodeToName = make(map[int]string)
-	PhonebookUI.NameToCoCode = make(map[string]int)
-	PhonebookUI.CompanyList = PhonebookUI.CompanyList[:0] // empty it first
+// loadCompanies reads the companies into PhonebookUI. The maps are built
+// before they replace the old ones, so pages being rendered while another
+// instance's change is reloaded never see a partial list. If the companies
+// cannot be read the current lists are kept and the error is returned.
+func loadCompanies() error {
+	coCodeToName := make(map[int]string)
+	nameToCoCode := make(map[string]int)
+	var list []db.Company
 
 	rows, err := Phonebook.prepstmt.GetAllCompanies.Query()
-	errcheck(err)
+	if err != nil {
+		return err
+	}
 	defer rows.Close()
 	for rows.Next() {
 		var c db.Company
-		errcheck(rows.Scan(&c.CoCode, &c.LegalName, &c.CommonName, &c.Address, &c.Address2, &c.City, &c.State, &c.PostalCode, &c.Country, &c.Phone, &c.Fax, &c.Email, &c.Designation, &c.Active, &c.EmploysPersonnel))
-		PhonebookUI.CompanyList = append(PhonebookUI.CompanyList, c)
+		if err = rows.Scan(&c.CoCode, &c.LegalName, &c.CommonName, &c.Address, &c.Address2, &c.City, &c.State, &c.PostalCode, &c.Country, &c.Phone, &c.Fax, &c.Email, &c.Designation, &c.Active, &c.EmploysPersonnel); err != nil {
+			return err
+		}
+		list = append(list, c)
 		if c.EmploysPersonnel != 0 {
-			PhonebookUI.CoCodeToName[c.CoCode] = c.LegalName
-			PhonebookUI.NameToCoCode[c.LegalName] = c.CoCode
+			coCodeToName[c.CoCode] = c.LegalName
+			nameToCoCode[c.LegalName] = c.CoCode
 		}
 
 	}
-	errcheck(rows.Err())
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	uiListsLock.Lock()
+	PhonebookUI.CoCodeToName = coCodeToName
+	PhonebookUI.NameToCoCode = nameToCoCode
+	PhonebookUI.CompanyList = list
+	uiListsLock.Unlock()
+	idx.Errlog("loadCompanies", idx.ReloadCompanies())
+	return nil
 }
 
-func loadClasses() {
+// loadClasses reads the classes into PhonebookUI. If they cannot be read the
+// current lists are kept and the error is returned.
+func loadClasses() error {
 	var code int
 	var name string
 
-	PhonebookUI.NameToClassCode = make(map[string]int)
-	PhonebookUI.ClassCodeToName = make(map[int]string)
+	nameToClassCode := make(map[string]int)
+	classCodeToName := make(map[int]string)
 	rows, err := Phonebook.db.Query("select classcode,designation from classes")
-	errcheck(err)
+	if err != nil {
+		return err
+	}
 	defer rows.Close()
 	for rows.Next() {
-		errcheck(rows.Scan(&code, &name))
-		PhonebookUI.NameToClassCode[name] = code
-		PhonebookUI.ClassCodeToName[code] = name
+		if err = rows.Scan(&code, &name); err != nil {
+			return err
+		}
+		nameToClassCode[name] = code
+		classCodeToName[code] = name
 	}
 	// for k, v := range Phonebook.NameToClassCode {
 	// 	fmt.Printf("%s %d\n", k, v)
 	// }
-	errcheck(rows.Err())
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	uiListsLock.Lock()
+	PhonebookUI.NameToClassCode = nameToClassCode
+	PhonebookUI.ClassCodeToName = classCodeToName
+	uiListsLock.Unlock()
+	idx.Errlog("loadClasses", idx.ReloadClasses())
+	return nil
+}
+
+// loadLookups reads the job titles and departments into PhonebookUI. If they
+// cannot be read the current lists are kept and the error is returned.
+func loadLookups() error {
+	var code int
+	var name string
+
+	nameToJobCode := make(map[string]int)
+	rows, err := Phonebook.db.Query("select jobcode,title from jobtitles")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err = rows.Scan(&code, &name); err != nil {
+			return err
+		}
+		nameToJobCode[name] = code
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	nameToDeptCode := make(map[string]int)
+	rows, err = Phonebook.db.Query("select deptcode,name from departments order by name")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err = rows.Scan(&code, &name); err != nil {
+			return err
+		}
+		nameToDeptCode[name] = code
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	uiListsLock.Lock()
+	PhonebookUI.NameToJobCode = nameToJobCode
+	PhonebookUI.NameToDeptCode = nameToDeptCode
+	uiListsLock.Unlock()
+	return nil
 }
 
 func getVer() string {
@@ -438,9 +543,6 @@ func getBTime() string {
 }
 
 func loadMaps() {
-	var code int
-	var name string
-
 	funcMap = template.FuncMap{
 		"compToString":         compensationTypeToString,
 		"acceptIntToString":    acceptIntToString,
@@ -454,6 +556,9 @@ func loadMaps() {
 		"div":                  div,
 		"smrand":               smrand,
 		"hasFieldAccess":       hasFieldAccess,
+		"localPassword":        authn.LocalPassword,
+		"roleName":             authz.RoleName,
+		"permString":           authz.PermString,
 		"hasPERMMODaccess":     hasPERMMODaccess,
 		"hasAdminScreenAccess": hasAdminScreenAccess,
 		"showAdminButton":      showAdminButton,
@@ -465,28 +570,7 @@ func loadMaps() {
 		"GetVersionNo":         getVer,
 		"GetBuildTime":         getBTime,
 	}
-	loadCompanies()
-	loadClasses()
-
-	PhonebookUI.NameToJobCode = make(map[string]int)
-	rows, err := Phonebook.db.Query("select jobcode,title from jobtitles")
-	errcheck(err)
-	defer rows.Close()
-	for rows.Next() {
-		errcheck(rows.Scan(&code, &name))
-		PhonebookUI.NameToJobCode[name] = code
-	}
-	errcheck(rows.Err())
-
-	PhonebookUI.NameToDeptCode = make(map[string]int)
-	rows, err = Phonebook.db.Query("select deptcode,name from departments order by name")
-	errcheck(err)
-	defer rows.Close()
-	for rows.Next() {
-		errcheck(rows.Scan(&code, &name))
-		PhonebookUI.NameToDeptCode[name] = code
-	}
-	errcheck(rows.Err())
+	errcheck(reloadMaps())
 
 	PhonebookUI.AcceptCodeToName = make(map[int]string)
 	for i := ACPTUNKNOWN; i <= ACPTLAST; i++ {
@@ -529,38 +613,50 @@ func initHTTP() {
 	http.HandleFunc("/adminEditClass/", adminEditClassHandler)
 	http.HandleFunc("/adminEditCo/", adminEditCompanyHandler)
 	http.HandleFunc("/adminView/", adminViewHandler)
-	http.HandleFunc("/adminViewBtn/", adminViewBtnHandler)
-	http.HandleFunc("/become/", adminBecomeHandler)
+	http.HandleFunc("/adminViewBtn/", csrfPOST(adminViewBtnHandler))
+	http.HandleFunc("/apikeys/", csrfForm(apikeysHandler))
+	http.HandleFunc("/become/", csrfPOST(adminBecomeHandler))
 	http.HandleFunc("/class/", classHandler)
 	http.HandleFunc("/company/", companyHandler)
-	http.HandleFunc("/delClass/", delClassHandler)
+	http.HandleFunc("/delClass/", csrfPOST(delClassHandler))
 	http.HandleFunc("/delClassRefErr/", delClassRefErr)
-	http.HandleFunc("/delCompany/", delCoHandler)
+	http.HandleFunc("/delCompany/", csrfPOST(delCoHandler))
 	http.HandleFunc("/delCoRefErr/", delCoRefErr)
-	http.HandleFunc("/delPerson/", delPersonHandler)
+	http.HandleFunc("/delPerson/", csrfPOST(delPersonHandler))
 	http.HandleFunc("/delPersonRefErr/", delPersonRefErrHandler)
 	http.HandleFunc("/detail/", detailHandler)
 	http.HandleFunc("/detailpop/", detailpopHandler)
 	http.HandleFunc("/editDetail/", editDetailHandler)
+	http.HandleFunc("/explain/", permExplainHandler)
 	http.HandleFunc("/extAdminShutdown/", extAdminShutdown)
 	http.HandleFunc("/help/", helpHandler)
+	http.HandleFunc("/history/", historyHandler)
 	http.HandleFunc("/inactivatePerson/", inactivatePersonHandler)
 	http.HandleFunc("/logoff/", logoffHandler)
+	http.HandleFunc("/oidc/callback/", oidcCallbackHandler)
+	http.HandleFunc("/oidc/login/", oidcLoginHandler)
 	http.HandleFunc("/pop/", popHandler)
 	http.HandleFunc("/resetpw/", resetpwHandler)
-	http.HandleFunc("/restart/", restartHandler)
-	http.HandleFunc("/saveAdminEdit/", saveAdminEditHandler)
-	http.HandleFunc("/saveAdminEditClass/", saveAdminEditClassHandler)
-	http.HandleFunc("/saveAdminEditCo/", saveAdminEditCoHandler)
-	http.HandleFunc("/savePersonDetails/", savePersonDetailsHandler)
-	http.HandleFunc("/saveSetup/", saveSetupHandler)
+	http.HandleFunc("/restart/", csrfPOST(restartHandler))
+	http.HandleFunc("/role/", csrfForm(roleHandler))
+	http.HandleFunc("/roles/", csrfForm(rolesHandler))
+	http.HandleFunc("/saveAdminEdit/", csrfPOST(saveAdminEditHandler))
+	http.HandleFunc("/saveAdminEditClass/", csrfPOST(saveAdminEditClassHandler))
+	http.HandleFunc("/saveAdminEditCo/", csrfPOST(saveAdminEditCoHandler))
+	http.HandleFunc("/savePersonDetails/", csrfPOST(savePersonDetailsHandler))
+	http.HandleFunc("/saveSetup/", csrfPOST(saveSetupHandler))
 	http.HandleFunc("/search/", searchHandler)
+	http.HandleFunc("/searchall/", searchAllHandler)
 	http.HandleFunc("/searchcl/", searchClassHandler)
 	http.HandleFunc("/searchco/", searchCompaniesHandler)
+	http.HandleFunc("/secevents/", secEventsHandler)
+	http.HandleFunc("/setpw/", setpwHandler)
 	http.HandleFunc("/setup/", setupHandler)
-	http.HandleFunc("/shutdown/", shutdownHandler)
+	http.HandleFunc("/shutdown/", csrfPOST(shutdownHandler))
 	http.HandleFunc("/signin/", signinHandler)
+	http.HandleFunc("/signin2fa/", signin2faHandler)
 	http.HandleFunc("/status/", statusHandler)
+	http.HandleFunc("/twofactor/", csrfForm(twofactorHandler))
 	http.HandleFunc("/stats/", statsHandler)
 	http.HandleFunc("/weblogin/", webloginHandler)
 	http.HandleFunc("/v1/", ws.V1ServiceHandler)
@@ -631,6 +727,10 @@ func main() {
 	// Phonebook.db = db.DB.DirDB
 	// buildPreparedStatements()
 	lib.ReadConfig()
+	lib.Errcheck(authn.Init())
+	if err = writeAdminToken(); err != nil {
+		ulog("Could not write %s, activate.sh will not be able to stop phonebook: %s\n", adminTokenFile, err.Error())
+	}
 	dbopenparms := lib.GetSQLOpenString(Phonebook.DBUser, Phonebook.DBName)
 	pbdb, err := sql.Open("mysql", dbopenparms)
 	lib.Errcheck(err)
@@ -652,7 +752,9 @@ func main() {
 	//==============================================
 	// Load some of the database info...
 	//==============================================
+	initReload()
 	loadMaps()
+	lib.Errcheck(idx.Init(Phonebook.db))
 	readAccessRoles()
 	if Phonebook.Debug {
 		dumpAccessRoles()
@@ -669,6 +771,8 @@ func main() {
 
 	initHTTP()
 	ws.InitServices(Phonebook.db)
+	ws.SetReloadHandlers(companiesChanged, classesChanged)
+	go reloadWatcher()
 
 	ulog("Phonebook initiating HTTP service on port %d\n", Phonebook.Port)
 	err = http.ListenAndServe(fmt.Sprintf(":%d", Phonebook.Port), nil)
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"net/http"
+	"phonebook/db"
+	"phonebook/lib"
+	"phonebook/sess"
+	"phonebook/sso"
+	"strings"
+	"time"
+)
+
+// oidcCookieName is the cookie that holds the sso.Login values while the
+// browser is at the OpenID Connect provider
+const oidcCookieName = "airsso"
+
+// oidcCookie returns the cookie holding l. A nil l clears the cookie. It is
+// sent with the provider's redirect back to us, so it must be SameSite Lax.
+func oidcCookie(l *sso.Login) *http.Cookie {
+	c := http.Cookie{
+		Name:     oidcCookieName,
+		Path:     "/oidc/",
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(lib.PBConfig.BaseURL, "https:"),
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   -1,
+	}
+	if l != nil {
+		c.Value = l.State + "." + l.Nonce + "." + l.Verifier
+		c.MaxAge = int((10 * time.Minute) / time.Second)
+	}
+	return &c
+}
+
+// oidcLoginHandler starts single sign-on. It sends the browser to the
+// OpenID Connect provider.
+//-----------------------------------------------------------------------------
+func oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if !sso.Enabled() {
+		http.Redirect(w, r, "/signin/", http.StatusFound)
+		return
+	}
+	l, err := sso.NewLogin()
+	if err != nil {
+		ulog("oidcLoginHandler: sso.NewLogin: %s\n", err.Error())
+		http.Redirect(w, r, "/signin/5", http.StatusFound)
+		return
+	}
+	u, err := sso.AuthURL(r.Context(), &l)
+	if err != nil {
+		ulog("oidcLoginHandler: sso.AuthURL: %s\n", err.Error())
+		http.Redirect(w, r, "/signin/5", http.StatusFound)
+		return
+	}
+	http.SetCookie(w, oidcCookie(&l))
+	http.Redirect(w, r, u, http.StatusFound)
+}
+
+// oidcUserName returns the username of the person with the supplied email
+// address, or "" if there is none. See OIDCConfig.
+func oidcUserName(email string) (string, error) {
+	email = strings.ToLower(email)
+	username, err := db.GetUserNameByEmail(email)
+	if err != nil || len(username) > 0 {
+		return username, err
+	}
+	k := strings.LastIndex(email, "@")
+	if k <= 0 {
+		return "", nil
+	}
+	for i := 0; i < len(lib.PBConfig.OIDC.UserNameDomains); i++ {
+		if strings.ToLower(lib.PBConfig.OIDC.UserNameDomains[i]) == email[k+1:] {
+			return email[:k], nil
+		}
+	}
+	return "", nil
+}
+
+// oidcCallbackHandler is where the OpenID Connect provider sends the
+// browser back with a code. The state must match the cookie set by
+// oidcLoginHandler. The email address in the ID token picks the person,
+// who then gets a session the same way as after a password, including the
+// second step if they need one.
+//-----------------------------------------------------------------------------
+func oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(oidcCookieName)
+	http.SetCookie(w, oidcCookie(nil)) // each login value is used once
+	if !sso.Enabled() || err != nil {
+		http.Redirect(w, r, "/signin/", http.StatusFound)
+		return
+	}
+	if e := r.FormValue("error"); len(e) > 0 {
+		ulog("oidcCallbackHandler: provider returned error %s: %s\n", e, r.FormValue("error_description"))
+		http.Redirect(w, r, "/signin/5", http.StatusFound)
+		return
+	}
+	v := strings.Split(cookie.Value, ".")
+	state := r.FormValue("state")
+	if len(v) != 3 || len(state) == 0 || subtle.ConstantTimeCompare([]byte(v[0]), []byte(state)) != 1 {
+		ulog("oidcCallbackHandler: state does not match\n")
+		sess.LogSecEvent(r, db.SecEvent{Type: db.SECSIGNINFAILED, Detail: "single sign-on state does not match"})
+		http.Redirect(w, r, "/signin/5", http.StatusFound)
+		return
+	}
+	l := sso.Login{State: v[0], Nonce: v[1], Verifier: v[2]}
+
+	Phonebook.ReqCountersMem <- 1    // ask to access the shared mem, blocks until granted
+	<-Phonebook.ReqCountersMemAck    // make sure we got it
+	Counters.SignIn++                // initialize our data
+	Phonebook.ReqCountersMemAck <- 1 // tell Dispatcher we're done with the data
+
+	claims, err := sso.Exchange(r.Context(), r.FormValue("code"), &l)
+	if err != nil {
+		ulog("oidcCallbackHandler: %s\n", err.Error())
+		sess.LogSecEvent(r, db.SecEvent{Type: db.SECSIGNINFAILED, Detail: "single sign-on: " + err.Error()})
+		http.Redirect(w, r, "/signin/5", http.StatusFound)
+		return
+	}
+	myusername, err := oidcUserName(claims.Email)
+	if err != nil {
+		ulog("oidcCallbackHandler: looking up %s: %s\n", claims.Email, err.Error())
+		http.Redirect(w, r, "/signin/2", http.StatusFound)
+		return
+	}
+
+	var firstname, preferredname, email, passhash string
+	var uid, RID int
+	err = db.PrepStmts.LoginInfo.QueryRow(myusername).Scan(&uid, &firstname, &preferredname, &email, &passhash, &RID)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			ulog("oidcCallbackHandler: login username: %s,  error = %v\n", myusername, err)
+			http.Redirect(w, r, "/signin/2", http.StatusFound)
+			return
+		}
+		ulog("oidcCallbackHandler: no person matches %s (subject %s)\n", claims.Email, claims.Subject)
+		sess.LogSecEvent(r, db.SecEvent{Type: db.SECSIGNINFAILED, ActorName: claims.Email, Detail: "single sign-on, no person matches subject " + claims.Subject})
+		http.Redirect(w, r, "/signin/6", http.StatusFound)
+		return
+	}
+
+	need, err := db.TwoFactorNeeded(int64(uid), RID)
+	if err != nil {
+		ulog("oidcCallbackHandler: db.TwoFactorNeeded: %s\n", err.Error())
+		http.Redirect(w, r, "/signin/2", http.StatusFound)
+		return
+	}
+	if need {
+		startSecondStep(w, r, int64(uid), myusername)
+		return
+	}
+
+	ulog("user %s logged in with single sign-on as %s\n", myusername, claims.Email)
+	sess.LogSecEvent(r, db.SecEvent{Type: db.SECSIGNIN, Actor: int64(uid), ActorName: myusername, Detail: "single sign-on as " + claims.Email})
+	if err = db.LoginSucceeded(myusername); err != nil {
+		ulog("oidcCallbackHandler: db.LoginSucceeded: %s\n", err.Error())
+	}
+	name := firstname
+	if len(preferredname) > 0 {
+		name = preferredname
+	}
+	startWebSession(w, r, uid, myusername, name, RID)
+	http.Redirect(w, r, "/search/", http.StatusFound)
+}
@@ -0,0 +1,125 @@
+// Package pwhash hashes and verifies passwords. Each scheme is a Hasher.
+// New passwords are hashed with the default hasher (bcrypt unless changed
+// with SetDefault). Verify recognizes the scheme of a stored hash, so users
+// whose passwords were hashed with an older scheme, including the original
+// unsalted SHA-512 hex digests, can still sign in. Verify reports when a
+// stored hash should be replaced, and the caller then stores a new hash of
+// the password the user just supplied.
+package pwhash
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Hasher is implemented by each password hashing scheme
+type Hasher interface {
+	// Hash returns the encoded hash of password, including its salt and
+	// parameters.
+	Hash(password string) (string, error)
+
+	// Recognizes returns true if hash was produced by this scheme
+	Recognizes(hash string) bool
+
+	// Verify returns true if password matches hash
+	Verify(password, hash string) bool
+
+	// NeedsRehash returns true if hash was produced by this scheme with
+	// parameters weaker than the current ones.
+	NeedsRehash(hash string) bool
+}
+
+var hashers = map[string]Hasher{}
+var dflt Hasher
+var dfltName string
+
+func init() {
+	Register("sha512", legacySHA512{})
+	Register("bcrypt", &Bcrypt{Cost: BCRYPTCOST})
+	Register("argon2id", &Argon2id{Time: ARGON2TIME, Memory: ARGON2MEMORY, Threads: ARGON2THREADS})
+	if err := SetDefault("bcrypt"); err != nil {
+		panic(err)
+	}
+}
+
+// Register adds a hasher under the supplied name, replacing any hasher
+// already registered with that name.
+//-----------------------------------------------------------------------------
+func Register(name string, h Hasher) {
+	hashers[name] = h
+}
+
+// Names returns the names of the registered hashers
+//-----------------------------------------------------------------------------
+func Names() []string {
+	var m []string
+	for k := range hashers {
+		m = append(m, k)
+	}
+	sort.Strings(m)
+	return m
+}
+
+// SetDefault selects the hasher used for new passwords. An empty name
+// keeps the current default. The legacy sha512 scheme cannot be the
+// default.
+//-----------------------------------------------------------------------------
+func SetDefault(name string) error {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if len(name) == 0 {
+		return nil
+	}
+	h, ok := hashers[name]
+	if !ok || name == "sha512" {
+		return fmt.Errorf("unknown password hash scheme: %s (use one of %s)", name, strings.Join(Names(), ", "))
+	}
+	dflt = h
+	dfltName = name
+	return nil
+}
+
+// Default returns the name of the hasher used for new passwords
+//-----------------------------------------------------------------------------
+func Default() string {
+	return dfltName
+}
+
+// Hash returns the hash of password using the default hasher. Store the
+// result as is, it includes everything Verify needs.
+//-----------------------------------------------------------------------------
+func Hash(password string) (string, error) {
+	return dflt.Hash(password)
+}
+
+// Verify checks password against a stored hash.
+//
+// INPUTS
+//  password - the password supplied by the user
+//  hash     - the stored hash
+//
+// RETURNS
+//  ok     - true if the password matches
+//  rehash - true if the password matches and the stored hash should be
+//           replaced with Hash(password)
+//-----------------------------------------------------------------------------
+func Verify(password, hash string) (ok, rehash bool) {
+	hash = strings.TrimSpace(hash)
+	for _, h := range hashers {
+		if !h.Recognizes(hash) {
+			continue
+		}
+		if !h.Verify(password, hash) {
+			return false, false
+		}
+		return true, h != dflt || h.NeedsRehash(hash)
+	}
+
+	//---------------------------------------------------------------
+	// Unknown or missing hash, for example an unknown user. Spend
+	// about the same time as a real check so that the response time
+	// does not reveal which user names exist.
+	//---------------------------------------------------------------
+	dflt.Hash(password)
+	return false, false
+}
@@ -0,0 +1,128 @@
+package pwhash
+
+import (
+	"crypto/sha512"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testArgon2 uses small parameters so the tests run quickly
+var testArgon2 = &Argon2id{Time: 1, Memory: 64, Threads: 1}
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		h    Hasher
+	}{
+		{"bcrypt", &Bcrypt{Cost: bcrypt.MinCost}},
+		{"argon2id", testArgon2},
+	}
+	for _, tt := range tests {
+		hash, err := tt.h.Hash("correct horse")
+		if err != nil {
+			t.Fatalf("%s: Hash: %s", tt.name, err)
+		}
+		if !tt.h.Recognizes(hash) {
+			t.Errorf("%s: does not recognize its own hash %q", tt.name, hash)
+		}
+		if !tt.h.Verify("correct horse", hash) {
+			t.Errorf("%s: the password does not verify", tt.name)
+		}
+		if tt.h.Verify("correct horse ", hash) {
+			t.Errorf("%s: a different password verifies", tt.name)
+		}
+		if tt.h.NeedsRehash(hash) {
+			t.Errorf("%s: a new hash needs a rehash", tt.name)
+		}
+		again, _ := tt.h.Hash("correct horse")
+		if again == hash {
+			t.Errorf("%s: two hashes of the same password are the same, the salt is missing", tt.name)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	sha := sha512.Sum512([]byte("secret"))
+	legacy := hex.EncodeToString(sha[:])
+	weak, err := (&Bcrypt{Cost: bcrypt.MinCost}).Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	argon, err := testArgon2.Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		password   string
+		hash       string
+		ok, rehash bool
+	}{
+		{"legacy sha512", "secret", legacy, true, true},
+		{"legacy sha512 upper case", "secret", strings.ToUpper(legacy), true, true},
+		{"legacy sha512 wrong password", "Secret", legacy, false, false},
+		{"bcrypt below the default cost", "secret", weak, true, true},
+		{"bcrypt wrong password", "secret!", weak, false, false},
+		{"argon2id when bcrypt is the default", "secret", argon, true, true},
+		{"empty hash", "secret", "", false, false},
+		{"unknown scheme", "secret", "$1$abc$def", false, false},
+	}
+	for _, tt := range tests {
+		ok, rehash := Verify(tt.password, tt.hash)
+		if ok != tt.ok || rehash != tt.rehash {
+			t.Errorf("%s: Verify = %v, %v, want %v, %v", tt.name, ok, rehash, tt.ok, tt.rehash)
+		}
+	}
+}
+
+func TestMalformedArgon2(t *testing.T) {
+	const salt = "c29tZXNhbHRzb21lc2FsdA"                     // 16 bytes
+	const key = "a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2U" // 32 bytes
+	tests := []struct {
+		name string
+		hash string
+	}{
+		{"no threads", "$argon2id$v=19$m=64,t=1,p=0$" + salt + "$" + key},
+		{"no passes", "$argon2id$v=19$m=64,t=0,p=1$" + salt + "$" + key},
+		{"too many passes", "$argon2id$v=19$m=64,t=100000,p=1$" + salt + "$" + key},
+		{"too much memory", "$argon2id$v=19$m=4294967295,t=1,p=1$" + salt + "$" + key},
+		{"too little memory", "$argon2id$v=19$m=1,t=1,p=4$" + salt + "$" + key},
+		{"threads overflow", "$argon2id$v=19$m=64,t=1,p=300$" + salt + "$" + key},
+		{"wrong version", "$argon2id$v=16$m=64,t=1,p=1$" + salt + "$" + key},
+		{"missing field", "$argon2id$v=19$m=64,t=1,p=1$" + salt},
+		{"bad salt", "$argon2id$v=19$m=64,t=1,p=1$!!!$" + key},
+		{"short salt", "$argon2id$v=19$m=64,t=1,p=1$c2FsdA$" + key},
+		{"no key", "$argon2id$v=19$m=64,t=1,p=1$" + salt + "$"},
+		{"short key", "$argon2id$v=19$m=64,t=1,p=1$" + salt + "$a2V5"},
+	}
+	for _, tt := range tests {
+		if _, err := decodeArgon2(tt.hash); err == nil {
+			t.Errorf("%s: decodeArgon2 accepted %q", tt.name, tt.hash)
+		}
+		if ok, _ := Verify("secret", tt.hash); ok {
+			t.Errorf("%s: Verify accepted %q", tt.name, tt.hash)
+		}
+		if !testArgon2.NeedsRehash(tt.hash) {
+			t.Errorf("%s: NeedsRehash is false for %q", tt.name, tt.hash)
+		}
+	}
+}
+
+func TestSetDefault(t *testing.T) {
+	defer SetDefault("bcrypt")
+	if err := SetDefault("sha512"); err == nil {
+		t.Errorf("the legacy sha512 scheme was accepted as the default")
+	}
+	if err := SetDefault("nosuch"); err == nil {
+		t.Errorf("an unknown scheme was accepted as the default")
+	}
+	if err := SetDefault(" Argon2id "); err != nil || Default() != "argon2id" {
+		t.Errorf("SetDefault(argon2id) = %v, Default() = %s", err, Default())
+	}
+	if err := SetDefault(""); err != nil || Default() != "argon2id" {
+		t.Errorf("SetDefault(\"\") changed the default to %s, err = %v", Default(), err)
+	}
+}
@@ -0,0 +1,185 @@
+package pwhash
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Default parameters for new hashes
+const (
+	BCRYPTCOST    = 12        // bcrypt work factor
+	ARGON2TIME    = 1         // argon2id passes over memory
+	ARGON2MEMORY  = 64 * 1024 // argon2id memory in KiB
+	ARGON2THREADS = 4         // argon2id parallelism
+	ARGON2SALTLEN = 16        // bytes of random salt
+	ARGON2KEYLEN  = 32        // bytes of hash output
+)
+
+// Limits on the parameters read from a stored argon2id hash. A hash outside
+// them is treated as malformed rather than passed to argon2, which panics on
+// some values and would spend any amount of time or memory on others.
+const (
+	ARGON2MAXTIME   = 64          // most passes over memory
+	ARGON2MAXMEMORY = 1024 * 1024 // most memory in KiB
+	ARGON2MINSALT   = 8           // fewest bytes of salt
+	ARGON2MINKEY    = 16          // fewest bytes of hash output
+	ARGON2MAXKEY    = 64          // most bytes of hash output
+)
+
+//-----------------------------------------------------------------------------
+//  bcrypt
+//-----------------------------------------------------------------------------
+
+// Bcrypt hashes passwords with bcrypt. Its hashes begin with $2a$, $2b$,
+// or $2y$.
+type Bcrypt struct {
+	Cost int
+}
+
+// Hash implements Hasher
+func (b *Bcrypt) Hash(password string) (string, error) {
+	h, err := bcrypt.GenerateFromPassword([]byte(password), b.Cost)
+	return string(h), err
+}
+
+// Recognizes implements Hasher
+func (b *Bcrypt) Recognizes(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+// Verify implements Hasher
+func (b *Bcrypt) Verify(password, hash string) bool {
+	return nil == bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+}
+
+// NeedsRehash implements Hasher
+func (b *Bcrypt) NeedsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost < b.Cost
+}
+
+//-----------------------------------------------------------------------------
+//  argon2id
+//-----------------------------------------------------------------------------
+
+// Argon2id hashes passwords with argon2id. Its hashes use the standard
+// encoding: $argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<salt>$<hash>
+// with unpadded base64 salt and hash.
+type Argon2id struct {
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+}
+
+// argon2Params holds the values decoded from an argon2id hash
+type argon2Params struct {
+	time    uint32
+	memory  uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+// Hash implements Hasher
+func (a *Argon2id) Hash(password string) (string, error) {
+	salt := make([]byte, ARGON2SALTLEN)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, a.Time, a.Memory, a.Threads, ARGON2KEYLEN)
+	b64 := base64.RawStdEncoding
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, a.Memory, a.Time, a.Threads, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+}
+
+// Recognizes implements Hasher
+func (a *Argon2id) Recognizes(hash string) bool {
+	return strings.HasPrefix(hash, "$argon2id$")
+}
+
+func decodeArgon2(hash string) (argon2Params, error) {
+	var p argon2Params
+	var version int
+	f := strings.Split(hash, "$")
+	if len(f) != 6 || f[1] != "argon2id" {
+		return p, fmt.Errorf("invalid argon2id hash")
+	}
+	if _, err := fmt.Sscanf(f[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return p, fmt.Errorf("unsupported argon2id version")
+	}
+	if _, err := fmt.Sscanf(f[3], "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads); err != nil {
+		return p, err
+	}
+	if p.threads < 1 || p.time < 1 || p.time > ARGON2MAXTIME || p.memory < 8*uint32(p.threads) || p.memory > ARGON2MAXMEMORY {
+		return p, fmt.Errorf("invalid argon2id parameters")
+	}
+	var err error
+	if p.salt, err = base64.RawStdEncoding.DecodeString(f[4]); err != nil {
+		return p, err
+	}
+	if p.key, err = base64.RawStdEncoding.DecodeString(f[5]); err != nil {
+		return p, err
+	}
+	if len(p.salt) < ARGON2MINSALT || len(p.key) < ARGON2MINKEY || len(p.key) > ARGON2MAXKEY {
+		return p, fmt.Errorf("invalid argon2id salt or hash length")
+	}
+	return p, nil
+}
+
+// Verify implements Hasher
+func (a *Argon2id) Verify(password, hash string) bool {
+	p, err := decodeArgon2(hash)
+	if err != nil {
+		return false
+	}
+	key := argon2.IDKey([]byte(password), p.salt, p.time, p.memory, p.threads, uint32(len(p.key)))
+	return 1 == subtle.ConstantTimeCompare(key, p.key)
+}
+
+// NeedsRehash implements Hasher
+func (a *Argon2id) NeedsRehash(hash string) bool {
+	p, err := decodeArgon2(hash)
+	return err != nil || p.time < a.Time || p.memory < a.Memory || p.threads < a.Threads || len(p.key) < ARGON2KEYLEN
+}
+
+//-----------------------------------------------------------------------------
+//  legacy SHA-512
+//-----------------------------------------------------------------------------
+
+// legacySHA512 verifies the unsalted SHA-512 hex digests that phonebook
+// originally stored. It is only used to verify; every match is rehashed.
+type legacySHA512 struct{}
+
+// Hash implements Hasher
+func (legacySHA512) Hash(password string) (string, error) {
+	sha := sha512.Sum512([]byte(password))
+	return hex.EncodeToString(sha[:]), nil
+}
+
+// Recognizes implements Hasher
+func (legacySHA512) Recognizes(hash string) bool {
+	if len(hash) != 2*sha512.Size {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
+
+// Verify implements Hasher
+func (l legacySHA512) Verify(password, hash string) bool {
+	h, _ := l.Hash(password)
+	return 1 == subtle.ConstantTimeCompare([]byte(h), []byte(strings.ToLower(hash)))
+}
+
+// NeedsRehash implements Hasher
+func (legacySHA512) NeedsRehash(hash string) bool {
+	return true
+}
@@ -0,0 +1,176 @@
+// Package qb is a small query builder that produces placeholder based
+// SQL along with the argument list to pass to Query, QueryRow, or Exec.
+// Column and table names are supplied by the code, never by the user.
+// Every value is passed as an argument so that user input cannot change
+// the structure of the query.
+package qb
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Cond is a condition for a WHERE clause. Conditions are combined with
+// And and Or.
+type Cond struct {
+	sql  string        // the sql for this condition with ? placeholders
+	args []interface{} // the values for the placeholders
+}
+
+// SQL returns the condition's sql and arguments
+func (c *Cond) SQL() (string, []interface{}) {
+	if c == nil {
+		return "", nil
+	}
+	return c.sql, c.args
+}
+
+// Empty returns true if the condition has no sql
+func (c *Cond) Empty() bool {
+	return c == nil || len(c.sql) == 0
+}
+
+// Raw returns a condition with the supplied sql and arguments. The number
+// of ? placeholders in s must match the number of arguments.
+func Raw(s string, args ...interface{}) *Cond {
+	return &Cond{sql: s, args: args}
+}
+
+func cmp(col, op string, v interface{}) *Cond {
+	return &Cond{sql: col + op + "?", args: []interface{}{v}}
+}
+
+// Eq returns the condition col = v
+func Eq(col string, v interface{}) *Cond { return cmp(col, "=", v) }
+
+// Ne returns the condition col <> v
+func Ne(col string, v interface{}) *Cond { return cmp(col, "<>", v) }
+
+// Gt returns the condition col > v
+func Gt(col string, v interface{}) *Cond { return cmp(col, ">", v) }
+
+// Ge returns the condition col >= v
+func Ge(col string, v interface{}) *Cond { return cmp(col, ">=", v) }
+
+// Lt returns the condition col < v
+func Lt(col string, v interface{}) *Cond { return cmp(col, "<", v) }
+
+// Le returns the condition col <= v
+func Le(col string, v interface{}) *Cond { return cmp(col, "<=", v) }
+
+// Like returns the condition col LIKE pattern. The pattern is used as is,
+// any wildcards in it are honored.
+func Like(col, pattern string) *Cond { return cmp(col, " LIKE ", pattern) }
+
+// Contains returns a LIKE condition that matches col values containing s
+func Contains(col, s string) *Cond { return Like(col, "%"+EscapeLike(s)+"%") }
+
+// BeginsWith returns a LIKE condition that matches col values starting with s
+func BeginsWith(col, s string) *Cond { return Like(col, EscapeLike(s)+"%") }
+
+// EndsWith returns a LIKE condition that matches col values ending with s
+func EndsWith(col, s string) *Cond { return Like(col, "%"+EscapeLike(s)) }
+
+// EscapeLike escapes the LIKE wildcard characters in s so that they
+// match literally.
+func EscapeLike(s string) string {
+	return strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_").Replace(s)
+}
+
+// InInts returns the condition col IN (v0,v1,...). If the list is empty
+// the condition is always false.
+func InInts(col string, v []int) *Cond {
+	if len(v) == 0 {
+		return &Cond{sql: "1=0"}
+	}
+	c := Cond{sql: col + " IN (" + strings.TrimSuffix(strings.Repeat("?,", len(v)), ",") + ")"}
+	for i := 0; i < len(v); i++ {
+		c.args = append(c.args, v[i])
+	}
+	return &c
+}
+
+func join(op string, conds []*Cond) *Cond {
+	var parts []string
+	var c Cond
+	for i := 0; i < len(conds); i++ {
+		if conds[i].Empty() {
+			continue
+		}
+		parts = append(parts, conds[i].sql)
+		c.args = append(c.args, conds[i].args...)
+	}
+	switch len(parts) {
+	case 0:
+		return &c
+	case 1:
+		c.sql = parts[0]
+	default:
+		c.sql = "(" + strings.Join(parts, op) + ")"
+	}
+	return &c
+}
+
+// And combines the supplied conditions with AND. Empty conditions are
+// ignored.
+func And(conds ...*Cond) *Cond { return join(" AND ", conds) }
+
+// Or combines the supplied conditions with OR. Empty conditions are
+// ignored.
+func Or(conds ...*Cond) *Cond { return join(" OR ", conds) }
+
+// Select describes a SELECT statement
+type Select struct {
+	Cols    string // comma separated list of columns
+	From    string // table name, may include joins
+	Where   *Cond  // optional condition
+	OrderBy string // optional comma separated list of columns
+	Limit   int    // if > 0, the maximum number of rows
+	Offset  int    // if > 0, the number of rows to skip
+}
+
+func (s *Select) where() (string, []interface{}) {
+	if s.Where.Empty() {
+		return "", nil
+	}
+	w, args := s.Where.SQL()
+	return " WHERE " + w, args
+}
+
+// SQL returns the sql and arguments for the select statement
+func (s *Select) SQL() (string, []interface{}) {
+	w, args := s.where()
+	q := "SELECT " + s.Cols + " FROM " + s.From + w
+	if len(s.OrderBy) > 0 {
+		q += " ORDER BY " + s.OrderBy
+	}
+	if s.Limit > 0 {
+		q += fmt.Sprintf(" LIMIT %d", s.Limit)
+		if s.Offset > 0 {
+			q += fmt.Sprintf(" OFFSET %d", s.Offset)
+		}
+	}
+	return q, args
+}
+
+// CountSQL returns the sql and arguments to count the rows that match
+// the select statement, ignoring the order, limit, and offset.
+func (s *Select) CountSQL() (string, []interface{}) {
+	w, args := s.where()
+	return "SELECT COUNT(*) FROM " + s.From + w, args
+}
+
+// Match returns the condition for a search operator as used by the w2ui
+// grid: "begins", "ends", "contains", or "is". Any other operator is
+// treated as "is".
+func Match(col, operator, v string) *Cond {
+	switch strings.ToLower(operator) {
+	case "begins":
+		return BeginsWith(col, v)
+	case "ends":
+		return EndsWith(col, v)
+	case "contains":
+		return Contains(col, v)
+	}
+	return Eq(col, v)
+}
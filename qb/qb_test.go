@@ -0,0 +1,84 @@
+package qb
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCond(t *testing.T) {
+	tests := []struct {
+		name string
+		c    *Cond
+		sql  string
+		args []interface{}
+	}{
+		{"eq", Eq("UID", 7), "UID=?", []interface{}{7}},
+		{"ne", Ne("Status", 0), "Status<>?", []interface{}{0}},
+		{"gt ge lt le", And(Gt("a", 1), Ge("b", 2), Lt("c", 3), Le("d", 4)), "(a>? AND b>=? AND c<? AND d<=?)", []interface{}{1, 2, 3, 4}},
+		{"like is used as is", Like("LastName", "Sm_th%"), "LastName LIKE ?", []interface{}{"Sm_th%"}},
+		{"contains", Contains("LastName", "50%_off"), "LastName LIKE ?", []interface{}{`%50\%\_off%`}},
+		{"begins", Match("LastName", "Begins", "O'Br"), "LastName LIKE ?", []interface{}{"O'Br%"}},
+		{"ends", Match("LastName", "ends", "son"), "LastName LIKE ?", []interface{}{"%son"}},
+		{"unknown operator is eq", Match("LastName", "drop table", "x"), "LastName=?", []interface{}{"x"}},
+		{"in", InInts("CoCode", []int{1, 2, 3}), "CoCode IN (?,?,?)", []interface{}{1, 2, 3}},
+		{"in empty", InInts("CoCode", nil), "1=0", nil},
+		{"raw", Raw("a=? OR b=?", 1, "x"), "a=? OR b=?", []interface{}{1, "x"}},
+		{"and of one", And(nil, Eq("a", 1), &Cond{}), "a=?", []interface{}{1}},
+		{"and of none", And(nil, &Cond{}), "", nil},
+		{"nested", Or(Eq("a", 1), And(Eq("b", 2), InInts("c", []int{3}))), "(a=? OR (b=? AND c IN (?)))", []interface{}{1, 2, 3}},
+	}
+	for _, tt := range tests {
+		sql, args := tt.c.SQL()
+		if sql != tt.sql {
+			t.Errorf("%s: sql = %q, want %q", tt.name, sql, tt.sql)
+		}
+		if !reflect.DeepEqual(args, tt.args) {
+			t.Errorf("%s: args = %#v, want %#v", tt.name, args, tt.args)
+		}
+	}
+}
+
+func TestEscapeLike(t *testing.T) {
+	tests := []struct {
+		s, want string
+	}{
+		{"plain", "plain"},
+		{"100%", `100\%`},
+		{"a_b", `a\_b`},
+		{`back\slash`, `back\\slash`},
+		{`\%`, `\\\%`},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := EscapeLike(tt.s); got != tt.want {
+			t.Errorf("EscapeLike(%q) = %q, want %q", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestSelect(t *testing.T) {
+	tests := []struct {
+		name       string
+		s          Select
+		sql, count string
+		args       []interface{}
+	}{
+		{"bare", Select{Cols: "UID", From: "people"},
+			"SELECT UID FROM people", "SELECT COUNT(*) FROM people", nil},
+		{"everything", Select{Cols: "UID,LastName", From: "people", Where: And(Eq("Status", 1), Contains("LastName", "x")), OrderBy: "LastName", Limit: 10, Offset: 20},
+			"SELECT UID,LastName FROM people WHERE (Status=? AND LastName LIKE ?) ORDER BY LastName LIMIT 10 OFFSET 20",
+			"SELECT COUNT(*) FROM people WHERE (Status=? AND LastName LIKE ?)", []interface{}{1, "%x%"}},
+		{"offset without limit is ignored", Select{Cols: "UID", From: "people", Where: &Cond{}, Offset: 5},
+			"SELECT UID FROM people", "SELECT COUNT(*) FROM people", nil},
+	}
+	for _, tt := range tests {
+		sql, args := tt.s.SQL()
+		if sql != tt.sql || !reflect.DeepEqual(args, tt.args) {
+			t.Errorf("%s: SQL = %q %#v, want %q %#v", tt.name, sql, args, tt.sql, tt.args)
+		}
+		sql, args = tt.s.CountSQL()
+		if sql != tt.count || !reflect.DeepEqual(args, tt.args) {
+			t.Errorf("%s: CountSQL = %q %#v, want %q %#v", tt.name, sql, args, tt.count, tt.args)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"phonebook/db"
+	"phonebook/lib"
+	"sync"
+	"time"
+)
+
+// reloadState holds the version of each cached list, as recorded in the
+// reloadversions table, that this instance has loaded.
+var reloadState struct {
+	sync.Mutex
+	have map[string]int64
+}
+
+// uiListsLock guards the lookup lists in PhonebookUI. They are replaced by
+// the loaders while handlers are reading them.
+var uiListsLock sync.RWMutex
+
+// initReload records the versions of the cached lists. It is called before
+// they are first loaded, so a change made while they load is picked up by
+// reloadWatcher.
+//-----------------------------------------------------------------------------
+func initReload() {
+	v, err := db.GetReloadVersions()
+	if err != nil {
+		ulog("initReload: could not read reload versions, changes made on other instances will be missed: %s\n", err.Error())
+		v = map[string]int64{}
+	}
+	reloadState.Lock()
+	reloadState.have = v
+	reloadState.Unlock()
+}
+
+// reloadMaps rebuilds the PhonebookUI lookup lists and the search index
+// entries that depend on them. Each list that cannot be read is left as it
+// was, and the first error is returned.
+//-----------------------------------------------------------------------------
+func reloadMaps() error {
+	var first error
+	for _, f := range []func() error{loadCompanies, loadClasses, loadLookups} {
+		if err := f(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// publishReload bumps the version of the supplied list so that the other
+// instances reload it. The caller reloads this instance's copy.
+//-----------------------------------------------------------------------------
+func publishReload(name string) {
+	reloadState.Lock()
+	defer reloadState.Unlock()
+	v, err := db.BumpReloadVersion(name)
+	if err != nil {
+		ulog("publishReload: other instances will not reload %s: %s\n", name, err.Error())
+		return
+	}
+	// If we had missed a change, leave our version behind so that
+	// reloadWatcher still picks it up.
+	if reloadState.have[name] == v-1 {
+		reloadState.have[name] = v
+	}
+}
+
+// companiesChanged reloads the companies after this instance changed them
+// and tells the other instances to do the same.
+func companiesChanged() {
+	publishReload(db.RELOADMAPS)
+	if err := loadCompanies(); err != nil {
+		ulog("companiesChanged: could not reload companies: %s\n", err.Error())
+	}
+}
+
+// classesChanged reloads the classes after this instance changed them and
+// tells the other instances to do the same.
+func classesChanged() {
+	publishReload(db.RELOADMAPS)
+	if err := loadClasses(); err != nil {
+		ulog("classesChanged: could not reload classes: %s\n", err.Error())
+	}
+}
+
+// rolesChanged reloads the roles after this instance changed them and tells
+// the other instances to do the same.
+func rolesChanged() error {
+	publishReload(db.RELOADROLES)
+	return reloadRoles()
+}
+
+// checkReload reloads every list whose version has moved since this
+// instance loaded it.
+//-----------------------------------------------------------------------------
+func checkReload() {
+	v, err := db.GetReloadVersions()
+	if err != nil {
+		ulog("checkReload: %s\n", err.Error())
+		return
+	}
+	reloadState.Lock()
+	defer reloadState.Unlock()
+	for _, name := range []string{db.RELOADMAPS, db.RELOADROLES} {
+		if v[name] == reloadState.have[name] {
+			continue
+		}
+		switch name {
+		case db.RELOADMAPS:
+			if err = reloadMaps(); err != nil {
+				ulog("checkReload: could not reload lookup lists: %s\n", err.Error())
+				continue
+			}
+		case db.RELOADROLES:
+			if err = reloadRoles(); err != nil {
+				ulog("checkReload: could not reload roles: %s\n", err.Error())
+				continue
+			}
+		}
+		ulog("reloaded %s, version %d\n", name, v[name])
+		reloadState.have[name] = v[name]
+	}
+}
+
+// reloadWatcher looks for lists changed by other instances every
+// ReloadCheckSeconds. A setting of 0 turns it off.
+//-----------------------------------------------------------------------------
+func reloadWatcher() {
+	if lib.PBConfig.ReloadCheckSeconds <= 0 {
+		return
+	}
+	for {
+		select {
+		case <-time.After(time.Duration(lib.PBConfig.ReloadCheckSeconds) * time.Second):
+			checkReload()
+		}
+	}
+}
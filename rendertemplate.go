@@ -1,18 +1,28 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"html/template"
 	"net/http"
 )
 
 // renderTemplate
-// It renders provide template with filenames
+// It renders provide template with filenames. Posted forms on the page get
+// the CSRF token of the user's session.
 func renderTemplate(w http.ResponseWriter, ui uiSupport, filenames string) error {
 	t, err := template.New("phoneBookBaseTemplate").Funcs(funcMap).ParseFiles("base.html", "header.html", filenames)
 	if err != nil {
 		fmt.Println(err.Error())
 	}
-	err = t.ExecuteTemplate(w, "base", &ui)
+	var b bytes.Buffer
+	if err = t.ExecuteTemplate(&b, "base", &ui); err != nil {
+		return err
+	}
+	page := b.Bytes()
+	if ui.X != nil && len(ui.X.Token) > 0 {
+		page = csrfInject(page, ui.X.Token)
+	}
+	_, err = w.Write(page)
 	return err
 }
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"phonebook/authz"
+	"phonebook/db"
+	"phonebook/sess"
+	"strconv"
+	"strings"
+)
+
+// roleElemNames are the headings for the elements in the role editor
+var roleElemNames = map[int]string{
+	authz.ELEMPERSON:  "Person",
+	authz.ELEMCOMPANY: "Company",
+	authz.ELEMCLASS:   "Business Unit",
+	authz.ELEMPBSVC:   "Phonebook Service",
+}
+
+// roleField is one field of the role being edited
+type roleField struct {
+	Elem  int    // element the field belongs to
+	Field string // field name
+	Descr string // description of the field
+	Perm  int    // permissions the role has on the field
+	Set   []bool // Set[i] is true if Perm has authz.PermBits[i]
+}
+
+// roleElem is the fields of one element of the role being edited
+type roleElem struct {
+	Name   string      // element heading
+	Fields []roleField // the element's fields
+}
+
+// roleListItem is a role on the roles page
+type roleListItem struct {
+	RID     int    // role id
+	Name    string // role name
+	Descr   string // role description
+	Members int    // number of people who hold the role
+}
+
+// roleScope is a choice of scope in the role editor
+type roleScope struct {
+	Scope int    // the authz.SCOPE value
+	Name  string // what the admin sees
+}
+
+// roleCompany is a company the role being edited can be limited to
+type roleCompany struct {
+	CoCode int    // company code
+	Name   string // company name
+	Set    bool   // true if the role is limited to the company
+}
+
+// roleAdmin is the data for the roles admin pages
+type roleAdmin struct {
+	Roles     []roleListItem  // all the roles
+	Role      authz.Role      // role being edited, Perms is not used
+	Elems     []roleElem      // fields of the role being edited, by element
+	Bits      []authz.PermBit // the permission bits, in column order
+	Members   []db.RoleMember // people who hold the role being edited
+	Scopes    []roleScope     // the scopes the role can have
+	Companies []roleCompany   // the companies a SCOPELIST role can be limited to
+}
+
+// roleFields returns every field that any role has a permission for. The
+// roles are all created with the same fields, so this is the list the
+// role editor offers.
+//-----------------------------------------------------------------------------
+func roleFields(roles []authz.Role) []authz.FieldPerm {
+	var f []authz.FieldPerm
+	seen := map[string]bool{}
+	for i := 0; i < len(roles); i++ {
+		for j := 0; j < len(roles[i].Perms); j++ {
+			p := roles[i].Perms[j]
+			k := fmt.Sprintf("%d/%s", p.Elem, p.Field)
+			if seen[k] {
+				continue
+			}
+			seen[k] = true
+			p.Perm = authz.PERMNONE
+			f = append(f, p)
+		}
+	}
+	return f
+}
+
+// findRole returns the role with the supplied rid, or nil if there is none
+func findRole(roles []authz.Role, rid int) *authz.Role {
+	for i := 0; i < len(roles); i++ {
+		if roles[i].RID == rid {
+			return &roles[i]
+		}
+	}
+	return nil
+}
+
+// roleNameErr returns a message for the admin if name cannot be used for a
+// role other than rid, or "" if it can.
+func roleNameErr(roles []authz.Role, rid int, name string) string {
+	if len(name) == 0 || len(name) > 25 {
+		return "Please enter a role name of at most 25 characters."
+	}
+	for i := 0; i < len(roles); i++ {
+		if roles[i].RID != rid && strings.EqualFold(roles[i].Name, name) {
+			return fmt.Sprintf("There is already a role named %s.", roles[i].Name)
+		}
+	}
+	return ""
+}
+
+// reloadRoles reads the roles from the database and gives every signed in
+// user the permissions of their role as it is now.
+//-----------------------------------------------------------------------------
+func reloadRoles() error {
+	roles, err := db.GetRoles()
+	if err != nil {
+		return err
+	}
+	authz.SetRoles(roles)
+	n := sess.RefreshPermMaps()
+	ulog("roles reloaded, permissions refreshed for %d sessions\n", n)
+	return nil
+}
+
+// rolesAccess returns true if ssn may use the roles admin pages. Whoever can
+// change the role a person holds in every company can also change the roles
+// themselves.
+func rolesAccess(w http.ResponseWriter, r *http.Request, ssn *sess.Session) bool {
+	if hasAllCoAccess(ssn, authz.ELEMPERSON, "Role", authz.PERMMOD) {
+		return true
+	}
+	ulog("Permissions refuse roles page on userid=%d (%s), role=%s\n", ssn.UID, ssn.Firstname, ssn.PMap.Urole.Name)
+	http.Redirect(w, r, "/search/", http.StatusFound)
+	return false
+}
+
+// rolesHandler lists the roles with the number of people who hold each of
+// them, and creates, clones and deletes roles.
+//-----------------------------------------------------------------------------
+func rolesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html")
+	var ssn *sess.Session
+	var ui uiSupport
+	ssn = nil
+	if 0 < initHandlerSession(ssn, &ui, w, r) {
+		return
+	}
+	ssn = ui.X
+	breadcrumbAdd(ssn, "Roles", "/roles/")
+
+	//============================================================
+	// SECURITY
+	//============================================================
+	if !rolesAccess(w, r, ssn) {
+		return
+	}
+
+	var errmsg string
+	var err error
+	roles := authz.GetRoles()
+	action := strings.ToLower(r.FormValue("action"))
+	if r.Method != "POST" {
+		action = ""
+	}
+	rid, _ := strconv.Atoi(r.FormValue("rid"))
+	name := strings.TrimSpace(r.FormValue("name"))
+	switch action {
+	case "create", "clone":
+		var nr authz.Role
+		nr.Name = name
+		nr.Descr = strings.TrimSpace(r.FormValue("descr"))
+		nr.Perms = roleFields(roles)
+		if action == "clone" {
+			from := findRole(roles, rid)
+			if from == nil {
+				errmsg = "Please choose the role to clone."
+				break
+			}
+			nr.Perms = append([]authz.FieldPerm{}, from.Perms...)
+			nr.Scope = from.Scope
+			nr.CoCodes = append([]int{}, from.CoCodes...)
+			nr.OutRID = from.OutRID
+			if len(nr.Descr) == 0 {
+				nr.Descr = from.Descr
+			}
+		}
+		if errmsg = roleNameErr(roles, 0, nr.Name); len(errmsg) > 0 {
+			break
+		}
+		if !sess.CoversRole(ssn, &nr) {
+			errmsg = "You cannot create a role that can do more, or in more companies, than your own."
+			break
+		}
+		if err = db.InsertRole(&nr); err != nil {
+			break
+		}
+		ulog("user %s (%d) created role %s (%d)\n", ssn.Username, ssn.UID, nr.Name, nr.RID)
+		sess.LogSecEvent(r, sess.SessionEvent(ssn, db.SECROLEEDIT, 0, nr.Name, fmt.Sprintf("created role %d", nr.RID)))
+		if err = rolesChanged(); err == nil {
+			http.Redirect(w, r, fmt.Sprintf("/role/%d", nr.RID), http.StatusFound)
+			return
+		}
+	case "delete":
+		dr := findRole(roles, rid)
+		if dr == nil {
+			break
+		}
+		if !sess.CoversRole(ssn, dr) {
+			ulog("Permissions refuse delete of role %s (%d) by userid=%d (%s), role=%s\n", dr.Name, rid, ssn.UID, ssn.Firstname, ssn.PMap.Urole.Name)
+			errmsg = "You cannot delete a role that can do more, or in more companies, than your own."
+			break
+		}
+		if err = db.DeleteRole(rid); err == db.ErrRoleInUse {
+			errmsg = fmt.Sprintf("Role %s cannot be deleted while people or API keys hold it, or another role uses it outside its companies.", dr.Name)
+			err = nil
+			break
+		}
+		if err == nil {
+			ulog("user %s (%d) deleted role %s (%d)\n", ssn.Username, ssn.UID, dr.Name, rid)
+			sess.LogSecEvent(r, sess.SessionEvent(ssn, db.SECROLEEDIT, 0, dr.Name, fmt.Sprintf("deleted role %d", rid)))
+			err = rolesChanged()
+		}
+	}
+
+	var z roleAdmin
+	var members []db.RoleMember
+	if err == nil {
+		members, err = db.GetRoleMembers()
+	}
+	if err != nil {
+		errmsg := fmt.Sprintf("rolesHandler: err = %v\n", err)
+		ulog(errmsg)
+		fmt.Println(errmsg)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	roles = authz.GetRoles()
+	for i := 0; i < len(roles); i++ {
+		it := roleListItem{RID: roles[i].RID, Name: roles[i].Name, Descr: roles[i].Descr}
+		for j := 0; j < len(members); j++ {
+			if members[j].RID == it.RID {
+				it.Members++
+			}
+		}
+		z.Roles = append(z.Roles, it)
+	}
+	ui.Z = &z
+	ui.ErrMsg = template.HTML(template.HTMLEscapeString(errmsg))
+
+	err = renderTemplate(w, ui, "roles.html")
+	if nil != err {
+		errmsg := fmt.Sprintf("rolesHandler: err = %v\n", err)
+		ulog(errmsg)
+		fmt.Println(errmsg)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// roleHandler shows the role whose rid is in the path, the people who hold
+// it, the companies it applies to, and a checkbox for each permission bit
+// on each field. Saving replaces the role's name, description, scope and
+// field permissions.
+//-----------------------------------------------------------------------------
+func roleHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html")
+	var ssn *sess.Session
+	var ui uiSupport
+	ssn = nil
+	if 0 < initHandlerSession(ssn, &ui, w, r) {
+		return
+	}
+	ssn = ui.X
+	path := "/role/"
+	rid, _ := strconv.Atoi(r.URL.Path[len(path):])
+	breadcrumbAdd(ssn, "Role", fmt.Sprintf("/role/%d", rid))
+
+	//============================================================
+	// SECURITY
+	//============================================================
+	if !rolesAccess(w, r, ssn) {
+		return
+	}
+
+	roles := authz.GetRoles()
+	role := findRole(roles, rid)
+	if role == nil {
+		http.Redirect(w, r, "/roles/", http.StatusFound)
+		return
+	}
+
+	var errmsg string
+	var err error
+	fields := roleFields(roles)
+	er := authz.Role{RID: rid, Name: role.Name, Descr: role.Descr, Scope: role.Scope, CoCodes: role.CoCodes, OutRID: role.OutRID}
+	er.Perms = make([]authz.FieldPerm, len(fields))
+	for i := 0; i < len(fields); i++ {
+		er.Perms[i] = fields[i]
+		for j := 0; j < len(role.Perms); j++ {
+			if role.Perms[j].Elem == fields[i].Elem && role.Perms[j].Field == fields[i].Field {
+				er.Perms[i].Perm = role.Perms[j].Perm
+				break
+			}
+		}
+	}
+
+	if r.Method == "POST" && strings.ToLower(r.FormValue("action")) == "save" {
+		errmsg, err = saveRole(r, ssn, roles, &er)
+	}
+
+	var z roleAdmin
+	var members []db.RoleMember
+	if err == nil {
+		members, err = db.GetRoleMembers()
+	}
+	if err != nil {
+		errmsg := fmt.Sprintf("roleHandler: err = %v\n", err)
+		ulog(errmsg)
+		fmt.Println(errmsg)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for i := 0; i < len(members); i++ {
+		if members[i].RID == rid {
+			z.Members = append(z.Members, members[i])
+		}
+	}
+	z.Role = authz.Role{RID: er.RID, Name: er.Name, Descr: er.Descr, Scope: er.Scope, OutRID: er.OutRID}
+	z.Bits = authz.PermBits
+	for sc := authz.SCOPEALL; sc <= authz.SCOPELIST; sc++ {
+		z.Scopes = append(z.Scopes, roleScope{Scope: sc, Name: authz.ScopeNames[sc]})
+	}
+	uiListsLock.RLock()
+	companies := PhonebookUI.CompanyList
+	uiListsLock.RUnlock()
+	for i := 0; i < len(companies); i++ {
+		c := roleCompany{CoCode: companies[i].CoCode, Name: companies[i].CommonName}
+		for j := 0; j < len(er.CoCodes); j++ {
+			if er.CoCodes[j] == c.CoCode {
+				c.Set = true
+			}
+		}
+		z.Companies = append(z.Companies, c)
+	}
+	roles = authz.GetRoles()
+	for i := 0; i < len(roles); i++ {
+		if roles[i].RID != rid {
+			z.Roles = append(z.Roles, roleListItem{RID: roles[i].RID, Name: roles[i].Name, Descr: roles[i].Descr})
+		}
+	}
+	for e := authz.ELEMPERSON; e <= authz.ELEMPBSVC; e++ {
+		el := roleElem{Name: roleElemNames[e]}
+		for i := 0; i < len(er.Perms); i++ {
+			f := er.Perms[i]
+			if f.Elem != e {
+				continue
+			}
+			rf := roleField{Elem: f.Elem, Field: f.Field, Descr: f.Descr, Perm: f.Perm}
+			for j := 0; j < len(authz.PermBits); j++ {
+				rf.Set = append(rf.Set, f.Perm&authz.PermBits[j].Bit != 0)
+			}
+			el.Fields = append(el.Fields, rf)
+		}
+		if len(el.Fields) > 0 {
+			z.Elems = append(z.Elems, el)
+		}
+	}
+	ui.Z = &z
+	ui.ErrMsg = template.HTML(template.HTMLEscapeString(errmsg))
+
+	err = renderTemplate(w, ui, "role.html")
+	if nil != err {
+		errmsg := fmt.Sprintf("roleHandler: err = %v\n", err)
+		ulog(errmsg)
+		fmt.Println(errmsg)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// saveRole updates er from the role editor form in r and saves it. Each
+// checked box is posted as a perm value of the form elem/field/bit, and
+// each checked company as a cocode value.
+//
+// RETURNS
+//  errmsg - message for the admin if the form is not valid
+//  err    - any other error encountered
+//-----------------------------------------------------------------------------
+func saveRole(r *http.Request, ssn *sess.Session, roles []authz.Role, er *authz.Role) (string, error) {
+	if !sess.CoversRole(ssn, er) {
+		ulog("Permissions refuse change to role %s (%d) by userid=%d (%s), role=%s\n", er.Name, er.RID, ssn.UID, ssn.Firstname, ssn.PMap.Urole.Name)
+		return "You cannot change a role that can do more, or in more companies, than your own.", nil
+	}
+	name := strings.TrimSpace(r.FormValue("name"))
+	if errmsg := roleNameErr(roles, er.RID, name); len(errmsg) > 0 {
+		return errmsg, nil
+	}
+	perms := map[string]int{}
+	for _, v := range r.Form["perm"] {
+		i := strings.LastIndex(v, "/")
+		if i < 0 {
+			continue
+		}
+		bit, _ := strconv.Atoi(v[i+1:])
+		perms[v[:i]] |= bit
+	}
+	scope, _ := strconv.Atoi(r.FormValue("scope"))
+	if _, ok := authz.ScopeNames[scope]; !ok {
+		return "Please choose the companies the role applies to.", nil
+	}
+	var cocodes []int
+	if scope == authz.SCOPELIST {
+		uiListsLock.RLock()
+		for _, v := range r.Form["cocode"] {
+			if c, err := strconv.Atoi(v); err == nil && len(PhonebookUI.CoCodeToName[c]) > 0 {
+				cocodes = append(cocodes, c)
+			}
+		}
+		uiListsLock.RUnlock()
+		if len(cocodes) == 0 {
+			return "Please choose at least one company for the role.", nil
+		}
+	}
+	outrid, _ := strconv.Atoi(r.FormValue("outrid"))
+	if scope == authz.SCOPEALL || outrid == er.RID || findRole(roles, outrid) == nil {
+		outrid = 0
+	}
+	old := *er
+	old.Perms = append([]authz.FieldPerm{}, er.Perms...)
+	er.Name = name
+	er.Descr = strings.TrimSpace(r.FormValue("descr"))
+	er.Scope = scope
+	er.CoCodes = cocodes
+	er.OutRID = outrid
+	for i := 0; i < len(er.Perms); i++ {
+		er.Perms[i].Perm = perms[fmt.Sprintf("%d/%s", er.Perms[i].Elem, er.Perms[i].Field)]
+	}
+
+	// don't let admins lock themselves out of this page
+	if er.RID == ssn.PMap.Urole.RID {
+		for i := 0; i < len(er.Perms); i++ {
+			f := er.Perms[i]
+			if f.Elem == authz.ELEMPERSON && f.Field == "Role" && f.Perm&authz.PERMMOD == 0 {
+				*er = old
+				return "You cannot take away your own role's permission to modify roles.", nil
+			}
+		}
+	}
+	if !sess.CoversRole(ssn, er) {
+		*er = old
+		return "You cannot give a role permissions, or companies, that your own role does not have.", nil
+	}
+
+	if err := db.UpdateRole(er); err != nil {
+		return "", err
+	}
+	var chg []string // what changed, for the security event
+	if old.Name != er.Name {
+		ulog("user %s (%d) renamed role %s (%d) to %s\n", ssn.Username, ssn.UID, old.Name, er.RID, er.Name)
+		chg = append(chg, fmt.Sprintf("renamed from %s", old.Name))
+	}
+	if old.Scope != er.Scope || fmt.Sprint(old.CoCodes) != fmt.Sprint(er.CoCodes) || old.OutRID != er.OutRID {
+		ulog("user %s (%d) changed role %s (%d) scope from %s %v, outside %d to %s %v, outside %d\n", ssn.Username, ssn.UID, er.Name, er.RID,
+			authz.ScopeNames[old.Scope], old.CoCodes, old.OutRID, authz.ScopeNames[er.Scope], er.CoCodes, er.OutRID)
+		chg = append(chg, fmt.Sprintf("scope from %s %v, outside %d to %s %v, outside %d",
+			authz.ScopeNames[old.Scope], old.CoCodes, old.OutRID, authz.ScopeNames[er.Scope], er.CoCodes, er.OutRID))
+	}
+	for i := 0; i < len(er.Perms); i++ {
+		if er.Perms[i].Perm != old.Perms[i].Perm {
+			ulog("user %s (%d) changed role %s (%d) %s.%s from 0x%03x to 0x%03x\n", ssn.Username, ssn.UID, er.Name, er.RID,
+				roleElemNames[er.Perms[i].Elem], er.Perms[i].Field, old.Perms[i].Perm, er.Perms[i].Perm)
+			chg = append(chg, fmt.Sprintf("%s.%s from 0x%03x to 0x%03x",
+				roleElemNames[er.Perms[i].Elem], er.Perms[i].Field, old.Perms[i].Perm, er.Perms[i].Perm))
+		}
+	}
+	if len(chg) > 0 {
+		sess.LogSecEvent(r, sess.SessionEvent(ssn, db.SECROLEEDIT, 0, er.Name, fmt.Sprintf("changed role %d: %s", er.RID, strings.Join(chg, "; "))))
+	}
+	return "", rolesChanged()
+}
@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"phonebook/authz"
 	"phonebook/db"
+	"phonebook/idx"
 	"phonebook/sess"
 	"strconv"
 	"strings"
@@ -72,7 +73,7 @@ func saveAdminEditHandler(w http.ResponseWriter, r *http.Request) {
 
 	if action == "delete" {
 		url := fmt.Sprintf("/delPerson/%d", uid)
-		http.Redirect(w, r, url, http.StatusFound)
+		http.Redirect(w, r, url, http.StatusTemporaryRedirect) // keeps the POST and its csrf field
 		return
 	}
 
@@ -149,6 +150,7 @@ func saveAdminEditHandler(w http.ResponseWriter, r *http.Request) {
 		var do db.PersonDetail // container for current info
 		do.UID = uid           // init
 		adminReadDetails(&do)  //read current data
+		oldRID := do.RID
 
 		//----------------------------------------------------------------------------
 		// If we're changing Status to Inactive, then it's like a delete. We'll have
@@ -166,6 +168,10 @@ func saveAdminEditHandler(w http.ResponseWriter, r *http.Request) {
 		// 	filterSecurityMerge(d, ssn, authz.ELEMPERSON, permRequired, dNew, d.UID)
 		// }
 		filterSecurityMerge(&do, ssn, authz.ELEMPERSON, authz.PERMMOD, &d, do.UID) // merge in new data
+		if do.RID != oldRID && !sess.CanGrantRole(ssn, do.RID) {
+			ulog("Permissions refuse role %d for uid %d on userid=%d (%s), role=%s\n", do.RID, uid, ssn.UID, ssn.Firstname, ssn.PMap.Urole.Name)
+			do.RID = oldRID
+		}
 
 		if int64(uid) == ssn.UID {
 			if 0 == len(do.PreferredName) {
@@ -208,90 +214,28 @@ func saveAdminEditHandler(w http.ResponseWriter, r *http.Request) {
 				}
 			}
 			do.UserName = UserName
-
-			//============================================
-			// OK, now write it to the db...
-			//============================================
-			_, err = Phonebook.prepstmt.adminInsertPerson.Exec(do.Salutation, do.FirstName, do.MiddleName, do.LastName, do.PreferredName, // 5
-				do.EmergencyContactName, do.EmergencyContactPhone, //7
-				do.PrimaryEmail, do.SecondaryEmail, do.OfficePhone, do.OfficeFax, do.CellPhone, do.CoCode, do.JobCode, //14
-				do.PositionControlNumber, do.DeptCode, //16
-				do.HomeStreetAddress, do.HomeStreetAddress2, do.HomeCity, do.HomeState, do.HomePostalCode, do.HomeCountry, // 22
-				do.Status, do.EligibleForRehire, do.Accepted401K, do.AcceptedDentalInsurance, do.AcceptedHealthInsurance, // 27
-				dateToDBStr(do.Hire), dateToDBStr(do.Termination), do.ClassCode, // 30
-				do.BirthMonth, do.BirthDOM, do.MgrUID, do.StateOfEmployment, do.CountryOfEmployment, // 35
-				dateToDBStr(do.LastReview), dateToDBStr(do.NextReview), do.RID, ssn.UID, do.UserName) // 37
-			errcheck(err)
-
-			// read this record back to get the UID...
-			rows, err := Phonebook.prepstmt.adminReadBack.Query(
-				do.FirstName, do.LastName, do.PrimaryEmail, do.OfficePhone, do.CoCode, do.JobCode)
-			errcheck(err)
-			defer rows.Close()
-			nUID = 0 // quick way to handle multiple matches... in this case, largest UID wins, it hast to be the latest person added
-			for rows.Next() {
-				errcheck(rows.Scan(&uid))
-				if uid > nUID {
-					nUID = uid
-				}
-			}
-			errcheck(rows.Err())
-			uid = nUID
-			do.UID = uid
-		} else {
-			//--------------------------
-			// update existing record
-			//--------------------------
-			_, err = Phonebook.prepstmt.adminUpdatePerson.Exec(
-				do.Salutation, do.FirstName, do.MiddleName, do.LastName, do.PreferredName,
-				do.EmergencyContactName, do.EmergencyContactPhone,
-				do.PrimaryEmail, do.SecondaryEmail, do.OfficePhone, do.OfficeFax, do.CellPhone, do.CoCode, do.JobCode,
-				do.PositionControlNumber, do.DeptCode,
-				do.HomeStreetAddress, do.HomeStreetAddress2, do.HomeCity, do.HomeState, do.HomePostalCode, do.HomeCountry,
-				do.Status, do.EligibleForRehire, do.Accepted401K, do.AcceptedDentalInsurance, do.AcceptedHealthInsurance,
-				dateToDBStr(do.Hire), dateToDBStr(do.Termination), do.ClassCode,
-				do.BirthMonth, do.BirthDOM, do.MgrUID, do.StateOfEmployment, do.CountryOfEmployment,
-				dateToDBStr(do.LastReview), dateToDBStr(do.NextReview), ssn.UID, do.RID,
-				uid)
-
-			if nil != err {
-				errmsg := fmt.Sprintf("saveAdminEditHandler: Phonebook.prepstmt.adminUpdatePerson.Exec: err = %v\n", err)
-				ulog(errmsg)
-				fmt.Println(errmsg)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-		}
-		//--------------------------------------------------------------------------
-		// Remove old compensation type(s) and Insert new compensation type(s)
-		//--------------------------------------------------------------------------
-		// ct, err := Phonebook.db.Prepare("DELETE FROM compensation WHERE uid=?")
-		// errcheck(err)
-		_, err = Phonebook.prepstmt.delPersonComp.Exec(do.UID)
-		errcheck(err)
-		// ct, err = Phonebook.db.Prepare("INSERT INTO compensation (uid,type) VALUES(?,?)")
-		// errcheck(err)
-		for i := 0; i < len(do.Comps); i++ {
-			_, err := Phonebook.prepstmt.insertComp.Exec(do.UID, do.Comps[i])
-			errcheck(err)
 		}
 
 		//--------------------------------------------------------------------------
-		// Update deductions...
+		// The deductions are written as checked on the form. The person, their
+		// compensation types and deductions, and the changelog rows for them are
+		// written in one transaction.
 		//--------------------------------------------------------------------------
-		// ct, err = Phonebook.db.Prepare("DELETE FROM deductions WHERE uid=?")
-		// errcheck(err)
-		_, err = Phonebook.prepstmt.delPersonDeduct.Exec(do.UID)
-		errcheck(err)
-		// ct, err = Phonebook.db.Prepare("INSERT INTO deductions (uid,deduction) VALUES(?,?)")
-		// errcheck(err)
-		for i := 0; i < len(do.MyDeductions); i++ {
-			// fmt.Printf("\"%s\" = %s\n", do.MyDeductions[i].Name, r.FormValue(do.MyDeductions[i].Name))
-			if r.FormValue(do.MyDeductions[i].Name) != "" {
-				_, err := Phonebook.prepstmt.insertDeduct.Exec(do.UID, do.MyDeductions[i].DCode)
-				errcheck(err)
-			}
+		do.Deductions = d.Deductions
+		if uid == 0 {
+			err = db.InsertPerson(&do, ssn.UID)
+		} else {
+			err = db.UpdatePerson(&do, ssn.UID)
+		}
+		if nil != err {
+			errmsg := fmt.Sprintf("saveAdminEditHandler: save uid=%d: err = %v\n", uid, err)
+			ulog(errmsg)
+			fmt.Println(errmsg)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
+		idx.Errlog("saveAdminEditHandler", idx.UpdatePerson(do.UID))
+		sess.LogRoleChange(r, ssn, do.UID, do.UserName, oldRID, do.RID)
 	}
 
 	s := breadcrumbBack(ssn, 2)
@@ -47,7 +47,7 @@ func saveAdminEditClassHandler(w http.ResponseWriter, r *http.Request) {
 	action := strings.ToLower(r.FormValue("action"))
 	if "delete" == action {
 		url := fmt.Sprintf("/delClass/%d", ClassCode)
-		http.Redirect(w, r, url, http.StatusFound)
+		http.Redirect(w, r, url, http.StatusTemporaryRedirect) // keeps the POST and its csrf field
 		return
 	}
 	if "save" == action {
@@ -75,28 +75,21 @@ func saveAdminEditClassHandler(w http.ResponseWriter, r *http.Request) {
 		filterSecurityMerge(&co, ssn, authz.ELEMCLASS, authz.PERMMOD, &c, 0) // merge new info based on permissions
 
 		if 0 == ClassCode {
-			_, err = Phonebook.prepstmt.insertClass.Exec(co.CoCode, co.Name, co.Designation, co.Description, ssn.UID)
-			errcheck(err)
-
-			// read this record back to get the ClassCode...
-			rows, err := Phonebook.prepstmt.classReadBack.Query(co.Name, co.Designation)
-			errcheck(err)
-			defer rows.Close()
-			nClassCode := 0 // quick way to handle multiple matches... in this case, largest ClassCode wins, it hast to be the latest db.Class added
-			for rows.Next() {
-				errcheck(rows.Scan(&ClassCode))
-				if ClassCode > nClassCode {
-					nClassCode = ClassCode
-				}
+			err = db.InsertClass(&co, ssn.UID)
+			if nil != err {
+				errmsg := fmt.Sprintf("saveAdminEditClassHandler: db.InsertClass: err = %v\n", err)
+				ulog(errmsg)
+				fmt.Println(errmsg)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
 			}
-			errcheck(rows.Err())
-			ClassCode = nClassCode
+			ClassCode = co.ClassCode
 			c.ClassCode = ClassCode
-			loadClasses() // This is a new db.Class, we've saved it, now we need to reload our company list...
+			classesChanged() // This is a new db.Class, we've saved it, now we need to reload our company list...
 		} else {
-			_, err = Phonebook.prepstmt.updateClass.Exec(co.CoCode, co.Name, co.Designation, co.Description, ssn.UID, ClassCode)
+			err = db.UpdateClass(&co, ssn.UID)
 			if nil != err {
-				errmsg := fmt.Sprintf("saveAdminEditClassHandler: Phonebook.prepstmt.adminUpdatePerson.Exec: err = %v\n", err)
+				errmsg := fmt.Sprintf("saveAdminEditClassHandler: db.UpdateClass: err = %v\n", err)
 				ulog(errmsg)
 				fmt.Println(errmsg)
 				http.Error(w, err.Error(), http.StatusInternalServerError)
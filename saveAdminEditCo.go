@@ -53,7 +53,7 @@ func saveAdminEditCoHandler(w http.ResponseWriter, r *http.Request) {
 	action := strings.ToLower(r.FormValue("action"))
 	if "delete" == action {
 		url := fmt.Sprintf("/delCompany/%d", CoCode)
-		http.Redirect(w, r, url, http.StatusFound)
+		http.Redirect(w, r, url, http.StatusTemporaryRedirect) // keeps the POST and its csrf field
 		return
 	}
 
@@ -93,31 +93,19 @@ func saveAdminEditCoHandler(w http.ResponseWriter, r *http.Request) {
 		filterSecurityMerge(&co, ssn, authz.ELEMCOMPANY, authz.PERMMOD, &c, 0) // merge
 
 		if 0 == CoCode {
-			_, err = Phonebook.prepstmt.insertCompany.Exec(c.LegalName, c.CommonName, c.Designation,
-				c.Email, c.Phone, c.Fax, c.Active, c.EmploysPersonnel,
-				c.Address, c.Address2, c.City, c.State, c.PostalCode, c.Country, ssn.UID)
-			errcheck(err)
-
-			// read this record back to get the CoCode...
-			rows, err := Phonebook.prepstmt.companyReadback.Query(c.CommonName, c.LegalName)
-			errcheck(err)
-			defer rows.Close()
-			nCoCode := 0 // quick way to handle multiple matches... in this case, largest CoCode wins, it hast to be the latest person added
-			for rows.Next() {
-				errcheck(rows.Scan(&CoCode))
-				if CoCode > nCoCode {
-					nCoCode = CoCode
-				}
+			err = db.InsertCompany(&c, ssn.UID)
+			if nil != err {
+				errmsg := fmt.Sprintf("saveAdminEditCoHandler: db.InsertCompany: err = %v\n", err)
+				ulog(errmsg)
+				fmt.Println(errmsg)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
 			}
-			errcheck(rows.Err())
-			CoCode = nCoCode
-			c.CoCode = CoCode
+			CoCode = c.CoCode
 		} else {
-			_, err = Phonebook.prepstmt.updateCompany.Exec(c.LegalName, c.CommonName, c.Designation, c.Email, c.Phone,
-				c.Fax, c.EmploysPersonnel, c.Active, c.Address, c.Address2, c.City, c.State,
-				c.PostalCode, c.Country, ssn.UID, CoCode)
+			err = db.UpdateCompany(&co, ssn.UID)
 			if nil != err {
-				errmsg := fmt.Sprintf("saveAdminEditCoHandler: Phonebook.prepstmt.updateCompany.Exec: err = %v\n", err)
+				errmsg := fmt.Sprintf("saveAdminEditCoHandler: db.UpdateCompany: err = %v\n", err)
 				ulog(errmsg)
 				fmt.Println(errmsg)
 				http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -125,6 +113,6 @@ func saveAdminEditCoHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 	}
-	loadCompanies() // It may be a new company, or its active/inactive status may have changed.
+	companiesChanged() // It may be a new company, or its active/inactive status may have changed.
 	http.Redirect(w, r, breadcrumbBack(ssn, 2), http.StatusFound)
 }
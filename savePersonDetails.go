@@ -1,7 +1,6 @@
 package main
 
 import (
-	"crypto/sha512"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awsutil"
@@ -13,9 +12,12 @@ import (
 	"net/http"
 	"os"
 	"path"
+	"phonebook/authn"
 	"phonebook/authz"
 	"phonebook/db"
+	"phonebook/idx"
 	"phonebook/lib"
+	"phonebook/pwhash"
 	"phonebook/sess"
 	"phonebook/ui"
 	"strconv"
@@ -202,28 +204,28 @@ func savePersonDetailsHandler(w http.ResponseWriter, r *http.Request) {
 		//=================================================================
 		//  Do the update
 		//=================================================================
-		_, err = Phonebook.prepstmt.updateMyDetails.Exec(d.PreferredName, d.PrimaryEmail, d.OfficePhone, d.CellPhone,
-			d.EmergencyContactName, d.EmergencyContactPhone,
-			d.HomeStreetAddress, d.HomeStreetAddress2, d.HomeCity, d.HomeState, d.HomePostalCode, d.HomeCountry,
-			ssn.UID, d.ProfileImagePath,
-			uid)
+		err = db.UpdateMyDetails(&d, ssn.UID)
 		if nil != err {
-			errmsg := fmt.Sprintf("savePersonDetailsHandler: Phonebook.prepstmt.updateMyDetails.Exec: err = %v\n", err)
+			errmsg := fmt.Sprintf("savePersonDetailsHandler: db.UpdateMyDetails: err = %v\n", err)
 			ulog(errmsg)
 			fmt.Println(errmsg)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
+		idx.Errlog("savePersonDetailsHandler", idx.UpdatePerson(uid)) // the preferred name may have changed
 
 		password := r.FormValue("password")
-		if "" != password {
-			sha := sha512.Sum512([]byte(password))
-			passhash := fmt.Sprintf("%x", sha)
-			_, err = Phonebook.prepstmt.updatePasswd.Exec(passhash, uid)
+		if "" != password && authn.LocalPassword(ssn.Username) {
+			passhash, err := pwhash.Hash(password)
+			if nil == err {
+				_, err = Phonebook.prepstmt.updatePasswd.Exec(passhash, uid)
+			}
 			if nil != err {
 				errmsg := fmt.Sprintf("savePersonDetailsHandler: Phonebook.prepstmt.updatePasswd.Exec: err = %v\n", err)
 				ulog(errmsg)
 				fmt.Println(errmsg)
 				http.Error(w, err.Error(), http.StatusInternalServerError)
+			} else {
+				sess.LogSecEvent(r, sess.SessionEvent(ssn, db.SECPWCHANGE, int64(uid), ssn.Username, ""))
 			}
 		}
 	}
@@ -6,9 +6,58 @@ import (
 	"phonebook/authz"
 	"phonebook/db"
 	"phonebook/sess"
-	"strings"
 )
 
+// searchSortColumns are the columns of the search results table that can
+// be sorted
+var searchSortColumns = []string{"FirstName", "LastName", "PreferredName", "PrimaryEmail", "OfficePhone", "CellPhone", "DeptName"}
+
+// searchURL returns the url for the search page with the filters in f
+func searchURL(f db.PeopleSearch) string {
+	return "/search/?" + f.Values().Encode()
+}
+
+// initSearchPaging fills in the paging and sorting links for the search
+// results in d.
+//-----------------------------------------------------------------------------
+func initSearchPaging(d *searchResults) {
+	f := d.Filter
+	d.First = 0
+	d.Last = 0
+	if len(d.Matches) > 0 {
+		d.First = f.Offset + 1
+		d.Last = f.Offset + len(d.Matches)
+	}
+	if f.Offset > 0 {
+		p := f
+		p.Offset -= p.Limit
+		if p.Offset < 0 {
+			p.Offset = 0
+		}
+		d.PrevURL = searchURL(p)
+	}
+	if int64(f.Offset+len(d.Matches)) < d.Total {
+		n := f
+		n.Offset += n.Limit
+		d.NextURL = searchURL(n)
+	}
+	d.SortURL = make(map[string]string, len(searchSortColumns))
+	for i := 0; i < len(searchSortColumns); i++ {
+		s := f
+		s.Offset = 0
+		s.SortField = searchSortColumns[i]
+		s.SortDesc = f.SortField == s.SortField && !f.SortDesc // clicking the current sort column reverses it
+		d.SortURL[s.SortField] = searchURL(s)
+	}
+	if len(f.Query) > 0 && f.SortField != db.SORTRELEVANCE {
+		s := f
+		s.Offset = 0
+		s.SortField = db.SORTRELEVANCE
+		s.SortDesc = false
+		d.SortURL[s.SortField] = searchURL(s)
+	}
+}
+
 func searchHandler(w http.ResponseWriter, r *http.Request) {
 	var ssn *sess.Session
 	var ui uiSupport
@@ -28,88 +77,23 @@ func searchHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/html")
 
 	var d searchResults
-	var s string
-	d.Query = strings.TrimSpace(r.FormValue("searchstring"))
-	inclterms := "" != r.FormValue("inclterms")
+	errcheck(r.ParseForm())
+	d.Filter = db.PeopleSearchFromValues(r.Form)
+	sess.PeopleSearchFilter(&d.Filter, ssn) // SECURITY: ignore filters on fields this user cannot see
+	d.Query = d.Filter.Query
 
-	searchTerms := strings.Split(d.Query, " ")
-
-	//===========================================================
-	//  First, determine the deptcodes that match this query...
-	//===========================================================
-	var dca []int
-	l := len(d.Query)
-	for deptname, deptcode := range ui.NameToDeptCode {
-		if l > 0 {
-			if strings.Contains(strings.ToLower(deptname), strings.ToLower(d.Query)) {
-				dca = append(dca, deptcode)
-			}
-		} else {
-			dca = append(dca, deptcode)
-		}
-	}
-
-	// Here are the major search fields
-	s = "select uid,lastname,firstname,preferredname,jobcode,primaryemail,officephone,officefax,cellphone,deptcode from people where "
-
-	// if the user has access and wants to include terminated employees...
-	if !inclterms {
-		s += "status>0 and "
-	}
-
-	// here are the general conditions
-	s += "("
-	if l > 0 {
-		switch len(searchTerms) {
-		case 2:
-			s += fmt.Sprintf(`((firstname like "%%%s%%" and lastname like "%%%s%%") or (PreferredName like "%%%s%%" and lastname like "%%%s%%") `,
-				searchTerms[0], searchTerms[1], searchTerms[0], searchTerms[1])
-		case 3:
-			s += fmt.Sprintf(`((firstname like "%%%s%%" and middlename like "%%%s%%" and lastname like "%%%s%%") or (PreferredName like "%%%s%%" and middlename like "%%%s%%" and lastname like "%%%s%%") `,
-				searchTerms[0], searchTerms[1], searchTerms[2], searchTerms[0], searchTerms[1], searchTerms[2])
-		default:
-			s += fmt.Sprintf("(lastname like \"%%%s%%\" or firstname like \"%%%s%%\" or PreferredName like \"%%%s%%\" ",
-				d.Query, d.Query, d.Query)
-
-		}
-		s += fmt.Sprintf("or primaryemail like \"%%%s%%\" or cellphone like \"%%%s%%\" or OfficePhone like \"%%%s%%\" or OfficeFax like \"%%%s%%\") ",
-			d.Query, d.Query, d.Query, d.Query)
-	}
-
-	// include departments...
-	if len(dca) > 0 {
-		if l > 0 {
-			s += "or "
-		}
-		s += "("
-		for i := 0; i < len(dca); i++ {
-			if i > 0 {
-				s += " or "
-			}
-			s += fmt.Sprintf("deptcode=%d", dca[i])
-		}
-		s += ") "
-	}
-	s += fmt.Sprintf(") order by lastname,firstname LIMIT 75")
-
-	// fmt.Printf("query = %s\n", s)
-	rows, err := Phonebook.db.Query(s)
+	m, total, err := db.SearchPeople(&d.Filter)
 	errcheck(err)
-	defer rows.Close()
-
-	for rows.Next() {
-		var m db.Person
-		errcheck(rows.Scan(&m.UID, &m.LastName, &m.FirstName, &m.PreferredName, &m.JobCode, &m.PrimaryEmail, &m.OfficePhone, &m.OfficeFax, &m.CellPhone, &m.DeptCode))
-		m.DeptName = getDepartmentFromDeptCode(m.DeptCode)
-		pm := &m
+	for i := 0; i < len(m); i++ {
 		// func (d *person) filterSecurityRead(sess *session, permRequired int) {
 		// 	filterSecurityRead(d, ELEMPERSON, sess, permRequired, d.UID)
 		// }
-		filterSecurityRead(pm, authz.ELEMPERSON, ssn, authz.PERMVIEW|authz.PERMMOD, m.UID)
-		d.Matches = append(d.Matches, m)
+		filterSecurityRead(&m[i], authz.ELEMPERSON, ssn, authz.PERMVIEW|authz.PERMMOD, m[i].UID)
 	}
-	errcheck(rows.Err())
-	if l == 0 {
+	d.Matches = m
+	d.Total = total
+	initSearchPaging(&d)
+	if len(d.Query) == 0 {
 		d.Query = " "
 	}
 	ui.R = &d
@@ -3,12 +3,14 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"phonebook/authz"
 	"phonebook/db"
+	"phonebook/idx"
+	"phonebook/qb"
 	"phonebook/sess"
 )
 
 func searchClassHandler(w http.ResponseWriter, r *http.Request) {
-	var s string
 	w.Header().Set("Content-Type", "text/html")
 	var ssn *sess.Session
 	var ui uiSupport
@@ -26,30 +28,14 @@ func searchClassHandler(w http.ResponseWriter, r *http.Request) {
 	var d searchClassResults
 
 	d.Query = r.FormValue("searchstring")
-	if len(d.Query) > 0 {
-		s = "select ClassCode,Name,Designation,Description from classes where "
-		s += fmt.Sprintf("Name like \"%%%s%%\" or Designation like \"%%%s%%\" or Description like \"%%%s%%\"",
-			d.Query, d.Query, d.Query)
-		s += fmt.Sprintf("order by Designation")
-		// fmt.Printf("query = %s\n", s)
-	} else {
+	d.Matches = searchClasses(d.Query)
+	if len(d.Query) == 0 {
 		d.Query = "  "
-		s = "select ClassCode,Name,Designation,Description from classes order by Designation"
 	}
-	rows, err := Phonebook.db.Query(s)
-	errcheck(err)
-	defer rows.Close()
-
-	for rows.Next() {
-		var c db.Class
-		errcheck(rows.Scan(&c.ClassCode, &c.Name, &c.Designation, &c.Description))
-		d.Matches = append(d.Matches, c)
-	}
-	errcheck(rows.Err())
 
 	ui.L = &d
 
-	err = renderTemplate(w, ui, "searchClass.html")
+	err := renderTemplate(w, ui, "searchClass.html")
 	if nil != err {
 		errmsg := fmt.Sprintf("searchClassHandler: err = %v\n", err)
 		ulog(errmsg)
@@ -57,3 +43,33 @@ func searchClassHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
+
+// searchClasses returns the classes whose name, designation, or description
+// contain query, along with those the name index matches. All classes are
+// returned if query is empty.
+//-----------------------------------------------------------------------------
+func searchClasses(query string) []db.Class {
+	var m []db.Class
+	q := qb.Select{
+		Cols:    "ClassCode,Name,Designation,Description",
+		From:    "classes",
+		OrderBy: "Designation",
+	}
+	if len(query) > 0 {
+		q.Where = qb.Or(qb.Contains("Name", query), qb.Contains("Designation", query), qb.Contains("Description", query))
+		if h := idx.Search(query, authz.ELEMCLASS, 0); len(h) > 0 { // include misspelled names
+			q.Where = qb.Or(q.Where, qb.InInts("ClassCode", idx.IDs(h)))
+		}
+	}
+	s, args := q.SQL()
+	rows, err := Phonebook.db.Query(s, args...)
+	errcheck(err)
+	defer rows.Close()
+	for rows.Next() {
+		var c db.Class
+		errcheck(rows.Scan(&c.ClassCode, &c.Name, &c.Designation, &c.Description))
+		m = append(m, c)
+	}
+	errcheck(rows.Err())
+	return m
+}
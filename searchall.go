@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"phonebook/authz"
+	"phonebook/db"
+	"phonebook/sess"
+	"strings"
+)
+
+// SEARCHALLMAX is the number of matches shown in each group of the
+// unified search page. The rest are reached through the per-entity pages.
+const SEARCHALLMAX = 10
+
+// searchAllHandler searches people, companies, and classes at once and
+// shows the matches in a group for each.
+//-----------------------------------------------------------------------------
+func searchAllHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html")
+	var ssn *sess.Session
+	var ui uiSupport
+	ssn = nil
+	if 0 < initHandlerSession(ssn, &ui, w, r) {
+		return
+	}
+	ssn = ui.X
+	breadcrumbReset(ssn, "Search", "/searchall/")
+
+	var d searchAllResults
+	d.Query = strings.TrimSpace(r.FormValue("searchstring"))
+	if len(d.Query) > 0 {
+		Phonebook.ReqCountersMem <- 1 // ask to access the shared mem, blocks until granted
+		<-Phonebook.ReqCountersMemAck // make sure we got it
+		Counters.SearchPeople++       // each group counts as a search of its own
+		Counters.SearchCompanies++
+		Counters.SearchClasses++
+		Phonebook.ReqCountersMemAck <- 1 // tell Dispatcher we're done with the data
+
+		//----------------------------------------------------
+		// People, with the same filtering as /search/
+		//----------------------------------------------------
+		f := db.NewPeopleSearch()
+		f.Query = d.Query
+		f.Limit = SEARCHALLMAX
+		sess.PeopleSearchFilter(&f, ssn)
+		m, total, err := db.SearchPeople(&f)
+		errcheck(err)
+		for i := 0; i < len(m); i++ {
+			filterSecurityRead(&m[i], authz.ELEMPERSON, ssn, authz.PERMVIEW|authz.PERMMOD, m[i].UID)
+		}
+		d.People = m
+		d.PeopleTotal = int(total)
+
+		//----------------------------------------------------
+		// Companies, with the same filtering as /searchco/
+		//----------------------------------------------------
+		co := searchCompanies(d.Query)
+		d.CompaniesTotal = len(co)
+		if len(co) > SEARCHALLMAX {
+			co = co[:SEARCHALLMAX]
+		}
+		for i := 0; i < len(co); i++ {
+			filterSecurityRead(&co[i], authz.ELEMCOMPANY, ssn, authz.PERMVIEW, 0)
+		}
+		d.Companies = co
+
+		//----------------------------------------------------
+		// Classes
+		//----------------------------------------------------
+		cl := searchClasses(d.Query)
+		d.ClassesTotal = len(cl)
+		if len(cl) > SEARCHALLMAX {
+			cl = cl[:SEARCHALLMAX]
+		}
+		for i := 0; i < len(cl); i++ {
+			filterSecurityRead(&cl[i], authz.ELEMCLASS, ssn, authz.PERMVIEW, 0)
+		}
+		d.Classes = cl
+	}
+	ui.G = &d
+
+	err := renderTemplate(w, ui, "searchall.html")
+	if nil != err {
+		errmsg := fmt.Sprintf("searchAllHandler: err = %v\n", err)
+		ulog(errmsg)
+		fmt.Println(errmsg)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
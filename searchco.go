@@ -5,6 +5,8 @@ import (
 	"net/http"
 	"phonebook/authz"
 	"phonebook/db"
+	"phonebook/idx"
+	"phonebook/qb"
 	"phonebook/sess"
 )
 
@@ -23,38 +25,22 @@ func searchCompaniesHandler(w http.ResponseWriter, r *http.Request) {
 	Counters.SearchCompanies++       // initialize our data
 	Phonebook.ReqCountersMemAck <- 1 // tell Dispatcher we're done with the data
 
-	var s string
 	var d searchCoResults
 
 	d.Query = r.FormValue("searchstring")
-	if len(d.Query) > 0 {
-		s = "select CoCode,LegalName,CommonName,Phone,Fax,Email,Designation from companies where "
-		s += fmt.Sprintf("LegalName like \"%%%s%%\" or CommonName like \"%%%s%%\" or Phone like \"%%%s%%\" or Fax like \"%%%s%%\" or email like \"%%%s%%\" or designation like \"%%%s%%\" ",
-			d.Query, d.Query, d.Query, d.Query, d.Query, d.Query)
-		s += fmt.Sprintf("order by Designation")
-		// fmt.Printf("query = %s\n", s)
-	} else {
-		s = "select CoCode,LegalName,CommonName,Phone,Fax,Email,Designation from companies order by Designation"
-		d.Query = " "
-	}
-	rows, err := Phonebook.db.Query(s)
-	errcheck(err)
-	defer rows.Close()
-
-	for rows.Next() {
-		var c db.Company
-		errcheck(rows.Scan(&c.CoCode, &c.LegalName, &c.CommonName, &c.Phone, &c.Fax, &c.Email, &c.Designation))
-		pc := &c
+	d.Matches = searchCompanies(d.Query)
+	for i := 0; i < len(d.Matches); i++ {
 		// func (c *db.Company) filterSecurityRead(ssn *sess.Session, permRequired int) {
 		// 	filterSecurityRead(c, authz.ELEMCOMPANY, ssn, permRequired, 0)
 		// }
-		filterSecurityRead(pc, authz.ELEMCOMPANY, ssn, authz.PERMVIEW, 0)
-		d.Matches = append(d.Matches, c)
+		filterSecurityRead(&d.Matches[i], authz.ELEMCOMPANY, ssn, authz.PERMVIEW, 0)
+	}
+	if len(d.Query) == 0 {
+		d.Query = " "
 	}
-	errcheck(rows.Err())
 
 	ui.T = &d
-	err = renderTemplate(w, ui, "searchco.html")
+	err := renderTemplate(w, ui, "searchco.html")
 
 	if nil != err {
 		errmsg := fmt.Sprintf("searchCompaniesHandler: err = %v\n", err)
@@ -63,3 +49,35 @@ func searchCompaniesHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
+
+// searchCompanies returns the companies whose names, phone numbers, email,
+// or designation contain query, along with those the name index matches.
+// All companies are returned if query is empty. The caller must apply
+// filterSecurityRead.
+//-----------------------------------------------------------------------------
+func searchCompanies(query string) []db.Company {
+	var m []db.Company
+	q := qb.Select{
+		Cols:    "CoCode,LegalName,CommonName,Phone,Fax,Email,Designation",
+		From:    "companies",
+		OrderBy: "Designation",
+	}
+	if len(query) > 0 {
+		q.Where = qb.Or(qb.Contains("LegalName", query), qb.Contains("CommonName", query), qb.Contains("Phone", query),
+			qb.Contains("Fax", query), qb.Contains("email", query), qb.Contains("designation", query))
+		if h := idx.Search(query, authz.ELEMCOMPANY, 0); len(h) > 0 { // include misspelled names
+			q.Where = qb.Or(q.Where, qb.InInts("CoCode", idx.IDs(h)))
+		}
+	}
+	s, args := q.SQL()
+	rows, err := Phonebook.db.Query(s, args...)
+	errcheck(err)
+	defer rows.Close()
+	for rows.Next() {
+		var c db.Company
+		errcheck(rows.Scan(&c.CoCode, &c.LegalName, &c.CommonName, &c.Phone, &c.Fax, &c.Email, &c.Designation))
+		m = append(m, c)
+	}
+	errcheck(rows.Err())
+	return m
+}
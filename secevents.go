@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"phonebook/authz"
+	"phonebook/db"
+	"phonebook/sess"
+)
+
+// secEvents is the data for the security events admin page
+type secEvents struct {
+	User   string        // username or uid filter
+	Type   string        // event type filter
+	From   string        // first day, yyyy-mm-dd
+	To     string        // last day, yyyy-mm-dd
+	Limit  int           // at most this many events
+	Types  []string      // the event types, for the type filter
+	Export string        // url of the JSON export of the events shown
+	Events []db.SecEvent // the events, the most recent first
+}
+
+// secEventsHandler lets an account security admin look through the
+// security events by user, type and date range. With format=json in the
+// query string the same events are returned as a JSON file for a SIEM.
+//-----------------------------------------------------------------------------
+func secEventsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html")
+	var ssn *sess.Session
+	var ui uiSupport
+	ssn = nil
+	if 0 < initHandlerSession(ssn, &ui, w, r) {
+		return
+	}
+	ssn = ui.X
+	breadcrumbAdd(ssn, "Security Events", "/secevents/")
+
+	//============================================================
+	// SECURITY
+	//============================================================
+	if !hasAllCoAccess(ssn, authz.ELEMPERSON, "Role", authz.PERMMOD) {
+		ulog("Permissions refuse secevents page on userid=%d (%s), role=%s\n", ssn.UID, ssn.Firstname, ssn.PMap.Urole.Name)
+		http.Redirect(w, r, "/search/", http.StatusFound)
+		return
+	}
+
+	f := db.SecEventFilterFromValues(r.URL.Query())
+	m, err := db.GetSecEvents(&f)
+	if err != nil {
+		errmsg := fmt.Sprintf("secEventsHandler: db.GetSecEvents: err = %v\n", err)
+		ulog(errmsg)
+		fmt.Println(errmsg)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if r.URL.Query().Get("format") == "json" {
+		b, err := json.MarshalIndent(m, "", "    ")
+		if err != nil {
+			errmsg := fmt.Sprintf("secEventsHandler: json.MarshalIndent: err = %v\n", err)
+			ulog(errmsg)
+			fmt.Println(errmsg)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", "attachment; filename=secevents.json")
+		w.Write(b)
+		return
+	}
+
+	v := f.Values()
+	q := secEvents{
+		User:   v.Get("user"),
+		Type:   f.Type,
+		From:   v.Get("from"),
+		To:     v.Get("to"),
+		Limit:  f.Limit,
+		Types:  db.SecEventTypes,
+		Events: m,
+	}
+	v.Set("format", "json")
+	q.Export = "/secevents/?" + v.Encode()
+	ui.V = &q
+
+	err = renderTemplate(w, ui, "secevents.html")
+	if nil != err {
+		errmsg := fmt.Sprintf("secEventsHandler: err = %v\n", err)
+		ulog(errmsg)
+		fmt.Println(errmsg)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
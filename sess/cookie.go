@@ -1,10 +1,15 @@
 package sess
 
 import (
-	"crypto/md5"
-	"fmt"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net"
+	"net/http"
 	"phonebook/db"
 	"phonebook/lib"
+	"strings"
 	"time"
 )
 
@@ -15,35 +20,174 @@ var SessionCookieName = string("air")
 
 // Cookie management for web client and web services
 
+// SESSIONTOKENLEN is the number of random bytes in a session token
+const SESSIONTOKENLEN = 32
+
+// NewSessionToken returns a new random session token. The token is the
+// cookie value, only its hash is stored in the sessions table.
+//-----------------------------------------------------------------------------
+func NewSessionToken() string {
+	b := make([]byte, SESSIONTOKENLEN)
+	_, err := rand.Read(b)
+	lib.Errcheck(err) // there is no safe way to continue without randomness
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// CSRFToken returns the token that forms posted with the supplied session
+// token must carry. It is derived from the session token, so it is the same
+// on every instance, changes when the session token is rotated, and cannot
+// be worked out without the session cookie or from the sessions table.
+//-----------------------------------------------------------------------------
+func CSRFToken(token string) string {
+	m := hmac.New(sha256.New, []byte(token))
+	m.Write([]byte("phonebook csrf"))
+	return base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+}
+
 // GenerateSessionCookie - create a new cookie
 //
 // INPUTS
 //  username   - user's login name
 //  useragent  - the user's client. If this is being called by another server
 //               via a web service, the server should pass in the user's agent
-//               used to make the request. This helps differentiate between the
-//               same user using multiple clients (perhaps different browsers
-//               at the same time).
-//  remoteaddr - the user's IP address in string form
+//               used to make the request. It is recorded with the session and
+//               can be required to match on later requests.
+//  remoteaddr - the user's IP address in string form. It is recorded with
+//               the session and can be required to match on later requests.
 //
 // RETURNS
-//  string     - a unique key identifier for the user
+//  db.SessionCookie - with a new random token in Cookie. Every login gets a
+//               different token.
 //-----------------------------------------------------------------------------
 func GenerateSessionCookie(UID int64, username, useragent, remoteaddr string) db.SessionCookie {
 	lib.Console("Entered GenerateSessionCookie:  ua = %s, ip = %s\n", useragent, remoteaddr)
 	var c db.SessionCookie
-	key := username + useragent + remoteaddr
-	c.Cookie = fmt.Sprintf("%x", md5.Sum([]byte(key)))
+	c.Cookie = NewSessionToken()
 	c.UID = UID
 	c.UserName = username
 	c.Expire = time.Now().Add(SessionManager.SessionTimeout * time.Minute)
 	c.UserAgent = useragent
 	c.IP = remoteaddr
-	lib.Console("GenerateSessionCookie    %s : %s : %s  --> %s\n", username, useragent, remoteaddr, c.Cookie)
+	lib.Console("GenerateSessionCookie    %s : %s : %s\n", username, useragent, remoteaddr)
 	lib.Console("   PAddr : User Agent    %s : %s\n", c.IP, c.UserAgent)
 	return c
 }
 
+// trustedProxy returns true if ip is one of the TrustedProxies in
+// config.json
+func trustedProxy(ip net.IP) bool {
+	for _, p := range lib.PBConfig.TrustedProxies {
+		if _, n, err := net.ParseCIDR(p); err == nil {
+			if n.Contains(ip) {
+				return true
+			}
+		} else if ip.Equal(net.ParseIP(p)) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address of the client that sent r, without the
+// port, as recorded with sessions and used to throttle sign ins. Anyone can
+// send X-Forwarded-For, so it is only used when the request came from one
+// of the TrustedProxies. The client is then the right-most address in it
+// that is not a trusted proxy. Addresses to the left of that one came from
+// the client and could be anything.
+//-----------------------------------------------------------------------------
+func ClientIP(r *http.Request) string {
+	host := r.RemoteAddr
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	ip := net.ParseIP(host)
+	if ip != nil && trustedProxy(ip) {
+		hops := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := net.ParseIP(strings.TrimSpace(hops[i]))
+			if hop == nil {
+				break // not written by a proxy we trust, keep the last good one
+			}
+			host = hop.String()
+			if !trustedProxy(hop) {
+				break
+			}
+		}
+	}
+	if len(host) > 40 { // size of the sessions table column
+		host = host[:40]
+	}
+	return host
+}
+
+// BindingOK returns true if a session created from ip with user agent ua
+// may be used by a client at reqIP with user agent reqUA. The checks are
+// only made when they are turned on with SessionBindIP and SessionBindUA
+// in config.json.
+//-----------------------------------------------------------------------------
+func BindingOK(ip, ua, reqIP, reqUA string) bool {
+	if lib.PBConfig.SessionBindIP && ip != reqIP {
+		lib.Ulog("session refused: created from IP %s, used from %s\n", ip, reqIP)
+		return false
+	}
+	if lib.PBConfig.SessionBindUA && ua != reqUA {
+		lib.Ulog("session refused: created from user agent %q, used from %q\n", ua, reqUA)
+		return false
+	}
+	return true
+}
+
+// RequestBindingOK returns true if the session created from ip with user
+// agent ua may be used for the request r. See BindingOK.
+//-----------------------------------------------------------------------------
+func RequestBindingOK(ip, ua string, r *http.Request) bool {
+	return BindingOK(ip, ua, ClientIP(r), r.Header.Get("User-Agent"))
+}
+
+// SetSessionCookie sends the session's token to the browser. It also puts
+// it in r, replacing any earlier session cookie, so that a handler called
+// directly after this one finds the session. The cookie is only sent over
+// https if that is how users reach phonebook.
+//-----------------------------------------------------------------------------
+func SetSessionCookie(w http.ResponseWriter, r *http.Request, s *Session, expire time.Time) {
+	cookie := http.Cookie{
+		Name:     SessionCookieName,
+		Value:    s.Token,
+		Expires:  expire,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(lib.PBConfig.BaseURL, "https:"),
+		SameSite: http.SameSiteLaxMode,
+	}
+	http.SetCookie(w, &cookie)
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for i := 0; i < len(cookies); i++ {
+		if cookies[i].Name != SessionCookieName {
+			r.AddCookie(cookies[i])
+		}
+	}
+	r.AddCookie(&cookie)
+}
+
+// RotateToken gives the session a new token, in memory and in the sessions
+// table. The old token stops working. Call it whenever the privileges of a
+// session change, then send the new token with SetSessionCookie.
+//-----------------------------------------------------------------------------
+func RotateToken(s *Session) error {
+	token := NewSessionToken()
+	if err := db.UpdateSessionToken(s.Token, token); err != nil {
+		return err
+	}
+	SessionManager.ReqSessionMem <- 1 // ask to access the shared mem, blocks until granted
+	<-SessionManager.ReqSessionMemAck // make sure we got it
+	delete(Sessions, s.Token)
+	s.Token = token
+	Sessions[token] = s
+	SessionManager.ReqSessionMemAck <- 1 // tell SessionDispatcher we're done with the data
+	return nil
+}
+
 // GetSessionCookie - try to find the supplied cookie
 //
 // INPUTS
@@ -84,8 +228,9 @@ func UpdateSessionCookie(s *Session) error {
 	return err
 }
 
-// DeleteSessionCookie - remove the cookie from the session list. This is called
-//                when the user explicitly logs out rather
+// DeleteSessionCookie - remove the cookie from the session db table. This
+//                is called when the user explicitly logs out rather than
+//                letting the session time out.
 //
 // INPUTS
 //  s           - the session containing the cookie
@@ -94,7 +239,7 @@ func UpdateSessionCookie(s *Session) error {
 //  error       - any errors encountered, or nil if no errors
 //-----------------------------------------------------------------------------
 func DeleteSessionCookie(s *Session) error {
-	return nil
+	return db.DeleteSessionCookie(s.Token)
 }
 
 // ExpiredCookieCleaner removes sessions that have timed out
@@ -0,0 +1,144 @@
+package sess
+
+import (
+	"fmt"
+	"phonebook/authz"
+	"phonebook/db"
+	"reflect"
+)
+
+// ExplainCheck is one of the reads the explain tools can check. Perm must
+// be the permRequired that the page or service passes to FilterSecurityRead.
+type ExplainCheck struct {
+	Name  string // short name, for the command line
+	Descr string // what does the read
+	Elem  int    // element read: authz.ELEMPERSON, ELEMCOMPANY or ELEMCLASS
+	Perm  int    // permRequired
+}
+
+// ExplainChecks are the reads the explain tools can check
+var ExplainChecks = []ExplainCheck{
+	{"detail", "Person detail page", authz.ELEMPERSON, authz.PERMVIEW | authz.PERMMGRVIEW},
+	{"adminview", "Person admin view and edit", authz.ELEMPERSON, authz.PERMVIEW | authz.PERMMOD},
+	{"people", "People web service", authz.ELEMPERSON, authz.PERMVIEW | authz.PERMOWNERVIEW | authz.PERMMGRVIEW},
+	{"company", "Company pages and web service", authz.ELEMCOMPANY, authz.PERMVIEW},
+	{"class", "Business unit pages and web service", authz.ELEMCLASS, authz.PERMVIEW},
+}
+
+// FindExplainCheck returns the check with the supplied name, or nil
+func FindExplainCheck(name string) *ExplainCheck {
+	for i := 0; i < len(ExplainChecks); i++ {
+		if ExplainChecks[i].Name == name {
+			return &ExplainChecks[i]
+		}
+	}
+	return nil
+}
+
+// FieldExplain tells how the permissions of a session apply to one field
+type FieldExplain struct {
+	Field string // field name
+	Perm  int    // the session's permissions on the field
+	Found bool   // false if the role has no permission for the field
+	Read  bool   // true if FilterSecurityRead leaves the field as it is
+	Why   string // what granted or denied the read
+	View  bool   // hasFieldAccess PERMVIEW, which the pages use to show a field
+	Mod   bool   // hasFieldAccess PERMMOD, which the pages use to offer a change
+}
+
+// Explanation tells how the permissions of a session apply to some data
+type Explanation struct {
+	Role   string         // name of the session's role
+	Scope  string         // which of the role's permissions apply to the data
+	Fields []FieldExplain // every field of the data, in order
+}
+
+// PreviewSession returns a session, neither signed in nor in Sessions, for
+// the person with the supplied uid and company holding the role rid. Its
+// permissions are set up the same way as those of a new session.
+//-----------------------------------------------------------------------------
+func PreviewSession(uid int64, coCode int, rid int) *Session {
+	s := new(Session)
+	s.UID = uid
+	s.CoCode = coCode
+	authz.GetRoleInfo(rid, &s.PMap)
+	s.PMap.SetOwnCompany(coCode)
+	return s
+}
+
+// ExplainViewer returns a PreviewSession for the person with the supplied
+// uid. If rid is not 0 it holds that role instead of their own.
+//-----------------------------------------------------------------------------
+func ExplainViewer(uid int, rid int) (*Session, error) {
+	var d db.PersonDetail
+	d.UID = uid
+	if err := db.GetPersonDetail(&d); err != nil {
+		return nil, err
+	}
+	if rid == 0 {
+		rid = d.RID
+	}
+	return PreviewSession(int64(uid), d.CoCode, rid), nil
+}
+
+// ExplainData reads the data that check c reads for the person, company or
+// class with the supplied id.
+//
+// RETURNS
+//  the data, for Explain or FilterSecurityRead
+//  the dataUID to pass with it
+//  any error encountered
+//-----------------------------------------------------------------------------
+func ExplainData(c *ExplainCheck, id int) (interface{}, int, error) {
+	switch c.Elem {
+	case authz.ELEMPERSON:
+		var d db.PersonDetail
+		d.UID = id
+		return &d, id, db.GetPersonDetail(&d)
+	case authz.ELEMCOMPANY:
+		var d db.Company
+		return &d, 0, db.GetCompanyInfo(id, &d)
+	case authz.ELEMCLASS:
+		var d db.Class
+		return &d, 0, db.GetClassInfo(id, &d)
+	}
+	return nil, 0, fmt.Errorf("unknown element %d", c.Elem)
+}
+
+// Explain reports what FilterSecurityRead would do with each field of d,
+// and why, along with what hasFieldAccess reports for the field. The
+// arguments are those of FilterSecurityRead, but d is not changed. ssn must
+// not be in Sessions, see PreviewSession.
+//-----------------------------------------------------------------------------
+func Explain(d interface{}, el int, ssn *Session, permRequired int, dataUID int) Explanation {
+	var x Explanation
+	x.Role = ssn.PMap.Urole.Name
+	pm := readPerms(ssn, d)
+	coCode, hasCo := dataCoCode(d)
+	switch {
+	case ssn.PMap.Scope == authz.SCOPEALL:
+		x.Scope = "the role applies to all companies"
+	case !hasCo:
+		x.Scope = "the data does not belong to a company, the role's own permissions apply"
+	case pm == &ssn.PMap:
+		x.Scope = fmt.Sprintf("company %d is one of the role's companies", coCode)
+	case ssn.PMap.Urole.OutRID != 0:
+		x.Scope = fmt.Sprintf("company %d is not one of the role's companies, the permissions of role %s apply, limited to the role's own",
+			coCode, authz.RoleName(ssn.PMap.Urole.OutRID))
+	default:
+		x.Scope = fmt.Sprintf("company %d is not one of the role's companies, the role has no permissions outside them", coCode)
+	}
+
+	pa := personAccess{ssn: ssn, uid: dataUID}
+	val := reflect.ValueOf(d).Elem()
+	for i := 0; i < val.NumField(); i++ {
+		var f FieldExplain
+		f.Field = val.Type().Field(i).Name
+		f.Perm, _ = elemPerm(pm, el, f.Field)
+		_, f.Found, f.Read, f.Why = readAccess(pm, el, f.Field, permRequired, &pa)
+		f.View = CoAccess(ssn, el, f.Field, authz.PERMVIEW, -1)
+		f.Mod = CoAccess(ssn, el, f.Field, authz.PERMMOD, -1)
+		x.Fields = append(x.Fields, f)
+	}
+	return x
+}
@@ -0,0 +1,56 @@
+package sess
+
+import (
+	"fmt"
+	"net/http"
+	"phonebook/authz"
+	"phonebook/db"
+	"phonebook/lib"
+)
+
+// LogSecEvent adds e to the security events. The address and client of the
+// request r are used unless e already has them. What e records has already
+// happened, so a failure to add it is logged rather than returned.
+//-----------------------------------------------------------------------------
+func LogSecEvent(r *http.Request, e db.SecEvent) {
+	if len(e.IP) == 0 {
+		e.IP = ClientIP(r)
+	}
+	if len(e.UserAgent) == 0 {
+		e.UserAgent = r.Header.Get("User-Agent")
+	}
+	if err := db.InsertSecEvent(&e); err != nil {
+		lib.Ulog("LogSecEvent: could not add %s event for %s: %s\n", e.Type, e.ActorName, err.Error())
+	}
+}
+
+// SessionEvent returns a security event of type typ done by the person signed
+// in to s. If they are acting as someone else, through /become/, the actor
+// is still the person who signed in and the detail says who they were
+// acting as.
+//-----------------------------------------------------------------------------
+func SessionEvent(s *Session, typ string, target int64, targetName, detail string) db.SecEvent {
+	e := db.SecEvent{Type: typ, Actor: s.UIDorig, ActorName: s.UsernameOrig, Target: target, TargetName: targetName, Detail: detail}
+	if s.UIDorig != s.UID {
+		e.Detail = fmt.Sprintf("acting as %s (%d)", s.Username, s.UID)
+		if len(detail) > 0 {
+			e.Detail += ", " + detail
+		}
+	}
+	return e
+}
+
+// LogRoleChange adds a role-assign event if the person uid, whose username
+// is username, was given a role other than oldRID by the person signed in to
+// s. A new person has an oldRID of 0.
+//-----------------------------------------------------------------------------
+func LogRoleChange(r *http.Request, s *Session, uid int, username string, oldRID, newRID int) {
+	if oldRID == newRID {
+		return
+	}
+	detail := fmt.Sprintf("role %s", authz.RoleName(newRID))
+	if oldRID > 0 {
+		detail = fmt.Sprintf("role changed from %s to %s", authz.RoleName(oldRID), authz.RoleName(newRID))
+	}
+	LogSecEvent(r, SessionEvent(s, db.SECROLEASSIGN, int64(uid), username, detail))
+}
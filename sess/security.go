@@ -0,0 +1,462 @@
+package sess
+
+import (
+	"fmt"
+	"phonebook/authz"
+	"phonebook/db"
+	"phonebook/lib"
+	"reflect"
+	"time"
+)
+
+// sulog is the security debug logger. Messages are only logged if the
+// session manager was initialized with security debugging enabled.
+func sulog(format string, a ...interface{}) {
+	if SessionManager.SecurityDebug {
+		lib.Ulog(format, a...)
+	}
+}
+
+// elemPerm returns the permission pm has for the supplied field of the
+// supplied element type.
+//-----------------------------------------------------------------------------
+func elemPerm(pm *authz.PermMaps, el int, n string) (int, bool) {
+	var perm int
+	var ok bool
+	switch el {
+	case authz.ELEMPERSON:
+		perm, ok = pm.Pp[n] // here's the permission we have
+	case authz.ELEMCOMPANY:
+		perm, ok = pm.Pco[n] // here's the permission we have
+	case authz.ELEMCLASS:
+		perm, ok = pm.Pcl[n] // here's the permission we have
+	case authz.ELEMPBSVC:
+		perm, ok = pm.Ppr[n] // here's the permission we have
+	}
+	return perm, ok
+}
+
+// CoAccess returns true if s has any of the access bits on field n of
+// element el for data that belongs to the company coCode. A coCode of -1
+// checks the role's own permissions. The caller must hold the session
+// memory unless s is not in Sessions.
+//-----------------------------------------------------------------------------
+func CoAccess(s *Session, el int, n string, access int, coCode int) bool {
+	pm := &s.PMap
+	if coCode >= 0 {
+		pm = s.PMap.For(coCode)
+	}
+	perm, _ := elemPerm(pm, el, n)
+	return 0 != perm&access
+}
+
+// HasCoAccess is CoAccess for a signed in session
+//-----------------------------------------------------------------------------
+func HasCoAccess(s *Session, el int, n string, access int, coCode int) bool {
+	SessionManager.ReqSessionMem <- 1 // ask to access the shared mem, blocks until granted
+	<-SessionManager.ReqSessionMemAck // make sure we got it
+	ok := CoAccess(s, el, n, access, coCode)
+	SessionManager.ReqSessionMemAck <- 1 // tell SessionDispatcher we're done with the data
+	return ok
+}
+
+// HasAllCoAccess returns true if s has any of the access bits on field n of
+// element el in every company. It is for pages and services that are not
+// about the data of one company, such as the role and API key admin pages,
+// which a role limited to some companies must not reach through the
+// permissions it has inside its scope.
+//-----------------------------------------------------------------------------
+func HasAllCoAccess(s *Session, el int, n string, access int) bool {
+	SessionManager.ReqSessionMem <- 1 // ask to access the shared mem, blocks until granted
+	<-SessionManager.ReqSessionMemAck // make sure we got it
+	perm, _ := elemPerm(s.PMap.Everywhere(), el, n)
+	SessionManager.ReqSessionMemAck <- 1 // tell SessionDispatcher we're done with the data
+	return 0 != perm&access
+}
+
+// CoversRole returns true if s allows everything the role r allows,
+// wherever r allows it, so that s may create r or give it to someone.
+//-----------------------------------------------------------------------------
+func CoversRole(s *Session, r *authz.Role) bool {
+	SessionManager.ReqSessionMem <- 1 // ask to access the shared mem, blocks until granted
+	<-SessionManager.ReqSessionMemAck // make sure we got it
+	ok := s.PMap.Covers(r)
+	SessionManager.ReqSessionMemAck <- 1 // tell SessionDispatcher we're done with the data
+	return ok
+}
+
+// CanGrantRole returns true if s may give someone, or an API key, the role
+// rid. It is false if there is no such role.
+//-----------------------------------------------------------------------------
+func CanGrantRole(s *Session, rid int) bool {
+	roles := authz.GetRoles()
+	for i := 0; i < len(roles); i++ {
+		if roles[i].RID == rid {
+			return CoversRole(s, &roles[i])
+		}
+	}
+	return false
+}
+
+// dataCoCode returns the CoCode field of the struct d points to, if it has
+// one.
+func dataCoCode(d interface{}) (int, bool) {
+	f := reflect.ValueOf(d).Elem().FieldByName("CoCode")
+	if !f.IsValid() || f.Kind() != reflect.Int {
+		return 0, false
+	}
+	return int(f.Int()), true
+}
+
+// readPerms returns the permissions ssn has for reading d. If the session's
+// role is limited to some companies they depend on the company d belongs
+// to. Data that does not belong to a company is not limited.
+//-----------------------------------------------------------------------------
+func readPerms(ssn *Session, d interface{}) *authz.PermMaps {
+	coCode, ok := dataCoCode(d)
+	if !ok {
+		return &ssn.PMap
+	}
+	return ssn.PMap.For(coCode)
+}
+
+// mergePerms returns the permissions ssn has for merging dNew into d. Both
+// the company d belongs to and, for a new record or one being moved, the
+// company in dNew must be in the session's scope.
+//-----------------------------------------------------------------------------
+func mergePerms(ssn *Session, d, dNew interface{}) *authz.PermMaps {
+	old, ok := dataCoCode(d)
+	if !ok {
+		return &ssn.PMap
+	}
+	nw, _ := dataCoCode(dNew)
+	pm := &ssn.PMap
+	if old != 0 {
+		pm = ssn.PMap.For(old)
+	}
+	if (old == 0 || nw != 0) && !ssn.PMap.InScope(nw) {
+		pm = ssn.PMap.For(nw)
+	}
+	return pm
+}
+
+// personAccess decides whether the owner and manager permission bits give a
+// session access to the data of one person. Whether the session belongs to
+// one of the person's managers of record is only looked up when needed,
+// and then only once.
+type personAccess struct {
+	ssn *Session
+	uid int // uid of the person whose data is being accessed
+	mgr int // 0 = not looked up yet, 1 = a manager of record, -1 = not
+}
+
+// grant returns true if pcheck, the permissions both held and required,
+// grants access, along with the reason. The owner bit only counts for the
+// person themself and the manager bit only for their managers of record.
+func (a *personAccess) grant(pcheck, ownerBit int) (bool, string) {
+	if p := pcheck &^ (ownerBit | authz.PERMMGRVIEW); p != 0 {
+		return true, "granted by " + authz.PermString(p)
+	}
+	if pcheck&ownerBit != 0 && int64(a.uid) == a.ssn.UID {
+		return true, "granted by " + authz.PermString(ownerBit) + ", the viewer is the person"
+	}
+	if pcheck&authz.PERMMGRVIEW != 0 && a.isManager() {
+		return true, fmt.Sprintf("granted by Manager View, the viewer is within %d levels above the person", lib.PBConfig.ManagerDepth)
+	}
+	why := "denied, the role only has " + authz.PermString(pcheck)
+	if pcheck&ownerBit != 0 {
+		why += ", the viewer is not the person"
+	}
+	if pcheck&authz.PERMMGRVIEW != 0 {
+		why += fmt.Sprintf(", the viewer is not within %d levels above the person", lib.PBConfig.ManagerDepth)
+	}
+	return false, why
+}
+
+// isManager returns true if the session belongs to one of the first
+// lib.PBConfig.ManagerDepth people in the MgrUID chain above a.uid
+func (a *personAccess) isManager() bool {
+	if a.mgr == 0 {
+		a.mgr = -1
+		ok, err := db.IsManagerOf(a.ssn.UID, a.uid, lib.PBConfig.ManagerDepth)
+		if err != nil {
+			lib.Ulog("personAccess: could not read managers of uid %d: %s\n", a.uid, err.Error())
+		}
+		if ok {
+			a.mgr = 1
+		}
+	}
+	return a.mgr > 0
+}
+
+// readAccess decides whether field n of element el can be read with the
+// permissions in pm. This is the test FilterSecurityRead makes on each
+// field, and the explain tools report it.
+//
+// RETURNS
+//  pcheck - the permissions in pm that are also in permRequired
+//  found  - false if pm has no permission for the field, it is not filtered
+//  ok     - true if the field can be read
+//  why    - what granted or denied it
+//-----------------------------------------------------------------------------
+func readAccess(pm *authz.PermMaps, el int, n string, permRequired int, pa *personAccess) (int, bool, bool, string) {
+	perm, found := elemPerm(pm, el, n)
+	if !found {
+		return 0, false, true, "not in the role's field permissions, not filtered"
+	}
+	pcheck := permRequired & perm // and it with the required permissions
+	if pcheck == 0 {
+		return 0, true, false, "denied, the role has " + authz.PermString(perm) + ", not " + authz.PermString(permRequired)
+	}
+	if el != authz.ELEMPERSON {
+		return pcheck, true, true, "granted by " + authz.PermString(pcheck)
+	}
+	ok, why := pa.grant(pcheck, authz.PERMOWNERVIEW) // the session uid needs to be the data uid or one of its managers
+	return pcheck, true, ok, why
+}
+
+//=========================================================================================
+// SYNOPSIS:
+//      FilterSecurityRead filters the data in d based on the permissions provided. If the
+//		permissions required are not met, the field is zeroed out.  To meet the requirement
+//		the ssn.Sessions permission for this field will be logically anded to the supplied
+//      perm.  If the result is non-zero, the condition is met.
+// ARGS:
+//      d            = the struct we want access to
+//		el			 = type of element: authz.ELEMPERSON, authz.ELEMCOMPANY, authz.ELEMCLASS
+//   	ssn          = session of the logged in user
+//   	permRequired = logical or of the required permissions.  Example authz.PERMVIEW | authz.PERMOWNERVIEW
+//		dataUID      = only used if el == PERSON. authz.PERMOWNERVIEW only grants access
+//		               if it is the session's uid, and authz.PERMMGRVIEW only if the
+//		               session's uid is one of its managers of record.
+//		If the session's role is limited to some companies and d has a CoCode that is
+//		not one of them, the role's permissions outside its scope are used.
+// RETURNS:
+//      ret val = the permissions found logically ANDed with permRequired.  This can be
+//				  useful for determining whether or not to check the OWNER uid to that of
+//				  the data being accessed. For example, if the data is accessible because of
+//				  authz.PERMOWNERMOD, the caller can compare the return value to authz.PERMOWNERMOD. If
+//				  equal, it needs to further check that the session uid matches the uid of the
+//				  data being edited before it allows the edit to proceed.
+//   	the data elements for this struct filtered based on the permissions associated
+//				  with the logged in user's session
+//=========================================================================================
+func FilterSecurityRead(d interface{}, el int, ssn *Session, permRequired int, dataUID int) int {
+	sulog("FilterSecurityRead: d, permRequired=0x%02x, session: %+v\n", permRequired, ssn)
+	pcheck := 0
+	pm := readPerms(ssn, d) // before CoCode is filtered out
+	pa := personAccess{ssn: ssn, uid: dataUID}
+	val := reflect.ValueOf(d).Elem()
+	for i := 0; i < val.NumField(); i++ {
+		field := val.Field(i)         // this is the struct (Foo)
+		n := val.Type().Field(i).Name // variable name for field(i)
+		t := field.Type().String()    // the variable type
+
+		sulog("%d. %s\n", i, n)
+		// Does this field have the required permissions?
+		p, found, ok, why := readAccess(pm, el, n, permRequired, &pa)
+		sulog("    %s\n", why)
+		if !found { // this means that the variable was not found in the access list
+			continue // if it's not there, we can ignore it
+		}
+		pcheck = p
+		if ok {
+			sulog("    requested permission granted\n")
+		} else if field.IsValid() {
+			if field.CanSet() {
+				sulog("    no permissions for this field - will zero out...\n")
+				switch t {
+				case "int":
+					sulog("No access to %s, type int, setting to 0\n", n)
+					field.SetInt(0)
+				case "string":
+					sulog("No access to %s, type string, setting to 0 length string\n", n)
+					field.SetString("")
+				case "time.Time":
+					sulog("No access to %s, type time.Time, setting to 0\n", n)
+					field.Set(reflect.ValueOf(time.Date(0, 0, 0, 0, 0, 0, 0, time.UTC)))
+				case "[]int":
+					sulog("No access to %s, type []int, setting to 0\n", n)
+					field.Set(reflect.ValueOf([]int{}))
+				default:
+					lib.Ulog("FilterSecurityRead: unhandled variable type. Name = %s, type = %s\n", n, t)
+				}
+			}
+		}
+	}
+	return pcheck
+}
+
+// FilterChanges returns the changes in m whose field can be read, using the
+// same test FilterSecurityRead makes on each field. The changes are to the
+// data of element el that belongs to the company coCode, and dataUID is as
+// for FilterSecurityRead. A change is dropped along with its field, so
+// neither its old nor its new value is seen.
+//-----------------------------------------------------------------------------
+func FilterChanges(m []db.Change, el int, ssn *Session, permRequired int, coCode int, dataUID int) []db.Change {
+	var r []db.Change
+	pm := ssn.PMap.For(coCode)
+	pa := personAccess{ssn: ssn, uid: dataUID}
+	for i := 0; i < len(m); i++ {
+		if _, _, ok, _ := readAccess(pm, el, m[i].Field, permRequired, &pa); ok {
+			r = append(r, m[i])
+		}
+	}
+	return r
+}
+
+//=========================================================================================
+// SYNOPSIS:
+//      FilterSecurityMerge merges the data in dNew with that of d based on the permissions
+//      in the sess.Session. The fields in d will be updated to the values
+//		in dNew provided the field permission allows it. The net result is that the values
+//		in d are merged with values of dNew where it is allowed. The resulting d is
+//		suitable for writing back to the database.
+// ARGS:
+// 		ssn         = session of the logged in user. If its role is limited to some
+// 		              companies, the company of d and, for a new record or one being
+// 		              moved, that of dNew must be in scope for the role's own permissions
+// 		              to apply.
+// 		permRequired = logical or of the required permissions.  Example authz.PERMMOD | authz.PERMOWNERMOD
+// 		dNew         = an updated version of d.
+// RETURNS:
+// 		the data elements for this struct filtered based on the supplied perm value
+//=========================================================================================
+func FilterSecurityMerge(d interface{}, ssn *Session, el int, permRequired int, dNew interface{}, UID int) {
+	val := reflect.ValueOf(d).Elem()
+	valNew := reflect.ValueOf(dNew).Elem()
+	pm := mergePerms(ssn, d, dNew)
+
+	for i := 0; i < val.NumField(); i++ {
+		field := val.Field(i)         // the next field in the structure
+		fieldNew := valNew.Field(i)   // the corresponding field in the new structure
+		n := val.Type().Field(i).Name // variable name for field(i)
+		t := field.Type().String()    // the variable type
+
+		// Do we have the required permissions to update this field?
+		perm, ok := elemPerm(pm, el, n)
+		if !ok { // !ok here means that the variable was not found in the access list
+			continue // if it's not there, we can ignore it
+		}
+		pcheck := permRequired & perm                                     // AND it with the required permissions
+		ok = 0 != pcheck                                                  // if the result is non-zero, the first test passes
+		if el == authz.ELEMPERSON && ok && pcheck == authz.PERMOWNERMOD { // if we passed it still may be an ownerMOD result...
+			ok = int64(UID) == ssn.UID // if so, the session uid needs to match the data uid to proceed
+		}
+
+		if ok && field.IsValid() {
+			if field.CanSet() {
+				switch t {
+				case "int":
+					field.Set(reflect.ValueOf(fieldNew.Interface()))
+				case "string":
+					field.SetString(fieldNew.String())
+				case "time.Time":
+					field.Set(reflect.ValueOf(fieldNew.Interface()))
+				case "[]int":
+					field.Set(reflect.ValueOf(fieldNew.Interface()))
+				default:
+					lib.Ulog("FilterSecurityMerge: unhandled variable type: %s\n", t)
+				}
+			}
+		}
+	}
+}
+
+// ListParamsFilter removes the search terms and sort order from p that refer
+// to fields of element el the session is not allowed to view, as
+// PeopleSearchFilter does for people. If the session's role is limited to
+// some companies, a field must be visible outside them too.
+//-----------------------------------------------------------------------------
+func ListParamsFilter(p *db.ListParams, el int, ssn *Session) {
+	SessionManager.ReqSessionMem <- 1 // ask to access the shared mem, blocks until granted
+	<-SessionManager.ReqSessionMemAck // make sure we got it
+	canView := func(n string) bool {
+		perm, ok := elemPerm(&ssn.PMap, el, n)
+		if ssn.PMap.Out != nil {
+			out, _ := elemPerm(ssn.PMap.Out, el, n)
+			perm &= out
+		}
+		return ok && 0 != perm&authz.PERMVIEW
+	}
+	var m []db.SearchTerm
+	for i := 0; i < len(p.Search); i++ {
+		if canView(p.Search[i].Field) {
+			m = append(m, p.Search[i])
+		}
+	}
+	p.Search = m
+	if len(p.SortField) > 0 && !canView(p.SortField) {
+		p.SortField = ""
+	}
+	SessionManager.ReqSessionMemAck <- 1 // tell SessionDispatcher we're done with the data
+}
+
+// PeopleSearchFilter removes the filters and sort order from f that refer to
+// person fields the session is not allowed to view. Otherwise a user could
+// learn the value of a hidden field by filtering on it. Searching inactive
+// people requires PERMMOD on Termination, the same as the search page's
+// "Include inactive employees" checkbox. If the session's role is limited
+// to some companies, a field must be visible outside them too, and if the
+// role can see no one outside them the search only finds people in them.
+//-----------------------------------------------------------------------------
+func PeopleSearchFilter(f *db.PeopleSearch, ssn *Session) {
+	SessionManager.ReqSessionMem <- 1 // ask to access the shared mem, blocks until granted
+	<-SessionManager.ReqSessionMemAck // make sure we got it
+	canView := func(n string) bool {
+		perm, ok := ssn.PMap.Pp[n]
+		if ssn.PMap.Out != nil {
+			perm &= ssn.PMap.Out.Pp[n]
+		}
+		return ok && 0 != perm&authz.PERMVIEW
+	}
+	if out := ssn.PMap.Out; out != nil {
+		seen := false
+		for _, perm := range out.Pp {
+			seen = seen || 0 != perm&authz.PERMVIEW
+		}
+		if !seen {
+			f.CoCodes = append([]int{}, ssn.PMap.CoCodes...)
+		}
+	}
+	if !canView("CoCode") {
+		f.CoCode = 0
+	}
+	if !canView("ClassCode") {
+		f.ClassCode = 0
+	}
+	if !canView("DeptCode") {
+		f.DeptCode = 0
+	}
+	if !canView("JobCode") {
+		f.JobCode = 0
+	}
+	if !canView("MgrUID") {
+		f.MgrUID = 0
+		f.MgrName = ""
+	}
+	if !canView("StateOfEmployment") {
+		f.StateOfEmployment = ""
+	}
+	if !canView("CountryOfEmployment") {
+		f.CountryOfEmployment = ""
+	}
+	if f.Status != 1 && 0 == ssn.PMap.Pp["Termination"]&authz.PERMMOD {
+		f.Status = 1
+	}
+	switch f.SortField {
+	case "FirstName", "LastName", "PreferredName", "PrimaryEmail", "OfficePhone", "CellPhone":
+		if !canView(f.SortField) {
+			f.SortField = "LastName"
+		}
+	case "DeptName":
+		if !canView("DeptCode") {
+			f.SortField = "LastName"
+		}
+	case "Employer":
+		if !canView("CoCode") {
+			f.SortField = "LastName"
+		}
+	}
+	SessionManager.ReqSessionMemAck <- 1 // tell SessionDispatcher we're done with the data
+}
@@ -7,6 +7,7 @@ import (
 	"phonebook/authz"
 	"phonebook/db"
 	"phonebook/lib"
+	"phonebook/qb"
 	"phonebook/ui"
 	"time"
 )
@@ -25,7 +26,7 @@ var SessionManager struct {
 
 // Session is the generic Session
 type Session struct {
-	Token        string         // this is the md5 hash, unique id, the cookie value
+	Token        string         // random unique id, the cookie value
 	Username     string         // associated username
 	Firstname    string         // user's first name
 	UID          int64          // user's db uid
@@ -146,6 +147,7 @@ func (s *Session) Refresh(w http.ResponseWriter, r *http.Request) int {
 		s.Expire = cookie.Expires            // update the Session information
 		SessionManager.ReqSessionMemAck <- 1 // tell SessionDispatcher we're done with the data
 		cookie.Path = "/"
+		cookie.HttpOnly = true
 		http.SetCookie(w, cookie)
 		lib.Console("Session.Expire = %v\n", s.Expire)
 		UpdateSessionCookie(s)
@@ -189,6 +191,42 @@ func NewSession(c *db.SessionCookie, firstname string, rid int) *Session {
 	return pvtNewSession(c, firstname, rid, true)
 }
 
+// NewKeySession returns a session for a web service request made with an
+// API key. It is not added to the session table, it only lasts for the one
+// request. A personal key can do no more than both its own role and the
+// current role of the person it belongs to allow.
+//-----------------------------------------------------------------------------
+func NewKeySession(k *db.APIKey, ip, useragent string) (*Session, error) {
+	if len(authz.RoleName(k.RID)) == 0 {
+		return nil, fmt.Errorf("API key %d has unknown role %d", k.KeyID, k.RID)
+	}
+	s := new(Session)
+	s.Username = k.Name
+	s.Firstname = k.Name
+	s.UID = k.UID
+	s.UIDorig = k.UID
+	s.Breadcrumbs = make([]ui.Crumb, 0)
+	s.Expire = time.Now().Add(SessionManager.SessionTimeout * time.Minute)
+	s.IP = ip
+	s.UserAgent = useragent
+	authz.GetRoleInfo(k.RID, &s.PMap)
+	if k.UID > 0 {
+		var RID int
+		s.Username = k.UserName
+		q, args := (&qb.Select{Cols: "CoCode,RID", From: "people", Where: qb.Eq("UID", k.UID)}).SQL()
+		if err := SessionManager.db.QueryRow(q, args...).Scan(&s.CoCode, &RID); err != nil {
+			return nil, err
+		}
+		var o authz.PermMaps
+		authz.GetRoleInfo(RID, &o)
+		s.PMap.SetOwnCompany(s.CoCode)
+		o.SetOwnCompany(s.CoCode)
+		authz.LimitPerms(&s.PMap, &o)
+	}
+	s.UsernameOrig = s.Username
+	return s, nil
+}
+
 // pvtNewSession creates a new session, updates the session table if necessary,
 // adds the new session to the in-memory session table, and returns the session
 //-----------------------------------------------------------------------------
@@ -198,6 +236,7 @@ func pvtNewSession(c *db.SessionCookie, firstname string, rid int, updateSession
 	s := new(Session)
 	s.Token = c.Cookie
 	s.Username = c.UserName
+	s.UsernameOrig = c.UserName
 	s.Firstname = firstname
 	s.UID = c.UID
 	s.UIDorig = c.UID
@@ -217,10 +256,12 @@ func pvtNewSession(c *db.SessionCookie, firstname string, rid int, updateSession
 	var d db.PersonDetail
 	d.UID = uid
 
-	err := SessionManager.db.QueryRow(fmt.Sprintf("SELECT CoCode FROM people WHERE UID=%d", uid)).Scan(&s.CoCode)
+	q, args := (&qb.Select{Cols: "CoCode", From: "people", Where: qb.Eq("UID", uid)}).SQL()
+	err := SessionManager.db.QueryRow(q, args...).Scan(&s.CoCode)
 	if nil != err {
 		lib.Ulog("Unable to read CoCode for userid=%d,  err = %v\n", uid, err)
 	}
+	s.PMap.SetOwnCompany(s.CoCode)
 
 	if updateSessionTable {
 		lib.Console("JUST BEFORE InsertSessionCookie: s.IP = %s, s.UserAgent = %s\n", s.IP, s.UserAgent)
@@ -247,7 +288,7 @@ func SessionDelete(s *Session) {
 	fmt.Printf("sess.Sessions before delete:\n")
 	DumpSessions()
 
-	if err := db.DeleteSessionCookie(s.Token); err != nil {
+	if err := DeleteSessionCookie(s); err != nil {
 		lib.Ulog("Error deleteing session cookie: %s\n", err.Error())
 	}
 
@@ -266,6 +307,50 @@ func SessionDelete(s *Session) {
 	DumpSessions()
 }
 
+// SessionDeleteUID removes every in-memory session that the supplied user
+// signed in to. It is used after the user's password changes. The caller
+// is responsible for the sessions table.
+//
+// RETURNS
+//  the number of sessions removed
+//-----------------------------------------------------------------------------
+func SessionDeleteUID(uid int64) int {
+	n := 0
+	ss := make(map[string]*Session, 0)
+	SessionManager.ReqSessionMem <- 1 // ask to access the shared mem, blocks until granted
+	<-SessionManager.ReqSessionMemAck // make sure we got it
+	for k, v := range Sessions {
+		if v.UIDorig == uid {
+			n++
+			continue
+		}
+		ss[k] = v
+	}
+	Sessions = ss
+	SessionManager.ReqSessionMemAck <- 1 // tell SessionDispatcher we're done with the data
+	return n
+}
+
+// RefreshPermMaps rebuilds the PermMaps of every session in memory from the
+// current roles, so that role changes apply without signing in again.
+//
+// RETURNS
+//  the number of sessions refreshed
+//-----------------------------------------------------------------------------
+func RefreshPermMaps() int {
+	SessionManager.ReqSessionMem <- 1 // ask to access the shared mem, blocks until granted
+	<-SessionManager.ReqSessionMemAck // make sure we got it
+	for _, s := range Sessions {
+		var pm authz.PermMaps
+		authz.GetRoleInfo(s.PMap.Urole.RID, &pm)
+		pm.SetOwnCompany(s.CoCode)
+		s.PMap = pm
+	}
+	n := len(Sessions)
+	SessionManager.ReqSessionMemAck <- 1 // tell SessionDispatcher we're done with the data
+	return n
+}
+
 //=====================================================================================
 // pvtElemPermsAny determines whether or not the Session has permissions to perform the
 // requested operations.  NOTE:  This interface does check the UID to fully cover
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"net/http"
 	"phonebook/authz"
 	"phonebook/db"
 	"phonebook/sess"
@@ -9,26 +10,23 @@ import (
 )
 
 func hasAccess(s *sess.Session, el int, fieldName string, access int) bool {
-	var perm int
-	var ok bool
+	return hasCoAccess(s, el, fieldName, access, -1)
+}
 
-	sess.SessionManager.ReqSessionMem <- 1 // ask to access the shared mem, blocks until granted
-	<-sess.SessionManager.ReqSessionMemAck // make sure we got it
-	switch el {
-	case authz.ELEMPERSON:
-		perm, ok = s.PMap.Pp[fieldName] // here's the permission we have
-	case authz.ELEMCOMPANY:
-		perm, ok = s.PMap.Pco[fieldName] // here's the permission we have
-	case authz.ELEMCLASS:
-		perm, ok = s.PMap.Pcl[fieldName] // here's the permission we have
-	case authz.ELEMPBSVC:
-		perm, ok = s.PMap.Ppr[fieldName] // here's the permission we have
-	}
-	sess.SessionManager.ReqSessionMemAck <- 1 // tell SessionDispatcher we're done with the data
-	ok = (0 != perm&access)
-	// fmt.Printf("hasFieldAccess: access to el: %d, field %s, access 0x%02x: %v\n", el, fieldName, access, ok)
-	return ok // could be true or false
+// hasCoAccess is hasAccess for data that belongs to the company coCode. If
+// the session's role is limited to some companies and coCode is not one of
+// them, the role's permissions outside its scope are checked. A coCode of
+// -1 checks the role's own permissions.
+func hasCoAccess(s *sess.Session, el int, fieldName string, access int, coCode int) bool {
+	return sess.HasCoAccess(s, el, fieldName, access, coCode)
+}
 
+// hasAllCoAccess is hasAccess in every company. The admin pages that are
+// not about one company's data, such as roles, API keys and the security
+// events, use it so that a role limited to some companies cannot reach
+// them through the permissions it has inside its scope.
+func hasAllCoAccess(s *sess.Session, el int, fieldName string, access int) bool {
+	return sess.HasAllCoAccess(s, el, fieldName, access)
 }
 
 func hasFieldAccess(token string, el int, fieldName string, access int) bool {
@@ -137,8 +135,15 @@ func showAdminButton(token string) bool {
 }
 
 // Privileged function allowing one user to become another user. This is meant
-// to be used by Administrators or User Support personnel.
-func sessionBecome(s *sess.Session, uid int) {
+// to be used by Administrators or User Support personnel. The session gets a
+// new token before its privileges change, and the new cookie is sent in w
+// and placed in r.
+func sessionBecome(w http.ResponseWriter, r *http.Request, s *sess.Session, uid int) error {
+	if err := sess.RotateToken(s); err != nil {
+		return err
+	}
+	sess.SetSessionCookie(w, r, s, s.Expire)
+
 	var d db.PersonDetail
 	d.Reports = make([]db.Person, 0)
 	d.UID = uid
@@ -151,7 +156,9 @@ func sessionBecome(s *sess.Session, uid int) {
 	s.UID = int64(uid)
 	s.Username = d.UserName
 	s.ImageURL = ui.GetImageLocation(uid)
+	s.CoCode = d.CoCode
 	authz.GetRoleInfo(d.RID, &s.PMap)
+	s.PMap.SetOwnCompany(s.CoCode)
 
 	if authz.Authz.SecurityDebug {
 		for i := 0; i < len(s.PMap.Urole.Perms); i++ {
@@ -160,4 +167,5 @@ func sessionBecome(s *sess.Session, uid int) {
 	}
 
 	ulog("user %d to BECOME user %d", s.UIDorig, s.UID)
+	return nil
 }
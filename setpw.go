@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"phonebook/db"
+	"phonebook/pwhash"
+	"phonebook/sess"
+)
+
+// MINPASSWORDLEN is the shortest password accepted on the set password page
+const MINPASSWORDLEN = 8
+
+// showSetPwPage shows the form where the user chooses a new password
+//-----------------------------------------------------------------------------
+func showSetPwPage(w http.ResponseWriter, username, token, errmsg string) {
+	t, _ := template.New("setpw.html").Funcs(funcMap).ParseFiles("setpw.html")
+	var ui uiSupport
+	handlerInitUIDate(&ui)
+	var ssn sess.Session
+	ssn.Username = username
+	ui.X = &ssn
+	ui.P = &pwReset{Token: token}
+	ui.ErrMsg = template.HTML(errmsg)
+	err := t.Execute(w, &ui)
+	if nil != err {
+		errmsg := fmt.Sprintf("showSetPwPage: err = %v\n", err)
+		ulog(errmsg)
+		fmt.Println(errmsg)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// setpwHandler is where the link in the password reset email leads. Like
+// resetpwHandler there is no session. The token in the link identifies the
+// user. The first visit shows the form, the form posts back here with
+// pagename=setpw and the new password. The token can only be used once.
+//-----------------------------------------------------------------------------
+func setpwHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.FormValue("token")
+	p, err := db.GetPWReset(token)
+	if err != nil {
+		if err != db.ErrPWResetInvalid {
+			ulog("setpwHandler: db.GetPWReset: %s\n", err.Error())
+		}
+		showResetPwPage(w, r, "This password reset link is invalid or has expired. Please request a new one.")
+		return
+	}
+
+	if r.FormValue("pagename") != "setpw" || r.Method != "POST" {
+		showSetPwPage(w, p.UserName, token, "")
+		return
+	}
+
+	password := r.FormValue("password")
+	if len(password) < MINPASSWORDLEN {
+		showSetPwPage(w, p.UserName, token, fmt.Sprintf("Your new password must be at least %d characters long.", MINPASSWORDLEN))
+		return
+	}
+	if password != r.FormValue("password2") {
+		showSetPwPage(w, p.UserName, token, "The passwords do not match.")
+		return
+	}
+	passhash, err := pwhash.Hash(password)
+	if err != nil {
+		ulog("setpwHandler: pwhash.Hash: %s\n", err.Error())
+		showSetPwPage(w, p.UserName, token, "Error setting password: "+err.Error())
+		return
+	}
+	if p, err = db.CompletePWReset(token, passhash); err != nil {
+		if err == db.ErrPWResetInvalid {
+			showResetPwPage(w, r, "This password reset link is invalid or has expired. Please request a new one.")
+			return
+		}
+		ulog("setpwHandler: db.CompletePWReset: %s\n", err.Error())
+		showSetPwPage(w, p.UserName, token, "Error setting password: "+err.Error())
+		return
+	}
+	n := sess.SessionDeleteUID(p.UID)
+	ulog("user %s reset their password, %d sessions signed out\n", p.UserName, n)
+	sess.LogSecEvent(r, db.SecEvent{Type: db.SECPWRESET, Actor: p.UID, ActorName: p.UserName, Target: p.UID, TargetName: p.UserName,
+		Detail: fmt.Sprintf("%d sessions signed out", n)})
+
+	var ssn sess.Session
+	ssn.Username = p.UserName
+	showPwResetDonePage(w, &ssn, &pwReset{Done: true}, "")
+}
@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"phonebook/lib"
 	"phonebook/sess"
+	"phonebook/sso"
 	"strconv"
 	"text/template"
 )
@@ -14,6 +15,10 @@ var ErrMsgs = []string{
 	"", // 0
 	"Username or password not found", // 1
 	"System error",                   // 2
+	"Too many failed sign in attempts. Please wait a while and try again", // 3
+	"Your sign in has expired. Please sign in again",                      // 4
+	"Single sign-on did not succeed. Please try again",                    // 5
+	"No directory account matches the email address you signed in with",   // 6
 }
 
 // normal call:  http://host:8250/search/
@@ -26,7 +31,7 @@ func signinHandler(w http.ResponseWriter, r *http.Request) {
 	if nil != cookie {
 		// lib.Console("Cookie named %s found.  value = %s\n", sess.SessionCookieName, cookie.Value)
 		s, ok := sess.SessionGet(cookie.Value)
-		if ok {
+		if ok && sess.RequestBindingOK(s.IP, s.UserAgent, r) {
 			if s.Token == cookie.Value {
 				// fmt.Printf("FOUND session, redirecting\n")
 				http.Redirect(w, r, "/search/", http.StatusFound)
@@ -43,7 +48,7 @@ func signinHandler(w http.ResponseWriter, r *http.Request) {
 		// lib.Console("session cookie:  %#v\n", c)
 		if err != nil {
 			lib.Ulog("signinHandler: error getting session cookie: %s\n", err.Error())
-		} else if len(c.Cookie) > 0 {
+		} else if len(c.Cookie) > 0 && sess.RequestBindingOK(c.IP, c.UserAgent, r) {
 			s := sess.NewSessionFromCookie(&c)
 			// lib.Console("Creating new session from cookie. s.Username = %s\n", s.Username)
 			if len(s.Username) > 0 {
@@ -80,6 +85,8 @@ func signinHandler(w http.ResponseWriter, r *http.Request) {
 	var S signin
 	S.ErrNo = n
 	S.ErrMsg = ErrMsgs[n]
+	S.SSO = sso.Enabled()
+	S.SSOText = sso.ButtonText()
 
 	ui.S = &S
 
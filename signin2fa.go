@@ -0,0 +1,290 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"net/http"
+	"phonebook/authz"
+	"phonebook/db"
+	"phonebook/lib"
+	"phonebook/sess"
+	"phonebook/totp"
+	"strings"
+	"time"
+)
+
+// startSecondStep is called once the password of a user who needs a second
+// step has been checked. It creates the login challenge and shows the page
+// asking for a code. Users who have not enrolled yet get a new secret and
+// enroll on the same page.
+//-----------------------------------------------------------------------------
+func startSecondStep(w http.ResponseWriter, r *http.Request, uid int64, username string) {
+	ttl := time.Duration(lib.PBConfig.TwoFactorMinutes) * time.Minute
+	token, err := db.NewLoginChallenge(uid, username, sess.ClientIP(r), r.Header.Get("User-Agent"), ttl)
+	if err != nil {
+		ulog("startSecondStep: db.NewLoginChallenge: %s\n", err.Error())
+		http.Redirect(w, r, "/signin/2", http.StatusFound)
+		return
+	}
+	tf, err := db.GetTwoFactor(uid)
+	if err == nil && !tf.Enabled {
+		tf.Secret, err = totp.NewSecret()
+		if err == nil {
+			err = db.StartTwoFactor(uid, tf.Secret)
+		}
+	}
+	if err != nil {
+		ulog("startSecondStep: %s\n", err.Error())
+		http.Redirect(w, r, "/signin/2", http.StatusFound)
+		return
+	}
+	ulog("user %s entered the correct password, waiting for the second step\n", username)
+	showSignin2faPage(w, username, newTwoFactor(&tf, username, token), "")
+}
+
+// newTwoFactor returns the page data for the supplied enrollment. The
+// secret is only included while the user is enrolling.
+func newTwoFactor(tf *db.TwoFactor, username, token string) *twoFactor {
+	f := twoFactor{Token: token, Enabled: tf.Enabled}
+	if !tf.Enabled && len(tf.Secret) > 0 {
+		f.Secret = tf.Secret
+		f.URI = template.URL(totp.URI(lib.PBConfig.TwoFactorIssuer, username, tf.Secret))
+	}
+	return &f
+}
+
+// showSignin2faPage shows the second step of sign in, or the user's new
+// recovery codes once they have enrolled.
+//-----------------------------------------------------------------------------
+func showSignin2faPage(w http.ResponseWriter, username string, f *twoFactor, errmsg string) {
+	t, _ := template.New("signin2fa.html").Funcs(funcMap).ParseFiles("signin2fa.html")
+	var ui uiSupport
+	handlerInitUIDate(&ui)
+	var ssn sess.Session
+	ssn.Username = username
+	ui.X = &ssn
+	ui.F = f
+	ui.ErrMsg = template.HTML(errmsg)
+	err := t.Execute(w, &ui)
+	if nil != err {
+		errmsg := fmt.Sprintf("showSignin2faPage: err = %v\n", err)
+		ulog(errmsg)
+		fmt.Println(errmsg)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// signin2faHandler handles the second step form. There is no session yet,
+// the login challenge token in the form identifies the user. The token
+// only works from the client that entered the password.
+//-----------------------------------------------------------------------------
+func signin2faHandler(w http.ResponseWriter, r *http.Request) {
+	ip := sess.ClientIP(r)
+	token := r.FormValue("token")
+	c, err := db.GetLoginChallenge(token)
+	if err != nil {
+		if err != db.ErrLoginChallengeInvalid {
+			ulog("signin2faHandler: db.GetLoginChallenge: %s\n", err.Error())
+		}
+		http.Redirect(w, r, "/signin/4", http.StatusFound)
+		return
+	}
+	if r.Method != "POST" || c.IP != ip || c.UserAgent != r.Header.Get("User-Agent") {
+		http.Redirect(w, r, "/signin/4", http.StatusFound)
+		return
+	}
+
+	wait, err := db.LoginWait(c.UserName, ip)
+	if err != nil {
+		ulog("signin2faHandler: db.LoginWait: %s\n", err.Error())
+	}
+	if wait > 0 {
+		ulog("second step for %s from %s refused, next attempt allowed in %s\n", c.UserName, ip, wait)
+		sess.LogSecEvent(r, db.SecEvent{Type: db.SECSIGNINREFUSED, Actor: c.UID, ActorName: c.UserName, Detail: fmt.Sprintf("second step, next attempt allowed in %s", wait)})
+		http.Redirect(w, r, "/signin/3", http.StatusFound)
+		return
+	}
+
+	tf, err := db.GetTwoFactor(c.UID)
+	var step int64
+	ok := false
+	if err == nil {
+		step, ok, err = db.CheckTwoFactorCode(&tf, r.FormValue("code"), true)
+	}
+	if err != nil {
+		ulog("signin2faHandler: %s\n", err.Error())
+		http.Redirect(w, r, "/signin/2", http.StatusFound)
+		return
+	}
+	if !ok {
+		ulog("second step code did not match for: %s\n", c.UserName)
+		sess.LogSecEvent(r, db.SecEvent{Type: db.SECSIGNINFAILED, Actor: c.UID, ActorName: c.UserName, Detail: "wrong second step code"})
+		if err = db.LoginFailed(c.UserName, ip); err != nil {
+			ulog("signin2faHandler: db.LoginFailed: %s\n", err.Error())
+		}
+		if err = db.LoginChallengeFailed(token, &c); err != nil {
+			ulog("signin2faHandler: db.LoginChallengeFailed: %s\n", err.Error())
+		}
+		if c.Attempts >= db.LOGINCHALLENGEMAXTRY {
+			http.Redirect(w, r, "/signin/1", http.StatusFound)
+			return
+		}
+		showSignin2faPage(w, c.UserName, newTwoFactor(&tf, c.UserName, token), "That code is not correct. Please try again.")
+		return
+	}
+
+	//----------------------------------------------
+	//  SECOND STEP ACCEPTED
+	//----------------------------------------------
+	if err = db.DeleteLoginChallenge(token); err != nil {
+		ulog("signin2faHandler: db.DeleteLoginChallenge: %s\n", err.Error())
+	}
+	var f twoFactor
+	if !tf.Enabled {
+		if f.Codes, err = db.EnableTwoFactor(c.UID, step); err != nil {
+			ulog("signin2faHandler: db.EnableTwoFactor: %s\n", err.Error())
+			http.Redirect(w, r, "/signin/2", http.StatusFound)
+			return
+		}
+		ulog("user %s enrolled in two-step sign in\n", c.UserName)
+	} else if step == 0 {
+		ulog("user %s used a recovery code to sign in\n", c.UserName)
+	}
+	if err = db.LoginSucceeded(c.UserName); err != nil {
+		ulog("signin2faHandler: db.LoginSucceeded: %s\n", err.Error())
+	}
+
+	var firstname, preferredname, email, passhash string
+	var uid, RID int
+	err = db.PrepStmts.LoginInfo.QueryRow(c.UserName).Scan(&uid, &firstname, &preferredname, &email, &passhash, &RID)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			ulog("signin2faHandler: login username: %s,  error = %v\n", c.UserName, err)
+		}
+		http.Redirect(w, r, "/signin/2", http.StatusFound)
+		return
+	}
+	name := firstname
+	if len(preferredname) > 0 {
+		name = preferredname
+	}
+	ulog("user %s logged in\n", c.UserName)
+	detail := "password and second step"
+	if len(f.Codes) > 0 {
+		detail = "password and second step, enrolled in two-step sign in"
+	} else if step == 0 {
+		detail = "password and recovery code"
+	}
+	sess.LogSecEvent(r, db.SecEvent{Type: db.SECSIGNIN, Actor: int64(uid), ActorName: c.UserName, Detail: detail})
+	startWebSession(w, r, uid, c.UserName, name, RID)
+	if len(f.Codes) > 0 {
+		f.Enabled = true
+		showSignin2faPage(w, c.UserName, &f, "")
+		return
+	}
+	searchHandler(w, r)
+}
+
+// twofactorHandler is where signed in users manage two-step sign in for
+// their own account. With no action it shows the current state. The
+// actions are:
+//   enable  - start enrolling with a new secret
+//   confirm - finish enrolling with a code from the authenticator app
+//   codes   - replace the recovery codes
+//   disable - stop using two-step sign in, if the role allows it
+// Every action except enable requires a current code.
+//-----------------------------------------------------------------------------
+func twofactorHandler(w http.ResponseWriter, r *http.Request) {
+	var ssn *sess.Session
+	var ui uiSupport
+	ssn = nil
+	if 0 < initHandlerSession(ssn, &ui, w, r) {
+		return
+	}
+	ssn = ui.X
+	breadcrumbAdd(ssn, "Two-Step Sign In", "/twofactor/")
+
+	// while another user is being impersonated, nothing here may change
+	uid := ssn.UID
+	tf, err := db.GetTwoFactor(uid)
+	if err != nil {
+		errmsg := fmt.Sprintf("twofactorHandler: db.GetTwoFactor: err = %v\n", err)
+		ulog(errmsg)
+		fmt.Println(errmsg)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	f := newTwoFactor(&tf, ssn.Username, "")
+	f.Required = authz.TwoFactorRequired(&ssn.PMap)
+	errmsg := ""
+
+	action := strings.ToLower(r.FormValue("action"))
+	if r.Method != "POST" || ssn.UID != ssn.UIDorig {
+		action = ""
+	}
+	switch action {
+	case "enable":
+		if tf.Enabled {
+			break
+		}
+		tf.Secret, err = totp.NewSecret()
+		if err == nil {
+			err = db.StartTwoFactor(uid, tf.Secret)
+		}
+		f = newTwoFactor(&tf, ssn.Username, "")
+	case "confirm", "codes", "disable":
+		var step int64
+		ok := false
+		if (action == "confirm") != tf.Enabled { // confirm is only for enrolling, the others only once enrolled
+			step, ok, err = db.CheckTwoFactorCode(&tf, r.FormValue("code"), action == "disable")
+		}
+		if err != nil || !ok {
+			errmsg = "That code is not correct. Please try again."
+			break
+		}
+		switch {
+		case action == "confirm":
+			f.Codes, err = db.EnableTwoFactor(uid, step)
+			ulog("user %s enrolled in two-step sign in\n", ssn.Username)
+		case action == "codes":
+			f.Codes, err = db.NewRecoveryCodes(uid)
+			ulog("user %s created new recovery codes\n", ssn.Username)
+		case f.Required:
+			errmsg = "Your role requires two-step sign in, it cannot be turned off."
+		default:
+			err = db.DeleteTwoFactor(uid)
+			ulog("user %s turned off two-step sign in\n", ssn.Username)
+		}
+		if err == nil && errmsg == "" {
+			if tf, err = db.GetTwoFactor(uid); err == nil {
+				codes := f.Codes
+				f = newTwoFactor(&tf, ssn.Username, "")
+				f.Required = authz.TwoFactorRequired(&ssn.PMap)
+				f.Codes = codes
+			}
+		}
+	}
+	if err != nil {
+		errmsg := fmt.Sprintf("twofactorHandler: err = %v\n", err)
+		ulog(errmsg)
+		fmt.Println(errmsg)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if tf.Enabled {
+		if f.Left, err = db.RecoveryCodesLeft(uid); err != nil {
+			ulog("twofactorHandler: db.RecoveryCodesLeft: %s\n", err.Error())
+		}
+	}
+
+	ui.F = f
+	ui.ErrMsg = template.HTML(errmsg)
+	err = renderTemplate(w, ui, "twofactor.html")
+	if nil != err {
+		errmsg := fmt.Sprintf("twofactorHandler: err = %v\n", err)
+		ulog(errmsg)
+		fmt.Println(errmsg)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
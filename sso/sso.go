@@ -0,0 +1,158 @@
+// Package sso implements the relying party side of OpenID Connect single
+// sign-on, using the authorization code flow with PKCE. The provider is
+// configured with OIDC in config.json. Its endpoints and signing keys are
+// discovered from the issuer URL the first time someone signs in.
+//
+// A sign in starts with NewLogin, whose values the caller keeps for the
+// browser, usually in a cookie, while the browser is sent to AuthURL. When
+// the provider redirects back with a code, Exchange trades it for an ID
+// token, checks the token and returns its claims.
+package sso
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"phonebook/lib"
+	"strings"
+	"sync"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// Login holds the values that tie a provider's answer to the browser that
+// started the sign in.
+type Login struct {
+	State    string // returned by the provider with the code
+	Nonce    string // must be in the ID token
+	Verifier string // PKCE code verifier
+}
+
+// Claims are the parts of the ID token used to find the person
+type Claims struct {
+	Subject       string `json:"sub"`
+	Email         string `json:"email"`
+	EmailVerified *bool  `json:"email_verified"` // nil if the provider does not say
+}
+
+var rp struct {
+	sync.Mutex
+	provider *oidc.Provider
+	verifier *oidc.IDTokenVerifier
+	config   oauth2.Config
+}
+
+// Enabled returns true if single sign-on is configured
+//-----------------------------------------------------------------------------
+func Enabled() bool {
+	return len(lib.PBConfig.OIDC.Issuer) > 0
+}
+
+// ButtonText returns the text of the single sign-on link
+//-----------------------------------------------------------------------------
+func ButtonText() string {
+	return lib.PBConfig.OIDC.ButtonText
+}
+
+// setup discovers the provider if that has not been done yet. If discovery
+// fails it is tried again on the next sign in.
+func setup(ctx context.Context) error {
+	rp.Lock()
+	defer rp.Unlock()
+	if rp.provider != nil {
+		return nil
+	}
+	c := lib.PBConfig.OIDC
+	p, err := oidc.NewProvider(ctx, c.Issuer)
+	if err != nil {
+		return fmt.Errorf("OIDC discovery for %s: %s", c.Issuer, err.Error())
+	}
+	redirect := c.RedirectURL
+	if len(redirect) == 0 {
+		redirect = strings.TrimRight(lib.PBConfig.BaseURL, "/") + "/oidc/callback/"
+	}
+	rp.config = oauth2.Config{
+		ClientID:     c.ClientID,
+		ClientSecret: c.ClientSecret,
+		Endpoint:     p.Endpoint(),
+		RedirectURL:  redirect,
+		Scopes:       append([]string{oidc.ScopeOpenID}, c.Scopes...),
+	}
+	rp.verifier = p.Verifier(&oidc.Config{ClientID: c.ClientID})
+	rp.provider = p
+	lib.Ulog("OIDC provider %s discovered\n", c.Issuer)
+	return nil
+}
+
+// random returns a random string for state and nonce values
+func random() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// NewLogin returns new random values for a sign in
+//-----------------------------------------------------------------------------
+func NewLogin() (Login, error) {
+	var l Login
+	var err error
+	if l.State, err = random(); err != nil {
+		return l, err
+	}
+	if l.Nonce, err = random(); err != nil {
+		return l, err
+	}
+	l.Verifier = oauth2.GenerateVerifier()
+	return l, nil
+}
+
+// AuthURL returns the provider's URL to send the browser to for the
+// supplied sign in.
+//-----------------------------------------------------------------------------
+func AuthURL(ctx context.Context, l *Login) (string, error) {
+	if err := setup(ctx); err != nil {
+		return "", err
+	}
+	return rp.config.AuthCodeURL(l.State, oauth2.S256ChallengeOption(l.Verifier), oidc.Nonce(l.Nonce)), nil
+}
+
+// Exchange trades the code the provider sent back for an ID token. The
+// token's signature, issuer, audience, expiry and nonce are checked, and
+// its email address must be present and, unless AllowUnverified is set,
+// not marked unverified.
+//-----------------------------------------------------------------------------
+func Exchange(ctx context.Context, code string, l *Login) (Claims, error) {
+	var c Claims
+	if err := setup(ctx); err != nil {
+		return c, err
+	}
+	tok, err := rp.config.Exchange(ctx, code, oauth2.VerifierOption(l.Verifier))
+	if err != nil {
+		return c, fmt.Errorf("code exchange: %s", err.Error())
+	}
+	raw, ok := tok.Extra("id_token").(string)
+	if !ok {
+		return c, fmt.Errorf("no id_token in token response")
+	}
+	idt, err := rp.verifier.Verify(ctx, raw)
+	if err != nil {
+		return c, fmt.Errorf("id_token: %s", err.Error())
+	}
+	if idt.Nonce != l.Nonce {
+		return c, fmt.Errorf("id_token nonce does not match")
+	}
+	if err = idt.Claims(&c); err != nil {
+		return c, fmt.Errorf("id_token claims: %s", err.Error())
+	}
+	if len(c.Email) == 0 {
+		return c, fmt.Errorf("no email in id_token for subject %s", c.Subject)
+	}
+	if c.EmailVerified != nil && !*c.EmailVerified && !lib.PBConfig.OIDC.AllowUnverified {
+		return c, fmt.Errorf("email %s is not verified", c.Email)
+	}
+	return c, nil
+}
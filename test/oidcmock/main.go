@@ -0,0 +1,216 @@
+// oidcmock is a minimal OpenID Connect provider for trying out single
+// sign-on on a development machine. It signs in whoever types an email
+// address on its authorize page. Point phonebook at it with
+//
+//   "OIDC": {"Issuer": "http://localhost:8280", "ClientID": "phonebook"}
+//
+// in config.json. It supports only what phonebook uses: discovery, the
+// authorization code flow with PKCE (S256), and the JWKS endpoint.
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+)
+
+// grant is an issued authorization code waiting to be exchanged
+type grant struct {
+	Email       string
+	Nonce       string
+	Challenge   string
+	ClientID    string
+	RedirectURI string
+	Expire      time.Time
+}
+
+// App is the mock provider's state
+var App struct {
+	Issuer   string
+	Key      *rsa.PrivateKey
+	Signer   jose.Signer
+	Verified bool
+	mu       sync.Mutex
+	Grants   map[string]grant
+}
+
+var authorizePage = template.Must(template.New("authorize").Parse(`<html><body>
+<h2>oidcmock sign in</h2>
+<form method="POST">
+{{range $k, $v := .}}<input type="hidden" name="{{$k}}" value="{{index $v 0}}">
+{{end}}Email: <input type="text" name="email" size="40"> <input type="submit" value="Sign In">
+</form></body></html>`))
+
+func randomString() string {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("writeJSON: %s\n", err.Error())
+	}
+}
+
+func tokenError(w http.ResponseWriter, code, desc string) {
+	writeJSON(w, http.StatusBadRequest, map[string]string{"error": code, "error_description": desc})
+}
+
+func discoveryHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                App.Issuer,
+		"authorization_endpoint":                App.Issuer + "/authorize",
+		"token_endpoint":                        App.Issuer + "/token",
+		"jwks_uri":                              App.Issuer + "/keys",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"scopes_supported":                      []string{"openid", "email"},
+	})
+}
+
+func keysHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+		{Key: &App.Key.PublicKey, KeyID: "oidcmock", Algorithm: "RS256", Use: "sig"},
+	}})
+}
+
+// authorizeHandler shows the sign in form, then redirects back to the
+// client with a code.
+func authorizeHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.Form.Get("code_challenge_method") != "S256" || len(r.Form.Get("code_challenge")) == 0 {
+		http.Error(w, "PKCE with S256 is required", http.StatusBadRequest)
+		return
+	}
+	email := r.PostForm.Get("email")
+	if r.Method != "POST" || len(email) == 0 {
+		if err := authorizePage.Execute(w, r.Form); err != nil {
+			log.Printf("authorizeHandler: %s\n", err.Error())
+		}
+		return
+	}
+	code := randomString()
+	App.mu.Lock()
+	App.Grants[code] = grant{
+		Email:       email,
+		Nonce:       r.Form.Get("nonce"),
+		Challenge:   r.Form.Get("code_challenge"),
+		ClientID:    r.Form.Get("client_id"),
+		RedirectURI: r.Form.Get("redirect_uri"),
+		Expire:      time.Now().Add(time.Minute),
+	}
+	App.mu.Unlock()
+	u, err := url.Parse(r.Form.Get("redirect_uri"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	q := u.Query()
+	q.Set("code", code)
+	q.Set("state", r.Form.Get("state"))
+	u.RawQuery = q.Encode()
+	log.Printf("issued code for %s\n", email)
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+// tokenHandler exchanges a code for an ID token
+func tokenHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil || r.Method != "POST" {
+		tokenError(w, "invalid_request", "POST a form")
+		return
+	}
+	clientID, _, ok := r.BasicAuth()
+	if !ok {
+		clientID = r.PostForm.Get("client_id")
+	}
+	code := r.PostForm.Get("code")
+	App.mu.Lock()
+	g, found := App.Grants[code]
+	delete(App.Grants, code)
+	App.mu.Unlock()
+	if !found || time.Now().After(g.Expire) || g.ClientID != clientID || g.RedirectURI != r.PostForm.Get("redirect_uri") {
+		tokenError(w, "invalid_grant", "unknown or expired code")
+		return
+	}
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(sum[:]) != g.Challenge {
+		tokenError(w, "invalid_grant", "code_verifier does not match")
+		return
+	}
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss":            App.Issuer,
+		"sub":            g.Email,
+		"aud":            clientID,
+		"iat":            now.Unix(),
+		"exp":            now.Add(5 * time.Minute).Unix(),
+		"nonce":          g.Nonce,
+		"email":          g.Email,
+		"email_verified": App.Verified,
+	}
+	idt, err := jwt.Signed(App.Signer).Claims(claims).CompactSerialize()
+	if err != nil {
+		tokenError(w, "server_error", err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     idt,
+	})
+}
+
+func main() {
+	port := flag.Int("p", 8280, "port to listen on")
+	issuer := flag.String("issuer", "", "issuer URL, default http://localhost:<port>")
+	verified := flag.Bool("verified", true, "mark email addresses as verified")
+	flag.Parse()
+
+	App.Issuer = *issuer
+	if len(App.Issuer) == 0 {
+		App.Issuer = fmt.Sprintf("http://localhost:%d", *port)
+	}
+	App.Verified = *verified
+	App.Grants = make(map[string]grant)
+	var err error
+	if App.Key, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		log.Fatal(err)
+	}
+	App.Signer, err = jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: jose.JSONWebKey{Key: App.Key, KeyID: "oidcmock"}},
+		(&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	http.HandleFunc("/.well-known/openid-configuration", discoveryHandler)
+	http.HandleFunc("/authorize", authorizeHandler)
+	http.HandleFunc("/keys", keysHandler)
+	http.HandleFunc("/token", tokenHandler)
+	log.Printf("oidcmock issuer %s listening on port %d\n", App.Issuer, *port)
+	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *port), nil))
+}
@@ -0,0 +1,116 @@
+// Package totp implements the time-based one-time passwords of RFC 6238,
+// as used by authenticator apps. Codes are 6 digits computed with
+// HMAC-SHA1 over 30 second steps. Secrets are exchanged in base32, usually
+// through an otpauth:// URI shown to the user when they enroll.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	SECRETLEN = 20               // bytes of random secret, the size of an SHA-1 hash
+	DIGITS    = 6                // digits in a code
+	STEP      = 30 * time.Second // how long a code is valid
+	SKEW      = 1                // steps before and after now that are also accepted
+)
+
+var b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewSecret returns a new random secret, base32 encoded
+func NewSecret() (string, error) {
+	b := make([]byte, SECRETLEN)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return b32.EncodeToString(b), nil
+}
+
+// decodeSecret decodes a base32 secret. Authenticator apps show secrets in
+// groups and in either case, so spaces are ignored and case does not matter.
+func decodeSecret(secret string) ([]byte, error) {
+	s := strings.ToUpper(strings.Replace(secret, " ", "", -1))
+	return b32.DecodeString(strings.TrimRight(s, "="))
+}
+
+// Step returns the time step containing t
+func Step(t time.Time) int64 {
+	return t.Unix() / int64(STEP/time.Second)
+}
+
+// code computes the code for the supplied step (RFC 4226 section 5.3)
+func code(key []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	h := hmac.New(sha1.New, key)
+	h.Write(msg[:])
+	sum := h.Sum(nil)
+	off := sum[len(sum)-1] & 0x0f
+	n := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < DIGITS; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", DIGITS, n%mod)
+}
+
+// Code returns the code for secret at time t
+func Code(secret string, t time.Time) (string, error) {
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return "", err
+	}
+	return code(key, Step(t)), nil
+}
+
+// Verify checks the code a user entered against secret at time t. Codes
+// from SKEW steps either side of t are accepted to allow for clock drift.
+// A code can only be used once: steps at or before last, the step of the
+// previous code accepted for this secret, are refused.
+//
+// RETURNS
+//  step - the step the code matched, to be saved as last for the next call
+//  ok   - true if the code is valid
+//-----------------------------------------------------------------------------
+func Verify(secret, entered string, t time.Time, last int64) (int64, bool) {
+	entered = strings.Replace(entered, " ", "", -1)
+	if len(entered) != DIGITS {
+		return 0, false
+	}
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return 0, false
+	}
+	now := Step(t)
+	for s := now - SKEW; s <= now+SKEW; s++ {
+		if s <= last {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(code(key, s)), []byte(entered)) == 1 {
+			return s, true
+		}
+	}
+	return 0, false
+}
+
+// URI returns the otpauth:// URI that authenticator apps use to add an
+// account. issuer is the name the app shows for the service.
+func URI(issuer, account, secret string) string {
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprintf("%d", DIGITS))
+	v.Set("period", fmt.Sprintf("%d", int(STEP/time.Second)))
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
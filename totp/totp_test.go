@@ -0,0 +1,109 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA-1 secret of the RFC 6238 test vectors,
+// "12345678901234567890", base32 encoded
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// TestCode checks the RFC 6238 appendix B vectors. The RFC lists 8 digit
+// codes, a 6 digit code is the last 6 digits.
+func TestCode(t *testing.T) {
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		got, err := Code(rfcSecret, time.Unix(tt.unix, 0))
+		if err != nil {
+			t.Fatalf("Code: %s", err)
+		}
+		if got != tt.want {
+			t.Errorf("Code at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+	spaced := strings.ToLower(rfcSecret[:8] + " " + rfcSecret[8:] + "====")
+	if got, err := Code(spaced, time.Unix(59, 0)); err != nil || got != "287082" {
+		t.Errorf("Code with a lower case, spaced, padded secret = %s, %v", got, err)
+	}
+	if _, err := Code("not base32!", time.Unix(59, 0)); err == nil {
+		t.Errorf("Code accepted a secret that is not base32")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := Step(now)
+	at := func(d time.Duration) string {
+		c, _ := Code(rfcSecret, now.Add(d))
+		return c
+	}
+	tests := []struct {
+		name    string
+		entered string
+		last    int64
+		step    int64
+		ok      bool
+	}{
+		{"current", at(0), 0, step, true},
+		{"with a space", at(0)[:3] + " " + at(0)[3:], 0, step, true},
+		{"one step early", at(-STEP), 0, step - 1, true},
+		{"one step late", at(STEP), 0, step + 1, true},
+		{"two steps early", at(-2 * STEP), 0, 0, false},
+		{"two steps late", at(2 * STEP), 0, 0, false},
+		{"wrong code", "000000", 0, 0, false},
+		{"too short", at(0)[:5], 0, 0, false},
+		{"too long", at(0) + "1", 0, 0, false},
+		{"replayed", at(0), step, 0, false},
+		{"earlier than the last code", at(-STEP), step, 0, false},
+		{"later than the last code", at(STEP), step, step + 1, true},
+	}
+	for _, tt := range tests {
+		s, ok := Verify(rfcSecret, tt.entered, now, tt.last)
+		if ok != tt.ok || s != tt.step {
+			t.Errorf("%s: Verify(%q, last %d) = %d, %v, want %d, %v", tt.name, tt.entered, tt.last, s, ok, tt.step, tt.ok)
+		}
+	}
+
+	// the step returned is what stops the same code being used twice
+	s, ok := Verify(rfcSecret, at(0), now, 0)
+	if !ok {
+		t.Fatalf("the current code was refused")
+	}
+	if _, ok = Verify(rfcSecret, at(0), now.Add(STEP), s); ok {
+		t.Errorf("a code was accepted twice")
+	}
+	if _, ok = Verify("not base32!", at(0), now, 0); ok {
+		t.Errorf("a code was accepted for a secret that is not base32")
+	}
+}
+
+func TestNewSecret(t *testing.T) {
+	a, err := NewSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := NewSecret()
+	if a == b {
+		t.Errorf("two new secrets are the same")
+	}
+	key, err := decodeSecret(a)
+	if err != nil || len(key) != SECRETLEN {
+		t.Errorf("NewSecret %q decodes to %d bytes, err %v", a, len(key), err)
+	}
+	c, _ := Code(a, time.Now())
+	if _, ok := Verify(a, c, time.Now(), 0); !ok {
+		t.Errorf("the code for a new secret was refused")
+	}
+}
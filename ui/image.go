@@ -7,13 +7,15 @@ import (
 	"phonebook/lib"
 )
 
+// DefaultProfileImage is the image shown for people who have not uploaded
+// a profile image
+const DefaultProfileImage = "defaultProfileImage.png"
+
 // GetImageLocation returns the ImageURL for the specified user.
 func GetImageLocation(uid int) string {
 	var imagePath string
 
-	defaultImageName := "defaultProfileImage.png"
-
-	im := defaultImageName // If something went wrong  or database doesn't have imagePath than display default image
+	im := DefaultProfileImage // If something went wrong  or database doesn't have imagePath than display default image
 	err := db.PrepStmts.GetImagePath.QueryRow(uid).Scan(&imagePath)
 	if imagePath != "" && err == nil {
 		im = imagePath
@@ -1,18 +1,17 @@
 package main
 
 import (
-	"crypto/sha512"
 	"database/sql"
 	"fmt"
 	"html/template"
 	"net/http"
+	"phonebook/authn"
 	"phonebook/db"
 	"phonebook/lib"
+	"phonebook/pwhash"
 	"phonebook/sess"
 	"strings"
 	"time"
-
-	"gopkg.in/gomail.v2"
 )
 
 func handlerInitUIDate(ui *uiSupport) {
@@ -53,6 +52,10 @@ func initHandlerSession(ssn *sess.Session, ui *uiSupport, w http.ResponseWriter,
 		//--------------------------------------------------------------
 		lib.Console("**** initHandlerSession found cookie %s in request Headers: %s\n", cookie.Name, cookie.Value)
 		ssn, ok = sess.SessionGet(cookie.Value)
+		if ok && ssn != nil && !sess.RequestBindingOK(ssn.IP, ssn.UserAgent, r) {
+			http.Redirect(w, r, "/signin/", http.StatusFound) // the cookie was not issued to this client
+			return 1
+		}
 		ui.X = ssn
 		if ok && ssn != nil {
 			ssn.Refresh(w, r) // Found it.
@@ -73,7 +76,7 @@ func initHandlerSession(ssn *sess.Session, ui *uiSupport, w http.ResponseWriter,
 			http.Redirect(w, r, "/signin/", http.StatusFound)
 			return 1
 		}
-		if len(c.Cookie) > 0 {
+		if len(c.Cookie) > 0 && sess.RequestBindingOK(c.IP, c.UserAgent, r) {
 			//--------------------------------------------------------------
 			// Found a valid session. Add it to our in-memory table
 			// and continue...
@@ -102,13 +105,8 @@ func webloginHandler(w http.ResponseWriter, r *http.Request) {
 	// errcheck(err)
 	// fmt.Printf("\n\ndumpRequest = %s\n", string(dump))
 	ua := r.Header.Get("User-Agent")
-	ip := r.RemoteAddr
+	ip := sess.ClientIP(r)
 	lib.Console("Entered webloginHandler.  ip = %s, ua = %s\n", ip, ua)
-	fwdaddr := r.Header.Get("X-Forwarded-For")
-	lib.Console("**** Forwarded-For address. fwdaddr = %q\n", fwdaddr)
-	if len(fwdaddr) > 0 {
-		ip = fwdaddr
-	}
 
 	//-------------------------------------------
 	//  Handle FORGOT PASSWORD requests...
@@ -130,14 +128,26 @@ func webloginHandler(w http.ResponseWriter, r *http.Request) {
 	n := 0 //error number associated with this login attempt
 	loggedIn := false
 	myusername := strings.ToLower(r.FormValue("username"))
-	password := []byte(r.FormValue("password"))
-	sha := sha512.Sum512(password)
-	mypasshash := fmt.Sprintf("%x", sha)
+	password := r.FormValue("password")
 	email := ""
 
+	//-------------------------------------------
+	//  Too many recent failed attempts?
+	//-------------------------------------------
+	wait, err := db.LoginWait(myusername, ip)
+	if err != nil {
+		ulog("webloginHandler: db.LoginWait: %s\n", err.Error())
+	}
+	if wait > 0 {
+		ulog("sign in for %s from %s refused, next attempt allowed in %s\n", myusername, ip, wait)
+		sess.LogSecEvent(r, db.SecEvent{Type: db.SECSIGNINREFUSED, ActorName: myusername, Detail: fmt.Sprintf("next attempt allowed in %s", wait)})
+		http.Redirect(w, r, "/signin/3", http.StatusFound)
+		return
+	}
+
 	var passhash, firstname, preferredname string
 	var uid, RID int
-	err := db.PrepStmts.LoginInfo.QueryRow(myusername).Scan(&uid, &firstname, &preferredname, &email, &passhash, &RID)
+	err = db.PrepStmts.LoginInfo.QueryRow(myusername).Scan(&uid, &firstname, &preferredname, &email, &passhash, &RID)
 	switch {
 	case err == sql.ErrNoRows:
 		ulog("No user with username = %s\n", myusername)
@@ -149,34 +159,58 @@ func webloginHandler(w http.ResponseWriter, r *http.Request) {
 		// ulog("found username %s in database. UID = %d\n", myusername, uid)
 	}
 
-	if passhash == mypasshash {
+	ok := false
+	if n == 0 {
+		if ok, err = authn.Authenticate(myusername, password, passhash); err != nil {
+			ulog("webloginHandler: authn.Authenticate: %s\n", err.Error())
+			n = 2
+		}
+	} else {
+		pwhash.Verify(password, "") // take the same time as a real check
+	}
+	if ok && n == 0 {
 		//----------------------------------------------
 		//  USERNAME AND PASSWORD ARE ACCEPTED
 		//----------------------------------------------
+
+		//----------------------------------------------
+		//  SECOND STEP, IF THE USER NEEDS ONE
+		//----------------------------------------------
+		need, err := db.TwoFactorNeeded(int64(uid), RID)
+		if err != nil {
+			ulog("webloginHandler: db.TwoFactorNeeded: %s\n", err.Error())
+			http.Redirect(w, r, "/signin/2", http.StatusFound)
+			return
+		}
+		if need {
+			startSecondStep(w, r, int64(uid), myusername)
+			return
+		}
+
 		loggedIn = true
 		ulog("user %s logged in\n", myusername)
-		//=================================================================================
-		// There could be multiple ssn.Sessions from the same user on different browsers.
-		// These could be on the same or separate machines. We need the IP and the browser
-		// to guarantee uniqueness...
-		//=================================================================================
-		expiration := time.Now().Add(10 * time.Minute)
-		lib.Console("USERAGENT = %s, ip = %s\n", ua, ip)
-		c := sess.GenerateSessionCookie(int64(uid), myusername, ua, ip)
-		lib.Console("After call to GenerateSessionCookie: ip = %s, ua = %s\n", c.IP, c.UserAgent)
+		sess.LogSecEvent(r, db.SecEvent{Type: db.SECSIGNIN, Actor: int64(uid), ActorName: myusername, Detail: "password"})
+		if err = db.LoginSucceeded(myusername); err != nil {
+			ulog("webloginHandler: db.LoginSucceeded: %s\n", err.Error())
+		}
 		name := firstname
 		if len(preferredname) > 0 {
 			name = preferredname
 		}
-
-		s := sess.NewSession(&c, name, RID)
-		cookie := http.Cookie{Name: sess.SessionCookieName, Value: s.Token, Expires: expiration}
-		cookie.Path = "/"
-		http.SetCookie(w, &cookie)
-		r.AddCookie(&cookie) // need this so that the redirect to search finds the cookie
+		startWebSession(w, r, uid, myusername, name, RID)
 	} else {
 		ulog("user name or password did not match for: %s\n", myusername)
-		n = 1
+		why := "wrong password"
+		if uid == 0 {
+			why = "no such user name"
+		}
+		sess.LogSecEvent(r, db.SecEvent{Type: db.SECSIGNINFAILED, Actor: int64(uid), ActorName: myusername, Detail: why})
+		if n == 0 {
+			n = 1
+		}
+		if err = db.LoginFailed(myusername, ip); err != nil {
+			ulog("webloginHandler: db.LoginFailed: %s\n", err.Error())
+		}
 	}
 
 	if !loggedIn {
@@ -187,6 +221,26 @@ func webloginHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// startWebSession creates the session for a user who has signed in and
+// sends its cookie. The cookie is also put in r so that a handler called
+// directly afterwards finds the session.
+//-----------------------------------------------------------------------------
+func startWebSession(w http.ResponseWriter, r *http.Request, uid int, username, name string, RID int) {
+	//=================================================================================
+	// Every login gets a new random token, so the same user can have several
+	// sessions on different browsers. The IP and the browser are recorded with
+	// the session so they can be checked on later requests...
+	//=================================================================================
+	ua := r.Header.Get("User-Agent")
+	ip := sess.ClientIP(r)
+	expiration := time.Now().Add(10 * time.Minute)
+	lib.Console("USERAGENT = %s, ip = %s\n", ua, ip)
+	c := sess.GenerateSessionCookie(int64(uid), username, ua, ip)
+	lib.Console("After call to GenerateSessionCookie: ip = %s, ua = %s\n", c.IP, c.UserAgent)
+	s := sess.NewSession(&c, name, RID)
+	sess.SetSessionCookie(w, r, s, expiration)
+}
+
 func showResetPwPage(w http.ResponseWriter, r *http.Request, errmsg string) {
 	t, _ := template.New("resetpw.html").Funcs(funcMap).ParseFiles("resetpw.html")
 	var ui uiSupport
@@ -227,6 +281,24 @@ func resetpwHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	myusername := strings.ToLower(r.FormValue("username"))
+	ip := sess.ClientIP(r)
+
+	//-------------------------------------------
+	//  Too many recent reset requests?
+	//-------------------------------------------
+	wait, err := db.PWResetWait(myusername, ip)
+	if err != nil {
+		ulog("resetpwHandler: db.PWResetWait: %s\n", err.Error())
+	}
+	if wait > 0 {
+		ulog("password reset for %s from %s refused, next request allowed in %s\n", myusername, ip, wait)
+		errmsg := fmt.Sprintf("Too many password reset requests. Please try again in %d minutes.\n", int(wait/time.Minute)+1) + stillNeedHelp
+		showResetPwPage(w, r, errmsg)
+		return
+	}
+	if err = db.PWResetRequested(myusername, ip); err != nil {
+		ulog("resetpwHandler: db.PWResetRequested: %s\n", err.Error())
+	}
 
 	//-------------------------------------
 	// validate that myusername exists
@@ -242,6 +314,11 @@ func resetpwHandler(w http.ResponseWriter, r *http.Request) {
 		showResetPwPage(w, r, errmsg)
 		return
 	}
+	if !authn.LocalPassword(myusername) {
+		errmsg := fmt.Sprintf("The password for %s is your corporate directory password. Please reset it there.", myusername)
+		showResetPwPage(w, r, errmsg)
+		return
+	}
 	if emailAddr == "" {
 		errmsg := fmt.Sprintf("Error: No email address for user: %s", myusername) + stillNeedHelp
 		showResetPwPage(w, r, errmsg)
@@ -271,48 +348,52 @@ func resetpwHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	//-------------------------------------
-	// reset the password for myusername
-	//-------------------------------------
-	password := lib.RandPasswordStringRunes(8)
-	err = lib.UpdateUserPassword(myusername, password, Phonebook.db)
+	//----------------------------------------------------------------
+	// Create a reset token for myusername. The password itself does
+	// not change until the user follows the emailed link.
+	//----------------------------------------------------------------
+	token, err := db.NewPWReset(int64(uid), myusername, ip, time.Duration(lib.PBConfig.PWResetMinutes)*time.Minute)
 	if nil != err {
-		errmsg += fmt.Sprintf("Error updating password = %s\n", err.Error())
+		ulog("resetpwHandler: db.NewPWReset: %s\n", err.Error())
+		errmsg += fmt.Sprintf("Error creating password reset = %s\n", err.Error())
 		showResetPwPage(w, r, errmsg)
 		return
 	}
 
 	//------------------------------------------------------------------------------
-	// send an email to the associated account that the password has been changed.
+	// send an email to the associated account with the link to reset the password
 	//------------------------------------------------------------------------------
-	m := gomail.NewMessage()
-	m.SetHeader("From", "sman@accordinterests.com")
 	ulog("To address is set to: \"%s\"\n", emailAddr)
-	m.SetHeader("To", emailAddr)
-	msg := fmt.Sprintf("Hello %s,<br><br>Your password has been set to:  %s<br><br>", myusername, password)
-	msg += `Please log into <a href="https://directory.airoller.com/">https://directory.airoller.com/</a>`
-	m.SetHeader("Subject", "Your password has been updated")
-	m.SetBody("text/html", msg)
-	if err := lib.SMTPDialAndSend(m); err != nil {
+	detail := "link sent to " + emailAddr
+	if err := lib.SendPWResetEmail(emailAddr, myusername, token); err != nil {
 		errmsg += fmt.Sprintf("Error sending emailAddr = %s", err.Error())
+		detail = "link could not be sent: " + err.Error()
 	}
+	sess.LogSecEvent(r, db.SecEvent{Type: db.SECPWRESETREQ, Target: int64(uid), TargetName: myusername, Detail: detail})
 
 	//-------------------------------------
 	// notify user
 	//-------------------------------------
+	var ssn sess.Session
+	ssn.Username = myusername
+	showPwResetDonePage(w, &ssn, &pwReset{Minutes: lib.PBConfig.PWResetMinutes}, errmsg)
+}
+
+// showPwResetDonePage tells the user that the reset link was sent, or that
+// the password was changed if p.Done is set.
+//-----------------------------------------------------------------------------
+func showPwResetDonePage(w http.ResponseWriter, ssn *sess.Session, p *pwReset, errmsg string) {
 	t, _ := template.New("pwreset.html").Funcs(funcMap).ParseFiles("pwreset.html")
 	var ui uiSupport
 	handlerInitUIDate(&ui)
-	var ssn sess.Session
-	ssn.Username = myusername
-	ui.X = &ssn
+	ui.X = ssn
+	ui.P = p
 	ui.ErrMsg = template.HTML(errmsg)
-	err = t.Execute(w, &ui)
+	err := t.Execute(w, &ui)
 	if nil != err {
-		errmsg := fmt.Sprintf("signinHandler: err = %v\n", err)
+		errmsg := fmt.Sprintf("showPwResetDonePage: err = %v\n", err)
 		ulog(errmsg)
 		fmt.Println(errmsg)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
-
 }
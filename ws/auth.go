@@ -1,16 +1,22 @@
 package ws
 
 import (
-	"crypto/sha512"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 	"path/filepath"
+	"phonebook/authn"
+	"phonebook/authz"
 	"phonebook/db"
+	"phonebook/jwt"
 	"phonebook/lib"
+	"phonebook/pwhash"
+	"phonebook/qb"
 	"phonebook/sess"
 	"phonebook/ui"
 	"strings"
+	"time"
 )
 
 // AuthenticateData is the struct with the username and password
@@ -21,7 +27,8 @@ type AuthenticateData struct {
 	Pass       string `json:"pass"`
 	FLAGS      uint64 `json:"flags"`
 	UserAgent  string `json:"useragent"`
-	RemoteAddr string `json:"remoteaddr"`
+	RemoteAddr string `json:"remoteaddr"` // the user's address, only used from a service account, see svcTrustedCaller
+	OTP        string `json:"otp"`        // authenticator or recovery code, for users with two-step sign in
 }
 
 // AuthSuccessResponse will be the response structure used when
@@ -33,6 +40,7 @@ type AuthSuccessResponse struct {
 	ImageURL string `json:"ImageURL"`
 	Token    string `json:"Token"`
 	Expire   string `json:"Expire"` // DATETIMEFMT in this format "2006-01-02T15:04 "
+	JWT      string `json:"jwt"`    // signed token, checked offline with the keys from /v1/keys
 }
 
 // ValidateCookie describes the data sent by an AIR app to check
@@ -63,6 +71,21 @@ func getImageURL(UID int64) (string, error) {
 	return fname, nil
 }
 
+// svcTrustedCaller returns true if r comes from another server in the
+// suite signing a user in on their behalf, which it shows by sending the
+// API key of a service account. Only such a caller may say which address
+// the user signed in from. Anyone else could send a different address on
+// every attempt and never be throttled.
+//-----------------------------------------------------------------------------
+func svcTrustedCaller(r *http.Request) bool {
+	h := r.Header.Get("Authorization")
+	if len(h) == 0 {
+		return false
+	}
+	ssn, err := getKeySession(r, h)
+	return err == nil && ssn.UID == 0
+}
+
 // SvcAuthenticate generates a password hash from the supplied POST info and
 //     along with the user name compares it to what is in the database. If
 //     there is a match, then the response is {status: success}.  If it fails
@@ -92,23 +115,65 @@ func SvcAuthenticate(w http.ResponseWriter, r *http.Request, d *ServiceData) {
 		return
 	}
 
-	lib.Console("User = %s, Pass = %s\n", foo.User, foo.Pass)
+	lib.Console("User = %s\n", foo.User)
 	lib.Console("IP = %s, UserAgent = %s\n", foo.RemoteAddr, foo.UserAgent)
 
 	fwdaddr := r.Header.Get("X-Forwarded-For")
 	lib.Console("X-Forwarded-For value = %q\n", fwdaddr)
 
+	//-------------------------------------------------------------------
+	// Throttle by the end user's address when a trusted server sends it,
+	// otherwise by the address the request came from.
+	//-------------------------------------------------------------------
+	user := strings.ToLower(foo.User)
+	ip := sess.ClientIP(r)
+	if a := net.ParseIP(strings.TrimSpace(foo.RemoteAddr)); a != nil && svcTrustedCaller(r) {
+		ip = a.String()
+	} else if len(foo.RemoteAddr) > 0 {
+		lib.Console("%s: remoteaddr %q ignored, the caller is not a service account\n", funcname, foo.RemoteAddr)
+	}
+	wait, err := db.LoginWait(user, ip)
+	if err != nil {
+		lib.Ulog("%s: db.LoginWait: %s\n", funcname, err.Error())
+	}
+	if wait > 0 {
+		lib.Ulog("sign in for %s from %s refused, next attempt allowed in %s\n", user, ip, wait)
+		sess.LogSecEvent(r, db.SecEvent{Type: db.SECSIGNINREFUSED, ActorName: user, IP: ip, UserAgent: foo.UserAgent,
+			Detail: fmt.Sprintf("web service, next attempt allowed in %s", wait)})
+		SvcErrorReturn(w, fmt.Errorf("too many failed login attempts, try again in %s", wait.Round(time.Second)), funcname)
+		return
+	}
+
 	UID, Name, err := DoAuthentication(foo.User, foo.Pass)
 	if err != nil {
+		sess.LogSecEvent(r, db.SecEvent{Type: db.SECSIGNINFAILED, ActorName: user, IP: ip, UserAgent: foo.UserAgent, Detail: "web service"})
+		if e := db.LoginFailed(user, ip); e != nil {
+			lib.Ulog("%s: db.LoginFailed: %s\n", funcname, e.Error())
+		}
 		SvcErrorReturn(w, err, funcname)
 		return
 	}
+	if UID > 0 {
+		if err = svcSecondStep(UID, foo.OTP); err != nil {
+			lib.Ulog("%s: second step for %s refused: %s\n", funcname, user, err.Error())
+			sess.LogSecEvent(r, db.SecEvent{Type: db.SECSIGNINFAILED, Actor: UID, ActorName: user, IP: ip, UserAgent: foo.UserAgent,
+				Detail: "web service, second step: " + err.Error()})
+			if e := db.LoginFailed(user, ip); e != nil {
+				lib.Ulog("%s: db.LoginFailed: %s\n", funcname, e.Error())
+			}
+			SvcErrorReturn(w, err, funcname)
+			return
+		}
+	}
+	if e := db.LoginSucceeded(user); e != nil {
+		lib.Ulog("%s: db.LoginSucceeded: %s\n", funcname, e.Error())
+	}
 	if UID > 0 {
 
 		// get image location(URL)
 		imageProfilePath := ui.GetImageLocation(int(UID))
 
-		c := sess.GenerateSessionCookie(UID, foo.User, foo.UserAgent, foo.RemoteAddr)
+		c := sess.GenerateSessionCookie(UID, foo.User, foo.UserAgent, ip)
 
 		g := AuthSuccessResponse{
 			Status:   "success",
@@ -117,10 +182,12 @@ func SvcAuthenticate(w http.ResponseWriter, r *http.Request, d *ServiceData) {
 			ImageURL: imageProfilePath,
 			Token:    c.Cookie,
 			Expire:   c.Expire.In(sess.SessionManager.ZoneUTC).Format(JSONDATETIME),
+			JWT:      svcSignedToken(UID, user, c.Expire),
 		}
 		lib.Console("g = %#v\n", g)
 		SvcWriteResponse(&g, w)
 		lib.Ulog("user %s successfully logged in\n", foo.User)
+		sess.LogSecEvent(r, db.SecEvent{Type: db.SECSIGNIN, Actor: UID, ActorName: user, IP: ip, UserAgent: foo.UserAgent, Detail: "web service"})
 		err = db.InsertSessionCookie(c.UID, c.UserName, c.Cookie, &c.Expire, c.UserAgent, c.IP)
 		if err == nil {
 			return
@@ -131,9 +198,70 @@ func SvcAuthenticate(w http.ResponseWriter, r *http.Request, d *ServiceData) {
 	}
 }
 
-// DoAuthentication builds a password hash out of the supplied user and
-// password information. It then looks up the user in the database. If the
-// password hashes match, then the login is successful
+// svcSecondStep checks the code sent with an authenticate request by a user
+// who needs two-step sign in. Users whose role requires it but who have not
+// enrolled are refused, they enroll by signing in to the directory.
+//
+// RETURNS:
+//  error = nil if the user may sign in, otherwise the reason they may not
+//-----------------------------------------------------------------------------
+func svcSecondStep(UID int64, code string) error {
+	RID, err := svcUserRID(UID)
+	if err != nil {
+		return err
+	}
+	need, err := db.TwoFactorNeeded(UID, RID)
+	if err != nil || !need {
+		return err
+	}
+	tf, err := db.GetTwoFactor(UID)
+	if err != nil {
+		return err
+	}
+	if !tf.Enabled {
+		return fmt.Errorf("two-step sign in is required, sign in to the directory to set it up")
+	}
+	if len(code) == 0 {
+		return fmt.Errorf("two-step sign in code required")
+	}
+	_, ok, err := db.CheckTwoFactorCode(&tf, code, true)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("login failed")
+	}
+	return nil
+}
+
+// svcUserRID returns the rid of the user with the supplied uid
+//-----------------------------------------------------------------------------
+func svcUserRID(UID int64) (int, error) {
+	q, args := (&qb.Select{Cols: "RID", From: "people", Where: qb.Eq("UID", UID)}).SQL()
+	var RID int
+	err := SvcCtx.db.QueryRow(q, args...).Scan(&RID)
+	return RID, err
+}
+
+// svcSignedToken returns a signed token for the supplied user that expires
+// with their session. If the token cannot be made the error is logged and
+// "" is returned, clients that only use the session token still work.
+//-----------------------------------------------------------------------------
+func svcSignedToken(UID int64, username string, expire time.Time) string {
+	RID, err := svcUserRID(UID)
+	if err == nil {
+		var tok string
+		if tok, err = jwt.New(UID, username, authz.RoleName(RID), expire); err == nil {
+			return tok
+		}
+	}
+	lib.Ulog("svcSignedToken: uid %d: %s\n", UID, err.Error())
+	return ""
+}
+
+// DoAuthentication looks up the supplied user in the database and checks
+// the password with the user's authentication provider. If it is correct,
+// then the login is successful.
 //
 // INPUTS:
 //  User = username
@@ -146,20 +274,23 @@ func SvcAuthenticate(w http.ResponseWriter, r *http.Request, d *ServiceData) {
 //-----------------------------------------------------------------------------
 func DoAuthentication(User, Pass string) (int64, string, error) {
 	myusername := strings.ToLower(User)
-	password := []byte(Pass)
-	sha := sha512.Sum512(password)
-	mypasshash := fmt.Sprintf("%x", sha)
 
 	// lookup the user
-	q := fmt.Sprintf("SELECT UID,FirstName,PreferredName,passhash FROM people WHERE UserName=%q", myusername)
+	q, args := (&qb.Select{Cols: "UID,FirstName,PreferredName,passhash", From: "people", Where: qb.Eq("UserName", myusername)}).SQL()
 	var passhash string
 	var UID int64
 	var first, preferred string
-	err := SvcCtx.db.QueryRow(q).Scan(&UID, &first, &preferred, &passhash)
+	err := SvcCtx.db.QueryRow(q, args...).Scan(&UID, &first, &preferred, &passhash)
 	if err != nil {
+		pwhash.Verify(Pass, "") // take the same time as a real check
 		return int64(0), first, err
 	}
-	if passhash != mypasshash {
+	ok, err := authn.Authenticate(myusername, Pass, passhash)
+	if err != nil {
+		lib.Ulog("DoAuthentication: authn.Authenticate: %s\n", err.Error())
+		return int64(0), first, fmt.Errorf("login failed")
+	}
+	if !ok {
 		err := fmt.Errorf("login failed")
 		return int64(0), first, err
 	}
@@ -201,6 +332,10 @@ func SvcValidateCookie(w http.ResponseWriter, r *http.Request, d *ServiceData) {
 	if err != nil {
 		lib.Ulog("signinHandler: error getting session cookie: %s\n", err.Error())
 	}
+	if len(c.Cookie) == 0 || !sess.BindingOK(c.IP, c.UserAgent, foo.IP, foo.UserAgent) {
+		SvcErrorReturn(w, fmt.Errorf("session not found"), funcname)
+		return
+	}
 	lib.Console("Found session cookie: %d, %s, %s\n", c.UID, c.UserName, c.Expire.Format("1/2/2006 15:04:05"))
 	lib.Console("                      IP = %s,  UserAgent = %s\n", c.IP, c.UserAgent)
 
@@ -213,10 +348,35 @@ func SvcValidateCookie(w http.ResponseWriter, r *http.Request, d *ServiceData) {
 		ImageURL: imageProfilePath,
 		Token:    c.Cookie,
 		Expire:   c.Expire.In(sess.SessionManager.ZoneUTC).Format(JSONDATETIME),
+		JWT:      svcSignedToken(c.UID, c.UserName, c.Expire),
 	}
 	SvcWriteResponse(&g, w)
 }
 
+// SvcKeys returns the public keys that the tokens from authenticate are
+// signed with, as a JSON Web Key Set. Services use it to check the tokens
+// without calling phonebook for each one.
+//
+// INPUTS:
+//     w = file descriptor to write result
+//     r = http requrest
+//     d = pointer to data parsed by service dispatcher
+//
+// RETURNS:
+//     nothing at this time
+//-----------------------------------------------------------------------------
+func SvcKeys(w http.ResponseWriter, r *http.Request, d *ServiceData) {
+	var funcname = "SvcKeys"
+	ks, err := jwt.Keys()
+	if err != nil {
+		lib.Ulog("%s: jwt.Keys: %s\n", funcname, err.Error())
+		SvcErrorReturn(w, fmt.Errorf("signing keys are not available"), funcname)
+		return
+	}
+	w.Header().Set("Cache-Control", "max-age=300")
+	SvcWriteResponse(&ks, w)
+}
+
 // SvcLogoff removes a session from the
 func SvcLogoff(w http.ResponseWriter, r *http.Request, d *ServiceData) {
 	var funcname = "SvcLogoff"
@@ -236,6 +396,7 @@ func SvcLogoff(w http.ResponseWriter, r *http.Request, d *ServiceData) {
 	ssn, ok := sess.SessionGet(foo.CookieVal)
 	if ok {
 		lib.Console("found session with that cookie. Deleting.\n")
+		sess.LogSecEvent(r, sess.SessionEvent(ssn, db.SECSIGNOUT, 0, "", "web service"))
 		sess.SessionDelete(ssn)
 	} else {
 		lib.Console("No session with that cookie. Deleting the cooki.\n")
@@ -0,0 +1,226 @@
+package ws
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"phonebook/authz"
+	"phonebook/db"
+	"phonebook/lib"
+	"phonebook/sess"
+	"strconv"
+)
+
+// ClassGridRecord is a class as sent to the w2ui grid and form
+type ClassGridRecord struct {
+	Recid int `json:"recid"`
+	db.Class
+}
+
+// ClassListResponse is the response to a request for a list of classes
+type ClassListResponse struct {
+	Status  string            `json:"status"`
+	Total   int64             `json:"total"`
+	Records []ClassGridRecord `json:"records"`
+}
+
+// ClassResponse is the response to a request for a single class
+type ClassResponse struct {
+	Status string          `json:"status"`
+	Record ClassGridRecord `json:"record"`
+}
+
+// SvcClasses is the dispatcher for the classes web service
+//  @Title Classes
+//  @URL /v1/classes/[ClassCode]
+//  @Method  POST or GET
+//  @Synopsis Get, save, or delete classes
+//  @Description Handles the w2ui grid and form commands. A get without a
+//  @Description ClassCode returns a page of classes using the offset, limit,
+//  @Description search, and sort info in the request. A get with a
+//  @Description ClassCode returns that class. A save with recid 0 creates a
+//  @Description new class, otherwise it updates the class. A delete removes
+//  @Description the selected classes. All data is filtered by the field
+//  @Description permissions of the caller.
+//  @Input WebGridRequest
+//  @Response ClassListResponse, ClassResponse, SvcStatusResponse
+// wsdoc }
+//-----------------------------------------------------------------------------
+func SvcClasses(w http.ResponseWriter, r *http.Request, d *ServiceData) {
+	funcname := "SvcClasses"
+	lib.Console("Entered %s\n", funcname)
+
+	ssn, err := svcSession(r, d)
+	if err != nil {
+		SvcErrorReturn(w, err, funcname)
+		return
+	}
+	req, err := getGridRequest(d)
+	if err != nil {
+		SvcErrorReturn(w, err, funcname)
+		return
+	}
+	if len(d.DetVal) > 0 {
+		if req.Recid, err = strconv.Atoi(d.DetVal); err != nil {
+			e := fmt.Errorf("invalid ClassCode: %s", d.DetVal)
+			SvcErrorReturn(w, e, funcname)
+			return
+		}
+	}
+
+	switch req.Cmd {
+	case "get":
+		if req.Recid > 0 {
+			svcGetClass(w, &req, ssn)
+			return
+		}
+		svcGetClasses(w, &req, ssn)
+	case "save":
+		svcSaveClass(w, &req, ssn)
+	case "delete":
+		svcDeleteClasses(w, &req, ssn)
+	default:
+		e := fmt.Errorf("unhandled command: %s", req.Cmd)
+		SvcErrorReturn(w, e, funcname)
+	}
+}
+
+// svcGetClasses returns the page of classes described by req
+//-----------------------------------------------------------------------------
+func svcGetClasses(w http.ResponseWriter, req *WebGridRequest, ssn *sess.Session) {
+	funcname := "svcGetClasses"
+	if !ssn.ElemPermsAny(authz.ELEMCLASS, authz.PERMVIEW) {
+		lib.Ulog("Permissions refuse %s on userid=%d (%s), role=%s\n", funcname, ssn.UID, ssn.Firstname, ssn.PMap.Urole.Name)
+		SvcErrorReturn(w, fmt.Errorf("permission denied"), funcname)
+		return
+	}
+	p := req.listParams()
+	sess.ListParamsFilter(p, authz.ELEMCLASS, ssn)
+	m, total, err := db.GetClasses(p)
+	if err != nil {
+		SvcErrorReturn(w, err, funcname)
+		return
+	}
+	g := ClassListResponse{Status: "success", Total: total, Records: []ClassGridRecord{}}
+	for i := 0; i < len(m); i++ {
+		rec := ClassGridRecord{Recid: m[i].ClassCode, Class: m[i]}
+		sess.FilterSecurityRead(&rec.Class, authz.ELEMCLASS, ssn, authz.PERMVIEW, 0)
+		g.Records = append(g.Records, rec)
+	}
+	SvcWriteResponse(&g, w)
+}
+
+// svcGetClass returns the class identified by req.Recid
+//-----------------------------------------------------------------------------
+func svcGetClass(w http.ResponseWriter, req *WebGridRequest, ssn *sess.Session) {
+	funcname := "svcGetClass"
+	if !ssn.ElemPermsAny(authz.ELEMCLASS, authz.PERMVIEW) {
+		lib.Ulog("Permissions refuse %s on userid=%d (%s), role=%s\n", funcname, ssn.UID, ssn.Firstname, ssn.PMap.Urole.Name)
+		SvcErrorReturn(w, fmt.Errorf("permission denied"), funcname)
+		return
+	}
+	var c db.Class
+	if err := db.GetClassInfo(req.Recid, &c); err != nil {
+		if err == sql.ErrNoRows {
+			err = fmt.Errorf("class %d was not found", req.Recid)
+		}
+		SvcErrorReturn(w, err, funcname)
+		return
+	}
+	sess.FilterSecurityRead(&c, authz.ELEMCLASS, ssn, authz.PERMVIEW, 0)
+	g := ClassResponse{Status: "success", Record: ClassGridRecord{Recid: req.Recid, Class: c}}
+	SvcWriteResponse(&g, w)
+}
+
+// svcSaveClass creates or updates a class. Only the fields the caller is
+// allowed to modify are changed.
+//-----------------------------------------------------------------------------
+func svcSaveClass(w http.ResponseWriter, req *WebGridRequest, ssn *sess.Session) {
+	funcname := "svcSaveClass"
+	perm := authz.PERMMOD
+	if req.Recid == 0 {
+		perm = authz.PERMCREATE
+	}
+	if !ssn.ElemPermsAny(authz.ELEMCLASS, perm) {
+		lib.Ulog("Permissions refuse %s on userid=%d (%s), role=%s\n", funcname, ssn.UID, ssn.Firstname, ssn.PMap.Urole.Name)
+		SvcErrorReturn(w, fmt.Errorf("permission denied"), funcname)
+		return
+	}
+
+	var co db.Class // container for current information
+	if req.Recid > 0 {
+		if err := db.GetClassInfo(req.Recid, &co); err != nil {
+			if err == sql.ErrNoRows {
+				err = fmt.Errorf("class %d was not found", req.Recid)
+			}
+			SvcErrorReturn(w, err, funcname)
+			return
+		}
+	}
+	c := co
+	if len(req.Record) > 0 {
+		if err := json.Unmarshal(req.Record, &c); err != nil {
+			e := fmt.Errorf("%s: Error with json.Unmarshal:  %s", funcname, err.Error())
+			SvcErrorReturn(w, e, funcname)
+			return
+		}
+	}
+	if len(c.Designation) > 3 {
+		c.Designation = c.Designation[0:3]
+	}
+	sess.FilterSecurityMerge(&co, ssn, authz.ELEMCLASS, authz.PERMMOD, &c, 0) // merge new info based on permissions
+	co.ClassCode = req.Recid
+
+	var err error
+	if req.Recid == 0 {
+		err = db.InsertClass(&co, ssn.UID)
+	} else {
+		err = db.UpdateClass(&co, ssn.UID)
+	}
+	if err != nil {
+		lib.Ulog("%s: error saving class %d: %s\n", funcname, req.Recid, err.Error())
+		SvcErrorReturn(w, err, funcname)
+		return
+	}
+	svcReloadClasses()
+	g := SvcStatusResponse{Status: "success", Recid: int64(co.ClassCode)}
+	SvcWriteResponse(&g, w)
+}
+
+// svcDeleteClasses removes the classes listed in req.Selected, or the class
+// identified by req.Recid. It stops at the first class that cannot be
+// deleted.
+//-----------------------------------------------------------------------------
+func svcDeleteClasses(w http.ResponseWriter, req *WebGridRequest, ssn *sess.Session) {
+	funcname := "svcDeleteClasses"
+	m := req.Selected
+	if req.Recid > 0 {
+		m = append(m, req.Recid)
+	}
+	for i := 0; i < len(m); i++ {
+		var c db.Class
+		if err := db.GetClassInfo(m[i], &c); err != nil {
+			if err == sql.ErrNoRows {
+				err = fmt.Errorf("class with ClassCode %d was not found", m[i])
+			}
+			SvcErrorReturn(w, err, funcname)
+			return
+		}
+		if !sess.HasCoAccess(ssn, authz.ELEMCLASS, "ElemEntity", authz.PERMDEL, c.CoCode) {
+			lib.Ulog("Permissions refuse %s for class %d of company %d on userid=%d (%s), role=%s\n", funcname, m[i], c.CoCode, ssn.UID, ssn.Firstname, ssn.PMap.Urole.Name)
+			SvcErrorReturn(w, fmt.Errorf("permission denied"), funcname)
+			return
+		}
+	}
+	for i := 0; i < len(m); i++ {
+		if err := db.DeleteClass(m[i], ssn.UID); err != nil {
+			svcReloadClasses()
+			SvcErrorReturn(w, err, funcname)
+			return
+		}
+		lib.Ulog("%s: userid=%d (%s) deleted class %d\n", funcname, ssn.UID, ssn.Firstname, m[i])
+	}
+	svcReloadClasses()
+	SvcWriteSuccessResponse(w)
+}
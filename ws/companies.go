@@ -0,0 +1,228 @@
+package ws
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"phonebook/authz"
+	"phonebook/db"
+	"phonebook/lib"
+	"phonebook/sess"
+	"strconv"
+)
+
+// LEGALNAMESIZE and COMMONNAMESIZE are the sql sizes of the company
+// legal name and common name
+const (
+	LEGALNAMESIZE  = 50
+	COMMONNAMESIZE = 50
+)
+
+// CompanyGridRecord is a company as sent to the w2ui grid and form
+type CompanyGridRecord struct {
+	Recid int `json:"recid"`
+	db.Company
+}
+
+// CompanyListResponse is the response to a request for a list of companies
+type CompanyListResponse struct {
+	Status  string              `json:"status"`
+	Total   int64               `json:"total"`
+	Records []CompanyGridRecord `json:"records"`
+}
+
+// CompanyResponse is the response to a request for a single company
+type CompanyResponse struct {
+	Status string            `json:"status"`
+	Record CompanyGridRecord `json:"record"`
+}
+
+// SvcCompanies is the dispatcher for the companies web service
+//  @Title Companies
+//  @URL /v1/companies/[CoCode]
+//  @Method  POST or GET
+//  @Synopsis Get, save, or delete companies
+//  @Description Handles the w2ui grid and form commands. A get without a
+//  @Description CoCode returns a page of companies using the offset, limit,
+//  @Description search, and sort info in the request. A get with a CoCode
+//  @Description returns that company. A save with recid 0 creates a new
+//  @Description company, otherwise it updates the company. A delete removes
+//  @Description the selected companies. All data is filtered by the field
+//  @Description permissions of the caller.
+//  @Input WebGridRequest
+//  @Response CompanyListResponse, CompanyResponse, SvcStatusResponse
+// wsdoc }
+//-----------------------------------------------------------------------------
+func SvcCompanies(w http.ResponseWriter, r *http.Request, d *ServiceData) {
+	funcname := "SvcCompanies"
+	lib.Console("Entered %s\n", funcname)
+
+	ssn, err := svcSession(r, d)
+	if err != nil {
+		SvcErrorReturn(w, err, funcname)
+		return
+	}
+	req, err := getGridRequest(d)
+	if err != nil {
+		SvcErrorReturn(w, err, funcname)
+		return
+	}
+	if len(d.DetVal) > 0 {
+		if req.Recid, err = strconv.Atoi(d.DetVal); err != nil {
+			e := fmt.Errorf("invalid CoCode: %s", d.DetVal)
+			SvcErrorReturn(w, e, funcname)
+			return
+		}
+	}
+
+	switch req.Cmd {
+	case "get":
+		if req.Recid > 0 {
+			svcGetCompany(w, &req, ssn)
+			return
+		}
+		svcGetCompanies(w, &req, ssn)
+	case "save":
+		svcSaveCompany(w, &req, ssn)
+	case "delete":
+		svcDeleteCompanies(w, &req, ssn)
+	default:
+		e := fmt.Errorf("unhandled command: %s", req.Cmd)
+		SvcErrorReturn(w, e, funcname)
+	}
+}
+
+// svcGetCompanies returns the page of companies described by req
+//-----------------------------------------------------------------------------
+func svcGetCompanies(w http.ResponseWriter, req *WebGridRequest, ssn *sess.Session) {
+	funcname := "svcGetCompanies"
+	if !ssn.ElemPermsAny(authz.ELEMCOMPANY, authz.PERMVIEW) {
+		lib.Ulog("Permissions refuse %s on userid=%d (%s), role=%s\n", funcname, ssn.UID, ssn.Firstname, ssn.PMap.Urole.Name)
+		SvcErrorReturn(w, fmt.Errorf("permission denied"), funcname)
+		return
+	}
+	p := req.listParams()
+	sess.ListParamsFilter(p, authz.ELEMCOMPANY, ssn)
+	m, total, err := db.GetCompanies(p)
+	if err != nil {
+		SvcErrorReturn(w, err, funcname)
+		return
+	}
+	g := CompanyListResponse{Status: "success", Total: total, Records: []CompanyGridRecord{}}
+	for i := 0; i < len(m); i++ {
+		rec := CompanyGridRecord{Recid: m[i].CoCode, Company: m[i]}
+		sess.FilterSecurityRead(&rec.Company, authz.ELEMCOMPANY, ssn, authz.PERMVIEW, 0)
+		g.Records = append(g.Records, rec)
+	}
+	SvcWriteResponse(&g, w)
+}
+
+// svcGetCompany returns the company identified by req.Recid
+//-----------------------------------------------------------------------------
+func svcGetCompany(w http.ResponseWriter, req *WebGridRequest, ssn *sess.Session) {
+	funcname := "svcGetCompany"
+	if !ssn.ElemPermsAny(authz.ELEMCOMPANY, authz.PERMVIEW) {
+		lib.Ulog("Permissions refuse %s on userid=%d (%s), role=%s\n", funcname, ssn.UID, ssn.Firstname, ssn.PMap.Urole.Name)
+		SvcErrorReturn(w, fmt.Errorf("permission denied"), funcname)
+		return
+	}
+	var c db.Company
+	if err := db.GetCompanyInfo(req.Recid, &c); err != nil {
+		if err == sql.ErrNoRows {
+			err = fmt.Errorf("company %d was not found", req.Recid)
+		}
+		SvcErrorReturn(w, err, funcname)
+		return
+	}
+	sess.FilterSecurityRead(&c, authz.ELEMCOMPANY, ssn, authz.PERMVIEW, 0)
+	g := CompanyResponse{Status: "success", Record: CompanyGridRecord{Recid: req.Recid, Company: c}}
+	SvcWriteResponse(&g, w)
+}
+
+// svcSaveCompany creates or updates a company. Only the fields the caller
+// is allowed to modify are changed.
+//-----------------------------------------------------------------------------
+func svcSaveCompany(w http.ResponseWriter, req *WebGridRequest, ssn *sess.Session) {
+	funcname := "svcSaveCompany"
+	perm := authz.PERMMOD
+	if req.Recid == 0 {
+		perm = authz.PERMCREATE
+	}
+	if !ssn.ElemPermsAny(authz.ELEMCOMPANY, perm) {
+		lib.Ulog("Permissions refuse %s on userid=%d (%s), role=%s\n", funcname, ssn.UID, ssn.Firstname, ssn.PMap.Urole.Name)
+		SvcErrorReturn(w, fmt.Errorf("permission denied"), funcname)
+		return
+	}
+
+	var co db.Company // container for current information
+	if req.Recid > 0 {
+		if err := db.GetCompanyInfo(req.Recid, &co); err != nil {
+			if err == sql.ErrNoRows {
+				err = fmt.Errorf("company %d was not found", req.Recid)
+			}
+			SvcErrorReturn(w, err, funcname)
+			return
+		}
+	}
+	c := co
+	if len(req.Record) > 0 {
+		if err := json.Unmarshal(req.Record, &c); err != nil {
+			e := fmt.Errorf("%s: Error with json.Unmarshal:  %s", funcname, err.Error())
+			SvcErrorReturn(w, e, funcname)
+			return
+		}
+	}
+	if len(c.LegalName) > LEGALNAMESIZE {
+		c.LegalName = c.LegalName[0:LEGALNAMESIZE]
+	}
+	if len(c.CommonName) > COMMONNAMESIZE {
+		c.CommonName = c.CommonName[0:COMMONNAMESIZE]
+	}
+	sess.FilterSecurityMerge(&co, ssn, authz.ELEMCOMPANY, authz.PERMMOD, &c, 0) // merge
+	co.CoCode = req.Recid
+
+	var err error
+	if req.Recid == 0 {
+		err = db.InsertCompany(&co, ssn.UID)
+	} else {
+		err = db.UpdateCompany(&co, ssn.UID)
+	}
+	if err != nil {
+		lib.Ulog("%s: error saving company %d: %s\n", funcname, req.Recid, err.Error())
+		SvcErrorReturn(w, err, funcname)
+		return
+	}
+	svcReloadCompanies() // It may be a new company, or its active/inactive status may have changed.
+	g := SvcStatusResponse{Status: "success", Recid: int64(co.CoCode)}
+	SvcWriteResponse(&g, w)
+}
+
+// svcDeleteCompanies removes the companies listed in req.Selected, or the
+// company identified by req.Recid. It stops at the first company that
+// cannot be deleted.
+//-----------------------------------------------------------------------------
+func svcDeleteCompanies(w http.ResponseWriter, req *WebGridRequest, ssn *sess.Session) {
+	funcname := "svcDeleteCompanies"
+	m := req.Selected
+	if req.Recid > 0 {
+		m = append(m, req.Recid)
+	}
+	for i := 0; i < len(m); i++ {
+		if !sess.HasCoAccess(ssn, authz.ELEMCOMPANY, "ElemEntity", authz.PERMDEL, m[i]) {
+			lib.Ulog("Permissions refuse %s for company %d on userid=%d (%s), role=%s\n", funcname, m[i], ssn.UID, ssn.Firstname, ssn.PMap.Urole.Name)
+			SvcErrorReturn(w, fmt.Errorf("permission denied"), funcname)
+			return
+		}
+	}
+	for i := 0; i < len(m); i++ {
+		if err := db.DeleteCompany(m[i], ssn.UID); err != nil {
+			svcReloadCompanies()
+			SvcErrorReturn(w, err, funcname)
+			return
+		}
+		lib.Ulog("%s: userid=%d (%s) deleted company %d\n", funcname, ssn.UID, ssn.Firstname, m[i])
+	}
+	svcReloadCompanies()
+	SvcWriteSuccessResponse(w)
+}
@@ -0,0 +1,83 @@
+package ws
+
+import (
+	"encoding/json"
+	"fmt"
+	"phonebook/db"
+	"strings"
+)
+
+// GenSearch describes a search condition sent by the w2ui grid
+type GenSearch struct {
+	Field    string      `json:"field"`
+	Type     string      `json:"type"`
+	Operator string      `json:"operator"`
+	Value    interface{} `json:"value"`
+}
+
+// ColSort describes the sort order requested by the w2ui grid
+type ColSort struct {
+	Field     string `json:"field"`
+	Direction string `json:"direction"`
+}
+
+// WebGridRequest is the request structure sent by the w2ui grid and form
+// widgets. Cmd is "get", "save", or "delete".
+type WebGridRequest struct {
+	Cmd         string          `json:"cmd"`
+	Recid       int             `json:"recid"`
+	Limit       int             `json:"limit"`
+	Offset      int             `json:"offset"`
+	Selected    []int           `json:"selected"`
+	SearchLogic string          `json:"searchLogic"`
+	Search      []GenSearch     `json:"search"`
+	Sort        []ColSort       `json:"sort"`
+	Record      json.RawMessage `json:"record"`
+}
+
+// getGridRequest parses the w2ui request in d. The request may be in the
+// body of a POST or in the "request" parameter of a GET. If there is no
+// request data the command defaults to "get".
+//-----------------------------------------------------------------------------
+func getGridRequest(d *ServiceData) (WebGridRequest, error) {
+	var req WebGridRequest
+	data := d.data
+	if len(data) == 0 {
+		if v, ok := d.QueryParams["request"]; ok && len(v) > 0 {
+			data = v[0]
+		}
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal([]byte(data), &req); err != nil {
+			return req, fmt.Errorf("Error with json.Unmarshal:  %s", err.Error())
+		}
+	}
+	if len(req.Cmd) == 0 {
+		req.Cmd = "get"
+	}
+	req.Cmd = strings.ToLower(req.Cmd)
+	return req, nil
+}
+
+// listParams converts the paging, search, and sort information in a w2ui
+// grid request to the form used by the db list functions.
+//-----------------------------------------------------------------------------
+func (req *WebGridRequest) listParams() *db.ListParams {
+	p := db.ListParams{
+		SearchLogic: req.SearchLogic,
+		Offset:      req.Offset,
+		Limit:       req.Limit,
+	}
+	for i := 0; i < len(req.Search); i++ {
+		p.Search = append(p.Search, db.SearchTerm{
+			Field:    req.Search[i].Field,
+			Operator: req.Search[i].Operator,
+			Value:    fmt.Sprint(req.Search[i].Value),
+		})
+	}
+	if len(req.Sort) > 0 {
+		p.SortField = req.Sort[0].Field
+		p.SortDesc = strings.ToLower(req.Sort[0].Direction) == "desc"
+	}
+	return &p
+}
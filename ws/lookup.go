@@ -0,0 +1,201 @@
+package ws
+
+import (
+	"fmt"
+	"net/http"
+	"phonebook/authz"
+	"phonebook/idx"
+	"phonebook/lib"
+	"phonebook/sess"
+	"phonebook/ui"
+	"strconv"
+	"strings"
+)
+
+// LOOKUPMAX is the default and LOOKUPLIMIT the largest number of matches
+// returned by the lookup service.
+const (
+	LOOKUPMAX   = 10
+	LOOKUPLIMIT = 50
+)
+
+// LookupItem is a single match returned by the lookup service. ID and Text
+// are what the w2ui list and combo fields expect.
+type LookupItem struct {
+	ID        int    `json:"id"`
+	Text      string `json:"text"`
+	Type      string `json:"type"` // person, company, or class
+	UID       int    `json:"UID,omitempty"`
+	CoCode    int    `json:"CoCode,omitempty"`
+	ClassCode int    `json:"ClassCode,omitempty"`
+	Name      string `json:"name"`
+	Title     string `json:"title"` // job title, company common name, or class designation
+	ImageURL  string `json:"imageURL,omitempty"`
+	URL       string `json:"url"` // the page for this item
+}
+
+// LookupResponse is the response to a lookup request
+type LookupResponse struct {
+	Status  string       `json:"status"`
+	Records []LookupItem `json:"records"`
+}
+
+// lookupTypes maps the type names accepted by the lookup service to
+// element types
+var lookupTypes = map[string]int{
+	"person":  authz.ELEMPERSON,
+	"people":  authz.ELEMPERSON,
+	"company": authz.ELEMCOMPANY,
+	"class":   authz.ELEMCLASS,
+}
+
+// lookupNameField is the field whose view permission lets the caller see
+// the name of a person, company or class
+var lookupNameField = map[int]string{
+	authz.ELEMPERSON:  "LastName",
+	authz.ELEMCOMPANY: "LegalName",
+	authz.ELEMCLASS:   "Name",
+}
+
+// SvcLookup returns the best matches for a partial name. It is meant for
+// type-ahead fields and only reads the in-memory name index.
+//  @Title Lookup
+//  @URL /v1/lookup/
+//  @Method  GET
+//  @Synopsis Type-ahead search for people, companies, and classes
+//  @Description q (or search) is the text typed so far. type limits the
+//  @Description matches to person, company, or class, or a comma separated
+//  @Description list of them; all types are searched if it is omitted. max
+//  @Description is the number of matches to return, default 10. Inactive
+//  @Description people and companies are only returned if inactive=1.
+//  @Description employer=1 limits companies to those that employ personnel.
+//  @Description Only the types and fields the caller may view are returned.
+//  @Input query parameters
+//  @Response LookupResponse
+// wsdoc }
+//-----------------------------------------------------------------------------
+func SvcLookup(w http.ResponseWriter, r *http.Request, d *ServiceData) {
+	funcname := "SvcLookup"
+	lib.Console("Entered %s\n", funcname)
+
+	ssn, err := svcSession(r, d)
+	if err != nil {
+		SvcErrorReturn(w, err, funcname)
+		return
+	}
+	get := func(name string) string {
+		if v, ok := d.QueryParams[name]; ok && len(v) > 0 {
+			return strings.TrimSpace(v[0])
+		}
+		return ""
+	}
+	q := get("q")
+	if len(q) == 0 {
+		q = get("search")
+	}
+	max := LOOKUPMAX
+	if n, err := strconv.Atoi(get("max")); err == nil && n > 0 {
+		max = n
+	}
+	if max > LOOKUPLIMIT {
+		max = LOOKUPLIMIT
+	}
+	inactive := get("inactive") == "1"
+	employer := get("employer") == "1"
+
+	//----------------------------------------------------------------
+	// SECURITY: only search the types whose names the caller can see
+	//----------------------------------------------------------------
+	kinds := map[int]bool{}
+	if t := get("type"); len(t) > 0 {
+		for _, s := range strings.Split(t, ",") {
+			k, ok := lookupTypes[strings.ToLower(strings.TrimSpace(s))]
+			if !ok {
+				SvcErrorReturn(w, fmt.Errorf("unknown type: %s", s), funcname)
+				return
+			}
+			kinds[k] = true
+		}
+	} else {
+		kinds[authz.ELEMPERSON] = true
+		kinds[authz.ELEMCOMPANY] = true
+		kinds[authz.ELEMCLASS] = true
+	}
+	if kinds[authz.ELEMPERSON] && !sess.HasCoAccess(ssn, authz.ELEMPERSON, "LastName", authz.PERMVIEW, -1) {
+		delete(kinds, authz.ELEMPERSON)
+	}
+	if kinds[authz.ELEMCOMPANY] && !sess.HasCoAccess(ssn, authz.ELEMCOMPANY, "LegalName", authz.PERMVIEW, -1) {
+		delete(kinds, authz.ELEMCOMPANY)
+	}
+	if kinds[authz.ELEMCLASS] && !sess.HasCoAccess(ssn, authz.ELEMCLASS, "Name", authz.PERMVIEW, -1) {
+		delete(kinds, authz.ELEMCLASS)
+	}
+
+	g := LookupResponse{Status: "success", Records: []LookupItem{}}
+	if len(q) == 0 || len(kinds) == 0 {
+		SvcWriteResponse(&g, w)
+		return
+	}
+	kind := 0
+	if len(kinds) == 1 {
+		for k := range kinds {
+			kind = k
+		}
+	}
+	m := idx.Search(q, kind, 0)
+	for i := 0; i < len(m) && len(g.Records) < max; i++ {
+		h := &m[i]
+		if !kinds[h.Kind] {
+			continue
+		}
+
+		//----------------------------------------------------------------
+		// SECURITY: a role limited to some companies may have fewer
+		// permissions, or none, for the company the hit belongs to
+		//----------------------------------------------------------------
+		can := func(el int, n string, perm int) bool {
+			return sess.HasCoAccess(ssn, el, n, perm, h.CoCode)
+		}
+		if !can(h.Kind, lookupNameField[h.Kind], authz.PERMVIEW) {
+			continue
+		}
+		inactivePeople := can(authz.ELEMPERSON, "Termination", authz.PERMMOD) // same rule as the people search
+		if !h.Active && (!inactive || (h.Kind == authz.ELEMPERSON && !inactivePeople)) {
+			continue
+		}
+		item := LookupItem{ID: h.ID, Text: h.Name, Name: h.Name}
+		switch h.Kind {
+		case authz.ELEMPERSON:
+			item.Type = "person"
+			item.UID = h.ID
+			item.URL = fmt.Sprintf("/detail/%d", h.ID)
+			if can(authz.ELEMPERSON, "JobCode", authz.PERMVIEW) {
+				item.Title = h.Title
+			}
+			im := h.Image
+			if len(im) == 0 {
+				im = ui.DefaultProfileImage
+			}
+			item.ImageURL = ui.GenerateImageLocation(im)
+		case authz.ELEMCOMPANY:
+			if employer && !h.Employer {
+				continue
+			}
+			item.Type = "company"
+			item.CoCode = h.ID
+			item.URL = fmt.Sprintf("/company/%d", h.ID)
+			if can(authz.ELEMCOMPANY, "CommonName", authz.PERMVIEW) {
+				item.Title = h.Title
+			}
+		case authz.ELEMCLASS:
+			item.Type = "class"
+			item.ClassCode = h.ID
+			item.URL = fmt.Sprintf("/class/%d", h.ID)
+			if can(authz.ELEMCLASS, "Designation", authz.PERMVIEW) {
+				item.Title = h.Title
+			}
+		}
+		g.Records = append(g.Records, item)
+	}
+	SvcWriteResponse(&g, w)
+}
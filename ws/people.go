@@ -0,0 +1,313 @@
+package ws
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"phonebook/authz"
+	"phonebook/db"
+	"phonebook/idx"
+	"phonebook/lib"
+	"phonebook/sess"
+	"strconv"
+)
+
+// PeopleListResponse is the response to a request for a list of people
+type PeopleListResponse struct {
+	Status  string            `json:"status"`
+	Total   int64             `json:"total"`
+	Records []db.PersonDetail `json:"records"`
+}
+
+// PersonResponse is the response to a request for a single person
+type PersonResponse struct {
+	Status string          `json:"status"`
+	Record db.PersonDetail `json:"record"`
+}
+
+// SvcPeople is the dispatcher for the people web service
+//  @Title People
+//  @URL /v1/people/[UID]
+//  @Method  GET, POST, PUT, DELETE
+//  @Synopsis List, read, create, update, or delete people
+//  @Description GET without a UID returns a list of people. The query
+//  @Description parameters offset and limit select the page. GET with a
+//  @Description UID returns the details for that person. POST without a
+//  @Description UID creates a new person. POST or PUT with a UID updates
+//  @Description the person. DELETE with a UID removes the person. All
+//  @Description data is filtered by the field permissions of the caller.
+//  @Input db.PersonDetail
+//  @Response PeopleListResponse, PersonResponse, SvcStatusResponse
+// wsdoc }
+//-----------------------------------------------------------------------------
+func SvcPeople(w http.ResponseWriter, r *http.Request, d *ServiceData) {
+	funcname := "SvcPeople"
+	lib.Console("Entered %s\n", funcname)
+
+	ssn, err := svcSession(r, d)
+	if err != nil {
+		SvcErrorReturn(w, err, funcname)
+		return
+	}
+
+	uid := 0
+	if len(d.DetVal) > 0 {
+		if uid, err = strconv.Atoi(d.DetVal); err != nil || uid <= 0 {
+			e := fmt.Errorf("invalid UID: %s", d.DetVal)
+			SvcErrorReturn(w, e, funcname)
+			return
+		}
+	}
+
+	switch r.Method {
+	case "GET":
+		if uid == 0 {
+			svcGetPeople(w, r, d, ssn)
+			return
+		}
+		svcGetPerson(w, r, uid, ssn)
+	case "POST", "PUT":
+		if uid == 0 && r.Method == "POST" {
+			svcCreatePerson(w, r, d, ssn)
+			return
+		}
+		svcUpdatePerson(w, r, d, uid, ssn)
+	case "DELETE":
+		svcDeletePerson(w, r, uid, ssn)
+	default:
+		e := fmt.Errorf("unsupported method: %s", r.Method)
+		SvcErrorReturn(w, e, funcname)
+	}
+}
+
+// svcGetPeople returns a page of people. Each person's data is filtered
+// by the permissions in the caller's session.
+//-----------------------------------------------------------------------------
+func svcGetPeople(w http.ResponseWriter, r *http.Request, d *ServiceData, ssn *sess.Session) {
+	funcname := "svcGetPeople"
+	if !ssn.ElemPermsAny(authz.ELEMPERSON, authz.PERMVIEW|authz.PERMOWNERVIEW|authz.PERMMGRVIEW) {
+		lib.Ulog("Permissions refuse %s on userid=%d (%s), role=%s\n", funcname, ssn.UID, ssn.Firstname, ssn.PMap.Urole.Name)
+		SvcErrorReturn(w, fmt.Errorf("permission denied"), funcname)
+		return
+	}
+
+	offset, limit := 0, 100
+	if v, ok := d.QueryParams["offset"]; ok && len(v) > 0 {
+		if n, err := strconv.Atoi(v[0]); err == nil && n >= 0 {
+			offset = n
+		}
+	}
+	if v, ok := d.QueryParams["limit"]; ok && len(v) > 0 {
+		if n, err := strconv.Atoi(v[0]); err == nil && n > 0 {
+			limit = n
+		}
+	}
+	if limit > 1000 {
+		limit = 1000
+	}
+
+	m, total, err := db.GetPeople(offset, limit)
+	if err != nil {
+		SvcErrorReturn(w, err, funcname)
+		return
+	}
+	for i := 0; i < len(m); i++ {
+		sess.FilterSecurityRead(&m[i], authz.ELEMPERSON, ssn, authz.PERMVIEW|authz.PERMOWNERVIEW|authz.PERMMGRVIEW, m[i].UID)
+	}
+	g := PeopleListResponse{Status: "success", Total: total, Records: m}
+	SvcWriteResponse(&g, w)
+}
+
+// svcGetPerson returns the details for the person with the supplied uid,
+// filtered by the permissions in the caller's session.
+//-----------------------------------------------------------------------------
+func svcGetPerson(w http.ResponseWriter, r *http.Request, uid int, ssn *sess.Session) {
+	funcname := "svcGetPerson"
+	if !ssn.ElemPermsAny(authz.ELEMPERSON, authz.PERMVIEW|authz.PERMOWNERVIEW|authz.PERMMGRVIEW) {
+		lib.Ulog("Permissions refuse %s on userid=%d (%s), role=%s\n", funcname, ssn.UID, ssn.Firstname, ssn.PMap.Urole.Name)
+		SvcErrorReturn(w, fmt.Errorf("permission denied"), funcname)
+		return
+	}
+	var p db.PersonDetail
+	p.UID = uid
+	if err := db.GetPersonDetail(&p); err != nil {
+		if err == sql.ErrNoRows {
+			err = fmt.Errorf("person with UID %d was not found", uid)
+		}
+		SvcErrorReturn(w, err, funcname)
+		return
+	}
+	sess.FilterSecurityRead(&p, authz.ELEMPERSON, ssn, authz.PERMVIEW|authz.PERMOWNERVIEW|authz.PERMMGRVIEW, p.UID)
+	g := PersonResponse{Status: "success", Record: p}
+	SvcWriteResponse(&g, w)
+}
+
+// svcCreatePerson adds a new person. Only the fields the caller is allowed
+// to modify are taken from the request.
+//-----------------------------------------------------------------------------
+func svcCreatePerson(w http.ResponseWriter, r *http.Request, d *ServiceData, ssn *sess.Session) {
+	funcname := "svcCreatePerson"
+	if !ssn.ElemPermsAny(authz.ELEMPERSON, authz.PERMCREATE) {
+		lib.Ulog("Permissions refuse %s on userid=%d (%s), role=%s\n", funcname, ssn.UID, ssn.Firstname, ssn.PMap.Urole.Name)
+		SvcErrorReturn(w, fmt.Errorf("permission denied"), funcname)
+		return
+	}
+	var dNew, p db.PersonDetail
+	if err := json.Unmarshal([]byte(d.data), &dNew); err != nil {
+		e := fmt.Errorf("%s: Error with json.Unmarshal:  %s", funcname, err.Error())
+		SvcErrorReturn(w, e, funcname)
+		return
+	}
+	sess.FilterSecurityMerge(&p, ssn, authz.ELEMPERSON, authz.PERMMOD, &dNew, 0)
+	if len(p.FirstName) == 0 || len(p.LastName) == 0 {
+		SvcErrorReturn(w, fmt.Errorf("FirstName and LastName are required"), funcname)
+		return
+	}
+	if p.RID != 0 && !sess.CanGrantRole(ssn, p.RID) {
+		lib.Ulog("Permissions refuse %s role %d on userid=%d (%s), role=%s\n", funcname, p.RID, ssn.UID, ssn.Firstname, ssn.PMap.Urole.Name)
+		SvcErrorReturn(w, fmt.Errorf("permission denied: role %d can do more than your own", p.RID), funcname)
+		return
+	}
+	if p.RID == 0 {
+		p.RID = 4 // default security role is Viewer
+	}
+	var err error
+	if p.UserName, err = db.GenerateUserName(p.FirstName, p.LastName); err != nil {
+		SvcErrorReturn(w, err, funcname)
+		return
+	}
+	if err = db.InsertPerson(&p, ssn.UID); err != nil {
+		lib.Ulog("%s: error inserting person: %s\n", funcname, err.Error())
+		SvcErrorReturn(w, err, funcname)
+		return
+	}
+	idx.Errlog(funcname, idx.UpdatePerson(p.UID))
+	sess.LogRoleChange(r, ssn, p.UID, p.UserName, 0, p.RID)
+	g := SvcStatusResponse{Status: "success", Recid: int64(p.UID)}
+	SvcWriteResponse(&g, w)
+}
+
+// svcUpdatePerson updates the person with the supplied uid. Fields missing
+// from the request keep their current values, and only the fields the
+// caller is allowed to modify are changed.
+//-----------------------------------------------------------------------------
+func svcUpdatePerson(w http.ResponseWriter, r *http.Request, d *ServiceData, uid int, ssn *sess.Session) {
+	funcname := "svcUpdatePerson"
+	if !ssn.ElemPermsAny(authz.ELEMPERSON, authz.PERMMOD|authz.PERMOWNERMOD) {
+		lib.Ulog("Permissions refuse %s on userid=%d (%s), role=%s\n", funcname, ssn.UID, ssn.Firstname, ssn.PMap.Urole.Name)
+		SvcErrorReturn(w, fmt.Errorf("permission denied"), funcname)
+		return
+	}
+	if uid == 0 {
+		var x struct{ UID int }
+		if err := json.Unmarshal([]byte(d.data), &x); err == nil {
+			uid = x.UID
+		}
+	}
+	if uid == 0 {
+		SvcErrorReturn(w, fmt.Errorf("the UID of the person to update is required"), funcname)
+		return
+	}
+
+	var do db.PersonDetail // current info
+	do.UID = uid
+	if err := db.GetPersonDetail(&do); err != nil {
+		if err == sql.ErrNoRows {
+			err = fmt.Errorf("person with UID %d was not found", uid)
+		}
+		SvcErrorReturn(w, err, funcname)
+		return
+	}
+	dNew := do
+	if err := json.Unmarshal([]byte(d.data), &dNew); err != nil {
+		e := fmt.Errorf("%s: Error with json.Unmarshal:  %s", funcname, err.Error())
+		SvcErrorReturn(w, e, funcname)
+		return
+	}
+	status := do.Status
+	oldRID := do.RID
+	sess.FilterSecurityMerge(&do, ssn, authz.ELEMPERSON, authz.PERMMOD|authz.PERMOWNERMOD, &dNew, uid)
+	do.UID = uid
+	if do.RID != oldRID && !sess.CanGrantRole(ssn, do.RID) {
+		lib.Ulog("Permissions refuse %s role %d on userid=%d (%s), role=%s\n", funcname, do.RID, ssn.UID, ssn.Firstname, ssn.PMap.Urole.Name)
+		SvcErrorReturn(w, fmt.Errorf("permission denied: role %d can do more than your own", do.RID), funcname)
+		return
+	}
+
+	//----------------------------------------------------------------------------
+	// Inactivating a person is like a delete, nobody may report to them...
+	//----------------------------------------------------------------------------
+	if status == 1 && do.Status == 0 {
+		count, err := db.GetDirectReportsCount(uid)
+		if err != nil {
+			SvcErrorReturn(w, err, funcname)
+			return
+		}
+		if count > 0 {
+			e := fmt.Errorf("cannot inactivate UID %d, %d people report to this person", uid, count)
+			SvcErrorReturn(w, e, funcname)
+			return
+		}
+	}
+
+	if err := db.UpdatePerson(&do, ssn.UID); err != nil {
+		lib.Ulog("%s: error updating person %d: %s\n", funcname, uid, err.Error())
+		SvcErrorReturn(w, err, funcname)
+		return
+	}
+	idx.Errlog(funcname, idx.UpdatePerson(uid))
+	sess.LogRoleChange(r, ssn, uid, do.UserName, oldRID, do.RID)
+	if int64(uid) == ssn.UID {
+		if 0 == len(do.PreferredName) {
+			ssn.Firstname = do.FirstName
+		} else {
+			ssn.Firstname = do.PreferredName
+		}
+	}
+	g := SvcStatusResponse{Status: "success", Recid: int64(uid)}
+	SvcWriteResponse(&g, w)
+}
+
+// svcDeletePerson removes the person with the supplied uid. It fails if
+// anyone reports to the person.
+//-----------------------------------------------------------------------------
+func svcDeletePerson(w http.ResponseWriter, r *http.Request, uid int, ssn *sess.Session) {
+	funcname := "svcDeletePerson"
+	if uid == 0 {
+		SvcErrorReturn(w, fmt.Errorf("the UID of the person to delete is required"), funcname)
+		return
+	}
+	var p db.PersonDetail
+	p.UID = uid
+	if err := db.GetPersonDetail(&p); err != nil {
+		if err == sql.ErrNoRows {
+			err = fmt.Errorf("person with UID %d was not found", uid)
+		}
+		SvcErrorReturn(w, err, funcname)
+		return
+	}
+	if !sess.HasCoAccess(ssn, authz.ELEMPERSON, "ElemEntity", authz.PERMDEL, p.CoCode) {
+		lib.Ulog("Permissions refuse %s for uid %d of company %d on userid=%d (%s), role=%s\n", funcname, uid, p.CoCode, ssn.UID, ssn.Firstname, ssn.PMap.Urole.Name)
+		SvcErrorReturn(w, fmt.Errorf("permission denied"), funcname)
+		return
+	}
+	count, err := db.GetDirectReportsCount(uid)
+	if err != nil {
+		SvcErrorReturn(w, err, funcname)
+		return
+	}
+	if count > 0 {
+		e := fmt.Errorf("cannot delete UID %d, %d people report to this person", uid, count)
+		SvcErrorReturn(w, e, funcname)
+		return
+	}
+	if err = db.DeletePerson(uid, ssn.UID); err != nil {
+		lib.Ulog("%s: error deleting person %d: %s\n", funcname, uid, err.Error())
+		SvcErrorReturn(w, err, funcname)
+		return
+	}
+	idx.Remove(authz.ELEMPERSON, uid)
+	lib.Ulog("%s: userid=%d (%s) deleted person %d\n", funcname, ssn.UID, ssn.Firstname, uid)
+	SvcWriteSuccessResponse(w)
+}
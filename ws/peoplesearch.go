@@ -0,0 +1,85 @@
+package ws
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"phonebook/authz"
+	"phonebook/db"
+	"phonebook/lib"
+	"phonebook/sess"
+)
+
+// PeopleSearchResponse is the response to a people search
+type PeopleSearchResponse struct {
+	Status  string          `json:"status"`
+	Total   int64           `json:"total"`
+	Filter  db.PeopleSearch `json:"filter"` // the filters that were applied
+	Records []db.Person     `json:"records"`
+}
+
+// SvcPeopleSearch searches the people table using the same filters as the
+// search page.
+//  @Title People Search
+//  @URL /v1/peoplesearch/
+//  @Method  GET or POST
+//  @Synopsis Search people by text, company, class, department, job title, manager, location, and status
+//  @Description With GET the filters are taken from the query parameters
+//  @Description searchstring, CoCode, ClassCode, DeptCode, JobCode, MgrUID,
+//  @Description MgrName, StateOfEmployment, CountryOfEmployment, Status,
+//  @Description sort, desc, offset, and limit. With POST they are taken
+//  @Description from the json body. Filters on fields the caller cannot
+//  @Description view are ignored, and the returned filter shows what was
+//  @Description actually applied. All data is filtered by the field
+//  @Description permissions of the caller.
+//  @Input db.PeopleSearch
+//  @Response PeopleSearchResponse
+// wsdoc }
+//-----------------------------------------------------------------------------
+func SvcPeopleSearch(w http.ResponseWriter, r *http.Request, d *ServiceData) {
+	funcname := "SvcPeopleSearch"
+	lib.Console("Entered %s\n", funcname)
+
+	ssn, err := svcSession(r, d)
+	if err != nil {
+		SvcErrorReturn(w, err, funcname)
+		return
+	}
+	if !ssn.ElemPermsAny(authz.ELEMPERSON, authz.PERMVIEW|authz.PERMOWNERVIEW|authz.PERMMGRVIEW) {
+		lib.Ulog("Permissions refuse %s on userid=%d (%s), role=%s\n", funcname, ssn.UID, ssn.Firstname, ssn.PMap.Urole.Name)
+		SvcErrorReturn(w, fmt.Errorf("permission denied"), funcname)
+		return
+	}
+
+	var f db.PeopleSearch
+	switch r.Method {
+	case "GET":
+		f = db.PeopleSearchFromValues(url.Values(d.QueryParams))
+	case "POST":
+		f = db.NewPeopleSearch()
+		if len(d.data) > 0 {
+			if err = json.Unmarshal([]byte(d.data), &f); err != nil {
+				e := fmt.Errorf("%s: Error with json.Unmarshal:  %s", funcname, err.Error())
+				SvcErrorReturn(w, e, funcname)
+				return
+			}
+		}
+	default:
+		e := fmt.Errorf("unsupported method: %s", r.Method)
+		SvcErrorReturn(w, e, funcname)
+		return
+	}
+
+	sess.PeopleSearchFilter(&f, ssn) // SECURITY: ignore filters on fields this user cannot see
+	m, total, err := db.SearchPeople(&f)
+	if err != nil {
+		SvcErrorReturn(w, err, funcname)
+		return
+	}
+	for i := 0; i < len(m); i++ {
+		sess.FilterSecurityRead(&m[i], authz.ELEMPERSON, ssn, authz.PERMVIEW|authz.PERMMOD, m[i].UID)
+	}
+	g := PeopleSearchResponse{Status: "success", Total: total, Filter: f, Records: m}
+	SvcWriteResponse(&g, w)
+}
@@ -5,10 +5,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"phonebook/authn"
+	"phonebook/db"
 	"phonebook/lib"
+	"phonebook/qb"
+	"phonebook/sess"
 	"strings"
-
-	"gopkg.in/gomail.v2"
+	"time"
 )
 
 // ResetPWDomains is the list of domains supported by the
@@ -25,8 +28,9 @@ type ResetPWData struct {
 	Username string `json:"username"`
 }
 
-// SvcResetPWHandler resets the password for the supplied user
-// cannot get logged in
+// SvcResetPWHandler emails the supplied user a single use link to the page
+// where they can choose a new password. The current password keeps working
+// until they do.
 func SvcResetPWHandler(w http.ResponseWriter, r *http.Request, d *ServiceData) {
 	var err error
 	funcname := "SvcResetPWHandler"
@@ -43,13 +47,31 @@ func SvcResetPWHandler(w http.ResponseWriter, r *http.Request, d *ServiceData) {
 
 	lib.Console("Username = %s\n", foo.Username)
 	myusername := strings.ToLower(foo.Username)
+	ip := sess.ClientIP(r)
+
+	//-------------------------------------------
+	//  Too many recent reset requests?
+	//-------------------------------------------
+	wait, err := db.PWResetWait(myusername, ip)
+	if err != nil {
+		lib.Ulog("%s: db.PWResetWait: %s\n", funcname, err.Error())
+	}
+	if wait > 0 {
+		lib.Ulog("password reset for %s from %s refused, next request allowed in %s\n", myusername, ip, wait)
+		SvcErrorReturn(w, fmt.Errorf("too many password reset requests, try again in %d minutes", int(wait/time.Minute)+1), funcname)
+		return
+	}
+	if err = db.PWResetRequested(myusername, ip); err != nil {
+		lib.Ulog("%s: db.PWResetRequested: %s\n", funcname, err.Error())
+	}
 
 	//-------------------------------------
 	// validate that myusername exists
 	//-------------------------------------
 	var PrimaryEmail string
-	q := fmt.Sprintf("SELECT PrimaryEmail FROM people WHERE UserName=%q", myusername)
-	err = SvcCtx.db.QueryRow(q).Scan(&PrimaryEmail)
+	var UID int64
+	q, args := (&qb.Select{Cols: "UID,PrimaryEmail", From: "people", Where: qb.Eq("UserName", myusername)}).SQL()
+	err = SvcCtx.db.QueryRow(q, args...).Scan(&UID, &PrimaryEmail)
 
 	switch {
 	case err == sql.ErrNoRows:
@@ -61,6 +83,11 @@ func SvcResetPWHandler(w http.ResponseWriter, r *http.Request, d *ServiceData) {
 		SvcErrorReturn(w, err, funcname)
 		return
 	}
+	if !authn.LocalPassword(myusername) {
+		err = fmt.Errorf("the password for %s is managed by the corporate directory", myusername)
+		SvcErrorReturn(w, err, funcname)
+		return
+	}
 	if PrimaryEmail == "" {
 		err = fmt.Errorf("Error: No email address for user: %s", myusername)
 		SvcErrorReturn(w, err, funcname)
@@ -70,7 +97,6 @@ func SvcResetPWHandler(w http.ResponseWriter, r *http.Request, d *ServiceData) {
 	//-------------------------------------
 	// validate domain
 	//-------------------------------------
-	errmsg := ""
 	domain := ""
 	k := strings.LastIndex(PrimaryEmail, "@")
 	if k > 0 {
@@ -89,28 +115,21 @@ func SvcResetPWHandler(w http.ResponseWriter, r *http.Request, d *ServiceData) {
 		return
 	}
 
-	//-------------------------------------
-	// reset the password for myusername
-	//-------------------------------------
-	password := lib.RandPasswordStringRunes(8)
-	err = lib.UpdateUserPassword(myusername, password, SvcCtx.db)
+	//----------------------------------------------------------------
+	// Create a reset token for myusername. The password itself does
+	// not change until the user follows the emailed link.
+	//----------------------------------------------------------------
+	token, err := db.NewPWReset(UID, myusername, ip, time.Duration(lib.PBConfig.PWResetMinutes)*time.Minute)
 	if nil != err {
-		e := fmt.Errorf("Error updating password: %s", err.Error())
+		e := fmt.Errorf("Error creating password reset: %s", err.Error())
 		SvcErrorReturn(w, e, funcname)
 		return
 	}
 
 	//------------------------------------------------------------------------------
-	// send an email to the associated account that the password has been changed.
+	// send an email to the associated account with the link to reset the password
 	//------------------------------------------------------------------------------
-	m := gomail.NewMessage()
-	m.SetHeader("From", "sman@accordinterests.com")
-	m.SetHeader("To", PrimaryEmail)
-	msg := fmt.Sprintf("Hello %s,<br><br>Your Accord password has been reset to:  %s<br><br>", myusername, password)
-	m.SetHeader("Subject", "Your Accord password has been updated")
-	m.SetBody("text/html", msg)
-	if err := lib.SMTPDialAndSend(m); err != nil {
-		errmsg += fmt.Sprintf("Error sending PrimaryEmail = %s", err.Error())
+	if err := lib.SendPWResetEmail(PrimaryEmail, myusername, token); err != nil {
 		e := fmt.Errorf("Error  sending email to %s: %s", PrimaryEmail, err.Error())
 		SvcErrorReturn(w, e, funcname)
 		return
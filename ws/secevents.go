@@ -0,0 +1,46 @@
+package ws
+
+import (
+	"net/http"
+	"net/url"
+	"phonebook/db"
+	"phonebook/lib"
+)
+
+// SecEventsResponse is the response to a security events request
+type SecEventsResponse struct {
+	Status  string        `json:"status"`
+	Records []db.SecEvent `json:"records"`
+}
+
+// SvcSecEvents returns security events: sign ins, password resets, acting
+// as another person, role changes, shutdowns and restarts. It is meant for
+// a SIEM, which can collect the new events by passing the id of the last
+// one it got as after.
+//  @Title Security Events
+//  @URL /v1/secevents/
+//  @Method  GET
+//  @Synopsis Security events by user, type and date range
+//  @Description user is the username or uid of the person who did it or
+//  @Description had it done to them. type is the event type. from and to
+//  @Description are the first and last day, yyyy-mm-dd. after returns only
+//  @Description the events with a greater id, oldest first; otherwise the
+//  @Description most recent are first. limit is the most to return,
+//  @Description default 1000. Only callers who may modify roles can use it.
+//  @Input query parameters
+//  @Response SecEventsResponse
+// wsdoc }
+//-----------------------------------------------------------------------------
+func SvcSecEvents(w http.ResponseWriter, r *http.Request, d *ServiceData) {
+	funcname := "SvcSecEvents"
+	lib.Console("Entered %s\n", funcname)
+
+	f := db.SecEventFilterFromValues(url.Values(d.QueryParams))
+	m, err := db.GetSecEvents(&f)
+	if err != nil {
+		SvcErrorReturn(w, err, funcname)
+		return
+	}
+	g := SecEventsResponse{Status: "success", Records: m}
+	SvcWriteResponse(&g, w)
+}
@@ -0,0 +1,163 @@
+package ws
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"mime"
+	"net/http"
+	"phonebook/authz"
+	"phonebook/db"
+	"phonebook/lib"
+	"phonebook/sess"
+	"strings"
+)
+
+// getSvcSession returns the session associated with the air cookie in the
+// supplied request, or with the API key if the request has one as a bearer
+// token. For a cookie it follows the same steps as the web handlers: first it
+// looks in the in-memory session table, then it checks the db sessions table
+// in case the cookie came from another app in the suite or the server was
+// restarted. If session binding is turned on, the request must come from
+// the IP address and user agent that signed in.
+//
+// INPUTS:
+//  r = http request
+//
+// RETURNS:
+//  the session or nil if there is no valid session
+//  any error encountered
+//-----------------------------------------------------------------------------
+func getSvcSession(r *http.Request) (*sess.Session, error) {
+	if h := r.Header.Get("Authorization"); len(h) > 0 {
+		return getKeySession(r, h)
+	}
+	cookie, err := r.Cookie(sess.SessionCookieName)
+	if err != nil {
+		return nil, fmt.Errorf("not logged in")
+	}
+	if ssn, ok := sess.SessionGet(cookie.Value); ok && ssn != nil {
+		if !sess.RequestBindingOK(ssn.IP, ssn.UserAgent, r) {
+			return nil, fmt.Errorf("not logged in")
+		}
+		return ssn, nil
+	}
+	c, err := sess.GetSessionCookie(cookie.Value)
+	if err != nil {
+		lib.Ulog("getSvcSession: error getting session cookie: %s\n", err.Error())
+		return nil, fmt.Errorf("not logged in")
+	}
+	if len(c.Cookie) > 0 && sess.RequestBindingOK(c.IP, c.UserAgent, r) {
+		ssn := sess.NewSessionFromCookie(&c)
+		if len(ssn.Username) > 0 {
+			return ssn, nil
+		}
+	}
+	return nil, fmt.Errorf("not logged in")
+}
+
+// getKeySession returns the session for a request that sends an API key in
+// its Authorization header:
+//     Authorization: Bearer pbk_...
+// The time and address of the request are recorded with the key.
+//-----------------------------------------------------------------------------
+func getKeySession(r *http.Request, h string) (*sess.Session, error) {
+	const bearer = "bearer "
+	if len(h) <= len(bearer) || strings.ToLower(h[:len(bearer)]) != bearer {
+		return nil, fmt.Errorf("not logged in")
+	}
+	k, err := db.GetAPIKey(strings.TrimSpace(h[len(bearer):]))
+	if err != nil {
+		if err != db.ErrAPIKeyInvalid {
+			lib.Ulog("getKeySession: db.GetAPIKey: %s\n", err.Error())
+		}
+		return nil, fmt.Errorf("not logged in")
+	}
+	ip := sess.ClientIP(r)
+	if err = db.UseAPIKey(&k, ip); err != nil {
+		lib.Ulog("getKeySession: db.UseAPIKey: %s\n", err.Error())
+	}
+	ssn, err := sess.NewKeySession(&k, ip, r.UserAgent())
+	if err != nil {
+		lib.Ulog("getKeySession: %s\n", err.Error())
+		return nil, fmt.Errorf("not logged in")
+	}
+	return ssn, nil
+}
+
+// svcAuthorize checks that the caller may use the service described by h.
+// Services in SvcPublic are always allowed. Any other service needs a
+// session with the permission declared in h, and the session is saved in d
+// for the handler. A service that is not public but declares no permission
+// is refused.
+//
+// RETURNS:
+//  true if the handler may be called, otherwise an error response has been
+//  written
+//-----------------------------------------------------------------------------
+func svcAuthorize(w http.ResponseWriter, r *http.Request, d *ServiceData, h *ServiceHandler) bool {
+	funcname := "svcAuthorize"
+	if SvcPublic[h.Cmd] {
+		return true
+	}
+	ssn, err := getSvcSession(r)
+	if err != nil {
+		SvcErrorReturn(w, err, funcname)
+		return false
+	}
+	if !svcCSRFOK(r) {
+		lib.Ulog("CSRF check failed: %s %s from %s\n", r.Method, r.URL.Path, sess.ClientIP(r))
+		SvcErrorReturn(w, fmt.Errorf("request refused: send the X-CSRF-Token header or a Content-Type of application/json"), funcname)
+		return false
+	}
+	allowed := false
+	switch {
+	case h.Perm == authz.PERMNONE:
+		lib.Ulog("%s: service %s declares no permission and is not public\n", funcname, h.Cmd)
+	case len(h.Field) > 0:
+		allowed = sess.HasAllCoAccess(ssn, h.Elem, h.Field, h.Perm)
+	default:
+		allowed = ssn.ElemPermsAny(h.Elem, h.Perm)
+	}
+	if !allowed {
+		lib.Ulog("Permissions refuse %s on userid=%d (%s), role=%s\n", h.Cmd, ssn.UID, ssn.Firstname, ssn.PMap.Urole.Name)
+		SvcErrorReturn(w, fmt.Errorf("permission denied"), funcname)
+		return false
+	}
+	d.ssn = ssn
+	return true
+}
+
+// svcCSRFOK returns true unless r is a cookie authenticated request that
+// changes something and could have been sent by another site. A browser
+// will not send a cross-site request with a custom header or a JSON content
+// type without a CORS preflight, which we never answer, so either one is
+// enough. Requests with an API key carry no cookie and are not at risk.
+//-----------------------------------------------------------------------------
+func svcCSRFOK(r *http.Request) bool {
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return true
+	}
+	if len(r.Header.Get("Authorization")) > 0 {
+		return true
+	}
+	cookie, err := r.Cookie(sess.SessionCookieName)
+	if err != nil || len(cookie.Value) == 0 {
+		return false
+	}
+	if h := r.Header.Get("X-CSRF-Token"); len(h) > 0 {
+		return 1 == subtle.ConstantTimeCompare([]byte(h), []byte(sess.CSRFToken(cookie.Value)))
+	}
+	t, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && t == "application/json"
+}
+
+// svcSession returns the session V1ServiceHandler found for the request, or
+// looks it up if the handler was reached some other way.
+//-----------------------------------------------------------------------------
+func svcSession(r *http.Request, d *ServiceData) (*sess.Session, error) {
+	if d.ssn != nil {
+		return d.ssn, nil
+	}
+	return getSvcSession(r)
+}
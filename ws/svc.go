@@ -9,13 +9,17 @@ import (
 	"mime/multipart"
 	"net/http"
 	"net/url"
+	"phonebook/authz"
 	"phonebook/lib"
+	"phonebook/sess"
 	"strings"
 )
 
 // SvcCtx holds global data needed by the service routines
 var SvcCtx struct {
-	db *sql.DB
+	db              *sql.DB
+	reloadCompanies func() // reloads the server's company lists
+	reloadClasses   func() // reloads the server's class lists
 }
 
 // ServiceData is the generalized data gatherer for svcHandler. It allows all
@@ -31,12 +35,20 @@ type ServiceData struct {
 	QueryParams  map[string][]string // parameters when HTTP GET is used
 	Files        map[string][]*multipart.FileHeader
 	MFValues     map[string][]string
+	ssn          *sess.Session // caller's session, set by V1ServiceHandler for services that are not public
 }
 
-// ServiceHandler describes the handler for all services
+// ServiceHandler describes the handler for a service and the permission a
+// caller needs to use it. V1ServiceHandler only calls the handler for a
+// caller whose session has one of the permissions in Perm on Field of Elem
+// in every company, or on any field of Elem if Field is "". Services in SvcPublic need no
+// session and declare authz.PERMNONE.
 type ServiceHandler struct {
 	Cmd     string
 	Handler func(http.ResponseWriter, *http.Request, *ServiceData)
+	Elem    int    // element the permission is on: authz.ELEMPERSON, ...
+	Field   string // field the permission is on, "" for any field of Elem
+	Perm    int    // logical or of the permissions that allow the service
 }
 
 // SvcError is the generalized error structure to return errors to the grid widget
@@ -59,13 +71,33 @@ type SvcStatusResponse struct {
 
 // Svcs is the table of all service handlers
 var Svcs = []ServiceHandler{
-	{"authenticate", SvcAuthenticate},
-	{"discon", SvcDisableConsole},
-	{"encon", SvcEnableConsole},
-	{"logoff", SvcLogoff},
-	{"resetpw", SvcResetPWHandler},
-	{"validatecookie", SvcValidateCookie},
-	{"version", SvcHandlerVersion},
+	{"authenticate", SvcAuthenticate, 0, "", authz.PERMNONE},
+	{"classes", SvcClasses, authz.ELEMCLASS, "", authz.PERMVIEW},
+	{"companies", SvcCompanies, authz.ELEMCOMPANY, "", authz.PERMVIEW},
+	{"discon", SvcDisableConsole, authz.ELEMPBSVC, "", authz.PERMEXEC},
+	{"encon", SvcEnableConsole, authz.ELEMPBSVC, "", authz.PERMEXEC},
+	{"keys", SvcKeys, 0, "", authz.PERMNONE},
+	{"logoff", SvcLogoff, 0, "", authz.PERMNONE},
+	{"lookup", SvcLookup, authz.ELEMPERSON, "", authz.PERMVIEW | authz.PERMOWNERVIEW | authz.PERMMGRVIEW},
+	{"people", SvcPeople, authz.ELEMPERSON, "", authz.PERMVIEW | authz.PERMOWNERVIEW | authz.PERMMGRVIEW},
+	{"peoplesearch", SvcPeopleSearch, authz.ELEMPERSON, "", authz.PERMVIEW | authz.PERMOWNERVIEW | authz.PERMMGRVIEW},
+	{"resetpw", SvcResetPWHandler, 0, "", authz.PERMNONE},
+	{"secevents", SvcSecEvents, authz.ELEMPERSON, "Role", authz.PERMMOD},
+	{"validatecookie", SvcValidateCookie, 0, "", authz.PERMNONE},
+	{"version", SvcHandlerVersion, 0, "", authz.PERMNONE},
+}
+
+// SvcPublic is the allowlist of services that are called without a session
+// by design. They sign users in and out, check a session or token on behalf
+// of another app in the suite, start a password reset, or return public
+// information. Every other service needs the permission in its Svcs entry.
+var SvcPublic = map[string]bool{
+	"authenticate":   true,
+	"keys":           true,
+	"logoff":         true,
+	"resetpw":        true,
+	"validatecookie": true,
+	"version":        true,
 }
 
 // InitServices initializes the context data needed by service routines
@@ -74,6 +106,27 @@ func InitServices(db *sql.DB) {
 	SvcCtx.db = db
 }
 
+// SetReloadHandlers sets the functions the service routines call after
+// they change the companies or classes tables so that the server can
+// refresh its cached lists.
+//-----------------------------------------------------------------------------
+func SetReloadHandlers(companies, classes func()) {
+	SvcCtx.reloadCompanies = companies
+	SvcCtx.reloadClasses = classes
+}
+
+func svcReloadCompanies() {
+	if SvcCtx.reloadCompanies != nil {
+		SvcCtx.reloadCompanies()
+	}
+}
+
+func svcReloadClasses() {
+	if SvcCtx.reloadClasses != nil {
+		SvcCtx.reloadClasses()
+	}
+}
+
 // V1ServiceHandler is the main dispatch point for WEB SERVICE requests
 //
 // The expected input is of the form:
@@ -96,8 +149,8 @@ func V1ServiceHandler(w http.ResponseWriter, r *http.Request) {
 	var d ServiceData
 
 	//-----------------------------------------------------------------------
-	// pathElements:  0   1
-	//               /v1/{subservice}/
+	// pathElements:  0   1            2
+	//               /v1/{subservice}/{ID}
 	// ex:           /v1/authenticate/
 	//-----------------------------------------------------------------------
 	lib.Console("RequestURI = %s\n", r.RequestURI)
@@ -107,12 +160,15 @@ func V1ServiceHandler(w http.ResponseWriter, r *http.Request) {
 		lib.Console("%d. %s\n", i, d.pathElements[i])
 	}
 	d.Service = d.pathElements[1]
+	if len(d.pathElements) > 2 {
+		d.DetVal = d.pathElements[2]
+	}
 
 	svcDebugURL(r, &d)
 	showRequestHeaders(r)
 
 	switch r.Method {
-	case "POST":
+	case "POST", "PUT":
 		if nil != getPOSTdata(w, r, &d) {
 			return
 		}
@@ -128,7 +184,9 @@ func V1ServiceHandler(w http.ResponseWriter, r *http.Request) {
 	found := false
 	for i := 0; i < len(Svcs); i++ {
 		if Svcs[i].Cmd == d.Service {
-			Svcs[i].Handler(w, r, &d)
+			if svcAuthorize(w, r, &d, &Svcs[i]) {
+				Svcs[i].Handler(w, r, &d)
+			}
 			found = true
 			break
 		}